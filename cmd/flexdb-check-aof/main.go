@@ -0,0 +1,59 @@
+// flexdb-check-aof validates a FlexDB AOF file and, with --fix, repairs a
+// damaged one by truncating it at the end of its last valid command.
+//
+//	flexdb-check-aof [--fix] file.aof
+//
+// It exits with 0 when the file is valid or was repaired, 1 when it is
+// damaged and 2 when it can't be read.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"flex-db/internal/db"
+)
+
+func main() {
+	fix := flag.Bool("fix", false, "Truncate a damaged file at the end of its last valid command")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [--fix] file.aof\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+
+	check, err := db.CheckAOF(path)
+	if err != nil {
+		fmt.Printf("Error reading %s: %v\n", path, err)
+		os.Exit(2)
+	}
+	if !check.First.IsZero() {
+		// the range --recover-to can pick from
+		fmt.Printf("Time stamps from %s to %s\n", check.First.Format(time.RFC3339), check.Last.Format(time.RFC3339))
+	}
+	if check.Damage == nil {
+		fmt.Printf("%s is valid: %d commands, %d bytes\n", path, check.Commands, check.Size)
+		return
+	}
+
+	damage := check.Damage
+	fmt.Printf("%s is damaged at byte %d of %d, after %d valid commands: %v\n",
+		path, damage.Offset, check.Size, check.Commands, damage.Err)
+	if !*fix {
+		fmt.Printf("Run with --fix to truncate the last %d bytes\n", check.Size-damage.Offset)
+		os.Exit(1)
+	}
+
+	if err := os.Truncate(path, damage.Offset); err != nil {
+		fmt.Printf("Error truncating %s: %v\n", path, err)
+		os.Exit(2)
+	}
+	fmt.Printf("Truncated %s to %d bytes, dropping the last %d\n", path, damage.Offset, check.Size-damage.Offset)
+}
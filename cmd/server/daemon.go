@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// daemonEnv is set in the environment of the re-executed background process
+// so it knows it is already the daemon
+const daemonEnv = "FLEXDB_DAEMONIZED"
+
+// isDaemonChild reports whether this process was started by startDaemon
+func isDaemonChild() bool {
+	return os.Getenv(daemonEnv) == "1"
+}
+
+// openLogFile opens the log file in append mode, or /dev/null when no log
+// file is configured so a detached daemon never writes to a closed terminal
+func openLogFile(path string) (*os.File, error) {
+	if path == "" {
+		path = os.DevNull
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+// redirectOutput sends everything the server prints to the log file
+func redirectOutput(path string) error {
+	file, err := openLogFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	os.Stdout = file
+	os.Stderr = file
+	return nil
+}
+
+// writePidFile records the server pid. It refuses to overwrite the pid file
+// of a server that is still running.
+func writePidFile(path string) error {
+	if data, err := os.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && processRunning(pid) {
+			return fmt.Errorf("pid file %s belongs to running process %d", path, pid)
+		}
+	}
+
+	return os.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+func removePidFile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error removing pid file: %v\n", err)
+	}
+}
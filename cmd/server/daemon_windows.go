@@ -0,0 +1,23 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// startDaemon is not available on Windows, which has no sessions to detach from
+func startDaemon(logPath string) (int, error) {
+	return 0, errors.New("daemon mode is not supported on Windows")
+}
+
+// processRunning reports whether a process with the given pid exists
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
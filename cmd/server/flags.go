@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"flex-db/internal/db"
+)
+
+// partitionFlags collects repeated --partition flags. Each one is a key
+// prefix followed by comma separated options:
+//
+//	--partition 'session:,snapshot=sessions.json,aof=sessions.aof,aof-sync=always'
+//	--partition 'cache:'
+//
+// A partition without snapshot and aof options is never persisted.
+type partitionFlags []db.Partition
+
+func (p *partitionFlags) String() string {
+	prefixes := make([]string, len(*p))
+	for i, part := range *p {
+		prefixes[i] = part.Prefix
+	}
+	return strings.Join(prefixes, " ")
+}
+
+func (p *partitionFlags) Set(value string) error {
+	fields := strings.Split(value, ",")
+	part := db.Partition{Prefix: fields[0], AOFSync: db.AOFSyncEverySecond}
+	if part.Prefix == "" {
+		return fmt.Errorf("partition needs a key prefix")
+	}
+
+	for _, field := range fields[1:] {
+		name, arg, ok := strings.Cut(field, "=")
+		if !ok || arg == "" {
+			return fmt.Errorf("partition option %q needs a value", field)
+		}
+		switch name {
+		case "snapshot":
+			part.Snapshot = arg
+		case "aof":
+			part.AOF = arg
+		case "aof-sync":
+			policy, err := parseSyncPolicy(arg)
+			if err != nil {
+				return err
+			}
+			part.AOFSync = policy
+		default:
+			return fmt.Errorf("unknown partition option %q", name)
+		}
+	}
+
+	*p = append(*p, part)
+	return nil
+}
+
+// listFlag collects the values of a repeated string flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseSyncPolicy parses an --aof-sync value
+func parseSyncPolicy(name string) (db.AOFSyncPolicy, error) {
+	switch name {
+	case "always":
+		return db.AOFSyncAlways, nil
+	case "everysec", "everySec":
+		return db.AOFSyncEverySecond, nil
+	case "no":
+		return db.AOFSyncNever, nil
+	default:
+		return 0, fmt.Errorf("invalid AOF sync policy: %s", name)
+	}
+}
+
+// parseLoadPolicy parses an --aof-load-policy value
+func parseLoadPolicy(name string) (db.AOFLoadPolicy, error) {
+	switch name {
+	case "truncate-tail":
+		return db.AOFLoadTruncateTail, nil
+	case "truncate":
+		return db.AOFLoadTruncate, nil
+	case "fail":
+		return db.AOFLoadFail, nil
+	default:
+		return 0, fmt.Errorf("invalid AOF load policy: %s", name)
+	}
+}
+
+// parseRecoverTime parses a --recover-to value: an RFC 3339 time, or a
+// local date and time
+func parseRecoverTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --recover-to time %q, expected e.g. 2006-01-02T15:04:05Z or '2006-01-02 15:04:05'", value)
+}
@@ -1,90 +1,482 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	"flex-db/internal/db"
+	"flex-db/internal/metrics"
 	"flex-db/internal/protocol"
 )
 
 func main() {
+	// flexdb import and flexdb export are clients of a running server
+	if runTransfer(os.Args[1:]) {
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sentinel" {
+		if err := runSentinel(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Command line flags
 	port := flag.Int("port", 9000, "Port to listen on")
+	adminPort := flag.Int("admin-port", 0, "Serve administrative commands only on this port, 0 to allow them on the main port")
+	adminBind := flag.String("admin-bind", "127.0.0.1", "Address the admin port listens on")
 	dbFile := flag.String("db", "data.json", "Database file path")
 
 	// AOF configuration
 	enableAOF := flag.Bool("aof", false, "Enable persistence")
 	aofFile := flag.String("aof-file", "flexdb.aof", "AOF file path")
 	aofSyncPolicy := flag.String("aof-sync", "everySec", "AOF sync policy: always, everySec, no")
+	aofSegmentSize := flag.Int64("aof-max-segment-size", 0, "Start a new AOF segment (file.aof.1, .2, ...) once the one appended to reaches this many bytes, 0 for a single file")
+	groupCommitWindow := flag.Duration("aof-group-commit-window", 0, "With --aof-sync always, wait this long after a write for others to share its fsync, 0 to sync right away")
+	aofLoadPolicy := flag.String("aof-load-policy", "truncate-tail", "What loading does with a damaged AOF: truncate-tail (only an incomplete last command), truncate or fail")
+	recoverTo := flag.String("recover-to", "", "Replay the AOF only up to this time, e.g. 2006-01-02T15:04:05Z, keeping the whole file aside")
+	encryptionKeyFile := flag.String("encryption-key-file", "", "File of '<id> <base64 key>' lines; the first key encrypts, the others only decrypt")
+	var encryptPatterns listFlag
+	flag.Var(&encryptPatterns, "encrypt", "Encrypt the persisted values of keys matching this glob pattern, repeatable")
+	var partitions partitionFlags
+	var historyPatterns listFlag
+	flag.Var(&historyPatterns, "history", "Keep the recent versions of string keys matching this glob pattern, repeatable")
+	historyDepth := flag.Int("history-depth", 10, "Versions kept per key with --history")
+	trashRetention := flag.Duration("trash-retention", 0, "Keep keys removed by DEL this long for UNDELETE, 0 to delete them right away")
+	flag.Var(&partitions, "partition", "Persist keys with a prefix separately: 'prefix[,snapshot=FILE][,aof=FILE][,aof-sync=POLICY]', repeatable")
+
+	// Text protocol configuration
+	noPrompt := flag.Bool("no-prompt", false, "Disable the interactive prompt on text protocol connections")
+	requirePass := flag.String("requirepass", "", "Require clients to authenticate with this password")
+	maxKeyLength := flag.Int("max-key-len", 0, "Longest key in bytes, 0 for no limit")
+	maxValueSize := flag.Int("max-value-size", 0, "Largest string value, list element or hash field in bytes, 0 for no limit")
+	maxElements := flag.Int("max-elements", 0, "Most elements in a list or fields in a hash, 0 for no limit")
+	snapshotWorkers := flag.Int("snapshot-workers", 0, "Goroutines encoding and decoding the snapshot (0 for one per CPU)")
+	lazyStart := flag.Bool("lazy-start", false, "Accept connections while the snapshot and AOF load, answering commands with LOADING until done")
+	saveRules := flag.String("save", db.FormatSaveRules(db.DefaultSaveRules), "Write a snapshot once '<seconds> <changes>' pairs are met, e.g. '900 1 300 10 60 10000', or '' to save only on SAVE and shutdown")
+	incrementalSnapshots := flag.Bool("incremental-snapshots", false, "Append the keys changed since the last snapshot to a journal instead of rewriting the snapshot on scheduled saves")
+	journalCompactRatio := flag.Float64("journal-compact-ratio", 1, "With --incremental-snapshots, rewrite the snapshot once its journal is this many times its size")
+	writeBackpressure := flag.Int("write-backpressure", 0, "Throttle writes while more than this many changes wait for a snapshot, 0 to disable")
+	backpressureWait := flag.Duration("write-backpressure-max-wait", time.Second, "Longest a write is throttled by --write-backpressure")
+	fileCompression := flag.String("file-compression", "none", "Compress the snapshot and rewritten AOFs on disk: none or gzip; compressed files are detected on load either way")
+	compressThreshold := flag.Int("compress-threshold", 0, "Compress string values of at least this many bytes, 0 to disable")
+	lazyValues := flag.Int("lazy-values", 0, "Leave snapshot values of at least this many bytes on disk at startup, loading each on first access, 0 to load everything")
+	trackAccess := flag.Bool("track-access", false, "Track per-key hit counts and access times for OBJECT FREQ/IDLETIME and KEYSTATS")
+	maxKeysReply := flag.Int("max-keys-reply", protocol.DefaultMaxKeysReply, "Most keys ALL and KEYS return without LIMIT, 0 for no limit")
+	bulkConfirmLimit := flag.Int("bulk-confirm-limit", protocol.DefaultBulkConfirmLimit, "Most keys the pattern and tag bulk commands (DELPATTERN, DELBYTAG, ...) change without FORCE, 0 for no limit")
+	maxLineLength := flag.Int("max-inline-len", protocol.DefaultMaxLineLength, "Longest inline command line in bytes, 0 for no limit")
+	maxRequestSize := flag.Int64("max-request-size", protocol.DefaultMaxRequestSize, "Largest single request in bytes, 0 for no limit")
+	outputHardLimit := flag.Int64("output-hard-limit", 0, "Disconnect clients with more unread output than this many bytes, 0 for no limit")
+	outputSoftLimit := flag.Int64("output-soft-limit", 0, "Disconnect clients whose unread output stays above this many bytes for --output-soft-seconds, 0 for no limit")
+	outputSoftSeconds := flag.Int("output-soft-seconds", 60, "How long unread output may stay above --output-soft-limit")
+	clientWriteTimeout := flag.Duration("client-write-timeout", 0, "Disconnect clients that don't read a reply within this time, 0 to wait forever")
+	faultInjection := flag.Bool("fault-injection", false, "Enable DEBUG FAULT for resilience testing (never in production)")
+	stopWritesOnError := flag.Bool("stop-writes-on-error", true, "Refuse writes while snapshots or AOF fsyncs are failing")
+	replicaOf := flag.String("replicaof", "", "Run as a read-only replica of the master at this host:port")
+	masterAuth := flag.String("masterauth", "", "Password to authenticate with the master with --replicaof")
+	replBacklog := flag.Int("repl-backlog-size", db.DefaultReplicationBacklog, "Bytes of recent writes kept so reconnecting replicas can resync partially")
+	clusterConfig := flag.String("cluster-config", "", "Run in cluster mode with the nodes and hash slots listed in this file")
+	raftID := flag.String("raft-id", "", "Replicate through a Raft group as the server with this unique ID")
+	raftAddr := flag.String("raft-addr", "", "host:port the other servers of the Raft group reach this one on")
+	raftDir := flag.String("raft-dir", "raft", "Directory of the Raft log and its snapshots")
+	raftBootstrap := flag.Bool("raft-bootstrap", false, "Start a new Raft group with this server as its first member")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics on this address at /metrics, e.g. :9121")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for clients and background writers on shutdown")
+
+	// Process management
+	daemonize := flag.Bool("daemonize", false, "Run the server in the background")
+	pidFile := flag.String("pidfile", "", "Write the server pid to this file")
+	logFile := flag.String("logfile", "", "Write server output to this file instead of stdout")
+	serviceAction := flag.String("service", "", "Manage the Windows service: install, uninstall, start or stop")
 	flag.Parse()
 
+	if *serviceAction != "" {
+		if err := controlService(*serviceAction, serviceArgs(os.Args[1:])); err != nil {
+			fmt.Printf("Error running service %s: %v\n", *serviceAction, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Service %s: %s done\n", serviceName, *serviceAction)
+		return
+	}
+
+	if *daemonize && !isDaemonChild() {
+		pid, err := startDaemon(*logFile)
+		if err != nil {
+			fmt.Printf("Error starting daemon: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("FlexDB started in the background with pid %d\n", pid)
+		return
+	}
+
+	// the daemon's output is already redirected by its parent
+	if *logFile != "" && !isDaemonChild() {
+		if err := redirectOutput(*logFile); err != nil {
+			fmt.Printf("Error redirecting output: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	options := []db.Option{
+		db.WithLimits(db.Limits{
+			MaxKeyLength: *maxKeyLength,
+			MaxValueSize: *maxValueSize,
+			MaxElements:  *maxElements,
+		}),
+	}
+
+	if *trackAccess {
+		options = append(options, db.WithAccessTracking())
+	}
+	if *snapshotWorkers > 0 {
+		options = append(options, db.WithSnapshotWorkers(*snapshotWorkers))
+	}
+	if *lazyStart {
+		options = append(options, db.WithBackgroundLoad())
+	}
+	rules, err := db.ParseSaveRules(*saveRules)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	options = append(options, db.WithSaveRules(rules...))
+	if *incrementalSnapshots {
+		if *journalCompactRatio <= 0 {
+			fmt.Println("Error: --journal-compact-ratio must be positive")
+			os.Exit(1)
+		}
+		options = append(options, db.WithIncrementalSnapshots(*journalCompactRatio))
+	}
+	if *writeBackpressure > 0 {
+		options = append(options, db.WithWriteBackpressure(*writeBackpressure, *backpressureWait))
+	}
+	compression, err := db.ParseFileCompression(*fileCompression)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	options = append(options, db.WithFileCompression(compression))
+	if *groupCommitWindow < 0 {
+		fmt.Println("Error: --aof-group-commit-window must not be negative")
+		os.Exit(1)
+	}
+	options = append(options, db.WithAOFGroupCommit(*groupCommitWindow))
+	if *aofSegmentSize < 0 {
+		fmt.Println("Error: --aof-max-segment-size must not be negative")
+		os.Exit(1)
+	}
+	options = append(options, db.WithAOFMaxSegmentSize(*aofSegmentSize))
+	if *compressThreshold > 0 {
+		options = append(options, db.WithCompression(*compressThreshold))
+	}
+	if *lazyValues > 0 {
+		options = append(options, db.WithLazyValues(*lazyValues))
+	}
+	if *replBacklog <= 0 {
+		fmt.Println("Error: --repl-backlog-size must be positive")
+		os.Exit(1)
+	}
+	options = append(options, db.WithReplicationBacklog(*replBacklog))
+	if *replicaOf != "" {
+		if _, _, err := net.SplitHostPort(*replicaOf); err != nil {
+			fmt.Printf("Error: invalid --replicaof address: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *raftID != "" {
+		if _, _, err := net.SplitHostPort(*raftAddr); err != nil {
+			fmt.Printf("Error: invalid --raft-addr address: %v\n", err)
+			os.Exit(1)
+		}
+		if *enableAOF || *replicaOf != "" || *clusterConfig != "" {
+			fmt.Println("Error: --raft-id can't be combined with --aof, --replicaof or --cluster-config")
+			os.Exit(1)
+		}
+	}
+
 	//add AOF options if enabled
-	var options []db.Option
 
 	if *enableAOF {
-		var syncPolicy db.AOFSyncPolicy
-
-		switch *aofSyncPolicy {
-		case "always":
-			syncPolicy = db.AOFSyncAlways
-		case "everysec", "everySec": 
-			syncPolicy = db.AOFSyncEverySecond
-		case "no":
-			syncPolicy = db.AOFSyncNever
-		default:
-			fmt.Printf("Invalid AOF sync policy: %s, using 'everySec'\n", *aofSyncPolicy)
+		syncPolicy, err := parseSyncPolicy(*aofSyncPolicy)
+		if err != nil {
+			fmt.Printf("%v, using 'everySec'\n", err)
 			syncPolicy = db.AOFSyncEverySecond
 		}
-		
-		options = append(options, db.WithAOF(*aofFile, syncPolicy))
+
+		loadPolicy, err := parseLoadPolicy(*aofLoadPolicy)
+		if err != nil {
+			fmt.Printf("%v, using 'truncate-tail'\n", err)
+			loadPolicy = db.AOFLoadTruncateTail
+		}
+
+		options = append(options, db.WithAOF(*aofFile, syncPolicy), db.WithAOFLoadPolicy(loadPolicy))
+		if *recoverTo != "" {
+			t, err := parseRecoverTime(*recoverTo)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			options = append(options, db.WithRecoverTo(t))
+		}
 		fmt.Printf("AOF persistence enabled with file: %s, sync policy: %s\n", *aofFile, *aofSyncPolicy)
 	}
-
-	// Initialize database
-	database := db.NewFlexDB(*dbFile, options...)
-	handler := protocol.NewHandler(database)
+	if *recoverTo != "" && !*enableAOF {
+		fmt.Println("Error: --recover-to needs --aof")
+		os.Exit(1)
+	}
+	for _, p := range partitions {
+		options = append(options, db.WithPartition(p))
+	}
+	if *encryptionKeyFile != "" {
+		options = append(options, db.WithEncryption(*encryptionKeyFile, encryptPatterns...))
+	} else if len(encryptPatterns) > 0 {
+		fmt.Println("Error: --encrypt needs --encryption-key-file")
+		os.Exit(1)
+	}
+	if len(historyPatterns) > 0 {
+		options = append(options, db.WithHistory(*historyDepth, historyPatterns...))
+	}
+	if *trashRetention > 0 {
+		options = append(options, db.WithTrash(*trashRetention))
+	}
 
 	// Set up signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	// under the Windows service manager, stop requests arrive on sigChan too
+	var service *serviceRunner
+	if runningAsService() {
+		service = startService(sigChan, *logFile == "")
+	}
+
+	// Initialize database
+	database, err := db.NewFlexDB(*dbFile, options...)
+	if err != nil {
+		printLoadError(err)
+		os.Exit(1)
+	}
+
+	handlerOptions := []protocol.HandlerOption{
+		protocol.WithRequestLimits(*maxLineLength, *maxRequestSize),
+		protocol.WithMaxKeysReply(*maxKeysReply),
+		protocol.WithBulkConfirmLimit(*bulkConfirmLimit),
+		protocol.WithAnnouncePort(*port),
+		protocol.WithOutputLimits(protocol.OutputLimits{
+			Hard:         *outputHardLimit,
+			Soft:         *outputSoftLimit,
+			SoftDuration: time.Duration(*outputSoftSeconds) * time.Second,
+			WriteTimeout: *clientWriteTimeout,
+		}),
+	}
+	if *noPrompt {
+		handlerOptions = append(handlerOptions, protocol.WithoutPrompt())
+	}
+	if *requirePass != "" {
+		handlerOptions = append(handlerOptions, protocol.WithPassword(*requirePass))
+	}
+	if *faultInjection {
+		handlerOptions = append(handlerOptions, protocol.WithFaultInjection())
+		fmt.Println("WARNING: fault injection is enabled, DEBUG FAULT can degrade this server")
+	}
+	if *adminPort != 0 {
+		handlerOptions = append(handlerOptions, protocol.WithAdminPort())
+	}
+	if *stopWritesOnError {
+		handlerOptions = append(handlerOptions, protocol.WithStopWritesOnPersistenceError())
+	}
+	if *masterAuth != "" {
+		handlerOptions = append(handlerOptions, protocol.WithMasterAuth(*masterAuth))
+	}
+	if *clusterConfig != "" {
+		option, err := protocol.WithCluster(*clusterConfig)
+		if err != nil {
+			fmt.Printf("Error reading cluster config: %v\n", err)
+			os.Exit(1)
+		}
+		handlerOptions = append(handlerOptions, option)
+		fmt.Printf("Cluster mode enabled with nodes file %s\n", *clusterConfig)
+	}
+	handlerOptions = append(handlerOptions, protocol.WithShutdownFunc(func() {
+		select {
+		case sigChan <- syscall.SIGTERM:
+		default: // a shutdown is already pending
+		}
+	}))
+	handler := protocol.NewHandler(database, handlerOptions...)
+	if *replicaOf != "" {
+		handler.ReplicaOf(*replicaOf)
+		fmt.Printf("Replicating from %s\n", *replicaOf)
+	}
+	if *raftID != "" {
+		err := handler.StartRaft(protocol.RaftConfig{
+			ID:        *raftID,
+			Addr:      *raftAddr,
+			Dir:       *raftDir,
+			Bootstrap: *raftBootstrap,
+		})
+		if err != nil {
+			fmt.Printf("Error starting Raft replication: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Raft replication enabled as %s on %s\n", *raftID, *raftAddr)
+	}
+
 	// Start server
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
 	if err != nil {
 		fmt.Printf("Error starting server: %v\n", err)
 		os.Exit(1)
 	}
-	
+
+	var adminListener net.Listener
+	if *adminPort != 0 {
+		adminListener, err = net.Listen("tcp", net.JoinHostPort(*adminBind, strconv.Itoa(*adminPort)))
+		if err != nil {
+			fmt.Printf("Error starting admin port: %v\n", err)
+			listener.Close()
+			os.Exit(1)
+		}
+		fmt.Printf("Admin commands are only accepted on %s\n", adminListener.Addr())
+	}
+
+	var metricsServer *http.Server
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler(handler))
+		metricsServer = &http.Server{Addr: *metricsAddr, Handler: mux}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fmt.Printf("Error serving metrics: %v\n", err)
+			}
+		}()
+		fmt.Printf("Prometheus metrics served on %s/metrics\n", *metricsAddr)
+	}
+
+	// written once the port is bound so init scripts can use it as a readiness signal
+	if *pidFile != "" {
+		if err := writePidFile(*pidFile); err != nil {
+			fmt.Printf("Error writing pid file: %v\n", err)
+			listener.Close()
+			os.Exit(1)
+		}
+		defer removePidFile(*pidFile)
+	}
+
 	fmt.Printf("FlexDB server started on port %d\n", *port)
 
-	// Handle connections in a separate goroutine
+	// once the snapshot and AOF are loaded and the port is bound, systemd
+	// can start routing clients to us. With --lazy-start the load is still
+	// running, and a failed load stops the server.
+	loadFailed := make(chan error, 1)
 	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				// Check if server is shutting down
+		<-database.Loaded()
+		if err := database.LoadError(); err != nil {
+			if !errors.Is(err, db.ErrLoadAborted) {
+				printLoadError(err)
+				loadFailed <- err
 				select {
-				case <-sigChan:
-					return
-				default:
-					fmt.Println("Connection error:", err)
-					continue
+				case sigChan <- syscall.SIGTERM:
+				default: // a shutdown is already pending
 				}
 			}
-
-			go handler.HandleConnection(conn)
+			return
+		}
+		if err := sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d\nSTATUS=Accepting connections on port %d", os.Getpid(), *port)); err != nil {
+			fmt.Println(err)
 		}
 	}()
 
+	// closed once shutdown starts so the accept loop can tell a closed
+	// listener apart from a connection error
+	stopping := make(chan struct{})
+
+	go runWatchdog(database, stopping)
+	service.markReady()
+
+	// Handle connections in separate goroutines
+	go acceptLoop(listener, handler.HandleConnection, stopping)
+	if adminListener != nil {
+		go acceptLoop(adminListener, handler.HandleAdminConnection, stopping)
+	}
+
 	// Wait for shutdown signal
 	<-sigChan
 	fmt.Println("\nShutting down server...")
+	if err := sdNotify("STOPPING=1"); err != nil {
+		fmt.Println(err)
+	}
+	close(stopping)
 	listener.Close()
-	database.Flush()
+	if adminListener != nil {
+		adminListener.Close()
+	}
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	// drain clients first so their last writes reach the snapshot and AOF
+	if err := handler.Shutdown(ctx); err != nil {
+		fmt.Printf("Error draining connections: %v\n", err)
+	}
+	if err := database.Shutdown(ctx); err != nil {
+		fmt.Printf("Error shutting down database: %v\n", err)
+	}
 	fmt.Println("Server shutdown complete")
-} 
\ No newline at end of file
+	service.markStopped()
+
+	select {
+	case <-loadFailed:
+		// os.Exit skips the deferred cleanup
+		if *pidFile != "" {
+			removePidFile(*pidFile)
+		}
+		os.Exit(1)
+	default:
+	}
+}
+
+// acceptLoop hands every connection accepted on listener to handle until
+// stopping is closed
+func acceptLoop(listener net.Listener, handle func(net.Conn), stopping <-chan struct{}) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// Check if server is shutting down
+			select {
+			case <-stopping:
+				return
+			default:
+				fmt.Println("Connection error:", err)
+				continue
+			}
+		}
+
+		go handle(conn)
+	}
+}
+
+// printLoadError reports why the database couldn't be loaded
+func printLoadError(err error) {
+	fmt.Printf("Error loading database: %v\n", err)
+	var damage *db.AOFError
+	if errors.Is(err, db.ErrChecksum) {
+		fmt.Println("The file changed on disk after it was written; restore it from a backup")
+	} else if errors.As(err, &damage) {
+		fmt.Printf("Run flexdb-check-aof --fix %s to truncate it at the last valid command, or start with --aof-load-policy truncate\n", damage.Path)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"flex-db/internal/resp"
+)
+
+// The sentinel subcommand watches a master and its replicas and fails
+// over when the master stops answering:
+//
+//	flexdb sentinel [--port 26379] [--name mymaster] --master localhost:9000
+//
+// Every check it asks the master for its replicas with ROLE. Once the
+// master failed every check for --down-after, the reachable replica with
+// the highest replication offset is promoted with REPLICAOF NO ONE and
+// the others, and the old master once it's back, are made its replicas.
+// Clients ask the sentinel where the master is with
+// SENTINEL GET-MASTER-ADDR-BY-NAME, as Redis Sentinel clients do.
+//
+// A single sentinel decides alone, so it should run where it sees the
+// servers as the clients do: a sentinel cut off from a healthy master
+// promotes a replica anyway.
+
+// sentinelCheckInterval is how often the sentinel checks the servers
+const sentinelCheckInterval = time.Second
+
+// sentinel is the state of flexdb sentinel
+type sentinel struct {
+	name      string
+	password  string
+	downAfter time.Duration
+
+	mu       sync.Mutex
+	master   string              // address of the current master
+	replicas map[string]struct{} // addresses of the known replicas
+	lastOK   time.Time           // when the master last answered
+}
+
+// runSentinel runs flexdb sentinel
+func runSentinel(args []string) error {
+	fs := flag.NewFlagSet("sentinel", flag.ExitOnError)
+	port := fs.Int("port", 26379, "Port clients ask for the master on")
+	name := fs.String("name", "mymaster", "Name clients know the master by")
+	master := fs.String("master", "", "Address of the master to watch, host:port")
+	password := fs.String("password", "", "Password of servers started with --requirepass")
+	downAfter := fs.Duration("down-after", 5*time.Second, "Fail over once the master hasn't answered for this long")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s sentinel [options] --master host:port\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *master == "" || fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if _, _, err := net.SplitHostPort(*master); err != nil {
+		return fmt.Errorf("invalid --master address: %w", err)
+	}
+	if *downAfter <= 0 {
+		return errors.New("--down-after must be positive")
+	}
+
+	s := &sentinel{
+		name:      *name,
+		password:  *password,
+		downAfter: *downAfter,
+		master:    *master,
+		replicas:  make(map[string]struct{}),
+		lastOK:    time.Now(),
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	go s.serve(listener)
+	fmt.Printf("Sentinel watching %s as %s, clients ask on port %d\n", *master, *name, *port)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(sentinelCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sigChan:
+			return nil
+		case <-ticker.C:
+			s.check()
+		}
+	}
+}
+
+// check asks the master for its replicas, reconfigures servers that
+// disagree about who the master is, and fails over once the master has
+// been down for downAfter
+func (s *sentinel) check() {
+	s.mu.Lock()
+	master := s.master
+	s.mu.Unlock()
+
+	role, err := s.role(master)
+	if err == nil && role.Array[0].Str == "master" {
+		s.mu.Lock()
+		s.lastOK = time.Now()
+		for _, r := range role.Array[2].Array {
+			if len(r.Array) >= 2 {
+				s.replicas[net.JoinHostPort(r.Array[0].Str, r.Array[1].Str)] = struct{}{}
+			}
+		}
+		s.mu.Unlock()
+		s.reconfigureReplicas()
+		return
+	}
+
+	s.mu.Lock()
+	down := time.Since(s.lastOK)
+	s.mu.Unlock()
+	if err == nil {
+		err = errors.New("it's a replica")
+	}
+	fmt.Printf("Master %s failed a check: %v\n", master, err)
+	if down >= s.downAfter {
+		s.failover(master)
+	}
+}
+
+// reconfigureReplicas makes known servers that aren't replicas of the
+// current master its replicas, like an old master that came back
+func (s *sentinel) reconfigureReplicas() {
+	s.mu.Lock()
+	master := s.master
+	var replicas []string
+	for addr := range s.replicas {
+		replicas = append(replicas, addr)
+	}
+	s.mu.Unlock()
+
+	host, port, _ := net.SplitHostPort(master)
+	for _, addr := range replicas {
+		if addr == master {
+			continue
+		}
+		role, err := s.role(addr)
+		if err != nil {
+			continue
+		}
+		following := role.Array[0].Str == "slave" && len(role.Array) >= 3 &&
+			net.JoinHostPort(role.Array[1].Str, strconv.FormatInt(role.Array[2].Int, 10)) == master
+		if following {
+			continue
+		}
+		fmt.Printf("Making %s a replica of %s\n", addr, master)
+		if _, err := s.call(addr, "REPLICAOF", host, port); err != nil {
+			fmt.Printf("Error reconfiguring %s: %v\n", addr, err)
+		}
+	}
+}
+
+// failover promotes the reachable replica with the highest replication
+// offset and makes the other replicas follow it
+func (s *sentinel) failover(old string) {
+	s.mu.Lock()
+	var candidates []string
+	for addr := range s.replicas {
+		if addr != old {
+			candidates = append(candidates, addr)
+		}
+	}
+	s.mu.Unlock()
+
+	best, bestOffset := "", int64(-1)
+	for _, addr := range candidates {
+		role, err := s.role(addr)
+		if err != nil || role.Array[0].Str != "slave" || len(role.Array) < 5 {
+			continue
+		}
+		if offset := role.Array[4].Int; offset > bestOffset {
+			best, bestOffset = addr, offset
+		}
+	}
+	if best == "" {
+		fmt.Printf("Master %s is down and no replica can take over\n", old)
+		return
+	}
+
+	fmt.Printf("Master %s is down, promoting %s at offset %d\n", old, best, bestOffset)
+	if _, err := s.call(best, "REPLICAOF", "NO", "ONE"); err != nil {
+		fmt.Printf("Error promoting %s: %v\n", best, err)
+		return
+	}
+
+	s.mu.Lock()
+	s.master = best
+	s.lastOK = time.Now()
+	delete(s.replicas, best)
+	s.replicas[old] = struct{}{} // demoted once it's back
+	s.mu.Unlock()
+	s.reconfigureReplicas()
+}
+
+// role returns the reply of ROLE on the server at addr
+func (s *sentinel) role(addr string) (resp.Value, error) {
+	reply, err := s.call(addr, "ROLE")
+	if err != nil {
+		return reply, err
+	}
+	if reply.Type != resp.Array || len(reply.Array) == 0 {
+		return reply, errors.New("unexpected ROLE reply")
+	}
+	if reply.Array[0].Str == "master" && (len(reply.Array) < 3 || reply.Array[2].Type != resp.Array) {
+		return reply, errors.New("unexpected ROLE reply")
+	}
+	return reply, nil
+}
+
+// call runs a command on the server at addr on a fresh connection, so a
+// server that stopped answering never stalls the sentinel for long
+func (s *sentinel) call(addr string, args ...string) (resp.Value, error) {
+	conn, err := net.DialTimeout("tcp", addr, sentinelCheckInterval)
+	if err != nil {
+		return resp.Value{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(sentinelCheckInterval))
+
+	c := &client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if s.password != "" {
+		if _, err := c.call("AUTH", s.password); err != nil {
+			return resp.Value{}, err
+		}
+	}
+	return c.call(args...)
+}
+
+// serve answers the clients asking where the master is
+func (s *sentinel) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveClient(conn)
+	}
+}
+
+// serveClient answers PING and the SENTINEL subcommands clients use
+func (s *sentinel) serveClient(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		v, err := resp.Parse(r)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(resp.Marshal(s.reply(v))); err != nil {
+			return
+		}
+	}
+}
+
+// reply runs a client's command
+func (s *sentinel) reply(v resp.Value) resp.Value {
+	if v.Type != resp.Array || len(v.Array) == 0 {
+		return resp.NewError("ERR Protocol error: expected a command")
+	}
+	args := make([]string, len(v.Array))
+	for i, item := range v.Array {
+		args[i] = item.Str
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return resp.NewSimpleString("PONG")
+	case "SENTINEL":
+	default:
+		return resp.NewError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	if len(args) != 3 {
+		return resp.NewError("ERR wrong number of arguments for 'sentinel' command")
+	}
+	if args[2] != s.name {
+		return resp.NewNullArray()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.ToUpper(args[1]) {
+	case "GET-MASTER-ADDR-BY-NAME":
+		host, port, _ := net.SplitHostPort(s.master)
+		return resp.NewArray([]resp.Value{resp.NewBulkString(host), resp.NewBulkString(port)})
+	case "REPLICAS", "SLAVES":
+		replicas := []resp.Value{}
+		for addr := range s.replicas {
+			replicas = append(replicas, resp.NewBulkString(addr))
+		}
+		return resp.NewArray(replicas)
+	}
+	return resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'", args[1]))
+}
@@ -0,0 +1,55 @@
+package main
+
+import "strings"
+
+// serviceName is the name FlexDB registers with the Windows service manager
+const serviceName = "FlexDB"
+
+// serviceRunner ties the server lifecycle to a platform service manager.
+// A nil runner means the server was started from a shell.
+type serviceRunner struct {
+	ready    chan struct{} // closed once the server accepts connections
+	stopped  chan struct{} // closed once shutdown has completed
+	finished chan struct{} // closed once the service manager knows we stopped
+}
+
+func newServiceRunner() *serviceRunner {
+	return &serviceRunner{
+		ready:    make(chan struct{}),
+		stopped:  make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+}
+
+// markReady tells the service manager the server is accepting connections
+func (r *serviceRunner) markReady() {
+	if r != nil {
+		close(r.ready)
+	}
+}
+
+// markStopped tells the service manager the server has shut down and waits
+// until it has acknowledged, so the process does not exit too early
+func (r *serviceRunner) markStopped() {
+	if r != nil {
+		close(r.stopped)
+		<-r.finished
+	}
+}
+
+// serviceArgs strips the -service flag from the command line, leaving the
+// arguments an installed service should be started with
+func serviceArgs(args []string) []string {
+	var result []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-service" || arg == "--service":
+			i++ // skip the action too
+		case strings.HasPrefix(arg, "-service=") || strings.HasPrefix(arg, "--service="):
+		default:
+			result = append(result, arg)
+		}
+	}
+	return result
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// runningAsService reports whether the Windows service manager started us
+func runningAsService() bool {
+	return false
+}
+
+// startService is only needed on Windows
+func startService(shutdown chan<- os.Signal, useEventLog bool) *serviceRunner {
+	return nil
+}
+
+// controlService is only supported on Windows
+func controlService(action string, args []string) error {
+	return errors.New("service management is only supported on Windows")
+}
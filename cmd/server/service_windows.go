@@ -0,0 +1,197 @@
+//go:build windows
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// runningAsService reports whether the Windows service manager started us
+func runningAsService() bool {
+	isService, err := svc.IsWindowsService()
+	return err == nil && isService
+}
+
+// startService hands control of the server lifecycle to the service manager.
+// Stop and shutdown requests are delivered on the shutdown channel, just like
+// signals are when running from a console.
+func startService(shutdown chan<- os.Signal, useEventLog bool) *serviceRunner {
+	if useEventLog {
+		if err := redirectToEventLog(); err != nil {
+			fmt.Printf("Error opening event log: %v\n", err)
+		}
+	}
+
+	runner := newServiceRunner()
+	go func() {
+		defer close(runner.finished)
+		if err := svc.Run(serviceName, &windowsService{runner: runner, shutdown: shutdown}); err != nil {
+			fmt.Printf("Error running service: %v\n", err)
+		}
+	}()
+	return runner
+}
+
+// windowsService implements svc.Handler
+type windowsService struct {
+	runner   *serviceRunner
+	shutdown chan<- os.Signal
+}
+
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending, WaitHint: 30000}
+
+	// loading a large snapshot or AOF can take a while
+	select {
+	case <-s.runner.ready:
+	case <-s.runner.stopped:
+		return false, 1
+	}
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: 30000}
+				s.shutdown <- syscall.SIGTERM
+				<-s.runner.stopped
+				return false, 0
+			}
+		case <-s.runner.stopped:
+			return false, 0
+		}
+	}
+}
+
+// redirectToEventLog forwards everything the server prints to the Windows
+// event log, one event per line
+func redirectToEventLog() error {
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return err
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		elog.Close()
+		return err
+	}
+
+	os.Stdout = writer
+	os.Stderr = writer
+
+	go func() {
+		defer elog.Close()
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			if strings.HasPrefix(line, "Error") {
+				elog.Error(1, line)
+			} else {
+				elog.Info(1, line)
+			}
+		}
+	}()
+	return nil
+}
+
+// controlService installs, uninstalls, starts or stops the FlexDB service
+func controlService(action string, args []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	if action == "install" {
+		return installService(m, args)
+	}
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %w", serviceName, err)
+	}
+	defer s.Close()
+
+	switch action {
+	case "uninstall":
+		if err := s.Delete(); err != nil {
+			return fmt.Errorf("failed to delete service: %w", err)
+		}
+		return eventlog.Remove(serviceName)
+	case "start":
+		return s.Start()
+	case "stop":
+		if _, err := s.Control(svc.Stop); err != nil {
+			return fmt.Errorf("failed to stop service: %w", err)
+		}
+		return waitForState(s, svc.Stopped, 30*time.Second)
+	default:
+		return fmt.Errorf("unknown service action %q, expected install, uninstall, start or stop", action)
+	}
+}
+
+// installService registers the current executable as an auto-start service
+// that runs with the given arguments
+func installService(m *mgr.Mgr, args []string) error {
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	s, err := m.CreateService(serviceName, executable, mgr.Config{
+		DisplayName: "FlexDB",
+		Description: "Lightweight Redis-like in-memory database",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("failed to create service: %w", err)
+	}
+	defer s.Close()
+
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("failed to register event log source: %w", err)
+	}
+	return nil
+}
+
+// waitForState polls the service until it reaches the wanted state
+func waitForState(s *mgr.Service, want svc.State, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := s.Query()
+		if err != nil {
+			return fmt.Errorf("failed to query service: %w", err)
+		}
+		if status.State == want {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for service to reach state %d", want)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"flex-db/internal/db"
+)
+
+// sdNotify sends a state update such as "READY=1" to systemd.
+// It does nothing when the server was not started by systemd with
+// Type=notify, i.e. when NOTIFY_SOCKET is unset.
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+
+	// a leading @ denotes a socket in the abstract namespace
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to systemd notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %w", err)
+	}
+	return nil
+}
+
+// sdWatchdogInterval returns how often the watchdog must be pinged, or 0 when
+// systemd has not enabled the watchdog for this process
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	// WATCHDOG_PID is set when the variables were meant for another process
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog pings the systemd watchdog at half the configured timeout for
+// as long as the keyspace stays responsive, until stop is closed
+func runWatchdog(database *db.FlexDB, stop <-chan struct{}) {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			// a deadlocked keyspace stops the pings so systemd restarts us
+			// the loader holds the keyspace lock, so skip the check until it's done
+			if !database.Loading() {
+				database.Ping()
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				fmt.Printf("Error pinging systemd watchdog: %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+)
+
+// The import and export subcommands move keys in and out of a running
+// server as JSONL or CSV records, see db.Record, and backup pulls a
+// snapshot from it with SYNC:
+//
+//	flexdb import [--addr localhost:9000] [--batch 1000] [--replace] keys.jsonl
+//	flexdb export [--addr localhost:9000] [--match 'user:*'] keys.csv
+//	flexdb backup [--addr localhost:9000] backup.json
+//
+// Import sends the records in IMPORT batches; export walks the keyspace
+// with SCAN. They report their progress on stderr once a second.
+
+// progressInterval is how often import and export report progress
+const progressInterval = time.Second
+
+// runTransfer runs the import or export subcommand if args name one, and
+// reports whether it did
+func runTransfer(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	var err error
+	switch args[0] {
+	case "import":
+		err = runImport(args[1:])
+	case "export":
+		err = runExport(args[1:])
+	case "backup":
+		err = runBackup(args[1:])
+	default:
+		return false
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	return true
+}
+
+// transferFlags are the flags the subcommands share
+type transferFlags struct {
+	addr     *string
+	password *string
+}
+
+func newTransferFlags(fs *flag.FlagSet) transferFlags {
+	return transferFlags{
+		addr:     fs.String("addr", "localhost:9000", "Address of the server"),
+		password: fs.String("password", "", "Password of a server started with --requirepass"),
+	}
+}
+
+// formatFlag defines the --format flag of import and export
+func formatFlag(fs *flag.FlagSet) *string {
+	return fs.String("format", "", "Record format: jsonl or csv (default: from the file extension, else jsonl)")
+}
+
+// recordFormat returns the format named by --format, or else the one the
+// file name suggests
+func recordFormat(name, path string) (db.RecordFormat, error) {
+	if name != "" {
+		return db.ParseRecordFormat(name)
+	}
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		return db.RecordCSV, nil
+	}
+	return db.RecordJSONL, nil
+}
+
+// dial connects to the server and authenticates if a password is set
+func (f transferFlags) dial() (*client, error) {
+	conn, err := net.Dial("tcp", *f.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if *f.password != "" {
+		if _, err := c.call("AUTH", *f.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// runImport runs flexdb import
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	flags := newTransferFlags(fs)
+	formatName := formatFlag(fs)
+	batchSize := fs.Int("batch", 1000, "Records sent per IMPORT command")
+	replace := fs.Bool("replace", false, "Overwrite existing keys instead of skipping them")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import [options] file|-\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *batchSize <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := fs.Arg(0)
+	format, err := recordFormat(*formatName, path)
+	if err != nil {
+		return err
+	}
+
+	input := os.Stdin
+	var size int64
+	if path != "-" {
+		if input, err = os.Open(path); err != nil {
+			return err
+		}
+		defer input.Close()
+		if info, err := input.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+
+	c, err := flags.dial()
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+
+	counter := &countingReader{r: input}
+	reader := db.NewRecordReader(counter, format)
+	progress := newProgress("Imported", "records", size)
+	var batch strings.Builder
+	writer := db.NewRecordWriter(&batch, db.RecordJSONL)
+	batched, firstLine := 0, 0
+	read, stored := 0, int64(0)
+
+	// batches are sent as JSONL whatever the file format, so each one
+	// stands on its own without the CSV header
+	send := func() error {
+		if batched == 0 {
+			return nil
+		}
+		writer.Flush()
+		cmd := []string{"IMPORT", "jsonl", batch.String()}
+		if *replace {
+			cmd = append(cmd, "REPLACE")
+		}
+		reply, err := c.call(cmd...)
+		if err != nil {
+			return fmt.Errorf("batch starting at line %d: %w", firstLine, err)
+		}
+		stored += reply.Int
+		batch.Reset()
+		batched = 0
+		progress.report(read, counter.n, false)
+		return nil
+	}
+
+	for {
+		rec, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if batched == 0 {
+			firstLine = reader.Line()
+		}
+		if err := writer.Write(rec); err != nil {
+			return fmt.Errorf("line %d: %w", reader.Line(), err)
+		}
+		batched++
+		read++
+		if batched == *batchSize {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := send(); err != nil {
+		return err
+	}
+	progress.report(read, counter.n, true)
+	fmt.Fprintf(os.Stderr, "%d keys stored, %d skipped as existing\n", stored, int64(read)-stored)
+	return nil
+}
+
+// runExport runs flexdb export
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	flags := newTransferFlags(fs)
+	formatName := formatFlag(fs)
+	match := fs.String("match", "*", "Export only keys matching this glob pattern")
+	count := fs.Int("count", 1000, "Keys read per SCAN call")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export [options] [file|-]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 || *count <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := "-"
+	if fs.NArg() == 1 {
+		path = fs.Arg(0)
+	}
+	format, err := recordFormat(*formatName, path)
+	if err != nil {
+		return err
+	}
+
+	output := os.Stdout
+	if path != "-" {
+		if output, err = os.Create(path); err != nil {
+			return err
+		}
+		defer output.Close()
+	}
+
+	c, err := flags.dial()
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+
+	writer := db.NewRecordWriter(output, format)
+	progress := newProgress("Exported", "records", 0)
+	exported, skipped := 0, 0
+	cursor := "0"
+	for {
+		reply, err := c.call("SCAN", cursor, "MATCH", *match, "COUNT", strconv.Itoa(*count))
+		if err != nil {
+			return err
+		}
+		if len(reply.Array) != 2 {
+			return fmt.Errorf("unexpected SCAN reply")
+		}
+		cursor = reply.Array[0].Str
+		keys := make([]string, len(reply.Array[1].Array))
+		for i, key := range reply.Array[1].Array {
+			keys[i] = key.Str
+		}
+
+		records, err := c.fetchRecords(keys)
+		if err != nil {
+			return err
+		}
+		for _, rec := range records {
+			if rec == nil {
+				skipped++
+				continue
+			}
+			if err := writer.Write(*rec); err != nil {
+				return err
+			}
+			exported++
+		}
+		progress.report(exported, 0, false)
+		if cursor == "0" {
+			break
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	progress.report(exported, 0, true)
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "%d keys skipped: expired while exporting, or of a type records can't hold\n", skipped)
+	}
+	return nil
+}
+
+// runBackup runs flexdb backup
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	flags := newTransferFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s backup [--addr host:port] [--password pass] file\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := fs.Arg(0)
+
+	c, err := flags.dial()
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+
+	c.w.Write(resp.Marshal(resp.NewArray([]resp.Value{resp.NewBulkString("SYNC")})))
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	header, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(header, "-") {
+		return errors.New(strings.TrimSpace(header[1:]))
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(header, "$")), 10, 64)
+	if !strings.HasPrefix(header, "$") || err != nil || size < 0 {
+		return fmt.Errorf("unexpected SYNC reply %q", strings.TrimSpace(header))
+	}
+
+	// written aside first, so a failed transfer never replaces a backup
+	temp := path + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	progress := newProgress("Received", "bytes", size)
+	counter := &countingReader{r: c.r}
+	_, err = io.CopyN(file, &progressReader{counter, progress}, size)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	progress.report(int(size), size, true)
+	return nil
+}
+
+// progressReader reports the bytes read through a countingReader
+type progressReader struct {
+	*countingReader
+	progress *progress
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.countingReader.Read(b)
+	p.progress.report(int(p.n), p.n, false)
+	return n, err
+}
+
+// fetchRecords reads the values of keys, pipelining the commands of a
+// SCAN page. Keys that are gone or whose type records can't hold are nil.
+func (c *client) fetchRecords(keys []string) ([]*db.Record, error) {
+	types := make([][]string, len(keys))
+	for i, key := range keys {
+		types[i] = []string{"TYPE", key}
+	}
+	typeReplies, err := c.pipeline(types)
+	if err != nil {
+		return nil, err
+	}
+
+	var cmds [][]string
+	for i, key := range keys {
+		switch typeReplies[i].Str {
+		case "string":
+			cmds = append(cmds, []string{"GET", key})
+		case "list":
+			cmds = append(cmds, []string{"LRANGE", key, "0", "-1"})
+		case "hash":
+			cmds = append(cmds, []string{"HGETALL", key})
+		case "set":
+			cmds = append(cmds, []string{"SMEMBERS", key})
+		case "zset":
+			cmds = append(cmds, []string{"ZRANGE", key, "0", "-1", "WITHSCORES"})
+		default:
+			continue
+		}
+		cmds = append(cmds, []string{"PTTL", key})
+	}
+	replies, err := c.pipeline(cmds)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*db.Record, len(keys))
+	for i, key := range keys {
+		typ := typeReplies[i].Str
+		switch typ {
+		case "string", "list", "hash", "set", "zset":
+		default:
+			continue
+		}
+		value, ttl := replies[0], replies[1]
+		replies = replies[2:]
+		if value.Null || ttl.Int == -2 {
+			// deleted between the commands
+			continue
+		}
+
+		rec := &db.Record{Key: key, Type: typ}
+		switch typ {
+		case "string":
+			rec.Value = value.Str
+		case "list", "set":
+			items := make([]string, len(value.Array))
+			for j, item := range value.Array {
+				items[j] = item.Str
+			}
+			rec.Value = items
+		case "hash":
+			fields := make(map[string]string, len(value.Array)/2)
+			for j := 0; j+1 < len(value.Array); j += 2 {
+				fields[value.Array[j].Str] = value.Array[j+1].Str
+			}
+			rec.Value = fields
+		case "zset":
+			scores := make(map[string]interface{}, len(value.Array)/2)
+			for j := 0; j+1 < len(value.Array); j += 2 {
+				score := value.Array[j+1].Str
+				if f, err := strconv.ParseFloat(score, 64); err == nil && score != "inf" && score != "-inf" {
+					scores[value.Array[j].Str] = f
+				} else {
+					scores[value.Array[j].Str] = score
+				}
+			}
+			rec.Value = scores
+		}
+		if ttl.Int > 0 {
+			// rounded up so a key about to expire doesn't lose its TTL
+			rec.TTL = (ttl.Int + 999) / 1000
+		}
+		records[i] = rec
+	}
+	return records, nil
+}
+
+// client is a minimal RESP client for the import and export subcommands
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// call sends a command and returns its reply, or the error it replied with
+func (c *client) call(args ...string) (resp.Value, error) {
+	replies, err := c.pipeline([][]string{args})
+	if err != nil {
+		return resp.Value{}, err
+	}
+	return replies[0], nil
+}
+
+// pipeline sends commands at once and returns their replies in order
+func (c *client) pipeline(cmds [][]string) ([]resp.Value, error) {
+	for _, args := range cmds {
+		items := make([]resp.Value, len(args))
+		for i, arg := range args {
+			items[i] = resp.NewBulkString(arg)
+		}
+		c.w.Write(resp.Marshal(resp.NewArray(items)))
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]resp.Value, len(cmds))
+	var firstErr error
+	for i := range cmds {
+		reply, err := resp.Parse(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if reply.Type == resp.Error && firstErr == nil {
+			firstErr = errors.New(reply.Str)
+		}
+		replies[i] = reply
+	}
+	return replies, firstErr
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// progress reports how many records or bytes were moved, at most once
+// per progressInterval
+type progress struct {
+	verb  string
+	unit  string
+	total int64 // bytes of the input, 0 if unknown
+	start time.Time
+	last  time.Time
+}
+
+func newProgress(verb, unit string, total int64) *progress {
+	now := time.Now()
+	return &progress{verb: verb, unit: unit, total: total, start: now, last: now}
+}
+
+// report prints the count moved, and how much of the input was read if
+// its size is known. The final report is always printed.
+func (p *progress) report(count int, offset int64, final bool) {
+	now := time.Now()
+	if !final && now.Sub(p.last) < progressInterval {
+		return
+	}
+	p.last = now
+
+	elapsed := now.Sub(p.start)
+	rate := float64(count) / elapsed.Seconds()
+	line := fmt.Sprintf("%s %d %s in %s (%.0f/s)", p.verb, count, p.unit, elapsed.Round(time.Millisecond), rate)
+	if p.total > 0 {
+		line += fmt.Sprintf(", %.1f%% of the input", 100*float64(offset)/float64(p.total))
+	}
+	fmt.Fprintln(os.Stderr, line)
+}
@@ -0,0 +1,191 @@
+package db
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// accessTracker records how often and how recently each key is used.
+// It has its own lock so reads holding only the keyspace read lock can
+// still record their access.
+type accessTracker struct {
+	mu      sync.Mutex
+	stats   map[string]*accessStats
+	started time.Time // last access reported for keys not touched since startup
+}
+
+type accessStats struct {
+	hits       uint64
+	lastAccess time.Time
+}
+
+// KeyAccess reports the access statistics of a key
+type KeyAccess struct {
+	Key        string
+	Hits       uint64
+	LastAccess time.Time
+}
+
+// WithAccessTracking records a hit count and last access time for every
+// key. It costs a map update per command, so it is off by default.
+func WithAccessTracking() Option {
+	return func(db *FlexDB) {
+		db.access = &accessTracker{
+			stats:   make(map[string]*accessStats),
+			started: time.Now(),
+		}
+	}
+}
+
+// touch records an access to key. Callers hold the keyspace lock.
+func (db *FlexDB) touch(key string) {
+	if db.access == nil {
+		return
+	}
+
+	db.access.mu.Lock()
+	defer db.access.mu.Unlock()
+
+	stats, ok := db.access.stats[key]
+	if !ok {
+		stats = &accessStats{}
+		db.access.stats[key] = stats
+	}
+	stats.hits++
+	stats.lastAccess = time.Now()
+}
+
+// accessOf returns the statistics of key. Callers hold the keyspace lock.
+func (db *FlexDB) accessOf(key string) KeyAccess {
+	db.access.mu.Lock()
+	defer db.access.mu.Unlock()
+
+	if stats, ok := db.access.stats[key]; ok {
+		return KeyAccess{Key: key, Hits: stats.hits, LastAccess: stats.lastAccess}
+	}
+	return KeyAccess{Key: key, LastAccess: db.access.started}
+}
+
+// restoreAccess sets the last access time of a key loaded from the
+// snapshot, so idle times survive restarts. Callers hold the keyspace lock.
+func (db *FlexDB) restoreAccess(key string, lastAccess time.Time) {
+	if db.access == nil {
+		return
+	}
+
+	db.access.mu.Lock()
+	db.access.stats[key] = &accessStats{lastAccess: lastAccess}
+	db.access.mu.Unlock()
+}
+
+// lastAccessUnix returns the last access time of a key as a Unix timestamp,
+// or 0 when access tracking is off. Callers hold the keyspace lock.
+func (db *FlexDB) lastAccessUnix(key string) int64 {
+	if db.access == nil {
+		return 0
+	}
+	return db.accessOf(key).LastAccess.Unix()
+}
+
+// forgetAccess drops the statistics of a deleted key.
+// Callers hold the keyspace lock.
+func (db *FlexDB) forgetAccess(key string) {
+	if db.access == nil {
+		return
+	}
+
+	db.access.mu.Lock()
+	delete(db.access.stats, key)
+	db.access.mu.Unlock()
+}
+
+// pruneAccess drops statistics of keys that no longer exist.
+// Callers hold the keyspace lock.
+func (db *FlexDB) pruneAccess() {
+	if db.access == nil {
+		return
+	}
+
+	db.access.mu.Lock()
+	defer db.access.mu.Unlock()
+
+	for key := range db.access.stats {
+		if _, ok := db.data[key]; !ok {
+			delete(db.access.stats, key)
+		}
+	}
+}
+
+// KeyAccess returns the access statistics of a single key
+func (db *FlexDB) KeyAccess(key string) (KeyAccess, error) {
+	if db.access == nil {
+		return KeyAccess{}, ErrAccessTrackingDisabled
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	val, ok := db.data[key]
+	if !ok || (val.Expiration != nil && db.now().After(*val.Expiration)) {
+		return KeyAccess{}, ErrKeyNotFound
+	}
+
+	return db.accessOf(key), nil
+}
+
+// IdleKeys returns the live keys that have not been accessed for at least
+// idle, least recently used first
+func (db *FlexDB) IdleKeys(idle time.Duration) ([]KeyAccess, error) {
+	if db.access == nil {
+		return nil, ErrAccessTrackingDisabled
+	}
+
+	db.lock.RLock()
+	now := time.Now()
+	var result []KeyAccess
+	for key, val := range db.data {
+		if val.Expiration != nil && now.After(*val.Expiration) {
+			continue
+		}
+		if access := db.accessOf(key); now.Sub(access.LastAccess) >= idle {
+			result = append(result, access)
+		}
+	}
+	db.lock.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].LastAccess.Equal(result[j].LastAccess) {
+			return result[i].LastAccess.Before(result[j].LastAccess)
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result, nil
+}
+
+// AccessStats returns the access statistics of every live key, most
+// frequently used first
+func (db *FlexDB) AccessStats() ([]KeyAccess, error) {
+	if db.access == nil {
+		return nil, ErrAccessTrackingDisabled
+	}
+
+	db.lock.RLock()
+	now := time.Now()
+	result := make([]KeyAccess, 0, len(db.data))
+	for key, val := range db.data {
+		if val.Expiration != nil && now.After(*val.Expiration) {
+			continue
+		}
+		result = append(result, db.accessOf(key))
+	}
+	db.lock.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Hits != result[j].Hits {
+			return result[i].Hits > result[j].Hits
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result, nil
+}
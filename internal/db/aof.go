@@ -2,15 +2,37 @@ package db
 
 import (
 	"bufio"
+	"errors"
+	"flex-db/internal/resp"
 	"flex-db/internal/utils"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// aofHeader starts every AOF written in the current format, in which each
+// command is a RESP array of bulk strings, so any byte can be logged.
+// Files without it hold one space separated command per line, the format
+// of earlier versions, which is still loaded. Such a file gets the header
+// appended when it's opened, and the commands after it are RESP.
+const aofHeader = "#FLEXDB-AOF 2\n"
+
+// aofCompressedPrefix starts the line before a compressed section of an
+// AOF: a gzip stream of RESP commands, whose length in bytes follows the
+// prefix. A rewrite with WithFileCompression writes its commands as one,
+// and the commands logged after it are appended uncompressed.
+const aofCompressedPrefix = "#GZIP "
+
+// aofCompressedLine is the line before a compressed section. The length is
+// padded to a fixed width so it can be filled in once the section is written.
+const aofCompressedLine = aofCompressedPrefix + "%020d\n"
+
 // AOFSyncPolicy determines when to sync AOF to disk
 type AOFSyncPolicy int
 
@@ -22,10 +44,29 @@ type AOFPersistence struct {
 	mu         sync.Mutex
 	enabled    bool
 	syncPolicy AOFSyncPolicy
+	done       chan struct{} // closed by Close to stop backgroundSync
+	base       bool          // a BASE was replayed, see replay
+	rebase     bool          // loaded fully without a BASE, see finishLoad
+	stamped    time.Time     // when the last time stamp was logged
+
+	// group commit with AOFSyncAlways, see groupCommit
+	syncMu   sync.Mutex    // held while groupCommit syncs the file outside mu
+	logged   atomic.Uint64 // commands logged, changed under mu
+	syncWake chan struct{} // wakes groupCommit
+	syncedMu sync.Mutex
+	synced   uint64     // commands known to be on disk, under syncedMu
+	syncDone *sync.Cond // broadcast when synced grows
+
+	// segments, see WithAOFMaxSegmentSize
+	size        atomic.Int64 // bytes in the file appended to, changed under mu
+	segments    []int        // numbers of the segments after the base, in order
+	nextSegment int          // number of the next segment
+	baseID      string       // BASE id of the base, see readBaseID
 }
 
 const (
-	// AOFSyncAlways syncs after every write
+	// AOFSyncAlways syncs every write before it is acknowledged, in
+	// groups, see groupCommit
 	AOFSyncAlways AOFSyncPolicy = iota
 	// AOFSyncEverySecond sync once per second
 	AOFSyncEverySecond
@@ -36,11 +77,15 @@ const (
 // To create a new AOF persistence manager
 func NewAOFPersistence(db *FlexDB, filePath string, syncPolicy AOFSyncPolicy) (*AOFPersistence, error) {
 	aof := &AOFPersistence{
-		db:         db,
-		filePath:   filePath,
-		syncPolicy: syncPolicy,
-		enabled:    true,
+		db:          db,
+		filePath:    filePath,
+		syncPolicy:  syncPolicy,
+		enabled:     true,
+		done:        make(chan struct{}),
+		syncWake:    make(chan struct{}, 1),
+		nextSegment: 1,
 	}
+	aof.syncDone = sync.NewCond(&aof.syncedMu)
 
 	// create directory if it doesn't exist
 	dir := filepath.Dir(filePath)
@@ -51,18 +96,32 @@ func NewAOFPersistence(db *FlexDB, filePath string, syncPolicy AOFSyncPolicy) (*
 		}
 	}
 
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	// commands are appended to the last segment, if any
+	active, err := aof.openSegments()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open AOF segments: %w", err)
+	}
+	file, err := os.OpenFile(active, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open AOF file: %w", err)
 	}
 
+	if err := writeHeader(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write AOF header: %w", err)
+	}
+
 	aof.file = file
 	aof.writer = bufio.NewWriter(file)
+	aof.size.Store(fileSize(file))
 
 	// start background sync if using every-second policy
 	if syncPolicy == AOFSyncEverySecond {
 		go aof.backgroundSync()
 	}
+	if syncPolicy == AOFSyncAlways {
+		go aof.groupCommit()
+	}
 
 	return aof, nil
 }
@@ -71,147 +130,446 @@ func (aof *AOFPersistence) LogCommand(cmd string, args ...string) error {
 	if !aof.enabled {
 		return nil
 	}
+	if err := aof.rotateIfFull(); err != nil {
+		// the command still goes to the current file
+		fmt.Printf("Error starting a new AOF segment: %v\n", err)
+	}
 
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	// format the command before writing for AOF
-	var sb strings.Builder
-	sb.WriteString(cmd)
-	for _, arg := range args {
-		sb.WriteString(" ") // space between command and argument
-		if strings.Contains(arg, " ") {
-			sb.WriteString("\"")
-			sb.WriteString(arg)
-			sb.WriteString("\"")
-		} else {
-			sb.WriteString(arg)
+	// stamped so the AOF can be recovered to a point in time
+	if now := time.Now(); now.Sub(aof.stamped) >= aofStampInterval {
+		stamp, stampArgs := stampCommand(now)
+		n, err := aof.writer.Write(encodeCommand(stamp, stampArgs))
+		aof.db.stats.aofBytes.Add(int64(n))
+		aof.size.Add(int64(n))
+		if err != nil {
+			return fmt.Errorf("failed to write to AOF buffer: %w", err)
 		}
+		aof.stamped = now
 	}
-	sb.WriteString("\n")
 
-	if _, err := aof.writer.WriteString(sb.String()); err != nil {
+	n, err := aof.writer.Write(encodeCommand(cmd, args))
+	aof.db.stats.aofBytes.Add(int64(n))
+	aof.size.Add(int64(n))
+	if err != nil {
 		return fmt.Errorf("failed to write to AOF buffer: %w", err)
 	}
 
 	if aof.syncPolicy == AOFSyncAlways {
-		if err := aof.sync(); err != nil {
-			return fmt.Errorf("failed to sync AOF: %w", err)
-		}
+		aof.requestSync()
 	}
 
 	return nil
 }
 
+// writeHeader starts an empty AOF with the header, or appends it to a
+// file in the line format that doesn't have it yet, so new commands can
+// be told apart
+func writeHeader(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		_, err := file.WriteString(aofHeader)
+		return err
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, info.Size()))
+	for {
+		line, err := reader.ReadString('\n')
+		if line == aofHeader {
+			return nil
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// a line cut short by a crash must not swallow the header
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	header := aofHeader
+	if last[0] != '\n' {
+		header = "\n" + header
+	}
+	_, err = file.WriteString(header)
+	return err
+}
+
+// encodeCommand encodes a command as a RESP array of bulk strings
+func encodeCommand(cmd string, args []string) []byte {
+	size := 16 + len(cmd)
+	for _, arg := range args {
+		size += 16 + len(arg)
+	}
+	buf := make([]byte, 0, size)
+
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)+1), 10)
+	buf = append(buf, '\r', '\n')
+	for i := -1; i < len(args); i++ {
+		part := cmd
+		if i >= 0 {
+			part = args[i]
+		}
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(part)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, part...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// decodeCommand decodes a command encoded by encodeCommand, or a line of
+// the older format
+func decodeCommand(data string) ([]string, error) {
+	if !strings.HasPrefix(data, "*") {
+		return parseCommandLine(data)
+	}
+	v, err := resp.Parse(bufio.NewReader(strings.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	return commandParts(v)
+}
+
+// commandParts returns the command and arguments of a RESP command
+func commandParts(v resp.Value) ([]string, error) {
+	if v.Type != resp.Array || v.Null {
+		return nil, errors.New("command is not an array")
+	}
+	parts := make([]string, len(v.Array))
+	for i, item := range v.Array {
+		if item.Type != resp.BulkString || item.Null {
+			return nil, errors.New("command argument is not a bulk string")
+		}
+		parts[i] = item.Str
+	}
+	return parts, nil
+}
+
+// unixMillis formats an expiration for the AOF. Expirations are logged as
+// absolute times, so replaying doesn't extend them by the time spent down.
+func unixMillis(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+// aofSerializer is implemented by value types that a SET can't recreate.
+// aofCommands returns the commands that rebuild the value under key when
+// the AOF is replayed, so a new type only has to implement it, and replay
+// its commands, to survive an AOF rewrite.
+type aofSerializer interface {
+	aofCommands(key string) [][]string
+}
+
+// aofBatch is the most elements a command written by a rewrite adds, so
+// a large value doesn't become one huge command
+const aofBatch = 64
+
+// batchedCommands returns cmd commands adding args to key, at most
+// aofBatch groups of width arguments each
+func batchedCommands(cmd, key string, args []string, width int) [][]string {
+	var cmds [][]string
+	for len(args) > 0 {
+		n := aofBatch * width
+		if n > len(args) {
+			n = len(args)
+		}
+		cmds = append(cmds, append([]string{cmd, key}, args[:n]...))
+		args = args[n:]
+	}
+	return cmds
+}
+
+// valueCommands returns the AOF commands that recreate a value under key,
+// followed by a PEXPIREAT for values with a TTL
+func valueCommands(key string, val Value) [][]string {
+	var cmds [][]string
+	switch data := val.Data.(type) {
+	case aofSerializer:
+		cmds = data.aofCommands(key)
+	case []string:
+		cmds = batchedCommands("RPUSH", key, data, 1)
+	case map[string]string:
+		args := make([]string, 0, 2*len(data))
+		for field, value := range data {
+			args = append(args, field, value)
+		}
+		cmds = batchedCommands("HSET", key, args, 2)
+	default:
+		str, _ := stringData(data)
+		cmds = append(cmds, []string{"SET", key, str})
+	}
+	if val.Expiration != nil {
+		cmds = append(cmds, []string{"PEXPIREAT", key, unixMillis(*val.Expiration)})
+	}
+	return cmds
+}
+
 func (aof *AOFPersistence) sync() error {
 	if err := aof.writer.Flush(); err != nil {
 		return err
 	}
-
-	return aof.file.Sync()
+	return aof.fsync(aof.file)
 }
 
 func (aof *AOFPersistence) backgroundSync() {
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		aof.mu.Lock()
-		aof.sync()
-		aof.mu.Unlock()
+	for {
+		select {
+		case <-aof.done:
+			return
+		case <-ticker.C:
+			aof.mu.Lock()
+			aof.sync()
+			aof.mu.Unlock()
+		}
 	}
 }
 
+// Close flushes buffered commands to disk and closes the AOF file.
+// Commands logged after Close are dropped.
 func (aof *AOFPersistence) Close() error {
+	aof.syncMu.Lock()
+	defer aof.syncMu.Unlock()
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	if err := aof.sync(); err != nil {
+	if !aof.enabled {
+		return nil
+	}
+	aof.enabled = false
+	close(aof.done)
+
+	err := aof.sync()
+	// nothing is logged anymore, so no client may wait for groupCommit
+	aof.markSynced(aof.logged.Load())
+	if err != nil {
+		aof.file.Close()
 		return err
 	}
 
 	return aof.file.Close()
 }
 
+// LoadAOF replays the AOF: the base file, then its segments in order
 func (aof *AOFPersistence) LoadAOF() error {
+	var stamped, replayed bool
+	files := aof.files()
+	for i, path := range files {
+		stopped, err := aof.loadFile(path, i == len(files)-1, &stamped, &replayed)
+		if err != nil || stopped {
+			return err
+		}
+	}
+	if !aof.db.recoverTo.IsZero() && replayed && !stamped {
+		return fmt.Errorf("can't recover AOF %s: %w", aof.filePath, errNoStamps)
+	}
+	return nil
+}
+
+// loadFile replays one file of the AOF and reports whether recovery to a
+// point in time stopped in it. Only the last file, the one appended to,
+// can be repaired by the load policy: the others were complete and synced
+// when the next one was started.
+func (aof *AOFPersistence) loadFile(path string, last bool, stamped, replayed *bool) (bool, error) {
 	// open file for reading
-	file, err := os.Open(aof.filePath)
+	file, err := os.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil
+			return false, nil
 		}
-		return fmt.Errorf("failed to open AOF file for loading: %w", err)
+		return false, fmt.Errorf("failed to open AOF file for loading: %w", err)
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue
-		}
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+	aof.db.loading.begin("aof", size)
 
-		// parse the command
-		parts, err := parseCommandLine(line)
+	r := newAOFReader(path, file, size)
+	for {
+		if err := aof.db.loading.advance(r.offset(), aof.db.stop); err != nil {
+			return false, err
+		}
 
+		parts, err := r.next()
+		if err == io.EOF {
+			return false, nil
+		}
+		var damage *AOFError
+		if errors.As(err, &damage) {
+			if !last {
+				return false, damage
+			}
+			return false, aof.loadDamaged(damage, size)
+		}
 		if err != nil {
-			return fmt.Errorf("error in parsing AOF line: %w", err)
+			return false, err
 		}
 
-		if len(parts) == 0 {
-			continue
+		if stamp, cut := aof.db.recoveryCutoff(parts); cut {
+			return true, aof.stopRecovery(stamp)
+		} else if !stamp.IsZero() {
+			*stamped = true
 		}
+		if err := aof.replay(parts); err != nil {
+			return false, err
+		}
+		*replayed = true
+	}
+}
 
-		// execute the command
-		cmd := strings.ToUpper(parts[0])
-		args := parts[1:]
+// truncate cuts the AOF file to size bytes
+func (aof *AOFPersistence) truncate(size int64) error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if err := aof.file.Truncate(size); err != nil {
+		return fmt.Errorf("failed to truncate AOF file: %w", err)
+	}
+	return nil
+}
 
-		switch cmd {
-		case "SET":
-			if len(args) < 2 {
-				continue
-			}
-			key := args[0]
-			value := args[1]
-
-			var expiry *time.Time
-			if len(args) >= 3 {
-				seconds, err := utils.ParseInt(args[2])
-				if err == nil {
-					t := time.Now().Add(time.Duration(seconds) * time.Second)
-					expiry = &t
-				}
-			}
-			aof.db.setWithoutLogging(key, value, expiry)
-		case "EXPIRE":
-			if len(args) != 2 {
-				continue
-			}
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
 
-			key := args[0]
-			seconds, err := utils.ParseInt(args[1])
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
 
-			if err != nil {
-				continue
-			}
+// replay applies one AOF command to the keyspace
+func (aof *AOFPersistence) replay(parts []string) error {
+	if len(parts) == 0 {
+		return nil
+	}
 
-			aof.db.expireWithoutLogging(key, time.Duration(seconds)*time.Second)
+	// execute the command
+	cmd := strings.ToUpper(parts[0])
+	args := parts[1:]
 
-		case "FLUSH":
-			// no need for flush while replaying AOF
-			continue
+	switch cmd {
+	case "ENC":
+		inner, err := aof.db.openCommand(args)
+		if err != nil {
+			return fmt.Errorf("error decrypting AOF line: %w", err)
+		}
+		innerParts, err := decodeCommand(inner)
+		if err != nil {
+			return fmt.Errorf("error in parsing encrypted AOF command: %w", err)
+		}
+		return aof.replay(innerParts)
+	case "SET", "PEXPIREAT":
+		return aof.db.replayExpiring(cmd, args)
+	case "EXPIRE":
+		if len(args) != 2 {
+			return nil
+		}
+
+		key := args[0]
+		seconds, err := utils.ParseInt(args[1])
+
+		if err != nil {
+			return nil
 		}
-	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error scanning AOF file: %w", err)
+		aof.db.expireWithoutLogging(key, time.Now().Add(time.Duration(seconds)*time.Second))
+
+	case "FLUSH":
+		// no need for flush while replaying AOF
+	case "TIMESTAMP":
+		// only read by recovery, see WithRecoverTo
+	case "BASE", "FLUSHALL":
+		// a rewrite starts with BASE and recreates every key of this AOF
+		// after it, so from there the file alone rebuilds them and the
+		// snapshot's copies are dropped. Files without it are replayed
+		// as before over the snapshot, which holds what they don't.
+		if cmd == "BASE" {
+			aof.base = true
+		}
+		if aof.base {
+			aof.db.dropKeysOf(aof)
+		}
+	default:
+		if fn, ok := builtinReplays[cmd]; ok {
+			if aof.base {
+				aof.db.applyReplay(cmd, args, fn)
+			}
+			return nil
+		}
+		aof.db.replayExtension(cmd, args)
 	}
 
 	return nil
 }
 
-// RewriteAOF compacts the AOF file by writing only commands needed for current state
+// replayExpiring applies a logged SET or PEXPIREAT, the commands that
+// carry absolute expirations. Malformed ones are skipped.
+func (db *FlexDB) replayExpiring(cmd string, args []string) error {
+	switch cmd {
+	case "SET":
+		if len(args) < 2 {
+			return nil
+		}
+		key := args[0]
+		value := args[1]
+
+		// "SET key value PXAT ms", or "SET key value seconds" in files
+		// written before expirations were logged as absolute times
+		var expiry *time.Time
+		if len(args) >= 4 && strings.ToUpper(args[2]) == "PXAT" {
+			ms, err := strconv.ParseInt(args[3], 10, 64)
+			if err == nil {
+				t := time.UnixMilli(ms)
+				expiry = &t
+			}
+		} else if len(args) >= 3 {
+			seconds, err := utils.ParseInt(args[2])
+			if err == nil {
+				t := time.Now().Add(time.Duration(seconds) * time.Second)
+				expiry = &t
+			}
+		}
+		db.setWithoutLogging(key, value, expiry)
+	case "PEXPIREAT":
+		if len(args) != 2 {
+			return nil
+		}
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil
+		}
+		db.expireWithoutLogging(args[0], time.UnixMilli(ms))
+	}
+	return nil
+}
+
+// RewriteAOF compacts the AOF file by writing only commands needed for current state.
+// The new file starts with BASE, so replaying it recreates its keys
+// whatever the snapshot holds, and its commands are followed by their
+// checksum, verified when the file is loaded.
 func (aof *AOFPersistence) RewriteAOF() error {
+	// keyspace lock first, like every write path, then the AOF locks
+	aof.db.lock.RLock()
+	defer aof.db.lock.RUnlock()
+	aof.syncMu.Lock()
+	defer aof.syncMu.Unlock()
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
@@ -220,23 +578,58 @@ func (aof *AOFPersistence) RewriteAOF() error {
 	if err != nil {
 		return fmt.Errorf("failed to create temporary file for AOF rewrite: %w", err)
 	}
-	writer := bufio.NewWriter(file)
-
-	snapshot := aof.db.All()
+	if _, err := file.WriteString(aofHeader); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write to temporary AOF file: %w", err)
+	}
+	compressed := aof.db.fileCompression != FileCompressionNone
+	if compressed {
+		if _, err := fmt.Fprintf(file, aofCompressedLine, 0); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write to temporary AOF file: %w", err)
+		}
+	}
+	counter := &countingWriter{w: file}
+	section := aof.db.compressedWriter(counter)
+	sum := newChecksum()
+	writer := bufio.NewWriter(io.MultiWriter(section, sum))
+
+	// BASE names the rewrite, for the manifest of the segments after it
+	now := time.Now()
+	baseID := strconv.FormatInt(now.UnixNano(), 10)
+	stamp, stampArgs := stampCommand(now)
+	if _, err := writer.Write(append(encodeCommand(stamp, stampArgs), encodeCommand("BASE", []string{baseID})...)); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write to temporary AOF file: %w", err)
+	}
 
-	// Write SET commands for all current keys
-	for key, value := range snapshot {
-		// Get TTL if any
-		ttl, err := aof.db.TTL(key)
-		var ttlArg string
-		if err == nil && ttl > 0 {
-			ttlArg = fmt.Sprintf(" %d", int(ttl.Seconds()))
+	// Write the commands recreating every live key this AOF logs
+	for key, val := range aof.db.data {
+		if val.Expiration != nil && now.After(*val.Expiration) {
+			continue
+		}
+		if aof.db.aofFor(key) != aof {
+			continue
+		}
+		// a value left on disk by WithLazyValues is decoded to be logged
+		val, ok := aof.db.peek(key)
+		if !ok {
+			continue
 		}
 
-		cmd := fmt.Sprintf("SET %s %v%s\n", key, value, ttlArg)
-		if _, err := writer.WriteString(cmd); err != nil {
-			file.Close()
-			return fmt.Errorf("failed to write to temporary AOF file: %w", err)
+		cmds := valueCommands(key, val)
+		if tags := aof.db.tags.tagsOf(key); len(tags) > 0 {
+			cmds = append(cmds, append([]string{"TAG", key}, tags...))
+		}
+		for _, c := range cmds {
+			cmd, args := c[0], c[1:]
+			if aof.db.encrypted(key) {
+				cmd, args = aof.db.sealCommand(key, cmd, args)
+			}
+			if _, err := writer.Write(encodeCommand(cmd, args)); err != nil {
+				file.Close()
+				return fmt.Errorf("failed to write to temporary AOF file: %w", err)
+			}
 		}
 	}
 
@@ -245,6 +638,22 @@ func (aof *AOFPersistence) RewriteAOF() error {
 		file.Close()
 		return fmt.Errorf("failed to flush temporary AOF file: %w", err)
 	}
+	// the checksum line covers the commands written above
+	if _, err := fmt.Fprintf(section, checksumLine, sum.Sum64()); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write to temporary AOF file: %w", err)
+	}
+	if err := section.Close(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to flush temporary AOF file: %w", err)
+	}
+	if compressed {
+		line := fmt.Sprintf(aofCompressedLine, counter.n)
+		if _, err := file.WriteAt([]byte(line), int64(len(aofHeader))); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write to temporary AOF file: %w", err)
+		}
+	}
 	if err := file.Sync(); err != nil {
 		file.Close()
 		return fmt.Errorf("failed to sync temporary AOF file: %w", err)
@@ -267,7 +676,14 @@ func (aof *AOFPersistence) RewriteAOF() error {
 
 	aof.file = file
 	aof.writer = bufio.NewWriter(file)
+	aof.size.Store(fileSize(file))
+	aof.stamped = now
+	aof.baseID = baseID
 
+	// the new base holds what the segments logged
+	if err := aof.dropSegments(); err != nil {
+		return fmt.Errorf("failed to update AOF manifest: %w", err)
+	}
 	return nil
 }
 
@@ -0,0 +1,301 @@
+package db
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"flex-db/internal/resp"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AOFLoadPolicy determines what loading does with a damaged AOF
+type AOFLoadPolicy int
+
+const (
+	// AOFLoadTruncateTail truncates a command cut short at the end of the
+	// file, as a crash mid-write leaves it, and stops on any other damage
+	AOFLoadTruncateTail AOFLoadPolicy = iota
+	// AOFLoadTruncate truncates the file at the first command it can't
+	// read, dropping the commands after it too
+	AOFLoadTruncate
+	// AOFLoadFail stops on any damage, leaving the file for
+	// flexdb-check-aof
+	AOFLoadFail
+)
+
+// WithAOFLoadPolicy sets what loading does with a damaged AOF, for the
+// main AOF and those of partitions. The default is AOFLoadTruncateTail.
+func WithAOFLoadPolicy(policy AOFLoadPolicy) Option {
+	return func(db *FlexDB) {
+		db.aofLoadPolicy = policy
+	}
+}
+
+// AOFError reports an AOF that can't be read past Offset, the end of its
+// last valid command. Truncated is set when the file ends in the middle
+// of a command, and unset when a command is malformed.
+type AOFError struct {
+	Path      string
+	Offset    int64
+	Truncated bool
+	Err       error
+}
+
+func (e *AOFError) Error() string {
+	return fmt.Sprintf("AOF %s is damaged at byte %d: %v", e.Path, e.Offset, e.Err)
+}
+
+func (e *AOFError) Unwrap() error {
+	return e.Err
+}
+
+// aofReader reads the commands of an AOF file, in the line format until
+// the header and as RESP after it
+type aofReader struct {
+	path    string
+	size    int64
+	counter *countingReader
+	reader  *bufio.Reader
+	legacy  bool // until the header is read
+
+	section      *aofReader // reads the compressed section being read, if any
+	sectionStart int64      // where that section's line starts
+
+	sum      hash.Hash64 // checksum of the commands since the header
+	sumStart int64       // where those commands start
+}
+
+func newAOFReader(path string, r io.Reader, size int64) *aofReader {
+	counter := &countingReader{r: r}
+	return &aofReader{
+		path:    path,
+		size:    size,
+		counter: counter,
+		reader:  bufio.NewReader(counter),
+		legacy:  true,
+	}
+}
+
+// offset returns where the next command starts
+func (r *aofReader) offset() int64 {
+	return r.counter.n - int64(r.reader.Buffered())
+}
+
+// next returns the next command. It returns io.EOF at the end of the
+// file and an *AOFError if the command can't be read.
+func (r *aofReader) next() ([]string, error) {
+	for {
+		if r.section != nil {
+			parts, err := r.nextCompressed()
+			if err == io.EOF {
+				continue
+			}
+			return parts, err
+		}
+
+		start := r.offset()
+		damaged := func(truncated bool, err error) error {
+			return &AOFError{Path: r.path, Offset: start, Truncated: truncated, Err: err}
+		}
+
+		next, err := r.reader.Peek(1)
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading AOF file: %w", err)
+		}
+
+		switch {
+		case next[0] == '#':
+			line, err := r.reader.ReadString('\n')
+			if err == io.EOF {
+				return nil, damaged(true, errors.New("incomplete header"))
+			}
+			if strings.HasPrefix(line, checksumPrefix) {
+				if err := r.verify(line); err != nil {
+					return nil, &AOFError{Path: r.path, Offset: r.sumStart, Err: err}
+				}
+				continue
+			}
+			if strings.HasPrefix(line, aofCompressedPrefix) {
+				if err := r.openSection(start, line); err != nil {
+					return nil, damaged(false, err)
+				}
+				continue
+			}
+			if line != aofHeader {
+				return nil, damaged(false, fmt.Errorf("unknown header %q", strings.TrimSpace(line)))
+			}
+			r.legacy = false
+			r.sum, r.sumStart = newChecksum(), r.offset()
+
+		case r.legacy:
+			line, err := r.reader.ReadString('\n')
+			if err != nil && err != io.EOF {
+				return nil, fmt.Errorf("error reading AOF file: %w", err)
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if line == "" {
+				continue
+			}
+			parts, err := parseCommandLine(line)
+			if err != nil {
+				return nil, damaged(false, err)
+			}
+			return parts, nil
+
+		case next[0] != '*':
+			// resp.Parse would take it for an inline command
+			return nil, damaged(false, errors.New("command is not an array"))
+
+		default:
+			// no command is longer than the rest of the file, and a
+			// length claiming more is a write cut short
+			limits := resp.Limits{MaxRequestSize: r.size - start}
+			v, err := resp.ParseWithLimits(r.reader, limits)
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, resp.ErrRequestTooLarge) {
+				return nil, damaged(true, errors.New("the last command is incomplete"))
+			}
+			if err != nil {
+				return nil, damaged(false, err)
+			}
+			parts, err := commandParts(v)
+			if err != nil {
+				return nil, damaged(false, err)
+			}
+			if r.sum != nil && len(parts) > 0 {
+				// encodeCommand wrote it, so it encodes back to the same bytes
+				r.sum.Write(encodeCommand(parts[0], parts[1:]))
+			}
+			return parts, nil
+		}
+	}
+}
+
+// openSection starts reading the compressed section announced by line
+func (r *aofReader) openSection(start int64, line string) error {
+	size, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, aofCompressedPrefix)), 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid compressed section header %q", strings.TrimSpace(line))
+	}
+	gz, err := gzip.NewReader(io.LimitReader(r.reader, size))
+	if err != nil {
+		return fmt.Errorf("compressed section: %w", err)
+	}
+
+	r.section = newAOFReader(r.path, gz, math.MaxInt64)
+	r.section.legacy = false
+	r.section.sum = newChecksum()
+	r.sectionStart = start
+	return nil
+}
+
+// verify checks the commands read since the header against a checksum
+// line. A rewrite ends its commands with one; commands appended later
+// aren't covered.
+func (r *aofReader) verify(line string) error {
+	sum, err := parseChecksum(line)
+	if err != nil {
+		return err
+	}
+	if r.sum == nil || sum != r.sum.Sum64() {
+		return fmt.Errorf("the rewritten commands don't match their checksum: %w", ErrChecksum)
+	}
+	// nothing after it is covered
+	r.sum = nil
+	return nil
+}
+
+// nextCompressed returns the next command of the compressed section, or
+// io.EOF once it's read. Damage anywhere in the section is reported at
+// its start and never as a truncated tail: a section is written whole by
+// a rewrite, and cutting it would drop every key the rewrite saved.
+func (r *aofReader) nextCompressed() ([]string, error) {
+	parts, err := r.section.next()
+	if err == nil {
+		return parts, nil
+	}
+	if err == io.EOF {
+		r.section = nil
+		return nil, io.EOF
+	}
+
+	var damage *AOFError
+	if errors.As(err, &damage) {
+		err = damage.Err
+	}
+	return nil, &AOFError{Path: r.path, Offset: r.sectionStart, Err: fmt.Errorf("compressed section: %w", err)}
+}
+
+// AOFCheck is what CheckAOF found in an AOF file
+type AOFCheck struct {
+	Commands int       // commands read before the end or the damage
+	Size     int64     // size of the file
+	Damage   *AOFError // nil if every command can be read
+	First    time.Time // first time stamp, zero if there is none
+	Last     time.Time // last time stamp read
+}
+
+// CheckAOF reads every command of the AOF file at path, without applying
+// them, to find whether and where it is damaged. It only fails if the
+// file can't be read. Truncating the file at Damage.Offset repairs it,
+// dropping the commands from there on.
+func CheckAOF(path string) (AOFCheck, error) {
+	var check AOFCheck
+	file, err := os.Open(path)
+	if err != nil {
+		return check, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return check, err
+	}
+	check.Size = info.Size()
+
+	r := newAOFReader(path, file, check.Size)
+	for {
+		parts, err := r.next()
+		if err == io.EOF {
+			return check, nil
+		}
+		if errors.As(err, &check.Damage) {
+			return check, nil
+		}
+		if err != nil {
+			return check, err
+		}
+		if stamp, ok := stampTime(parts); ok {
+			if check.First.IsZero() {
+				check.First = stamp
+			}
+			check.Last = stamp
+		}
+		check.Commands++
+	}
+}
+
+// loadDamaged applies the load policy to a damaged AOF: the damaged part
+// is truncated with a warning, or the error is returned to stop loading
+func (aof *AOFPersistence) loadDamaged(damage *AOFError, size int64) error {
+	// the commands a checksum covers are already replayed, so truncating
+	// them would leave the keyspace holding what the file no longer does
+	if errors.Is(damage, ErrChecksum) {
+		return damage
+	}
+	policy := aof.db.aofLoadPolicy
+	if policy == AOFLoadTruncate || (policy == AOFLoadTruncateTail && damage.Truncated) {
+		fmt.Printf("%v, truncating the last %d bytes\n", damage, size-damage.Offset)
+		return aof.truncate(damage.Offset)
+	}
+	return damage
+}
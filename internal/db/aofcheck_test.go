@@ -0,0 +1,115 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Damage appended to a valid AOF: a command cut short, as a crash
+// mid-write leaves it, and a malformed command followed by a valid one
+const (
+	truncatedCommand = "*3\r\n$3\r\nSET\r\n$1\r\nc"
+	malformedCommand = "+OK\r\n*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1\r\n3\r\n"
+)
+
+// writeAOF writes an AOF setting a and b and returns its path
+func writeAOF(t *testing.T, dir string) string {
+	t.Helper()
+	path := filepath.Join(dir, "flex.aof")
+	db := openTestDB(t, filepath.Join(dir, "first.db"), WithAOF(path, AOFSyncAlways))
+	db.Set("a", "1", nil)
+	db.Set("b", "2", nil)
+	db.Close()
+	return path
+}
+
+// damageAOF appends damage to the AOF at path and returns where it starts
+func damageAOF(t *testing.T, path, damage string) int64 {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(damage); err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestCheckAOF(t *testing.T) {
+	for _, damage := range []string{truncatedCommand, malformedCommand} {
+		path := writeAOF(t, t.TempDir())
+		clean, err := CheckAOF(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clean.Damage != nil {
+			t.Fatalf("CheckAOF found damage in a valid AOF: %v", clean.Damage)
+		}
+
+		offset := damageAOF(t, path, damage)
+		check, err := CheckAOF(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if check.Commands != clean.Commands || check.Damage == nil || check.Damage.Offset != offset {
+			t.Errorf("CheckAOF(%q): %+v, want %d commands and damage at %d", damage, check, clean.Commands, offset)
+			continue
+		}
+		if truncated := damage == truncatedCommand; check.Damage.Truncated != truncated {
+			t.Errorf("CheckAOF(%q): truncated %v, want %v", damage, check.Damage.Truncated, truncated)
+		}
+	}
+}
+
+func TestAOFLoadPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy AOFLoadPolicy
+		damage string
+		loads  bool
+	}{
+		{"tail truncates a cut command", AOFLoadTruncateTail, truncatedCommand, true},
+		{"tail stops on a malformed command", AOFLoadTruncateTail, malformedCommand, false},
+		{"truncate drops a malformed command", AOFLoadTruncate, malformedCommand, true},
+		{"fail stops on a cut command", AOFLoadFail, truncatedCommand, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := writeAOF(t, dir)
+			offset := damageAOF(t, path, tt.damage)
+			db, err := NewFlexDB(filepath.Join(dir, "second.db"), WithAOF(path, AOFSyncAlways), WithAOFLoadPolicy(tt.policy))
+			if !tt.loads {
+				var damage *AOFError
+				if !errors.As(err, &damage) {
+					t.Fatalf("NewFlexDB: %v, want an AOFError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			if info, err := os.Stat(path); err != nil || info.Size() != offset {
+				t.Errorf("AOF not truncated to %d bytes: %v", offset, err)
+			}
+			for key, want := range map[string]string{"a": "1", "b": "2"} {
+				if val, err := db.Get(key); err != nil || val != want {
+					t.Errorf("%s: %v, %v", key, val, err)
+				}
+			}
+			if _, err := db.Get("c"); !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("c was loaded from past the damage: %v", err)
+			}
+		})
+	}
+}
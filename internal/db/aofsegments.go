@@ -0,0 +1,317 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AOF segments
+//
+// With WithAOFMaxSegmentSize, commands stop being appended to the AOF file
+// once it reaches the size and go to numbered segments next to it instead,
+// flexdb.aof.1, flexdb.aof.2 and so on, each started once the previous one
+// is full. Only the last segment is ever written to, so the others can be
+// copied elsewhere as they are. The AOF file itself stays the base: what
+// a rewrite writes, followed by the segments in the order the manifest,
+// flexdb.aof.manifest, lists them:
+//
+//	#FLEXDB-AOF-MANIFEST 1
+//	base 1715000000000000000
+//	next 3
+//	segment flexdb.aof.1
+//	segment flexdb.aof.2
+//
+// A rewrite recreates every key in a new base, after which the segments
+// are deleted. The manifest names the rewrite its segments follow, from
+// the BASE command the rewrite starts with, so segments left behind by a
+// rewrite interrupted before it could delete them are never replayed over
+// the new base.
+
+// aofManifestHeader starts every AOF manifest
+const aofManifestHeader = "#FLEXDB-AOF-MANIFEST 1\n"
+
+// WithAOFMaxSegmentSize starts a new AOF segment whenever the file being
+// appended to reaches size bytes, for the main AOF and those of
+// partitions. Zero, the default, appends to a single file. Segments
+// already listed in a manifest are loaded and appended to either way.
+func WithAOFMaxSegmentSize(size int64) Option {
+	return func(db *FlexDB) {
+		db.aofSegmentSize = size
+	}
+}
+
+// manifestPath returns the path of the manifest of the AOF
+func (aof *AOFPersistence) manifestPath() string {
+	return aof.filePath + ".manifest"
+}
+
+// segmentPath returns the path of segment n of the AOF
+func (aof *AOFPersistence) segmentPath(n int) string {
+	return aof.filePath + "." + strconv.Itoa(n)
+}
+
+// files returns the paths of the base and the segments, in replay order
+func (aof *AOFPersistence) files() []string {
+	files := []string{aof.filePath}
+	for _, n := range aof.segments {
+		files = append(files, aof.segmentPath(n))
+	}
+	return files
+}
+
+// aofManifest is the content of an AOF manifest
+type aofManifest struct {
+	base     string // BASE id of the rewrite the segments follow
+	next     int    // number of the next segment
+	segments []int  // numbers of the segments, in order
+}
+
+// readManifest reads the manifest of the AOF. It returns nil if there is
+// none.
+func (aof *AOFPersistence) readManifest() (*aofManifest, error) {
+	data, err := os.ReadFile(aof.manifestPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	text := string(data)
+	if !strings.HasPrefix(text, aofManifestHeader) {
+		return nil, fmt.Errorf("AOF manifest %s has no header", aof.manifestPath())
+	}
+	m := &aofManifest{next: 1}
+	prefix := filepath.Base(aof.filePath) + "."
+	for _, line := range strings.Split(strings.TrimPrefix(text, aofManifestHeader), "\n") {
+		if line == "" {
+			continue
+		}
+		field, value, _ := strings.Cut(line, " ")
+		switch field {
+		case "base":
+			m.base = value
+		case "next":
+			if m.next, err = strconv.Atoi(value); err != nil || m.next < 1 {
+				return nil, fmt.Errorf("AOF manifest %s: invalid line %q", aof.manifestPath(), line)
+			}
+		case "segment":
+			n, err := strconv.Atoi(strings.TrimPrefix(value, prefix))
+			if !strings.HasPrefix(value, prefix) || err != nil || n < 1 {
+				return nil, fmt.Errorf("AOF manifest %s: invalid segment %q", aof.manifestPath(), value)
+			}
+			m.segments = append(m.segments, n)
+		default:
+			return nil, fmt.Errorf("AOF manifest %s: invalid line %q", aof.manifestPath(), line)
+		}
+	}
+	if len(m.segments) > 0 && m.next <= m.segments[len(m.segments)-1] {
+		m.next = m.segments[len(m.segments)-1] + 1
+	}
+	return m, nil
+}
+
+// writeManifest replaces the manifest of the AOF atomically
+func (aof *AOFPersistence) writeManifest(m aofManifest) error {
+	var b strings.Builder
+	b.WriteString(aofManifestHeader)
+	fmt.Fprintf(&b, "base %s\nnext %d\n", m.base, m.next)
+	for _, n := range m.segments {
+		fmt.Fprintf(&b, "segment %s\n", filepath.Base(aof.segmentPath(n)))
+	}
+
+	tempFile := aof.manifestPath() + ".tmp"
+	file, err := os.Create(tempFile)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(b.String()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, aof.manifestPath())
+}
+
+// openSegments reads the manifest and returns the path of the file to
+// append to: the last segment, or the base if there are none. Segments
+// whose manifest names another rewrite than the base are deleted; the
+// base already holds what they logged.
+func (aof *AOFPersistence) openSegments() (string, error) {
+	base, err := readBaseID(aof.filePath)
+	m, manifestErr := aof.readManifest()
+	if manifestErr != nil {
+		return "", manifestErr
+	}
+	if m == nil {
+		// a damaged base is reported by the load
+		aof.baseID = base
+		return aof.filePath, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("can't tell whether the segments of AOF %s belong to it: %w", aof.filePath, err)
+	}
+
+	aof.baseID, aof.nextSegment = base, m.next
+	if m.base != base {
+		fmt.Printf("AOF %s was rewritten after its segments were written, deleting them\n", aof.filePath)
+		aof.segments = m.segments
+		if err := aof.dropSegments(); err != nil {
+			return "", err
+		}
+		return aof.filePath, nil
+	}
+	if len(m.segments) == 0 {
+		return aof.filePath, nil
+	}
+	last := len(m.segments) - 1
+	for _, n := range m.segments[:last] {
+		if _, err := os.Stat(aof.segmentPath(n)); err != nil {
+			return "", fmt.Errorf("AOF segment listed in %s: %w", aof.manifestPath(), err)
+		}
+	}
+	aof.segments = m.segments
+	return aof.segmentPath(m.segments[last]), nil
+}
+
+// readBaseID returns the id the BASE command of the AOF at path gives
+// the rewrite that wrote it, or "" if it wasn't rewritten
+func readBaseID(path string) (string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// a rewrite starts with its time stamp and BASE
+	r := newAOFReader(path, file, info.Size())
+	for {
+		parts, err := r.next()
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		switch strings.ToUpper(parts[0]) {
+		case "TIMESTAMP":
+			continue
+		case "BASE":
+			if len(parts) > 1 {
+				return parts[1], nil
+			}
+		}
+		return "", nil
+	}
+}
+
+// rotateIfFull starts a new segment if the file being appended to has
+// reached the segment size. Callers hold the keyspace lock.
+func (aof *AOFPersistence) rotateIfFull() error {
+	limit := aof.db.aofSegmentSize
+	if limit <= 0 || aof.size.Load() < limit {
+		return nil
+	}
+
+	// groupCommit may be syncing the file being closed
+	aof.syncMu.Lock()
+	defer aof.syncMu.Unlock()
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if !aof.enabled || aof.size.Load() < limit {
+		return nil
+	}
+
+	if err := aof.sync(); err != nil {
+		return err
+	}
+	n := aof.nextSegment
+	path := aof.segmentPath(n)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	err = writeHeader(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	segments := append(aof.segments[:len(aof.segments):len(aof.segments)], n)
+	if err == nil {
+		// the segment only counts once the manifest lists it
+		err = aof.writeManifest(aofManifest{base: aof.baseID, next: n + 1, segments: segments})
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+
+	aof.file.Close()
+	aof.file = file
+	aof.writer.Reset(file)
+	aof.segments = segments
+	aof.nextSegment = n + 1
+	aof.size.Store(int64(len(aofHeader)))
+	// each segment starts with a time stamp, so it tells when it begins
+	aof.stamped = time.Time{}
+	return nil
+}
+
+// dropSegments deletes the segments once a rewrite replaced the base. The
+// manifest is updated first: until then it names the previous rewrite,
+// so the segments are ignored if the server stops in between. Callers
+// hold aof.mu, if the AOF is open.
+func (aof *AOFPersistence) dropSegments() error {
+	var err error
+	if aof.db.aofSegmentSize > 0 {
+		// kept to number the next segments after the previous ones
+		err = aof.writeManifest(aofManifest{base: aof.baseID, next: aof.nextSegment})
+	} else {
+		err = os.Remove(aof.manifestPath())
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	aof.removeSegments(aof.segments)
+	aof.segments = nil
+	return nil
+}
+
+// removeSegments deletes segment files
+func (aof *AOFPersistence) removeSegments(segments []int) {
+	for _, n := range segments {
+		if err := os.Remove(aof.segmentPath(n)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Error removing AOF segment: %v\n", err)
+		}
+	}
+}
+
+// fileSize returns the size of file, 0 if it can't be read
+func fileSize(file *os.File) int64 {
+	info, err := file.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
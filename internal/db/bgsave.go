@@ -0,0 +1,258 @@
+package db
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+)
+
+// BGSave starts writing a snapshot in the background and returns right
+// away. It fails with ErrSaveInProgress while another background snapshot
+// is being written. The outcome is reported by PersistenceStats.
+func (db *FlexDB) BGSave() error {
+	if db.Loading() {
+		return ErrLoading
+	}
+	if db.bgsaving.Load() {
+		return ErrSaveInProgress
+	}
+	go db.backgroundSave(false)
+	return nil
+}
+
+// BGSaveInProgress reports whether a background snapshot is being written
+func (db *FlexDB) BGSaveInProgress() bool {
+	return db.bgsaving.Load()
+}
+
+// bgsave writes a snapshot without holding the keyspace lock while it is
+// encoded and written. Under a read lock it only copies every key into
+// its persisted form, which is much faster than encoding it; the copies
+// share nothing that commands change in place, so the snapshot reflects
+// the moment they were taken. The cost is holding that copy in memory
+// until the snapshot is written, unlike save. If incremental, only the
+// keys changed since the last save are copied and appended to the
+// journals when they can take them, see WithIncrementalSnapshots.
+func (db *FlexDB) bgsave(incremental bool) error {
+	db.saveMu.Lock()
+	defer db.saveMu.Unlock()
+	db.bgsaving.Store(true)
+	defer db.bgsaving.Store(false)
+
+	db.lock.RLock()
+	// a partial keyspace must never replace the snapshot
+	if !db.loadSucceeded() {
+		db.lock.RUnlock()
+		return ErrLoading
+	}
+	start := time.Now()
+	changes, since := db.pendingChanges()
+	keys, all := db.takeDirtyKeys()
+	targets := db.snapshotTargets()
+	if incremental && !all && db.journalsReady(targets) {
+		captured := db.captureKeys(targets, keys)
+		db.lock.RUnlock()
+		return db.saveJournals(targets, captured, start, changes, since)
+	}
+	entries := db.captureKeyspace(targets)
+	db.lock.RUnlock()
+
+	var written int64
+	for i, target := range targets {
+		captured := entries[i]
+		n, err := db.saveTo(target.file, func(w *bufio.Writer) error {
+			return db.writeCaptured(w, captured)
+		})
+		written += n
+		if err != nil {
+			db.stats.recordSave(start, written, err)
+			db.markAllDirty()
+			return err
+		}
+	}
+	db.stats.recordSave(start, written, nil)
+	db.markSaved(changes, since)
+	return nil
+}
+
+// captureKeyspace copies the keys of each snapshot target, in the order of
+// targets. Callers hold the keyspace lock.
+func (db *FlexDB) captureKeyspace(targets []snapshotTarget) [][]snapshotEntry {
+	targetOf := db.targetIndex(targets)
+	sealer := db.snapshotSealer()
+
+	entries := make([][]snapshotEntry, len(targets))
+	for k, v := range db.data {
+		i, ok := targetOf(k)
+		if !ok {
+			continue
+		}
+
+		e := db.captureEntry(k, v)
+		if e.sealer != nil {
+			e.sealer = sealer
+		}
+		entries[i] = append(entries[i], e)
+	}
+	return entries
+}
+
+// targetIndex returns a function finding which of targets a key is saved
+// to, false for a partition without a snapshot file
+func (db *FlexDB) targetIndex(targets []snapshotTarget) func(key string) (int, bool) {
+	index := make(map[*partition]int, len(targets))
+	for i, target := range targets {
+		index[target.part] = i
+	}
+	return func(key string) (int, bool) {
+		var part *partition
+		if len(db.partitions) > 0 {
+			part = db.partitionOf(key)
+		}
+		i, ok := index[part]
+		return i, ok
+	}
+}
+
+// snapshotSealer returns a copy of the encryption keys, so captured keys
+// are encrypted with the keys active now even if they are reloaded while
+// the snapshot is written
+func (db *FlexDB) snapshotSealer() *encryption {
+	if db.encryption == nil {
+		return nil
+	}
+	keys := *db.encryption
+	return &keys
+}
+
+// captureEntry describes a key for a background snapshot, copying what
+// commands change in place once the keyspace lock is released. Sorted
+// sets, sets and the other structured types are already copied by their
+// persisted form, and compressed strings are replaced, never changed.
+func (db *FlexDB) captureEntry(k string, v Value) snapshotEntry {
+	v = resident(v)
+	switch data := v.Data.(type) {
+	case []string:
+		v.Data = append([]string(nil), data...)
+	case map[string]string:
+		hash := make(map[string]string, len(data))
+		for field, value := range data {
+			hash[field] = value
+		}
+		v.Data = hash
+	case *chunkedString:
+		// full chunks never change and APPEND only writes past the end
+		// of the last one, so copying the chunk list is enough
+		v.Data = &chunkedString{chunks: append([][]byte(nil), data.chunks...), size: data.size}
+	}
+	return db.snapshotEntryOf(k, v)
+}
+
+// writeCaptured writes entries captured by captureKeyspace as a snapshot
+func (db *FlexDB) writeCaptured(w *bufio.Writer, entries []snapshotEntry) error {
+	produce := func(emit func([]snapshotEntry) bool) error {
+		for start := 0; start < len(entries); start += snapshotBatchSize {
+			end := start + snapshotBatchSize
+			if end > len(entries) {
+				end = len(entries)
+			}
+			if !emit(entries[start:end]) {
+				return nil
+			}
+		}
+		return nil
+	}
+
+	encode := func(batch []snapshotEntry) encodedBatch {
+		encoded := make([]encodedEntry, len(batch))
+		for i, e := range batch {
+			entry, err := db.encodeSnapshotEntry(e)
+			if err != nil {
+				return encodedBatch{err: err}
+			}
+			encoded[i] = entry
+		}
+		return encodedBatch{entries: encoded}
+	}
+
+	return writeEntries(w, db.workerCount(), produce, encode)
+}
+
+// Backup writes a snapshot of the whole keyspace to w, as it was when
+// Backup was called, and returns how many bytes it wrote. Partitions are
+// included whether or not they have snapshot files of their own. The
+// output is a snapshot file like any other: compressed and encrypted as
+// configured, and loadable with --db. Like bgsave, it only holds the
+// keyspace lock while copying the keys.
+func (db *FlexDB) Backup(w io.Writer) (int64, error) {
+	return db.backup(w, nil)
+}
+
+// backup is Backup, calling taken, if not nil, while the keyspace is held
+// still after it was copied
+func (db *FlexDB) backup(w io.Writer, taken func()) (int64, error) {
+	db.lock.RLock()
+	if !db.loadSucceeded() {
+		db.lock.RUnlock()
+		return 0, ErrLoading
+	}
+	sealer := db.snapshotSealer()
+	entries := make([]snapshotEntry, 0, len(db.data))
+	for k, v := range db.data {
+		e := db.captureEntry(k, v)
+		if e.sealer != nil {
+			e.sealer = sealer
+		}
+		entries = append(entries, e)
+	}
+	if taken != nil {
+		taken()
+	}
+	db.lock.RUnlock()
+
+	n, _, err := db.encodeSnapshot(w, func(bw *bufio.Writer) error {
+		return db.writeCaptured(bw, entries)
+	})
+	return n, err
+}
+
+// ReplaceKeyspace replaces every key with those of the snapshot at path,
+// as written by Backup. The AOFs are rewritten and a snapshot is
+// scheduled, since the files no longer match the keyspace.
+func (db *FlexDB) ReplaceKeyspace(path string) error {
+	return db.replaceKeyspace(path, nil)
+}
+
+// replaceKeyspace is ReplaceKeyspace, running swapped, if set, while the
+// keyspace is still locked
+func (db *FlexDB) replaceKeyspace(path string, swapped func()) error {
+	db.saveMu.Lock()
+	db.lock.Lock()
+	for key := range db.data {
+		db.deleteWithoutLogging(key)
+	}
+	err := db.load(path)
+	// the snapshot has no journal to keep track of
+	delete(db.journals, path)
+	if swapped != nil {
+		swapped()
+	}
+	db.lock.Unlock()
+	db.saveMu.Unlock()
+
+	db.markAllDirty()
+	db.triggerWrite()
+	if err != nil {
+		return err
+	}
+	for _, aof := range db.aofs() {
+		if !aof.enabled {
+			continue
+		}
+		if err := aof.RewriteAOF(); err != nil {
+			fmt.Printf("Error rewriting AOF %s after replacing the keyspace: %v\n", aof.filePath, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// keyWaiters wakes commands blocked on a key when it may have changed, so
+// they can retry instead of polling. A wakeup only means "look again": the
+// woken command must check the key itself, as another client may have
+// consumed the change first.
+type keyWaiters struct {
+	mu      sync.Mutex
+	waiters map[string][]*waiter
+}
+
+// waiter is a command blocked on one or more keys. The first signal on
+// any of them wakes it.
+type waiter struct {
+	ch   chan struct{}
+	once sync.Once
+}
+
+func (w *waiter) wake() {
+	w.once.Do(func() { close(w.ch) })
+}
+
+// watchKeys registers for the next signal on any of keys. Register before
+// checking the keys, so a change between the check and the wait isn't
+// missed, and call cancel once done waiting.
+func (db *FlexDB) watchKeys(keys []string) (<-chan struct{}, func()) {
+	w := &db.keyWaiters
+	me := &waiter{ch: make(chan struct{})}
+
+	w.mu.Lock()
+	if w.waiters == nil {
+		w.waiters = make(map[string][]*waiter)
+	}
+	for _, key := range keys {
+		w.waiters[key] = append(w.waiters[key], me)
+	}
+	w.mu.Unlock()
+
+	cancel := func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		for _, key := range keys {
+			waiters := w.waiters[key]
+			for i, other := range waiters {
+				if other == me {
+					waiters = append(waiters[:i], waiters[i+1:]...)
+					break
+				}
+			}
+			if len(waiters) == 0 {
+				delete(w.waiters, key)
+			} else {
+				w.waiters[key] = waiters
+			}
+		}
+	}
+	return me.ch, cancel
+}
+
+// signalKey wakes every command waiting on key
+func (db *FlexDB) signalKey(key string) {
+	w := &db.keyWaiters
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, waiter := range w.waiters[key] {
+		waiter.wake()
+	}
+	delete(w.waiters, key)
+}
+
+// waitHooksKey is the context key of the hooks set with WithWaitHooks
+type waitHooksKey struct{}
+
+type waitHooks struct {
+	before, after func()
+}
+
+// WithWaitHooks returns a copy of ctx that makes blocking calls run before
+// when they start waiting and after when they stop, so a caller can let go
+// of a lock while it would only sit idle holding it
+func WithWaitHooks(ctx context.Context, before, after func()) context.Context {
+	return context.WithValue(ctx, waitHooksKey{}, waitHooks{before, after})
+}
+
+// waiting runs the before hook of ctx, if any, and returns the matching
+// after hook to run once the wait is over
+func waiting(ctx context.Context) func() {
+	hooks, ok := ctx.Value(waitHooksKey{}).(waitHooks)
+	if !ok {
+		return func() {}
+	}
+	hooks.before()
+	return hooks.after
+}
+
+// blockOn runs attempt until it succeeds, waiting in between for key to be
+// signalled or, if attempt returned a non-zero time, for that time to
+// come. It returns attempt's error, ctx's error when ctx ends first, and
+// ErrShuttingDown when the database shuts down.
+func (db *FlexDB) blockOn(ctx context.Context, key string, attempt func() (bool, time.Time, error)) error {
+	return db.blockOnKeys(ctx, []string{key}, attempt)
+}
+
+// blockOnKeys is blockOn waiting for any of keys to be signalled
+func (db *FlexDB) blockOnKeys(ctx context.Context, keys []string, attempt func() (bool, time.Time, error)) error {
+	for {
+		// watch before looking, so a change in between still wakes us
+		signalled, cancel := db.watchKeys(keys)
+		done, retryAt, err := attempt()
+		if err != nil || done {
+			cancel()
+			return err
+		}
+
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if !retryAt.IsZero() {
+			timer = time.NewTimer(time.Until(retryAt))
+			retry = timer.C
+		}
+
+		resume := waiting(ctx)
+		select {
+		case <-signalled:
+		case <-retry:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-db.stop:
+			err = ErrShuttingDown
+		}
+		resume()
+		cancel()
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"strings"
+)
+
+// snapshotHeader starts every snapshot written in the current format: the
+// JSON object follows it and a checksum line ends the file. Snapshots
+// starting with '{' were written before it and are loaded unchecked.
+const snapshotHeader = "#FLEXDB-SNAPSHOT 1\n"
+
+// checksumPrefix starts the line holding the CRC-64 (ECMA) of what
+// precedes it: the whole snapshot, or the commands of an AOF rewrite
+const checksumPrefix = "#CRC64 "
+
+// checksumLine is a checksum line, always checksumLineLen bytes long
+const checksumLine = checksumPrefix + "%016x\n"
+
+const checksumLineLen = len(checksumPrefix) + 16 + 1
+
+// ErrChecksum is returned when a snapshot or an AOF rewrite doesn't match
+// its checksum, meaning it changed on disk after it was written
+var ErrChecksum = errors.New("checksum mismatch")
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// newChecksum returns the hash checksum lines hold
+func newChecksum() hash.Hash64 {
+	return crc64.New(crcTable)
+}
+
+// parseChecksum reads the sum of a checksum line
+func parseChecksum(line string) (uint64, error) {
+	var sum uint64
+	if len(line) != checksumLineLen || !strings.HasPrefix(line, checksumPrefix) {
+		return 0, fmt.Errorf("invalid checksum line %q", strings.TrimSpace(line))
+	}
+	if _, err := fmt.Sscanf(line[len(checksumPrefix):], "%016x\n", &sum); err != nil {
+		return 0, fmt.Errorf("invalid checksum line %q", strings.TrimSpace(line))
+	}
+	return sum, nil
+}
+
+// checksumReader hashes what is read through it, holding back the last
+// checksumLineLen bytes, which end up being the checksum line
+type checksumReader struct {
+	r    io.Reader
+	hash hash.Hash64
+	held []byte
+}
+
+func newChecksumReader(r io.Reader) *checksumReader {
+	return &checksumReader{r: r, hash: newChecksum()}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.held = append(c.held, p[:n]...)
+	if extra := len(c.held) - checksumLineLen; extra > 0 {
+		c.hash.Write(c.held[:extra])
+		c.held = append(c.held[:0], c.held[extra:]...)
+	}
+	return n, err
+}
+
+// verify reads the rest of the stream and checks it against the checksum
+// line it ends with
+func (c *checksumReader) verify() error {
+	if _, err := io.Copy(io.Discard, c); err != nil {
+		return err
+	}
+	sum, err := parseChecksum(string(c.held))
+	if err != nil {
+		return err
+	}
+	if sum != c.hash.Sum64() {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// readSnapshotHeader reads the header of a snapshot and reports whether
+// it has one. Snapshots written before the header have none.
+func readSnapshotHeader(r *bufio.Reader) (bool, error) {
+	next, err := r.Peek(1)
+	if err != nil || next[0] != '#' {
+		return false, nil
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return false, errors.New("incomplete header")
+	}
+	if line != snapshotHeader {
+		return false, fmt.Errorf("unsupported snapshot version %q", strings.TrimSpace(line))
+	}
+	return true, nil
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// corruptFile replaces old with new, of the same length, in the file at
+// path
+func corruptFile(t *testing.T, path, old, new string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(old)) {
+		t.Fatalf("%s doesn't hold %q", path, old)
+	}
+	if err := os.WriteFile(path, bytes.Replace(data, []byte(old), []byte(new), 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flex.db")
+	db := openTestDB(t, path)
+	db.Set("k", "hello", nil)
+	db.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), snapshotHeader) {
+		t.Errorf("snapshot doesn't start with the header: %q", data)
+	}
+	if _, err := parseChecksum(string(data[len(data)-checksumLineLen:])); err != nil {
+		t.Errorf("snapshot doesn't end with a checksum: %v", err)
+	}
+
+	db = openTestDB(t, path)
+	if val, err := db.Get("k"); err != nil || val != "hello" {
+		t.Fatalf("k after reload: %v, %v", val, err)
+	}
+	db.Close()
+
+	corruptFile(t, path, "hello", "jello")
+	if _, err := NewFlexDB(path); !errors.Is(err, ErrChecksum) {
+		t.Errorf("loading a corrupted snapshot: %v, want ErrChecksum", err)
+	}
+}
+
+func TestAOFRewriteChecksum(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "flex.aof")
+	db := openTestDB(t, filepath.Join(dir, "first.db"), WithAOF(path, AOFSyncAlways))
+	db.Set("k", "hello", nil)
+	if err := db.RewriteAOF(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if check, err := CheckAOF(path); err != nil || check.Damage != nil {
+		t.Fatalf("CheckAOF of a rewritten AOF: %+v, %v", check, err)
+	}
+	corruptFile(t, path, "hello", "jello")
+	check, err := CheckAOF(path)
+	if err != nil || check.Damage == nil || !errors.Is(check.Damage, ErrChecksum) {
+		t.Fatalf("CheckAOF of a corrupted rewrite: %+v, %v", check, err)
+	}
+
+	// truncating wouldn't undo the commands already replayed
+	_, err = NewFlexDB(filepath.Join(dir, "second.db"), WithAOF(path, AOFSyncAlways), WithAOFLoadPolicy(AOFLoadTruncate))
+	if !errors.Is(err, ErrChecksum) {
+		t.Errorf("loading a corrupted rewrite: %v, want ErrChecksum", err)
+	}
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// chunkSize is the size of each piece of a chunked string. Strings grown
+// past it by APPEND switch to the chunked representation.
+const chunkSize = 64 * 1024
+
+// chunkedString stores a large string as fixed size pieces so appending
+// only ever copies the last piece, and snapshots can write it piece by piece
+type chunkedString struct {
+	chunks [][]byte // every chunk but the last is full
+	size   int
+}
+
+// newChunkedString splits s into chunks
+func newChunkedString(s string) *chunkedString {
+	c := &chunkedString{}
+	c.append(s)
+	return c
+}
+
+// append adds s to the end of the string, filling the last chunk first
+func (c *chunkedString) append(s string) {
+	c.size += len(s)
+	for len(s) > 0 {
+		if n := len(c.chunks); n == 0 || len(c.chunks[n-1]) == chunkSize {
+			c.chunks = append(c.chunks, make([]byte, 0, chunkSize))
+		}
+
+		last := &c.chunks[len(c.chunks)-1]
+		free := chunkSize - len(*last)
+		if free > len(s) {
+			free = len(s)
+		}
+		*last = append(*last, s[:free]...)
+		s = s[free:]
+	}
+}
+
+// String joins the chunks into a single string
+func (c *chunkedString) String() string {
+	var sb strings.Builder
+	sb.Grow(c.size)
+	for _, chunk := range c.chunks {
+		sb.Write(chunk)
+	}
+	return sb.String()
+}
+
+// loadChunked restores a chunked string from its snapshot form, an array of
+// base64 encoded chunks
+func loadChunked(data interface{}) (*chunkedString, error) {
+	parts, ok := data.([]interface{})
+	if !ok {
+		return nil, errors.New("chunked value is not an array")
+	}
+
+	c := &chunkedString{}
+	for _, part := range parts {
+		encoded, ok := part.(string)
+		if !ok {
+			return nil, errors.New("chunk is not a string")
+		}
+		chunk, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		c.append(string(chunk))
+	}
+	return c, nil
+}
+
+// Append appends value to the string stored at key, creating it if needed,
+// and returns the new length. Strings that grow past chunkSize are kept
+// chunked so repeated appends don't copy the whole value.
+func (db *FlexDB) Append(key, value string) (int, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if limit := db.limits.MaxValueSize; limit > 0 {
+		if val, ok := db.lookup(key); ok && len(value)+lengthOf(val) > limit {
+			return 0, fmt.Errorf("%w (limit is %d bytes)", ErrValueTooLarge, limit)
+		}
+		if err := db.checkValues(value); err != nil {
+			return 0, err
+		}
+	}
+
+	db.expireKeys(key)
+	length, err := db.appendWithoutLogging(key, value, false)
+	if err != nil {
+		return 0, err
+	}
+
+	if db.logging() {
+		if err := db.logCommand("APPEND", key, value); err != nil {
+			fmt.Printf("Error logging to AOF: %v\n", err)
+		}
+	}
+
+	db.touch(key)
+	db.triggerWrite(key)
+	return length, nil
+}
+
+func (db *FlexDB) appendWithoutLogging(key, value string, replaying bool) (int, error) {
+	val, exists := db.lookup(key)
+	// a replayed APPEND keeps an expired key, see Txn.Get
+	if exists && val.Expiration != nil && db.now().After(*val.Expiration) && !replaying {
+		delete(db.data, key)
+		exists = false
+	}
+
+	if !exists {
+		val = Value{Type: TypeString, Data: ""}
+		db.indexKey(key)
+	} else if val.Type != TypeString {
+		return 0, ErrWrongType
+	}
+
+	if chunked, ok := val.Data.(*chunkedString); ok {
+		chunked.append(value)
+	} else {
+		str, _ := stringData(val.Data)
+		if len(str)+len(value) > chunkSize {
+			chunked := newChunkedString(str)
+			chunked.append(value)
+			val.Data = chunked
+		} else {
+			val.Data = db.encodeString(str + value)
+		}
+	}
+	db.data[key] = val
+	db.recordVersion(key, val)
+
+	return lengthOf(val), nil
+}
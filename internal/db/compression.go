@@ -0,0 +1,95 @@
+package db
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"io"
+)
+
+// compressedString is the in-memory form of a string value stored
+// compressed. Reads inflate it back to the original string.
+type compressedString struct {
+	data []byte // DEFLATE stream
+	size int    // length of the original string
+}
+
+// WithCompression compresses string values of at least threshold bytes in
+// memory and in the snapshot. Values that don't shrink are kept as is.
+// Compression uses DEFLATE from the standard library at its fastest level.
+func WithCompression(threshold int) Option {
+	return func(db *FlexDB) {
+		db.compressThreshold = threshold
+	}
+}
+
+// encodeString returns the representation used to store value
+func (db *FlexDB) encodeString(value string) interface{} {
+	if db.compressThreshold <= 0 || len(value) < db.compressThreshold {
+		return value
+	}
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return value
+	}
+	w.Write([]byte(value))
+	if err := w.Close(); err != nil || buf.Len() >= len(value) {
+		return value
+	}
+
+	return &compressedString{data: buf.Bytes(), size: len(value)}
+}
+
+// stringData returns the string held by a string value, inflating it if it
+// is stored compressed. ok is false if data is not a string.
+func stringData(data interface{}) (s string, ok bool) {
+	switch v := data.(type) {
+	case string:
+		return v, true
+	case *compressedString:
+		return v.String(), true
+	case *chunkedString:
+		return v.String(), true
+	default:
+		return "", false
+	}
+}
+
+// String inflates the compressed value. Compressed data is either produced
+// by encodeString or validated by loadCompressed, so a decoding failure
+// means memory corruption.
+func (c *compressedString) String() string {
+	s, err := inflate(c.data, c.size)
+	if err != nil {
+		panic("flexdb: corrupted compressed value: " + err.Error())
+	}
+	return s
+}
+
+// inflate decompresses a DEFLATE stream, using sizeHint to preallocate
+func inflate(data []byte, sizeHint int) (string, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	buf := bytes.NewBuffer(make([]byte, 0, sizeHint))
+	if _, err := io.Copy(buf, r); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// loadCompressed restores a compressed string from its base64 snapshot
+// form, inflating it once to validate the data and learn its size
+func loadCompressed(encoded string) (*compressedString, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	s, err := inflate(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &compressedString{data: data, size: len(s)}, nil
+}
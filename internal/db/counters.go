@@ -0,0 +1,207 @@
+package db
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IncrBy adds delta to the integer stored as a string at key and returns
+// the result. A missing key counts as 0. The key keeps its TTL.
+func (db *FlexDB) IncrBy(key string, delta int64) (int64, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, err
+	}
+
+	var result int64
+	err := db.Update(func(tx *Txn) error {
+		val, exists := tx.Get(key)
+		current := "0"
+		if exists {
+			if val.Type != TypeString {
+				return ErrWrongType
+			}
+			current, _ = stringData(val.Data)
+		}
+		sum, err := addInt(current, delta)
+		if err != nil {
+			return err
+		}
+
+		result = sum
+		putCounter(tx, key, strconv.FormatInt(result, 10), val.Expiration)
+		return nil
+	})
+	return result, err
+}
+
+// IncrByFloat adds delta to the number stored as a string at key and
+// returns the result as stored, formatted like Redis: rounded to 17
+// significant digits, without trailing zeros or an exponent, so 1.1 plus
+// 2.2 gives 3.3. A missing key counts as 0. The key keeps its TTL.
+func (db *FlexDB) IncrByFloat(key string, delta float64) (string, error) {
+	if err := db.checkKey(key); err != nil {
+		return "", err
+	}
+
+	var result string
+	err := db.Update(func(tx *Txn) error {
+		val, exists := tx.Get(key)
+		current := "0"
+		if exists {
+			if val.Type != TypeString {
+				return ErrWrongType
+			}
+			current, _ = stringData(val.Data)
+		}
+		sum, err := addFloat(current, delta)
+		if err != nil {
+			return err
+		}
+
+		result = sum
+		putCounter(tx, key, result, val.Expiration)
+		return nil
+	})
+	return result, err
+}
+
+// HIncrBy adds delta to the integer stored in field of the hash at key
+// and returns the result. Missing keys and fields count as 0.
+func (db *FlexDB) HIncrBy(key, field string, delta int64) (int64, error) {
+	var result int64
+	_, err := db.incrHashField(key, field, func(current string) (string, error) {
+		sum, err := addInt(current, delta)
+		result = sum
+		return strconv.FormatInt(sum, 10), err
+	})
+	return result, err
+}
+
+// HIncrByFloat adds delta to the number stored in field of the hash at
+// key and returns the result, formatted as by IncrByFloat. Missing keys
+// and fields count as 0.
+func (db *FlexDB) HIncrByFloat(key, field string, delta float64) (string, error) {
+	return db.incrHashField(key, field, func(current string) (string, error) {
+		return addFloat(current, delta)
+	})
+}
+
+// incrHashField replaces field of the hash at key with what add returns
+// for its current value, "0" for missing keys and fields, and logs the
+// result as an HSET
+func (db *FlexDB) incrHashField(key, field string, add func(current string) (string, error)) (string, error) {
+	if err := db.checkKey(key); err != nil {
+		return "", err
+	}
+	if err := db.checkValues(field); err != nil {
+		return "", err
+	}
+
+	var result string
+	err := db.Update(func(tx *Txn) error {
+		val, exists := tx.Get(key)
+		var hash map[string]string
+		if exists {
+			if val.Type != TypeHash {
+				return ErrWrongType
+			}
+			hash = val.Data.(map[string]string)
+		}
+		current, fieldExists := hash[field]
+		if !fieldExists {
+			current = "0"
+			if err := db.checkElements(len(hash) + 1); err != nil {
+				return err
+			}
+		}
+		sum, err := add(current)
+		if err != nil {
+			return err
+		}
+
+		if hash == nil {
+			hash = make(map[string]string)
+			tx.Put(key, Value{Type: TypeHash, Data: hash})
+		}
+		hash[field] = sum
+		tx.markChanged(key)
+		tx.Log("HSET", key, field, sum)
+		result = sum
+		return nil
+	})
+	return result, err
+}
+
+// addInt adds delta to the integer in s. Values that aren't integers and
+// sums that overflow are refused.
+func addInt(s string, delta int64) (int64, error) {
+	current, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, ErrNotInteger
+	}
+	return current + delta, nil
+}
+
+// floatPrec is the precision, in bits, of the sums of addFloat: that of
+// the long double Redis adds with, so the errors of decimal fractions
+// stay below the 17 digits the sums are rounded to
+const floatPrec = 64
+
+// addFloat adds delta to the number in s and formats the sum as Redis
+// does, see IncrByFloat. Sums that aren't finite are refused, as they
+// couldn't be incremented again.
+func addFloat(s string, delta float64) (string, error) {
+	current, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(current) || math.IsInf(current, 0) {
+		return "", ErrNotFloat
+	}
+	if math.IsInf(current+delta, 0) {
+		return "", ErrNotFloat
+	}
+
+	// both numbers are taken as the decimals they were written as, like
+	// the shortest one reading back as delta, rather than as their nearest
+	// float64
+	x, _, err := big.ParseFloat(s, 10, floatPrec, big.ToNearestEven)
+	if err != nil {
+		return "", ErrNotFloat
+	}
+	y, _, _ := big.ParseFloat(strconv.FormatFloat(delta, 'g', -1, 64), 10, floatPrec, big.ToNearestEven)
+	return formatFloat(new(big.Float).SetPrec(floatPrec).Add(x, y)), nil
+}
+
+// formatFloat formats x rounded to 17 significant digits, without
+// trailing zeros or an exponent
+func formatFloat(x *big.Float) string {
+	sci := x.Text('e', 16)
+	exp, _ := strconv.Atoi(sci[strings.IndexByte(sci, 'e')+1:])
+	decimals := 16 - exp
+	if decimals < 0 {
+		decimals = 0
+	}
+	text := x.Text('f', decimals)
+	if strings.Contains(text, ".") {
+		text = strings.TrimRight(strings.TrimRight(text, "0"), ".")
+	}
+	if text == "-0" {
+		text = "0"
+	}
+	return text
+}
+
+// putCounter stores the new value of a counter with its expiration and
+// logs it as a SET of the result, so replay doesn't depend on the old value
+func putCounter(tx *Txn, key, value string, expiration *time.Time) {
+	tx.Put(key, Value{Type: TypeString, Data: value, Expiration: expiration})
+	if expiration != nil {
+		tx.Log("SET", key, value, "PXAT", unixMillis(*expiration))
+	} else {
+		tx.Log("SET", key, value)
+	}
+}
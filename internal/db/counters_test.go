@@ -0,0 +1,32 @@
+package db
+
+import "testing"
+
+func TestIncrByFloat(t *testing.T) {
+	db := newTestDB(t)
+
+	tests := []struct {
+		start string
+		delta float64
+		want  string
+	}{
+		{"1.1", 2.2, "3.3"},
+		{"10.50", 0.1, "10.6"},
+		{"0.1", 0.2, "0.3"},
+		{"5.0e3", 2.0e2, "5200"},
+		{"3", -3, "0"},
+		{"1e20", 1, "100000000000000000000"},
+		{"0.000001", 0.0000002, "0.0000012"},
+		{"-2.5", 1, "-1.5"},
+	}
+	for _, tt := range tests {
+		db.Set("f", tt.start, nil)
+		got, err := db.IncrByFloat("f", tt.delta)
+		if err != nil || got != tt.want {
+			t.Errorf("%s + %v: got %q %v, want %q", tt.start, tt.delta, got, err, tt.want)
+		}
+		if stored, _ := db.Get("f"); stored != tt.want {
+			t.Errorf("%s + %v: stored %v, want %q", tt.start, tt.delta, stored, tt.want)
+		}
+	}
+}
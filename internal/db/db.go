@@ -1,9 +1,11 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,9 +15,38 @@ const (
 	TypeString ValueType = iota
 	TypeList
 	TypeHash
+	TypeZSet
+	TypePQ
+	TypeSet
+	TypeTimeSeries
+	TypeQueue
 	// Future types can be added here
 )
 
+// String returns the name clients see for the type, as reported by TYPE
+func (t ValueType) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeList:
+		return "list"
+	case TypeHash:
+		return "hash"
+	case TypeZSet:
+		return "zset"
+	case TypePQ:
+		return "pq"
+	case TypeSet:
+		return "set"
+	case TypeTimeSeries:
+		return "timeseries"
+	case TypeQueue:
+		return "queue"
+	default:
+		return "unknown"
+	}
+}
+
 type Value struct {
 	Type       ValueType
 	Data       interface{}
@@ -24,11 +55,70 @@ type Value struct {
 
 // FlexDB is the main database structure
 type FlexDB struct {
-	data       map[string]Value
-	lock       sync.RWMutex
-	file       string
-	writeQueue chan struct{}
-	aof        *AOFPersistence  // if nil, AOF is not enabled
+	data              map[string]Value
+	lock              sync.RWMutex
+	file              string
+	aof               *AOFPersistence // if nil, AOF is not enabled
+	aofLoadPolicy     AOFLoadPolicy   // what loading does with a damaged AOF
+	groupCommitWindow time.Duration   // see WithAOFGroupCommit
+	aofSegmentSize    int64           // start a new AOF segment past this size, 0 disables, see WithAOFMaxSegmentSize
+	recoverTo         time.Time       // replay the AOF only up to this time, see WithRecoverTo
+	recovered         bool            // an AOF was recovered to recoverTo
+	limits            Limits          // size limits enforced on writes
+
+	compressThreshold int             // compress strings of at least this many bytes, 0 disables
+	fileCompression   FileCompression // how snapshots and AOF rewrites are compressed
+	access            *accessTracker  // nil unless access tracking is enabled
+	lazy              *lazyValues     // nil unless large values are loaded on first access
+
+	stop      chan struct{}  // closed to stop the background goroutines
+	workers   sync.WaitGroup // tracks writeLoop and expirationChecker
+	closeOnce sync.Once
+	closeErr  error
+
+	activeExpireDisabled atomic.Bool               // set with DEBUG SET-ACTIVE-EXPIRE 0
+	applyTime            atomic.Pointer[time.Time] // the time the keyspace goes by while set, see ApplyAt
+	expirer              atomic.Pointer[Expirer]   // takes over active expiration while set, see SetExpirer
+	fsyncFailureRate     atomic.Uint64             // float64 bits, see SetFsyncFailureRate
+
+	stats    persistStats // persistence counters, see PersistenceStats
+	saveMu   sync.Mutex   // held while a snapshot is written, see save and bgsave
+	bgsaving atomic.Bool  // a background snapshot is being written
+
+	// incremental snapshots, see WithIncrementalSnapshots
+	compactRatio float64             // compact a journal past this size relative to its snapshot, 0 disables
+	journals     map[string]*journal // journal of each snapshot file, guarded by saveMu
+
+	// snapshot scheduling, see triggerWrite and writeLoop
+	persistMu   sync.Mutex
+	needsSave   *sync.Cond          // signalled when changes are pending, wakes writeLoop
+	saved       *sync.Cond          // broadcast after a snapshot, wakes throttled writers
+	dirty       uint64              // changes since the last snapshot
+	dirtySince  time.Time           // when the oldest unsaved change was made
+	stopping    bool                // set by Shutdown, stops writeLoop and throttling
+	maxUnsaved  uint64              // throttle writers above this many unsaved changes, 0 disables
+	maxThrottle time.Duration       // longest a writer is throttled
+	saveRules   []SaveRule          // when writeLoop saves, see WithSaveRules
+	dirtyKeys   map[string]struct{} // keys changed since the last snapshot, see noteDirty
+	dirtyAll    bool                // any key may have changed since the last snapshot
+
+	loading         loadState // startup load of the snapshot and AOF
+	backgroundLoad  bool      // NewFlexDB returns before loading finishes
+	snapshotWorkers int       // goroutines encoding and decoding the snapshot, 0 for one per CPU
+
+	partitions []*partition          // key prefixes with their own persistence, see WithPartition
+	encryption *encryption           // nil unless persisted values are encrypted
+	leases     leaseTable            // see GrantLease
+	history    *historyTracker       // nil unless key history is kept, see WithHistory
+	trash      *trash                // nil unless DEL keeps keys for UNDELETE, see WithTrash
+	tags       tagIndex              // see Tag
+	keyIndex   keyIndex              // sorted key names for prefix reads, see PrefixGet
+	scanIndex  keyIndex              // key names in scan order, see Scan
+	keyWaiters keyWaiters            // commands blocked on a key, see watchKeys
+	replays    map[string]ReplayFunc // AOF commands added by embedders, see WithReplay
+	repl       replicationLog        // the stream sent to replicas, see PartialSync
+
+	initErr error // set by an option that failed, returned by NewFlexDB
 }
 
 type Option func(*FlexDB)
@@ -42,71 +132,137 @@ func WithAOF(aofPath string, syncPolicy AOFSyncPolicy) Option {
 		}
 
 		db.aof = aof
-		
-		// Load existing data from AOF if available
-		if err := aof.LoadAOF(); err != nil {
-			fmt.Printf("Failed to load data from AOF: %v\n", err)
-		}
 	}
 }
 
 func (db *FlexDB) setWithoutLogging(key string, value string, expiration *time.Time) {
+	if _, exists := db.data[key]; !exists {
+		db.indexKey(key)
+	}
 	db.data[key] = Value{
-		Type: TypeString,
-		Data: value,
-		Expiration: expiration,
+		Type:       TypeString,
+		Data:       db.encodeString(value),
+		Expiration: persistedExpiration(expiration),
 	}
+	db.recordVersion(key, db.data[key])
 }
 
 func (db *FlexDB) deleteWithoutLogging(key string) {
 	delete(db.data, key)
+	db.forgetAccess(key)
+	db.forgetHistory(key)
+	db.forgetTags(key)
 }
 
-func (db *FlexDB) expireWithoutLogging(key string, duration time.Duration) {
+func (db *FlexDB) expireWithoutLogging(key string, at time.Time) {
 	val, ok := db.data[key]
 	if !ok {
 		return
 	}
 
-	expiry := time.Now().Add(duration)
-	val.Expiration = &expiry
+	val.Expiration = persistedExpiration(&at)
 	db.data[key] = val
 }
 
-// NewFlexDB initializes DB and loads data from disk
-func NewFlexDB(filename string, options ...Option) *FlexDB {
+// persistedExpiration returns an expiration as the snapshot and the AOF
+// store it: truncated to the millisecond and without the monotonic clock
+// reading. Keys keep it in memory too, so they expire at the same instant
+// before and after a restart, and PTTL reads the same.
+func persistedExpiration(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	exp := time.UnixMilli(t.UnixMilli())
+	return &exp
+}
+
+// NewFlexDB initializes DB and loads data from disk. It fails if the
+// snapshot exists but can't be read. With WithBackgroundLoad it returns
+// right away and the load outcome is reported through Loaded and LoadError.
+func NewFlexDB(filename string, options ...Option) (*FlexDB, error) {
 	db := &FlexDB{
-		data:       make(map[string]Value),
-		file:       filename,
-		writeQueue: make(chan struct{}, 100),
+		data: make(map[string]Value),
+		tags: newTagIndex(),
+		file: filename,
+		stop: make(chan struct{}),
+
+		saveRules: DefaultSaveRules,
 	}
+	db.repl.init()
+	db.needsSave = sync.NewCond(&db.persistMu)
+	db.saved = sync.NewCond(&db.persistMu)
+	db.loading.done = make(chan struct{})
+	db.leases.leases = make(map[string]*leaseEntry)
+	db.leases.watchers = make(map[string][]chan LeaseEvent)
+	db.scanIndex.less = scanLess
 
 	for _, option := range options {
 		option(db)
 	}
+	if db.initErr != nil {
+		for _, aof := range db.aofs() {
+			aof.Close()
+		}
+		return nil, db.initErr
+	}
 
-	// Load data from JSON first -> snapshot loads faster
-	db.load()
+	if db.backgroundLoad {
+		db.workers.Add(1)
+		go func() {
+			defer db.workers.Done()
+			db.finishLoad(db.loadAll())
+		}()
+		return db, nil
+	}
 
-	// if AOF is enabled and exists, replay it to get the latest state
-	if db.aof != nil && db.aof.enabled {
-		if err := db.aof.LoadAOF(); err != nil {
-			fmt.Printf("Error loading AOF: %v\n", err)
+	if err := db.loadAll(); err != nil {
+		for _, aof := range db.aofs() {
+			aof.Close()
 		}
+		return nil, err
 	}
+	db.finishLoad(nil)
+	return db, nil
+}
 
-	go db.writeLoop()
-	go db.expirationChecker()
-	return db
+// finishLoad records the load outcome and, if it succeeded, starts the
+// background goroutines. They must not run earlier: a snapshot written
+// during the load would replace the file with a partial keyspace.
+func (db *FlexDB) finishLoad(err error) {
+	if err == nil {
+		db.workers.Add(2)
+		go db.writeLoop()
+		go db.expirationChecker()
+	}
+	db.loading.err = err
+	close(db.loading.done)
 }
 
 // expirationChecker periodically checks for expired keys
 func (db *FlexDB) expirationChecker() {
+	defer db.workers.Done()
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		now := time.Now()
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+		}
+
+		db.purgeTrash()
+		// replicas remove expired keys when their master's DEL arrives
+		if db.activeExpireDisabled.Load() || db.isReplica() {
+			continue
+		}
+		// and so do the followers of a leader
+		expirer := db.expirer.Load()
+		if expirer != nil && !(*expirer).Leading() {
+			continue
+		}
+
+		now := db.now()
 		keysToDelete := []string{}
 
 		db.lock.RLock()
@@ -117,58 +273,258 @@ func (db *FlexDB) expirationChecker() {
 		}
 		db.lock.RUnlock()
 
+		if expirer != nil {
+			if len(keysToDelete) > 0 {
+				(*expirer).Expire(keysToDelete)
+			}
+			continue
+		}
 		if len(keysToDelete) > 0 {
 			db.lock.Lock()
-			for _, k := range keysToDelete {
-				delete(db.data, k)
-			}
+			expired := db.expireKeys(keysToDelete...)
+			db.pruneAccess()
+			db.pruneHistory()
+			db.pruneTags()
 			db.lock.Unlock()
-			db.triggerWrite()
+			if len(expired) > 0 {
+				db.triggerWrite(expired...)
+			}
+		}
+	}
+}
+
+// expireKeys removes those of keys that have expired and logs a DEL for
+// them, so replicas and the AOF remove them at the same point of the
+// stream. Replicas don't expire keys themselves: they keep them, hidden
+// from their clients, until the master's DEL arrives, so the commands
+// they apply see the keys as the master did. Callers hold the keyspace
+// lock.
+func (db *FlexDB) expireKeys(keys ...string) []string {
+	if db.isReplica() {
+		return nil
+	}
+
+	now := db.now()
+	var expired []string
+	for _, key := range keys {
+		if val, ok := db.data[key]; ok && val.Expiration != nil && now.After(*val.Expiration) {
+			db.deleteWithoutLogging(key)
+			expired = append(expired, key)
+		}
+	}
+	if len(expired) > 0 && db.logging() {
+		if err := db.logCommand("DEL", expired...); err != nil {
+			fmt.Printf("Error logging to AOF: %v\n", err)
 		}
 	}
+	return expired
+}
+
+// now is the time the keyspace goes by: the clock's, or while ApplyAt
+// runs, the time it was given
+func (db *FlexDB) now() time.Time {
+	if t := db.applyTime.Load(); t != nil {
+		return *t
+	}
+	return time.Now()
+}
+
+// ApplyAt runs fn with the keyspace going by time t instead of the clock,
+// so a write replicated along with the time it was made decides which
+// keys have expired the same way on every server, whatever their clocks.
+// Commands running meanwhile go by t as well. Calls must not overlap.
+func (db *FlexDB) ApplyAt(t time.Time, fn func()) {
+	db.applyTime.Store(&t)
+	defer db.applyTime.Store(nil)
+	fn()
+}
+
+// Expirer takes over active expiration for replication where a single
+// leader decides which keys expire, see SetExpirer
+type Expirer interface {
+	// Leading reports whether this server is the leader. Other servers
+	// leave expiring keys to it.
+	Leading() bool
+	// Expire is called on the leader with keys found expired, to have
+	// every server remove them, typically with ExpireKeys
+	Expire(keys []string)
+}
+
+// SetExpirer makes the expiration checker hand the expired keys it finds
+// to e instead of removing them itself
+func (db *FlexDB) SetExpirer(e Expirer) {
+	db.expirer.Store(&e)
+}
+
+// ExpireKeys removes those of keys that have expired, logging a DEL for
+// them, and returns them. Keys written since they were found expired are
+// left alone.
+func (db *FlexDB) ExpireKeys(keys ...string) []string {
+	db.lock.Lock()
+	expired := db.expireKeys(keys...)
+	db.lock.Unlock()
+	if len(expired) > 0 {
+		db.triggerWrite(expired...)
+	}
+	return expired
 }
 
-// writeLoop handles periodic and triggered writes to disk
+// writeLoop writes a snapshot whenever a save rule is satisfied, see
+// WithSaveRules, and retries failed snapshots after a delay.
 func (db *FlexDB) writeLoop() {
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
+	defer db.workers.Done()
 
+	var retryAt time.Time
 	for {
-		select {
-		case <-db.writeQueue:
-			select {
-			case <-time.After(500 * time.Millisecond):
-				db.save()
-			case <-db.writeQueue:
-				db.save()
+		db.persistMu.Lock()
+		for !db.stopping {
+			due, ok := db.nextSave(retryAt)
+			if !ok {
+				db.needsSave.Wait()
+				continue
 			}
-		case <-ticker.C:
-			db.save()
+			wait := time.Until(due)
+			if wait <= 0 {
+				break
+			}
+			// a rule reached while waiting may make the save due sooner
+			timer := time.AfterFunc(wait, func() {
+				db.persistMu.Lock()
+				db.persistMu.Unlock()
+				db.needsSave.Broadcast()
+			})
+			db.needsSave.Wait()
+			timer.Stop()
+		}
+		stopping := db.stopping
+		db.persistMu.Unlock()
+		if stopping {
+			return
+		}
+
+		db.backgroundSave(true)
+		retryAt = time.Time{}
+		if db.PersistenceError() != nil {
+			retryAt = time.Now().Add(saveRetryInterval)
 		}
 	}
 }
 
 // Set stores a string value with an optional expiration time
-func (db *FlexDB) Set(key string, value string, expiration *time.Time) {
+func (db *FlexDB) Set(key string, value string, expiration *time.Time) error {
+	_, err := db.SetWithOptions(key, value, SetOptions{Expiration: expiration})
+	return err
+}
+
+// GetSet stores a string value and returns the previous one, and false if
+// the key didn't exist
+func (db *FlexDB) GetSet(key string, value string) (string, bool, error) {
+	res, err := db.SetWithOptions(key, value, SetOptions{Get: true})
+	return res.Old, res.Existed, err
+}
+
+// CompareAndSwap sets key to value if it currently holds expected, and
+// reports whether it did. A missing key never matches. The key keeps its
+// TTL, so a holder can update what it owns without extending it. A value
+// that isn't a string fails with ErrWrongType.
+func (db *FlexDB) CompareAndSwap(key, expected, value string) (bool, error) {
+	if err := db.checkValues(value); err != nil {
+		return false, err
+	}
+
+	swapped := false
+	err := db.Update(func(tx *Txn) error {
+		val, ok := tx.Get(key)
+		if !ok {
+			return nil
+		}
+		current, ok := stringData(val.Data)
+		if !ok {
+			return ErrWrongType
+		}
+		if current != expected {
+			return nil
+		}
+
+		tx.Put(key, Value{Type: TypeString, Data: db.encodeString(value), Expiration: val.Expiration})
+		if val.Expiration != nil {
+			tx.Log("SET", key, value, "PXAT", unixMillis(*val.Expiration))
+		} else {
+			tx.Log("SET", key, value)
+		}
+		swapped = true
+		return nil
+	})
+	return swapped, err
+}
+
+// SetOptions are the expiration and conditions of SetWithOptions
+type SetOptions struct {
+	Expiration *time.Time
+	NX         bool // only set if the key doesn't exist
+	XX         bool // only set if the key exists
+	Get        bool // return the previous value, which must be a string
+	KeepTTL    bool // keep the expiration of an existing key instead of Expiration
+}
+
+// SetResult is the outcome of SetWithOptions
+type SetResult struct {
+	Stored  bool   // false if a condition didn't hold
+	Old     string // the previous value, with SetOptions.Get
+	Existed bool   // whether the key existed, with SetOptions.Get
+}
+
+// SetWithOptions stores a string value if the conditions of opts hold,
+// checking them, reading the previous value and setting under one lock
+// acquisition. With Get, a previous value that isn't a string fails with
+// ErrWrongType and nothing is stored.
+func (db *FlexDB) SetWithOptions(key string, value string, opts SetOptions) (SetResult, error) {
+	var res SetResult
+	if err := db.checkKey(key); err != nil {
+		return res, err
+	}
+	if err := db.checkValues(value); err != nil {
+		return res, err
+	}
+
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
+	val, exists := db.lookup(key)
+	exists = exists && (val.Expiration == nil || db.now().Before(*val.Expiration))
+	if opts.Get && exists {
+		old, ok := stringData(val.Data)
+		if !ok {
+			return res, ErrWrongType
+		}
+		res.Old, res.Existed = old, true
+	}
+	if (opts.NX && exists) || (opts.XX && !exists) {
+		return res, nil
+	}
+
+	expiration := opts.Expiration
+	if opts.KeepTTL && exists {
+		expiration = val.Expiration
+	}
 	db.setWithoutLogging(key, value, expiration)
 
 	// log to aof if enabled
-	if db.aof != nil  && db.aof.enabled {
+	if db.logging() {
 		var args []string
 		args = append(args, key, value)
 		if expiration != nil {
-			seconds := int64(time.Until(*expiration).Seconds())
-			args = append(args, fmt.Sprintf("%d", seconds))
+			args = append(args, "PXAT", unixMillis(*expiration))
 		}
 
-		if err := db.aof.LogCommand("SET", args...); err != nil {
+		if err := db.logCommand("SET", args...); err != nil {
 			fmt.Printf("Error logging to AOF: %v\n", err)
 		}
 	}
-	db.triggerWrite()
+	db.touch(key)
+	db.triggerWrite(key)
+	res.Stored = true
+	return res, nil
 }
 
 // Get retrieves a value by key
@@ -176,24 +532,32 @@ func (db *FlexDB) Get(key string) (interface{}, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	val, ok := db.data[key]
+	val, ok := db.lookup(key)
 	if !ok {
-		return nil, errors.New("key not found")
+		return nil, ErrKeyNotFound
 	}
 
 	// Check if key has expired
-	if val.Expiration != nil && time.Now().After(*val.Expiration) {
+	if val.Expiration != nil && db.now().After(*val.Expiration) {
 		// Delete in a separate goroutine to avoid deadlock
 		go func() {
 			db.lock.Lock()
-			delete(db.data, key)
+			expired := db.expireKeys(key)
 			db.lock.Unlock()
-			db.triggerWrite()
+			if len(expired) > 0 {
+				db.triggerWrite(key)
+			}
 		}()
-		return nil, errors.New("key not found")
+		return nil, ErrKeyNotFound
+	}
+
+	str, ok := stringData(val.Data)
+	if !ok {
+		return nil, ErrWrongType
 	}
 
-	return val.Data, nil
+	db.touch(key)
+	return str, nil
 }
 
 // Delete removes a key-value pair
@@ -202,17 +566,18 @@ func (db *FlexDB) Delete(key string) error {
 	defer db.lock.Unlock()
 
 	if _, ok := db.data[key]; !ok {
-		return errors.New("key not found")
+		return ErrKeyNotFound
 	}
+	db.trashKey(key)
 	db.deleteWithoutLogging(key)
 
 	// log to AOF
-	if db.aof != nil && db.aof.enabled {
-		if err := db.aof.LogCommand("DEL", key); err != nil {
+	if db.logging() {
+		if err := db.logCommand("DEL", key); err != nil {
 			fmt.Printf("Error logging to AOF: %v\n", err)
 		}
 	}
-	db.triggerWrite()
+	db.triggerWrite(key)
 	return nil
 }
 
@@ -222,9 +587,14 @@ func (db *FlexDB) All() map[string]interface{} {
 	defer db.lock.RUnlock()
 
 	result := make(map[string]interface{})
-	for k, v := range db.data {
+	for k := range db.data {
+		v, ok := db.peek(k)
 		// Skip expired keys
-		if v.Expiration != nil && time.Now().After(*v.Expiration) {
+		if !ok || (v.Expiration != nil && db.now().After(*v.Expiration)) {
+			continue
+		}
+		if str, ok := stringData(v.Data); ok {
+			result[k] = str
 			continue
 		}
 		result[k] = v.Data
@@ -234,26 +604,55 @@ func (db *FlexDB) All() map[string]interface{} {
 
 // Expire sets an expiration time on a key
 func (db *FlexDB) Expire(key string, duration time.Duration) error {
+	return db.ExpireAt(key, db.now().Add(duration))
+}
+
+// ExpireAt makes a key expire at the given time
+func (db *FlexDB) ExpireAt(key string, at time.Time) error {
+	_, err := db.ExpireAtWithOptions(key, at, ExpireOptions{})
+	return err
+}
+
+// ExpireOptions are the conditions of ExpireAtWithOptions. A key without
+// an expiration counts as expiring never, so GT fails and LT holds for it.
+type ExpireOptions struct {
+	NX bool // only if the key has no expiration
+	XX bool // only if the key has an expiration
+	GT bool // only if the new expiration is later than the current one
+	LT bool // only if the new expiration is earlier than the current one
+}
+
+// ExpireAtWithOptions makes a key expire at the given time if the
+// conditions of opts hold, and reports whether they did
+func (db *FlexDB) ExpireAtWithOptions(key string, at time.Time, opts ExpireOptions) (bool, error) {
+	at = *persistedExpiration(&at)
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
 	val, ok := db.data[key]
-	if !ok {
-		return errors.New("key not found")
+	if !ok || (val.Expiration != nil && db.now().After(*val.Expiration)) {
+		return false, ErrKeyNotFound
 	}
 
-	expiry := time.Now().Add(duration)
-	val.Expiration = &expiry
+	current := val.Expiration
+	if (opts.NX && current != nil) || (opts.XX && current == nil) ||
+		(opts.GT && (current == nil || !at.After(*current))) ||
+		(opts.LT && current != nil && !at.Before(*current)) {
+		return false, nil
+	}
+
+	val.Expiration = &at
 	db.data[key] = val
 
 	// log to AOF if enabled
-	if db.aof != nil && db.aof.enabled {
-		if err := db.aof.LogCommand("EXPIRE", key, fmt.Sprintf("%d", int64(duration.Seconds()))); err != nil {
+	if db.logging() {
+		if err := db.logCommand("PEXPIREAT", key, unixMillis(at)); err != nil {
 			fmt.Printf("Error logging to AOF: %v\n", err)
 		}
 	}
-	db.triggerWrite()
-	return nil
+	db.touch(key)
+	db.triggerWrite(key)
+	return true, nil
 }
 
 // TTL returns the remaining time to live of a key with an expiration
@@ -263,7 +662,7 @@ func (db *FlexDB) TTL(key string) (time.Duration, error) {
 
 	val, ok := db.data[key]
 	if !ok {
-		return 0, errors.New("key not found")
+		return 0, ErrKeyNotFound
 	}
 
 	if val.Expiration == nil {
@@ -271,37 +670,138 @@ func (db *FlexDB) TTL(key string) (time.Duration, error) {
 	}
 
 	remaining := time.Until(*val.Expiration)
+	if remaining <= 0 {
+		return 0, ErrKeyNotFound
+	}
 
+	db.touch(key)
 	return remaining, nil
 }
 
-func (db *FlexDB) Flush() {
-	db.save()
+// Type returns the type of the value stored at key, and false if the key
+// doesn't exist
+func (db *FlexDB) Type(key string) (ValueType, bool) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	val, ok := db.data[key]
+	if !ok || (val.Expiration != nil && db.now().After(*val.Expiration)) {
+		return 0, false
+	}
+	return val.Type, true
+}
+
+// Exists returns how many of keys exist. A key given more than once is
+// counted each time.
+func (db *FlexDB) Exists(keys ...string) int {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	now := db.now()
+	count := 0
+	for _, key := range keys {
+		val, ok := db.data[key]
+		if ok && (val.Expiration == nil || !now.After(*val.Expiration)) {
+			count++
+		}
+	}
+	return count
+}
+
+// Ping returns once the keyspace lock can be taken, which makes it a cheap
+// liveness check for watchdogs
+func (db *FlexDB) Ping() {
+	db.lock.RLock()
+	db.lock.RUnlock()
+}
 
-	// if AOF is enabled
-	if db.aof != nil  &&  db.aof.enabled {
-		if err := db.aof.sync(); err != nil {
-			fmt.Printf("Error syncing AOF: %v\n", err)
+// Flush writes a snapshot and syncs the AOF, returning the first failure
+func (db *FlexDB) Flush() error {
+	if db.Loading() {
+		return ErrLoading
+	}
+	if err := db.save(); err != nil {
+		return err
+	}
+
+	for _, aof := range db.aofs() {
+		aof.mu.Lock()
+		var err error
+		if aof.enabled {
+			err = aof.sync()
+		}
+		aof.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to sync AOF: %w", err)
 		}
 	}
+	return nil
 }
 
-// for rewriting the AOF
+// RewriteAOF compacts every AOF, the main one and those of partitions
 func (db *FlexDB) RewriteAOF() error {
-	if db.aof == nil || !db.aof.enabled {
-		return errors.New("AOF not enabled")
+	if !db.aofEnabled() {
+		return ErrAOFDisabled
+	}
+	for _, aof := range db.aofs() {
+		if !aof.enabled {
+			continue
+		}
+		if err := aof.RewriteAOF(); err != nil {
+			return err
+		}
 	}
-	return db.aof.RewriteAOF()
+	return nil
 }
 
+// Shutdown stops the background goroutines, writes a final snapshot and
+// closes the AOF. It waits for the background goroutines until ctx is done;
+// the final snapshot and AOF close happen either way so buffered data is not lost.
+// Calling Shutdown more than once is safe.
+func (db *FlexDB) Shutdown(ctx context.Context) error {
+	db.closeOnce.Do(func() {
+		close(db.stop)
+		db.persistMu.Lock()
+		db.stopping = true
+		db.needsSave.Broadcast()
+		db.saved.Broadcast()
+		db.persistMu.Unlock()
+
+		done := make(chan struct{})
+		go func() {
+			db.workers.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			db.closeErr = fmt.Errorf("background workers did not stop: %w", ctx.Err())
+		}
 
-func (db *FlexDB) Close() {
-	db.Flush()
+		// save refuses to run after a failed or interrupted load
+		if err := db.save(); err != nil && !errors.Is(err, ErrLoading) && db.closeErr == nil {
+			db.closeErr = fmt.Errorf("final snapshot failed: %w", err)
+		}
 
-	// close AOF too, if enabled
-	if db.aof == nil || !db.aof.enabled {
-		if err := db.aof.Close(); err != nil {
-			fmt.Printf("Error closing AOF: %v\n", err)
+		// close AOF too, if enabled. Holding the write lock keeps
+		// in-flight commands from logging to a closing file.
+		db.lock.Lock()
+		for _, aof := range db.aofs() {
+			if err := aof.Close(); err != nil && db.closeErr == nil {
+				db.closeErr = fmt.Errorf("failed to close AOF %s: %w", aof.filePath, err)
+			}
 		}
-	}
+		if err := db.closeSpill(); err != nil && db.closeErr == nil {
+			db.closeErr = fmt.Errorf("failed to close spill file: %w", err)
+		}
+		db.lock.Unlock()
+	})
+
+	return db.closeErr
+}
+
+// Close shuts the database down without a deadline
+func (db *FlexDB) Close() error {
+	return db.Shutdown(context.Background())
 }
@@ -0,0 +1,24 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// newTestDB opens an empty database in a temporary directory
+func newTestDB(t *testing.T, options ...Option) *FlexDB {
+	t.Helper()
+	return openTestDB(t, filepath.Join(t.TempDir(), "flex.db"), options...)
+}
+
+// openTestDB opens the database kept in file and closes it when the test
+// ends
+func openTestDB(t *testing.T, file string, options ...Option) *FlexDB {
+	t.Helper()
+	db, err := NewFlexDB(file, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
@@ -0,0 +1,205 @@
+package db
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// KeyInfo describes how a key is stored internally
+type KeyInfo struct {
+	Type             ValueType
+	Encoding         string
+	Length           int // bytes for strings, elements for collections
+	SerializedLength int // size of the value in the JSON snapshot
+	Expiration       *time.Time
+}
+
+// encodingOf names the internal representation of a value
+func encodingOf(v Value) string {
+	switch data := resident(v).Data.(type) {
+	case string:
+		if _, err := strconv.ParseInt(data, 10, 64); err == nil {
+			return "int"
+		}
+		return "raw"
+	case *compressedString:
+		return "compressed"
+	case *chunkedString:
+		return "chunked"
+	case []string:
+		return "slice"
+	case map[string]string:
+		return "hashtable"
+	case *sortedSet:
+		return "sortedset"
+	case *priorityQueue:
+		return "heap"
+	case stringSet:
+		return "hashtable"
+	case *timeSeries:
+		return "samples"
+	case *jobQueue:
+		return "jobqueue"
+	case *coldValue:
+		return "cold"
+	default:
+		return "unknown"
+	}
+}
+
+// lengthOf returns the byte length of strings and the element count of collections
+func lengthOf(v Value) int {
+	switch data := v.Data.(type) {
+	case string:
+		return len(data)
+	case *compressedString:
+		return data.size
+	case *chunkedString:
+		return data.size
+	case []string:
+		return len(data)
+	case map[string]string:
+		return len(data)
+	case *sortedSet:
+		return data.Len()
+	case *priorityQueue:
+		return data.Len()
+	case stringSet:
+		return len(data)
+	case *timeSeries:
+		return len(data.samples)
+	case *jobQueue:
+		return data.Len()
+	default:
+		return 0
+	}
+}
+
+// Rough per-item overheads of Go values, used by memoryOf
+const (
+	stringHeaderSize = 16 // string header
+	sliceHeaderSize  = 24 // slice header
+	mapEntrySize     = 48 // map bucket share, key and value headers
+)
+
+// memoryOf estimates the bytes a key and its value take in memory. It
+// counts payloads and headers, not allocator slack, so it is meant for
+// comparing keys and types rather than matching the process size.
+func memoryOf(key string, v Value) int64 {
+	size := int64(mapEntrySize + len(key))
+	if v.Expiration != nil {
+		size += 24 // time.Time
+	}
+
+	switch data := resident(v).Data.(type) {
+	case string:
+		size += int64(len(data))
+	case *compressedString:
+		size += int64(sliceHeaderSize + len(data.data))
+	case *chunkedString:
+		size += sliceHeaderSize
+		for _, chunk := range data.chunks {
+			size += int64(sliceHeaderSize + cap(chunk))
+		}
+	case []string:
+		size += sliceHeaderSize
+		for _, item := range data {
+			size += int64(stringHeaderSize + len(item))
+		}
+	case map[string]string:
+		for field, value := range data {
+			size += int64(mapEntrySize + len(field) + len(value))
+		}
+	case *sortedSet:
+		// each member is in the score map and the ordered slice
+		size += sliceHeaderSize
+		for _, e := range data.entries {
+			size += int64(mapEntrySize + len(e.Member) + stringHeaderSize + 8)
+		}
+	case *priorityQueue:
+		size += sliceHeaderSize
+		for _, e := range data.entries {
+			size += int64(stringHeaderSize + len(e.Value) + 16)
+		}
+	case stringSet:
+		for member := range data {
+			size += int64(mapEntrySize + len(member))
+		}
+	case *timeSeries:
+		size += int64(sliceHeaderSize + 16*len(data.samples))
+	case *coldValue:
+		// the value itself is on disk
+		size += 64
+	case *jobQueue:
+		size += sliceHeaderSize
+		for _, job := range data.ready {
+			size += int64(2*stringHeaderSize + len(job.ID) + len(job.Payload))
+		}
+		for id, r := range data.reserved {
+			size += int64(mapEntrySize + len(id) + stringHeaderSize + len(r.Payload) + 24)
+		}
+	}
+	return size
+}
+
+// Inspect returns the internal representation details of a key
+func (db *FlexDB) Inspect(key string) (KeyInfo, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	val, ok := db.peek(key)
+	if !ok || (val.Expiration != nil && db.now().After(*val.Expiration)) {
+		return KeyInfo{}, ErrKeyNotFound
+	}
+
+	serialized, _ := json.Marshal(persistentData(val))
+
+	return KeyInfo{
+		Type:             val.Type,
+		Encoding:         encodingOf(val),
+		Length:           lengthOf(val),
+		SerializedLength: len(serialized),
+		Expiration:       val.Expiration,
+	}, nil
+}
+
+// Encoding returns the name of the internal representation of the value
+// at key, as shown by DEBUG OBJECT
+func (db *FlexDB) Encoding(key string) (string, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	val, ok := db.data[key]
+	if !ok || (val.Expiration != nil && db.now().After(*val.Expiration)) {
+		return "", ErrKeyNotFound
+	}
+	return encodingOf(val), nil
+}
+
+// MemoryUsage estimates the bytes key and its value take in memory, with
+// the same accounting as the per-type memory of INFO keyspace
+func (db *FlexDB) MemoryUsage(key string) (int64, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	val, ok := db.data[key]
+	if !ok || (val.Expiration != nil && db.now().After(*val.Expiration)) {
+		return 0, ErrKeyNotFound
+	}
+	return memoryOf(key, val), nil
+}
+
+// DebugSleep blocks every command for the given duration by holding the
+// keyspace lock, simulating a stalled server
+func (db *FlexDB) DebugSleep(d time.Duration) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	time.Sleep(d)
+}
+
+// SetActiveExpire turns the background removal of expired keys on or off.
+// Expired keys are still hidden from reads while it is off.
+func (db *FlexDB) SetActiveExpire(enabled bool) {
+	db.activeExpireDisabled.Store(!enabled)
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// Delay queues are sorted sets scored by due time in unix milliseconds,
+// with the payloads as members. Pushing a payload that is already queued
+// reschedules it rather than queueing it twice. Popping removes due items
+// atomically, so each is handed to exactly one consumer.
+
+// dueScore returns the score of an item due at t
+func dueScore(t time.Time) float64 {
+	return float64(t.UnixMilli())
+}
+
+// DelayPush queues payload on queue to become due after delay. It reports
+// whether the payload is new, false meaning it was rescheduled.
+func (db *FlexDB) DelayPush(queue, payload string, delay time.Duration) (bool, error) {
+	if err := db.checkKey(queue); err != nil {
+		return false, err
+	}
+	if err := db.checkValues(payload); err != nil {
+		return false, err
+	}
+
+	added := false
+	err := db.Update(func(tx *Txn) error {
+		zset, err := sortedSetAt(tx, queue)
+		if err != nil {
+			return err
+		}
+		if zset == nil {
+			zset = newSortedSet()
+			tx.Put(queue, Value{Type: TypeZSet, Data: zset})
+		} else if _, queued := zset.Score(payload); !queued {
+			if err := db.checkElements(zset.Len() + 1); err != nil {
+				return err
+			}
+		}
+
+		score := dueScore(db.now().Add(delay))
+		added = zset.Add(payload, score)
+		tx.markChanged(queue)
+		tx.Log("ZADD", queue, strconv.FormatFloat(score, 'f', -1, 64), payload)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	db.signalKey(queue)
+	return added, nil
+}
+
+// DelayPop removes and returns up to count items of queue that are due,
+// earliest first
+func (db *FlexDB) DelayPop(queue string, count int) ([]string, error) {
+	items, _, err := db.delayPop(queue, count)
+	return items, err
+}
+
+// DelayPopWait is DelayPop waiting for an item to become due when none is.
+// It returns ctx's error when ctx ends first, and ErrShuttingDown when the
+// database shuts down.
+func (db *FlexDB) DelayPopWait(ctx context.Context, queue string, count int) ([]string, error) {
+	var items []string
+	err := db.blockOn(ctx, queue, func() (bool, time.Time, error) {
+		var next time.Time
+		var err error
+		items, next, err = db.delayPop(queue, count)
+		return len(items) > 0, next, err
+	})
+	return items, err
+}
+
+// delayPop pops the due items of queue. When none is due it returns when
+// the earliest item will be, or the zero time for an empty queue.
+func (db *FlexDB) delayPop(queue string, count int) ([]string, time.Time, error) {
+	var items []string
+	var next time.Time
+	err := db.Update(func(tx *Txn) error {
+		zset, err := sortedSetAt(tx, queue)
+		if err != nil || zset == nil {
+			return err
+		}
+
+		now := dueScore(db.now())
+		for len(items) < count {
+			first, ok := zset.First()
+			if !ok || first.Score > now {
+				break
+			}
+			zset.Remove(first.Member)
+			items = append(items, first.Member)
+		}
+
+		if len(items) == 0 {
+			if first, ok := zset.First(); ok {
+				next = time.UnixMilli(int64(first.Score))
+			}
+			return nil
+		}
+		if zset.Len() == 0 {
+			tx.Delete(queue)
+		}
+		tx.markChanged(queue)
+		tx.Log("ZREM", append([]string{queue}, items...)...)
+		return nil
+	})
+	return items, next, err
+}
+
+// DelayLen returns the number of items of queue, due or not
+func (db *FlexDB) DelayLen(queue string) (int, error) {
+	length := 0
+	err := db.View(func(tx *Txn) error {
+		zset, err := sortedSetAt(tx, queue)
+		if err != nil || zset == nil {
+			return err
+		}
+		length = zset.Len()
+		return nil
+	})
+	return length, err
+}
+
+// DelayCancel removes payload from queue before it is popped, and reports
+// whether it was queued
+func (db *FlexDB) DelayCancel(queue, payload string) (bool, error) {
+	removed := false
+	err := db.Update(func(tx *Txn) error {
+		zset, err := sortedSetAt(tx, queue)
+		if err != nil || zset == nil || !zset.Remove(payload) {
+			return err
+		}
+		if zset.Len() == 0 {
+			tx.Delete(queue)
+		}
+		tx.markChanged(queue)
+		tx.Log("ZREM", queue, payload)
+		removed = true
+		return nil
+	})
+	return removed, err
+}
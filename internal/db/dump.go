@@ -0,0 +1,220 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// DUMP payloads hold the persisted form of a value as the snapshot writes
+// it, unencrypted and without its expiration, followed by a two byte
+// format version and a CRC-64 of everything before it, both little
+// endian like Redis's. Tags travel with the value; access times and
+// history stay behind.
+
+// dumpVersion is the payload format Dump writes and Restore accepts
+const dumpVersion = 1
+
+// ErrBadDumpPayload is returned by Restore for a payload that wasn't
+// written by Dump, was damaged, or comes from a newer version
+var ErrBadDumpPayload = errors.New("DUMP payload version or checksum are wrong")
+
+// Dump serializes the value of a key for Restore. It returns
+// ErrKeyNotFound if the key doesn't exist.
+func (db *FlexDB) Dump(key string) ([]byte, error) {
+	var payload []byte
+	err := db.View(func(tx *Txn) error {
+		val, ok := tx.Get(key)
+		if !ok {
+			return ErrKeyNotFound
+		}
+		var err error
+		payload, err = db.dumpValue(key, val)
+		return err
+	})
+	return payload, err
+}
+
+// dumpValue serializes the value of key for Restore. Callers hold the
+// keyspace lock.
+func (db *FlexDB) dumpValue(key string, val Value) ([]byte, error) {
+	pv := PersistentValue{
+		Type:     val.Type,
+		Data:     persistentData(val),
+		Encoding: persistentEncoding(val),
+		Tags:     db.persistedTags(key),
+	}
+	data, err := json.Marshal(pv)
+	if err != nil {
+		return nil, err
+	}
+	return sealDump(data), nil
+}
+
+// MigratedKey is a key handed over by Migrate
+type MigratedKey struct {
+	Key        string
+	Payload    []byte    // as written by Dump
+	Expiration time.Time // zero for none
+}
+
+// Migrate hands the keys that exist to send, serialized as by Dump, and
+// deletes them once send succeeded unless keep is set. The keyspace stays
+// locked until then, so no write slips in between the copy and the
+// delete, which makes moving the keys to another server atomic. It
+// returns ErrKeyNotFound if none of the keys exist, and send's error.
+func (db *FlexDB) Migrate(keys []string, keep bool, send func([]MigratedKey) error) error {
+	return db.Update(func(tx *Txn) error {
+		var moved []MigratedKey
+		for _, key := range keys {
+			val, ok := tx.Get(key)
+			if !ok {
+				continue
+			}
+			payload, err := db.dumpValue(key, val)
+			if err != nil {
+				return err
+			}
+			m := MigratedKey{Key: key, Payload: payload}
+			if val.Expiration != nil {
+				m.Expiration = *val.Expiration
+			}
+			moved = append(moved, m)
+		}
+		if len(moved) == 0 {
+			return ErrKeyNotFound
+		}
+		if err := send(moved); err != nil || keep {
+			return err
+		}
+
+		removed := make([]string, 0, len(moved))
+		for _, m := range moved {
+			if tx.Delete(m.Key) {
+				removed = append(removed, m.Key)
+			}
+		}
+		tx.Log("DEL", removed...)
+		return nil
+	})
+}
+
+// sealDump appends the version and checksum to a serialized value
+func sealDump(data []byte) []byte {
+	payload := binary.LittleEndian.AppendUint16(data, dumpVersion)
+	sum := newChecksum()
+	sum.Write(payload)
+	return binary.LittleEndian.AppendUint64(payload, sum.Sum64())
+}
+
+// openDump checks the version and checksum of a payload and returns the
+// serialized value
+func openDump(payload []byte) ([]byte, error) {
+	if len(payload) < 10 {
+		return nil, ErrBadDumpPayload
+	}
+	body, trailer := payload[:len(payload)-8], payload[len(payload)-8:]
+	sum := newChecksum()
+	sum.Write(body)
+	if binary.LittleEndian.Uint64(trailer) != sum.Sum64() {
+		return nil, ErrBadDumpPayload
+	}
+	data, version := body[:len(body)-2], body[len(body)-2:]
+	if binary.LittleEndian.Uint16(version) != dumpVersion {
+		return nil, ErrBadDumpPayload
+	}
+	return data, nil
+}
+
+// RestoreOptions are the options of Restore
+type RestoreOptions struct {
+	// Expiration is when the restored key expires, zero for never
+	Expiration time.Time
+	// Replace overwrites an existing key instead of failing
+	Replace bool
+}
+
+// Restore creates key from a payload written by Dump, on this or another
+// server. It returns ErrKeyExists if the key exists and opts.Replace isn't
+// set, and ErrBadDumpPayload for a payload it can't read. A key whose
+// expiration already passed is deleted rather than created.
+func (db *FlexDB) Restore(key string, payload []byte, opts RestoreOptions) error {
+	if err := db.checkKey(key); err != nil {
+		return err
+	}
+	data, err := openDump(payload)
+	if err != nil {
+		return err
+	}
+	var pv PersistentValue
+	if err := json.Unmarshal(data, &pv); err != nil || pv.Encoding == encodingEncrypted {
+		return ErrBadDumpPayload
+	}
+	pv.Expiration = 0
+	pv.PExpiration = 0
+	if !opts.Expiration.IsZero() {
+		// an expiration already passed makes decodeValue skip the key
+		pv.PExpiration = opts.Expiration.UnixMilli()
+		if pv.PExpiration <= 0 {
+			pv.PExpiration = 1
+		}
+	}
+	val, live := decodeValue(key, pv, db.now())
+	if live {
+		if err := db.checkRestored(val); err != nil {
+			return err
+		}
+		if str, ok := val.Data.(string); ok {
+			val.Data = db.encodeString(str)
+		}
+	}
+
+	return db.Update(func(tx *Txn) error {
+		if _, exists := tx.Get(key); exists && !opts.Replace {
+			return ErrKeyExists
+		}
+		if tx.Delete(key) {
+			tx.Log("DEL", key)
+		}
+		if !live {
+			return nil
+		}
+
+		tx.Put(key, val)
+		for _, cmd := range valueCommands(key, val) {
+			tx.Log(cmd[0], cmd[1:]...)
+		}
+		if len(pv.Tags) > 0 {
+			db.restoreTags(key, pv.Tags)
+			tx.Log("TAG", append([]string{key}, pv.Tags...)...)
+		}
+		return nil
+	})
+}
+
+// checkRestored validates a restored value against the configured limits
+func (db *FlexDB) checkRestored(val Value) error {
+	switch data := val.Data.(type) {
+	case []string:
+		if err := db.checkElements(len(data)); err != nil {
+			return err
+		}
+		return db.checkValues(data...)
+	case map[string]string:
+		if err := db.checkElements(len(data)); err != nil {
+			return err
+		}
+		for field, value := range data {
+			if err := db.checkValues(field, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		if str, ok := stringData(data); ok {
+			return db.checkValues(str)
+		}
+		return nil
+	}
+}
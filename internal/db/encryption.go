@@ -0,0 +1,280 @@
+package db
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"flex-db/internal/utils"
+)
+
+// encodingEncrypted marks a snapshot entry whose value is an encrypted
+// PersistentValue, base64 encoded
+const encodingEncrypted = "aes-gcm"
+
+// ErrEncryptionDisabled is returned by key management without WithEncryption
+var ErrEncryptionDisabled = errors.New("encryption not enabled")
+
+// EncryptionKey is an AES-256 key and the id persisted data refers to it by
+type EncryptionKey struct {
+	ID  string
+	Key []byte // 32 bytes
+}
+
+// EncryptionStatus describes the encryption setup
+type EncryptionStatus struct {
+	Patterns  []string
+	ActiveKey string   // id of the key new data is encrypted with
+	Keys      []string // ids of every known key, the active one first
+}
+
+// encryption encrypts the persisted values of keys matching patterns.
+// Keys are replaced under the keyspace lock, and every seal and open
+// happens under it, so the keyring needs no lock of its own.
+type encryption struct {
+	keyFile  string
+	patterns []string
+	keys     []EncryptionKey // the first one is active
+	aeads    map[string]cipher.AEAD
+}
+
+// WithEncryption encrypts the values of keys matching any of patterns in
+// the snapshot and the AOF with AES-256-GCM. Values stay in memory as
+// plain text, so reads are unaffected. keyFile lists one key per line as
+// "<id> <base64 key>"; the first key encrypts new data and the others only
+// decrypt older data, which makes key rotation a matter of adding a key on
+// top, reloading and re-encrypting. A key file that can't be read makes
+// NewFlexDB fail.
+func WithEncryption(keyFile string, patterns ...string) Option {
+	return func(db *FlexDB) {
+		keys, err := LoadEncryptionKeys(keyFile)
+		if err == nil {
+			db.encryption = &encryption{keyFile: keyFile, patterns: patterns}
+			err = db.encryption.setKeys(keys)
+		}
+		if err != nil && db.initErr == nil {
+			db.initErr = fmt.Errorf("failed to load encryption keys: %w", err)
+		}
+	}
+}
+
+// LoadEncryptionKeys reads a key file. Blank lines and lines starting
+// with # are ignored.
+func LoadEncryptionKeys(path string) ([]EncryptionKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var keys []EncryptionKey
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<id> <base64 key>\"", path, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s:%d: key must be 32 bytes, base64 encoded", path, line)
+		}
+		keys = append(keys, EncryptionKey{ID: fields[0], Key: key})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return keys, nil
+}
+
+// setKeys replaces the keyring
+func (e *encryption) setKeys(keys []EncryptionKey) error {
+	aeads := make(map[string]cipher.AEAD, len(keys))
+	for _, k := range keys {
+		if _, ok := aeads[k.ID]; ok {
+			return fmt.Errorf("duplicate key id %q", k.ID)
+		}
+		block, err := aes.NewCipher(k.Key)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", k.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", k.ID, err)
+		}
+		aeads[k.ID] = aead
+	}
+	e.keys = keys
+	e.aeads = aeads
+	return nil
+}
+
+// seal encrypts plain with the active key. The nonce is prepended to the
+// result, which is bound to the Redis key it belongs to so a value can't
+// be moved to another key in the file.
+func (e *encryption) seal(key string, plain []byte) (string, []byte) {
+	active := e.keys[0].ID
+	aead := e.aeads[active]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic("flexdb: no randomness for encryption: " + err.Error())
+	}
+	return active, aead.Seal(nonce, nonce, plain, []byte(key))
+}
+
+// open decrypts data sealed for key with the key called id
+func (e *encryption) open(id, key string, sealed []byte) ([]byte, error) {
+	aead, ok := e.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", id)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted value too short")
+	}
+	nonce, data := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, data, []byte(key))
+}
+
+// encrypted reports whether the persisted value of key is encrypted
+func (db *FlexDB) encrypted(key string) bool {
+	if db.encryption == nil {
+		return false
+	}
+	for _, pattern := range db.encryption.patterns {
+		if utils.MatchGlob(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptValue wraps a snapshot entry of key in an encrypted one. The type
+// and expiration stay readable so expired keys can be skipped on load.
+func (e *encryption) encryptValue(key string, pv PersistentValue) (PersistentValue, error) {
+	plain, err := json.Marshal(pv)
+	if err != nil {
+		return PersistentValue{}, err
+	}
+	id, sealed := e.seal(key, plain)
+	return PersistentValue{
+		Type:        pv.Type,
+		Encoding:    encodingEncrypted,
+		KeyID:       id,
+		Data:        base64.StdEncoding.EncodeToString(sealed),
+		Expiration:  pv.Expiration,
+		PExpiration: pv.PExpiration,
+	}, nil
+}
+
+// decryptValue unwraps a snapshot entry written by encryptValue
+func (db *FlexDB) decryptValue(key string, pv PersistentValue) (PersistentValue, error) {
+	if db.encryption == nil {
+		return PersistentValue{}, fmt.Errorf("key %q is encrypted but no encryption keys are configured", key)
+	}
+	encoded, _ := pv.Data.(string)
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return PersistentValue{}, fmt.Errorf("key %q: %w", key, err)
+	}
+	plain, err := db.encryption.open(pv.KeyID, key, sealed)
+	if err != nil {
+		return PersistentValue{}, fmt.Errorf("key %q: %w", key, err)
+	}
+
+	var inner PersistentValue
+	if err := json.Unmarshal(plain, &inner); err != nil {
+		return PersistentValue{}, fmt.Errorf("key %q: %w", key, err)
+	}
+	return inner, nil
+}
+
+// sealCommand wraps an AOF command changing key in an ENC command holding
+// it encrypted: ENC <key id> <key> <base64 RESP encoded command>
+func (db *FlexDB) sealCommand(key, cmd string, args []string) (string, []string) {
+	id, sealed := db.encryption.seal(key, encodeCommand(cmd, args))
+	return "ENC", []string{id, key, base64.StdEncoding.EncodeToString(sealed)}
+}
+
+// openCommand decrypts the command line of an ENC command
+func (db *FlexDB) openCommand(args []string) (string, error) {
+	if len(args) != 3 {
+		return "", errors.New("malformed ENC command")
+	}
+	if db.encryption == nil {
+		return "", fmt.Errorf("key %q is encrypted but no encryption keys are configured", args[1])
+	}
+	sealed, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		return "", err
+	}
+	plain, err := db.encryption.open(args[0], args[1], sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// ReloadEncryptionKeys reads the key file again, so a new active key can
+// be added without a restart. Keys still used by the snapshot or AOF must
+// stay in the file until Reencrypt has rewritten them.
+func (db *FlexDB) ReloadEncryptionKeys() error {
+	if db.encryption == nil {
+		return ErrEncryptionDisabled
+	}
+	keys, err := LoadEncryptionKeys(db.encryption.keyFile)
+	if err != nil {
+		return err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.encryption.setKeys(keys)
+}
+
+// Reencrypt writes a snapshot and rewrites the AOF, so that every
+// persisted value is encrypted with the active key and older keys can be
+// retired
+func (db *FlexDB) Reencrypt() error {
+	if db.encryption == nil {
+		return ErrEncryptionDisabled
+	}
+	if err := db.Flush(); err != nil {
+		return err
+	}
+	if !db.aofEnabled() {
+		return nil
+	}
+	return db.RewriteAOF()
+}
+
+// EncryptionStatus returns the encryption patterns and keys
+func (db *FlexDB) EncryptionStatus() (EncryptionStatus, error) {
+	if db.encryption == nil {
+		return EncryptionStatus{}, ErrEncryptionDisabled
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	status := EncryptionStatus{
+		Patterns:  db.encryption.patterns,
+		ActiveKey: db.encryption.keys[0].ID,
+	}
+	for _, k := range db.encryption.keys {
+		status.Keys = append(status.Keys, k.ID)
+	}
+	return status, nil
+}
@@ -0,0 +1,40 @@
+package db
+
+import "errors"
+
+// Errors returned by FlexDB operations. Callers should compare against these
+// with errors.Is instead of matching on the message text.
+var (
+	// ErrKeyNotFound is returned when a key does not exist or has expired
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrWrongType is returned when an operation targets a key holding a different type
+	ErrWrongType = errors.New("operation against a key holding the wrong kind of value")
+	// ErrFieldNotFound is returned when a hash field does not exist
+	ErrFieldNotFound = errors.New("field not found")
+	// ErrIndexOutOfRange is returned when a list index is outside the list
+	ErrIndexOutOfRange = errors.New("index out of range")
+	// ErrListEmpty is returned when popping from an empty list
+	ErrListEmpty = errors.New("list is empty")
+	// ErrKeyTooLong is returned when a key exceeds the configured length limit
+	ErrKeyTooLong = errors.New("key is too long")
+	// ErrValueTooLarge is returned when a value exceeds the configured size limit
+	ErrValueTooLarge = errors.New("value is too large")
+	// ErrTooManyElements is returned when a write would grow a list or hash past the configured limit
+	ErrTooManyElements = errors.New("too many elements")
+	// ErrAccessTrackingDisabled is returned by access statistics when tracking is off
+	ErrAccessTrackingDisabled = errors.New("access tracking is disabled")
+	// ErrAOFDisabled is returned by AOF operations when AOF persistence is off
+	ErrAOFDisabled = errors.New("AOF not enabled")
+	// ErrKeyExists is returned when a key that must not exist does
+	ErrKeyExists = errors.New("key already exists")
+	// ErrNotInteger is returned when incrementing a value that isn't an integer, or past the int64 range
+	ErrNotInteger = errors.New("value is not an integer or out of range")
+	// ErrNotFloat is returned when incrementing a value that isn't a float, or to NaN or an infinity
+	ErrNotFloat = errors.New("value is not a valid float")
+	// ErrScoreNaN is returned when an increment would make a sorted set score NaN
+	ErrScoreNaN = errors.New("resulting score is not a number (NaN)")
+	// ErrLoading is returned by snapshots requested before loading finished
+	ErrLoading = errors.New("dataset is still loading")
+	// ErrSaveInProgress is returned by BGSave while a background snapshot is being written
+	ErrSaveInProgress = errors.New("background save already in progress")
+)
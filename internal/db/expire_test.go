@@ -0,0 +1,78 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApplyAt(t *testing.T) {
+	db := newTestDB(t)
+	at := time.Now().Add(time.Hour)
+	db.Set("k", "v", &at)
+
+	db.ApplyAt(at.Add(time.Second), func() {
+		if _, err := db.Get("k"); err == nil {
+			t.Error("the key is live after its expiration at the applied time")
+		}
+	})
+	if _, err := db.Get("k"); err != nil {
+		t.Errorf("the key expired by the clock: %v", err)
+	}
+}
+
+func TestExpireKeys(t *testing.T) {
+	db := newTestDB(t)
+	past := time.Now().Add(-time.Second)
+	db.Set("old", "v", &past)
+	db.Set("fresh", "v", nil)
+
+	expired := db.ExpireKeys("old", "fresh", "missing")
+	if len(expired) != 1 || expired[0] != "old" {
+		t.Errorf("got %v, want [old]", expired)
+	}
+	if db.Exists("fresh") != 1 {
+		t.Error("a key that didn't expire was removed")
+	}
+}
+
+func TestApplyAtClockCommands(t *testing.T) {
+	db := newTestDB(t)
+	at := time.Now().Add(time.Hour)
+
+	// due by the applied time only
+	db.ApplyAt(at, func() {
+		if _, err := db.DelayPush("q", "job", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if items, _ := db.DelayPop("q", 1); len(items) != 0 {
+		t.Errorf("popped %v before it was due by the clock", items)
+	}
+	db.ApplyAt(at.Add(2*time.Minute), func() {
+		if items, _ := db.DelayPop("q", 1); len(items) != 1 {
+			t.Errorf("got %v, want the item due at the applied time", items)
+		}
+	})
+
+	// one request a minute, counted from the applied time
+	throttle := func() bool {
+		result, err := db.Throttle("limit", 0, 1, time.Minute, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.Allowed
+	}
+	db.ApplyAt(at, func() {
+		if !throttle() {
+			t.Error("the first request was refused")
+		}
+	})
+	if throttle() {
+		t.Error("a request by the clock was allowed before the applied time")
+	}
+	db.ApplyAt(at.Add(time.Minute), func() {
+		if !throttle() {
+			t.Error("a request a minute after the applied time was refused")
+		}
+	})
+}
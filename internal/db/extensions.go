@@ -0,0 +1,56 @@
+package db
+
+// ReplayFunc applies a command logged by an embedder's own command when
+// the AOF is replayed. It runs while the database loads, under the
+// keyspace lock, with a Txn whose Log does nothing.
+type ReplayFunc func(tx *Txn, args []string) error
+
+// WithReplay tells AOF replay how to apply lines starting with cmd, so
+// commands an embedder adds to the server can log their writes with
+// Txn.Log and have them survive a restart. It is only consulted for
+// commands the AOF doesn't already know, so built-in commands can't be
+// overridden. A line it fails to apply is reported and skipped.
+func WithReplay(cmd string, fn ReplayFunc) Option {
+	return func(db *FlexDB) {
+		if db.replays == nil {
+			db.replays = make(map[string]ReplayFunc)
+		}
+		db.replays[cmd] = fn
+	}
+}
+
+// replayExtension applies an AOF line with the function registered by
+// WithReplay, and reports whether there was one
+func (db *FlexDB) replayExtension(cmd string, args []string) bool {
+	fn, ok := db.replays[cmd]
+	if !ok {
+		return false
+	}
+	db.applyReplay(cmd, args, fn)
+	return true
+}
+
+// GetString returns the value of a live string key
+func (tx *Txn) GetString(key string) (string, bool) {
+	val, ok := tx.Get(key)
+	if !ok || val.Type != TypeString {
+		return "", false
+	}
+	return stringData(val.Data)
+}
+
+// PutString stores a string value under key without a TTL, compressed
+// like SET would. Outside AOF replay the key and value must fit the
+// configured limits.
+func (tx *Txn) PutString(key, value string) error {
+	if !tx.replaying {
+		if err := tx.db.checkKey(key); err != nil {
+			return err
+		}
+		if err := tx.db.checkValues(value); err != nil {
+			return err
+		}
+	}
+	tx.Put(key, Value{Type: TypeString, Data: tx.db.encodeString(value)})
+	return nil
+}
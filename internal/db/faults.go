@@ -0,0 +1,27 @@
+package db
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+)
+
+// errSimulatedFsync is returned by AOF syncs that fault injection made fail
+var errSimulatedFsync = errors.New("simulated fsync failure")
+
+// SetFsyncFailureRate makes the given fraction (0 to 1) of AOF syncs fail
+// with a simulated error. Used by fault injection; 0 turns it off.
+func (db *FlexDB) SetFsyncFailureRate(rate float64) {
+	db.fsyncFailureRate.Store(math.Float64bits(rate))
+}
+
+// FsyncFailureRate returns the current simulated fsync failure rate
+func (db *FlexDB) FsyncFailureRate() float64 {
+	return math.Float64frombits(db.fsyncFailureRate.Load())
+}
+
+// simulateFsyncFailure reports whether this sync should fail on purpose
+func (db *FlexDB) simulateFsyncFailure() bool {
+	rate := db.FsyncFailureRate()
+	return rate > 0 && rand.Float64() < rate
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// FileCompression selects how snapshots and rewritten AOFs are compressed
+// on disk
+type FileCompression int
+
+const (
+	// FileCompressionNone writes files as plain JSON and RESP
+	FileCompressionNone FileCompression = iota
+	// FileCompressionGzip writes them as gzip streams
+	FileCompressionGzip
+)
+
+// String returns the name ParseFileCompression reads
+func (c FileCompression) String() string {
+	switch c {
+	case FileCompressionGzip:
+		return "gzip"
+	default:
+		return "none"
+	}
+}
+
+// ParseFileCompression parses a compression name: none or gzip
+func ParseFileCompression(name string) (FileCompression, error) {
+	switch name {
+	case "none", "":
+		return FileCompressionNone, nil
+	case "gzip":
+		return FileCompressionGzip, nil
+	default:
+		return 0, fmt.Errorf("invalid file compression %q, expected none or gzip", name)
+	}
+}
+
+// WithFileCompression compresses snapshots, and AOFs when they are
+// rewritten. Commands appended to the AOF afterwards stay uncompressed so
+// each one reaches the disk on its own. Loading detects compressed files
+// by itself, so the setting can change between restarts.
+func WithFileCompression(c FileCompression) Option {
+	return func(db *FlexDB) {
+		db.fileCompression = c
+	}
+}
+
+// gzipMagic starts every gzip stream. Snapshots start with '{' and AOFs
+// with '#', '*' or a command name, so it can't be mistaken for either.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decompressed returns what r reads, decompressed if it's a gzip stream
+func decompressed(r *bufio.Reader) (io.Reader, error) {
+	magic, err := r.Peek(len(gzipMagic))
+	if err != nil || !bytes.Equal(magic, gzipMagic) {
+		return r, nil
+	}
+	return gzip.NewReader(r)
+}
+
+// compressedWriter wraps w in the configured compression. Closing the
+// result finishes the compressed stream without closing w.
+func (db *FlexDB) compressedWriter(w io.Writer) io.WriteCloser {
+	if db.fileCompression == FileCompressionGzip {
+		return gzip.NewWriter(w)
+	}
+	return nopWriteCloser{w}
+}
+
+// nopWriteCloser is an io.Writer whose Close does nothing
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
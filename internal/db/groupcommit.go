@@ -0,0 +1,121 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Group commit
+//
+// With AOFSyncAlways a command is only acknowledged once it is on disk,
+// but it doesn't sync the AOF itself: that would hold the keyspace lock
+// for a whole fsync per command. LogCommand only counts the command and
+// wakes groupCommit, which flushes everything logged so far and syncs it
+// in one go. Commands logged while an fsync runs are synced together by
+// the next one, so under load a single fsync covers many writers. Clients
+// wait in WaitForAOFSync, after the keyspace lock is released.
+
+// WithAOFGroupCommit makes the AOFs synced with AOFSyncAlways wait window
+// after the first command of a group before syncing it, so more commands
+// can join the group. Zero, the default, syncs right away and only groups
+// commands that arrive during an fsync.
+func WithAOFGroupCommit(window time.Duration) Option {
+	return func(db *FlexDB) {
+		db.groupCommitWindow = window
+	}
+}
+
+// requestSync counts a command logged with AOFSyncAlways and wakes
+// groupCommit. Callers hold aof.mu, so the count covers the buffered
+// commands.
+func (aof *AOFPersistence) requestSync() {
+	aof.logged.Add(1)
+	select {
+	case aof.syncWake <- struct{}{}:
+	default:
+	}
+}
+
+// groupCommit syncs the commands logged with AOFSyncAlways in groups until
+// Close
+func (aof *AOFPersistence) groupCommit() {
+	for {
+		select {
+		case <-aof.done:
+			return
+		case <-aof.syncWake:
+		}
+		if window := aof.db.groupCommitWindow; window > 0 {
+			time.Sleep(window)
+		}
+
+		// the file is synced outside aof.mu so commands can be logged in
+		// the meantime; syncMu keeps it from being replaced meanwhile
+		aof.syncMu.Lock()
+		aof.mu.Lock()
+		if !aof.enabled {
+			aof.mu.Unlock()
+			aof.syncMu.Unlock()
+			return
+		}
+		logged := aof.logged.Load()
+		err := aof.writer.Flush()
+		file := aof.file
+		aof.mu.Unlock()
+		if err == nil {
+			err = aof.fsync(file)
+		}
+		aof.syncMu.Unlock()
+
+		if err != nil {
+			fmt.Printf("Error syncing AOF: %v\n", err)
+		}
+		// waiters are released even if the sync failed, their commands
+		// having applied; the failure is reported by PersistenceStats
+		// and can stop writes
+		aof.markSynced(logged)
+	}
+}
+
+// markSynced releases the clients waiting for commands up to logged
+func (aof *AOFPersistence) markSynced(logged uint64) {
+	aof.syncedMu.Lock()
+	if logged > aof.synced {
+		aof.db.stats.groupedWrites.Add(logged - aof.synced)
+		aof.synced = logged
+	}
+	aof.syncedMu.Unlock()
+	aof.syncDone.Broadcast()
+}
+
+// waitSynced waits until the first logged commands have been synced
+func (aof *AOFPersistence) waitSynced(logged uint64) {
+	aof.syncedMu.Lock()
+	defer aof.syncedMu.Unlock()
+	for aof.synced < logged {
+		aof.syncDone.Wait()
+	}
+}
+
+// fsync syncs file, an AOF, to disk and records it in the stats
+func (aof *AOFPersistence) fsync(file *os.File) error {
+	start := time.Now()
+	err := file.Sync()
+	if err == nil && aof.db.simulateFsyncFailure() {
+		err = errSimulatedFsync
+	}
+	aof.db.stats.recordFsync(start, err)
+	return err
+}
+
+// WaitForAOFSync waits until the commands logged so far to AOFs synced
+// with AOFSyncAlways are on disk. A write is acknowledged after it, so the
+// client only hears of it once it is durable.
+func (db *FlexDB) WaitForAOFSync() {
+	for _, aof := range db.aofs() {
+		if aof.syncPolicy == AOFSyncAlways {
+			aof.waitSynced(aof.logged.Load())
+		}
+	}
+}
@@ -1,26 +1,31 @@
 package db
 
 import (
-	"errors"
 	"fmt"
-	"time"
 )
 
 // HSet sets the field in the hash stored at key to value.
 // Returns 1 if the field is new, 0 if it was updated.
 // Example: HSET user:1 name "John" -> 1
 func (db *FlexDB) HSet(key, field, value string) (int, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, err
+	}
+	if err := db.checkValues(field, value); err != nil {
+		return 0, err
+	}
+
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 	if exists {
 		// Check if key has expired
-		if val.Expiration != nil && time.Now().After(*val.Expiration) {
-			delete(db.data, key)
+		if val.Expiration != nil && db.now().After(*val.Expiration) {
+			db.expireKeys(key)
 			exists = false
 		} else if val.Type != TypeHash {
-			return 0, errors.New("value is not a hash")
+			return 0, ErrWrongType
 		}
 	}
 
@@ -38,18 +43,28 @@ func (db *FlexDB) HSet(key, field, value string) (int, error) {
 		}
 	}
 
+	if !fieldExists {
+		if err := db.checkElements(len(hashMap) + 1); err != nil {
+			return 0, err
+		}
+	}
+
 	hashMap[field] = value
 	val.Data = hashMap
 	db.data[key] = val
+	if !exists {
+		db.indexKey(key)
+	}
 
 	// Log to AOF if enabled
-	if db.aof != nil && db.aof.enabled {
-		if err := db.aof.LogCommand("HSET", key, field, value); err != nil {
+	if db.logging() {
+		if err := db.logCommand("HSET", key, field, value); err != nil {
 			fmt.Printf("Error logging to AOF: %v\n", err)
 		}
 	}
 
-	db.triggerWrite()
+	db.touch(key)
+	db.triggerWrite(key)
 	if fieldExists {
 		return 0, nil
 	}
@@ -63,25 +78,26 @@ func (db *FlexDB) HGet(key, field string) (string, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 	if !exists {
-		return "", errors.New("key not found")
+		return "", ErrKeyNotFound
 	}
 
-	if val.Expiration != nil && time.Now().After(*val.Expiration) {
-		return "", errors.New("key not found")
+	if val.Expiration != nil && db.now().After(*val.Expiration) {
+		return "", ErrKeyNotFound
 	}
 
 	if val.Type != TypeHash {
-		return "", errors.New("value is not a hash")
+		return "", ErrWrongType
 	}
 
 	hashMap := val.Data.(map[string]string)
 	value, exists := hashMap[field]
 	if !exists {
-		return "", errors.New("field not found")
+		return "", ErrFieldNotFound
 	}
 
+	db.touch(key)
 	return value, nil
 }
 
@@ -92,17 +108,17 @@ func (db *FlexDB) HDel(key string, fields ...string) (int, error) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 	if !exists {
 		return 0, nil
 	}
 
-	if val.Expiration != nil && time.Now().After(*val.Expiration) {
+	if val.Expiration != nil && db.now().After(*val.Expiration) {
 		return 0, nil
 	}
 
 	if val.Type != TypeHash {
-		return 0, errors.New("value is not a hash")
+		return 0, ErrWrongType
 	}
 
 	hashMap := val.Data.(map[string]string)
@@ -122,16 +138,18 @@ func (db *FlexDB) HDel(key string, fields ...string) (int, error) {
 		db.data[key] = val
 	}
 
+	db.touch(key)
+
 	// Log to AOF if enabled and fields were deleted
-	if deleted > 0 && db.aof != nil && db.aof.enabled {
+	if deleted > 0 && db.logging() {
 		args := append([]string{key}, fields...)
-		if err := db.aof.LogCommand("HDEL", args...); err != nil {
+		if err := db.logCommand("HDEL", args...); err != nil {
 			fmt.Printf("Error logging to AOF: %v\n", err)
 		}
 	}
 
 	if deleted > 0 {
-		db.triggerWrite()
+		db.triggerWrite(key)
 	}
 
 	return deleted, nil
@@ -144,17 +162,17 @@ func (db *FlexDB) HGetAll(key string) (map[string]string, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 	if !exists {
 		return map[string]string{}, nil
 	}
 
-	if val.Expiration != nil && time.Now().After(*val.Expiration) {
+	if val.Expiration != nil && db.now().After(*val.Expiration) {
 		return map[string]string{}, nil
 	}
 
 	if val.Type != TypeHash {
-		return nil, errors.New("value is not a hash")
+		return nil, ErrWrongType
 	}
 
 	hashMap := val.Data.(map[string]string)
@@ -163,6 +181,7 @@ func (db *FlexDB) HGetAll(key string) (map[string]string, error) {
 		result[k] = v
 	}
 
+	db.touch(key)
 	return result, nil
 }
 
@@ -173,21 +192,22 @@ func (db *FlexDB) HExists(key, field string) (bool, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 	if !exists {
 		return false, nil
 	}
 
-	if val.Expiration != nil && time.Now().After(*val.Expiration) {
+	if val.Expiration != nil && db.now().After(*val.Expiration) {
 		return false, nil
 	}
 
 	if val.Type != TypeHash {
-		return false, errors.New("value is not a hash")
+		return false, ErrWrongType
 	}
 
 	hashMap := val.Data.(map[string]string)
 	_, exists = hashMap[field]
+	db.touch(key)
 	return exists, nil
 }
 
@@ -198,20 +218,21 @@ func (db *FlexDB) HLen(key string) (int, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 	if !exists {
 		return 0, nil
 	}
 
-	if val.Expiration != nil && time.Now().After(*val.Expiration) {
+	if val.Expiration != nil && db.now().After(*val.Expiration) {
 		return 0, nil
 	}
 
 	if val.Type != TypeHash {
-		return 0, errors.New("value is not a hash")
+		return 0, ErrWrongType
 	}
 
 	hashMap := val.Data.(map[string]string)
+	db.touch(key)
 	return len(hashMap), nil
 }
 
@@ -222,17 +243,17 @@ func (db *FlexDB) HKeys(key string) ([]string, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 	if !exists {
 		return []string{}, nil
 	}
 
-	if val.Expiration != nil && time.Now().After(*val.Expiration) {
+	if val.Expiration != nil && db.now().After(*val.Expiration) {
 		return []string{}, nil
 	}
 
 	if val.Type != TypeHash {
-		return nil, errors.New("value is not a hash")
+		return nil, ErrWrongType
 	}
 
 	hashMap := val.Data.(map[string]string)
@@ -241,6 +262,7 @@ func (db *FlexDB) HKeys(key string) ([]string, error) {
 		keys = append(keys, k)
 	}
 
+	db.touch(key)
 	return keys, nil
 }
 
@@ -251,17 +273,17 @@ func (db *FlexDB) HVals(key string) ([]string, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 	if !exists {
 		return []string{}, nil
 	}
 
-	if val.Expiration != nil && time.Now().After(*val.Expiration) {
+	if val.Expiration != nil && db.now().After(*val.Expiration) {
 		return []string{}, nil
 	}
 
 	if val.Type != TypeHash {
-		return nil, errors.New("value is not a hash")
+		return nil, ErrWrongType
 	}
 
 	hashMap := val.Data.(map[string]string)
@@ -270,5 +292,6 @@ func (db *FlexDB) HVals(key string) ([]string, error) {
 		values = append(values, v)
 	}
 
+	db.touch(key)
 	return values, nil
 }
@@ -0,0 +1,206 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"flex-db/internal/utils"
+)
+
+// ErrHistoryDisabled is returned by HISTORY and GETVERSION without WithHistory
+var ErrHistoryDisabled = errors.New("key history not enabled")
+
+// KeyVersion is a value a string key held at some point
+type KeyVersion struct {
+	Version uint64 // counts the writes to the key, starting at 1
+	Time    time.Time
+	Value   string
+}
+
+// persistedVersion is the snapshot form of a KeyVersion
+type persistedVersion struct {
+	Version uint64 `json:"v"`
+	Time    int64  `json:"t"` // Unix milliseconds
+	Value   string `json:"data"`
+}
+
+// historyTracker keeps the recent versions of the string keys matching
+// its patterns. Like accessTracker it has its own lock, but versions are
+// only recorded by writers, which hold the keyspace lock.
+type historyTracker struct {
+	mu       sync.Mutex
+	depth    int
+	patterns []string
+	keys     map[string]*keyHistory
+}
+
+type keyHistory struct {
+	last     uint64       // version of the latest write
+	versions []KeyVersion // oldest first, at most depth
+}
+
+// WithHistory keeps the last depth versions of every string key matching
+// any of patterns, with the time each was written, so an accidental
+// overwrite can be inspected with HISTORY and undone with GETVERSION. The
+// current value counts as the latest version. Histories are saved in the
+// snapshot with their key and dropped when the key is deleted or expires.
+func WithHistory(depth int, patterns ...string) Option {
+	return func(db *FlexDB) {
+		if depth <= 0 || len(patterns) == 0 {
+			return
+		}
+		db.history = &historyTracker{
+			depth:    depth,
+			patterns: patterns,
+			keys:     make(map[string]*keyHistory),
+		}
+	}
+}
+
+// tracks reports whether the versions of key are kept
+func (t *historyTracker) tracks(key string) bool {
+	for _, pattern := range t.patterns {
+		if utils.MatchGlob(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordVersion records the value just written to key, if its history is
+// kept. Writes replayed from the AOF are not recorded, as the snapshot
+// already holds the history they would repeat. Callers hold the keyspace
+// lock.
+func (db *FlexDB) recordVersion(key string, val Value) {
+	if db.history == nil || val.Type != TypeString || !db.history.tracks(key) || db.Loading() {
+		return
+	}
+	str, ok := stringData(val.Data)
+	if !ok {
+		return
+	}
+
+	t := db.history
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.keys[key]
+	if !ok {
+		h = &keyHistory{}
+		t.keys[key] = h
+	}
+	h.last++
+	h.versions = append(h.versions, KeyVersion{Version: h.last, Time: time.Now(), Value: str})
+	if len(h.versions) > t.depth {
+		h.versions = append(h.versions[:0], h.versions[len(h.versions)-t.depth:]...)
+	}
+}
+
+// forgetHistory drops the history of a deleted key.
+// Callers hold the keyspace lock.
+func (db *FlexDB) forgetHistory(key string) {
+	if db.history == nil {
+		return
+	}
+
+	db.history.mu.Lock()
+	delete(db.history.keys, key)
+	db.history.mu.Unlock()
+}
+
+// pruneHistory drops the histories of keys that no longer exist.
+// Callers hold the keyspace lock.
+func (db *FlexDB) pruneHistory() {
+	if db.history == nil {
+		return
+	}
+
+	db.history.mu.Lock()
+	defer db.history.mu.Unlock()
+
+	for key := range db.history.keys {
+		if _, ok := db.data[key]; !ok {
+			delete(db.history.keys, key)
+		}
+	}
+}
+
+// persistedHistory returns the snapshot form of the history of key, or
+// nil if it has none
+func (db *FlexDB) persistedHistory(key string) []persistedVersion {
+	if db.history == nil {
+		return nil
+	}
+
+	db.history.mu.Lock()
+	defer db.history.mu.Unlock()
+
+	h, ok := db.history.keys[key]
+	if !ok {
+		return nil
+	}
+	versions := make([]persistedVersion, len(h.versions))
+	for i, v := range h.versions {
+		versions[i] = persistedVersion{Version: v.Version, Time: v.Time.UnixMilli(), Value: v.Value}
+	}
+	return versions
+}
+
+// restoreHistory sets the history of a key loaded from the snapshot.
+// Callers hold the keyspace lock.
+func (db *FlexDB) restoreHistory(key string, versions []persistedVersion) {
+	if db.history == nil || len(versions) == 0 {
+		return
+	}
+
+	h := &keyHistory{}
+	for _, v := range versions {
+		h.versions = append(h.versions, KeyVersion{Version: v.Version, Time: time.UnixMilli(v.Time), Value: v.Value})
+		h.last = v.Version
+	}
+	if len(h.versions) > db.history.depth {
+		h.versions = h.versions[len(h.versions)-db.history.depth:]
+	}
+
+	db.history.mu.Lock()
+	db.history.keys[key] = h
+	db.history.mu.Unlock()
+}
+
+// History returns the kept versions of key, newest first
+func (db *FlexDB) History(key string) ([]KeyVersion, error) {
+	if db.history == nil {
+		return nil, ErrHistoryDisabled
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	db.history.mu.Lock()
+	defer db.history.mu.Unlock()
+
+	h, ok := db.history.keys[key]
+	if !ok {
+		return nil, nil
+	}
+	versions := make([]KeyVersion, len(h.versions))
+	for i, v := range h.versions {
+		versions[len(versions)-1-i] = v
+	}
+	return versions, nil
+}
+
+// GetVersion returns the given version of key, if it is still kept
+func (db *FlexDB) GetVersion(key string, version uint64) (KeyVersion, bool, error) {
+	versions, err := db.History(key)
+	if err != nil {
+		return KeyVersion{}, false, err
+	}
+	for _, v := range versions {
+		if v.Version == version {
+			return v, true, nil
+		}
+	}
+	return KeyVersion{}, false, nil
+}
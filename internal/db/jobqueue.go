@@ -0,0 +1,354 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Job queues hand each job to one consumer at a time. Popping a job
+// reserves it for a visibility timeout instead of removing it; the
+// consumer acknowledges it once done, and a job not acknowledged in time
+// goes back to the front of the queue for another consumer. Jobs are
+// therefore delivered at least once, and consumers should be idempotent.
+
+// Job is a queued payload with the id used to acknowledge it
+type Job struct {
+	ID      string
+	Payload string
+}
+
+// reservation is a popped job awaiting acknowledgement
+type reservation struct {
+	Job
+	deadline time.Time
+}
+
+// jobQueue is the in-memory form of a job queue
+type jobQueue struct {
+	ready    []Job // oldest first
+	reserved map[string]reservation
+	nextID   uint64
+}
+
+func newJobQueue() *jobQueue {
+	return &jobQueue{reserved: make(map[string]reservation), nextID: 1}
+}
+
+// push queues payload and returns its job
+func (q *jobQueue) push(payload string) Job {
+	job := Job{ID: strconv.FormatUint(q.nextID, 10), Payload: payload}
+	q.nextID++
+	q.ready = append(q.ready, job)
+	return job
+}
+
+// requeue returns the jobs whose reservation lapsed by now to the front of
+// the queue, oldest first
+func (q *jobQueue) requeue(now time.Time) {
+	var lapsed []Job
+	for id, r := range q.reserved {
+		if !now.Before(r.deadline) {
+			lapsed = append(lapsed, r.Job)
+			delete(q.reserved, id)
+		}
+	}
+	if len(lapsed) == 0 {
+		return
+	}
+	sort.Slice(lapsed, func(i, j int) bool { return jobOrder(lapsed[i].ID) < jobOrder(lapsed[j].ID) })
+	q.ready = append(lapsed, q.ready...)
+}
+
+// nextDeadline returns when the earliest reservation lapses, or the zero
+// time if nothing is reserved
+func (q *jobQueue) nextDeadline() time.Time {
+	var next time.Time
+	for _, r := range q.reserved {
+		if next.IsZero() || r.deadline.Before(next) {
+			next = r.deadline
+		}
+	}
+	return next
+}
+
+// reserve pops up to count ready jobs, reserving them until deadline
+func (q *jobQueue) reserve(count int, deadline time.Time) []Job {
+	if count > len(q.ready) {
+		count = len(q.ready)
+	}
+	jobs := append([]Job(nil), q.ready[:count]...)
+	q.ready = q.ready[count:]
+	for _, job := range jobs {
+		q.reserved[job.ID] = reservation{Job: job, deadline: deadline}
+	}
+	return jobs
+}
+
+// reservedJobs returns the reserved jobs, oldest first
+func (q *jobQueue) reservedJobs() []reservation {
+	reserved := make([]reservation, 0, len(q.reserved))
+	for _, r := range q.reserved {
+		reserved = append(reserved, r)
+	}
+	sort.Slice(reserved, func(i, j int) bool { return jobOrder(reserved[i].ID) < jobOrder(reserved[j].ID) })
+	return reserved
+}
+
+// Len returns the number of jobs, ready or reserved
+func (q *jobQueue) Len() int {
+	return len(q.ready) + len(q.reserved)
+}
+
+// jobOrder returns the numeric order of a job id
+func jobOrder(id string) uint64 {
+	n, _ := strconv.ParseUint(id, 10, 64)
+	return n
+}
+
+// persisted returns the snapshot form of the queue
+func (q *jobQueue) persisted() map[string]interface{} {
+	ready := make([][2]string, len(q.ready))
+	for i, job := range q.ready {
+		ready[i] = [2]string{job.ID, job.Payload}
+	}
+	reserved := make([][3]interface{}, 0, len(q.reserved))
+	for _, r := range q.reservedJobs() {
+		reserved = append(reserved, [3]interface{}{r.ID, r.Payload, r.deadline.UnixMilli()})
+	}
+	return map[string]interface{}{"next": q.nextID, "ready": ready, "reserved": reserved}
+}
+
+// aofCommands returns the QADD and QRESERVE commands that recreate the
+// queue. Jobs keep their ids, and reserved ones their deadlines.
+func (q *jobQueue) aofCommands(key string) [][]string {
+	reserved := q.reservedJobs()
+	args := make([]string, 0, 2*q.Len())
+	for _, r := range reserved {
+		args = append(args, r.ID, r.Payload)
+	}
+	for _, job := range q.ready {
+		args = append(args, job.ID, job.Payload)
+	}
+	cmds := batchedCommands("QADD", key, args, 2)
+	for _, r := range reserved {
+		cmds = append(cmds, []string{"QRESERVE", key, strconv.FormatInt(r.deadline.UnixMilli(), 10), r.ID})
+	}
+	return cmds
+}
+
+// String formats the queue for ALL
+func (q *jobQueue) String() string {
+	return fmt.Sprintf("ready:%v reserved:%d", q.ready, len(q.reserved))
+}
+
+// loadJobQueue restores a job queue from its snapshot form
+func loadJobQueue(data interface{}) (*jobQueue, error) {
+	obj, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("job queue is not an object")
+	}
+	next, ok := obj["next"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("next job id is not a number")
+	}
+	ready, ok1 := obj["ready"].([]interface{})
+	reserved, ok2 := obj["reserved"].([]interface{})
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("jobs are not arrays")
+	}
+
+	q := newJobQueue()
+	q.nextID = uint64(next)
+	for _, j := range ready {
+		pair, ok := j.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("job is not an [id, payload] pair")
+		}
+		id, ok1 := pair[0].(string)
+		payload, ok2 := pair[1].(string)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("job is not an [id, payload] pair")
+		}
+		q.ready = append(q.ready, Job{ID: id, Payload: payload})
+	}
+	for _, r := range reserved {
+		triple, ok := r.([]interface{})
+		if !ok || len(triple) != 3 {
+			return nil, fmt.Errorf("reservation is not an [id, payload, deadline] triple")
+		}
+		id, ok1 := triple[0].(string)
+		payload, ok2 := triple[1].(string)
+		deadline, ok3 := triple[2].(float64)
+		if !ok1 || !ok2 || !ok3 {
+			return nil, fmt.Errorf("reservation is not an [id, payload, deadline] triple")
+		}
+		q.reserved[id] = reservation{Job: Job{ID: id, Payload: payload}, deadline: time.UnixMilli(int64(deadline))}
+	}
+	return q, nil
+}
+
+// QPush queues payloads on the job queue at key and returns the number of
+// jobs in the queue, ready or reserved
+func (db *FlexDB) QPush(key string, payloads ...string) (int, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, err
+	}
+	if err := db.checkValues(payloads...); err != nil {
+		return 0, err
+	}
+
+	length := 0
+	err := db.Update(func(tx *Txn) error {
+		q, err := jobQueueAt(tx, key)
+		if err != nil {
+			return err
+		}
+		if q == nil {
+			q = newJobQueue()
+			tx.Put(key, Value{Type: TypeQueue, Data: q})
+		} else if err := db.checkElements(q.Len() + len(payloads)); err != nil {
+			return err
+		}
+
+		// logged with their ids, so acknowledgements replay against the same jobs
+		logged := []string{key}
+		for _, payload := range payloads {
+			job := q.push(payload)
+			logged = append(logged, job.ID, job.Payload)
+		}
+		tx.markChanged(key)
+		tx.Log("QADD", logged...)
+		length = q.Len()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	db.signalKey(key)
+	return length, nil
+}
+
+// QPop reserves up to count jobs of the job queue at key for visibility,
+// oldest first. Jobs not acknowledged with QAck by then go back to the
+// front of the queue.
+func (db *FlexDB) QPop(key string, count int, visibility time.Duration) ([]Job, error) {
+	jobs, _, err := db.qpop(key, count, visibility)
+	return jobs, err
+}
+
+// QPopWait is QPop waiting for a job to be pushed or to come back from a
+// lapsed reservation when none is ready. It returns ctx's error when ctx
+// ends first, and ErrShuttingDown when the database shuts down.
+func (db *FlexDB) QPopWait(ctx context.Context, key string, count int, visibility time.Duration) ([]Job, error) {
+	var jobs []Job
+	err := db.blockOn(ctx, key, func() (bool, time.Time, error) {
+		var next time.Time
+		var err error
+		jobs, next, err = db.qpop(key, count, visibility)
+		return len(jobs) > 0, next, err
+	})
+	return jobs, err
+}
+
+// qpop reserves ready jobs. When none is ready it returns when the
+// earliest reservation lapses, or the zero time if nothing is reserved.
+func (db *FlexDB) qpop(key string, count int, visibility time.Duration) ([]Job, time.Time, error) {
+	var jobs []Job
+	var next time.Time
+	err := db.Update(func(tx *Txn) error {
+		q, err := jobQueueAt(tx, key)
+		if err != nil || q == nil {
+			return err
+		}
+
+		now := db.now()
+		q.requeue(now)
+		deadline := now.Add(visibility)
+		jobs = q.reserve(count, deadline)
+		if len(jobs) == 0 {
+			next = q.nextDeadline()
+			return nil
+		}
+
+		logged := []string{key, strconv.FormatInt(deadline.UnixMilli(), 10)}
+		for _, job := range jobs {
+			logged = append(logged, job.ID)
+		}
+		tx.markChanged(key)
+		tx.Log("QRESERVE", logged...)
+		return nil
+	})
+	return jobs, next, err
+}
+
+// QAck acknowledges reserved jobs of the job queue at key, removing them
+// for good, and returns how many were reserved. Jobs whose reservation
+// lapsed can't be acknowledged, as they may be handed to another
+// consumer. The key is deleted once the queue is empty.
+func (db *FlexDB) QAck(key string, ids ...string) (int, error) {
+	acked := 0
+	err := db.Update(func(tx *Txn) error {
+		q, err := jobQueueAt(tx, key)
+		if err != nil || q == nil {
+			return err
+		}
+
+		q.requeue(db.now())
+		var logged []string
+		for _, id := range ids {
+			if _, ok := q.reserved[id]; ok {
+				delete(q.reserved, id)
+				logged = append(logged, id)
+			}
+		}
+		if len(logged) == 0 {
+			return nil
+		}
+		if q.Len() == 0 {
+			tx.Delete(key)
+		}
+		tx.markChanged(key)
+		tx.Log("QACK", append([]string{key}, logged...)...)
+		acked = len(logged)
+		return nil
+	})
+	return acked, err
+}
+
+// QLen returns the number of ready and of reserved jobs of the job queue
+// at key
+func (db *FlexDB) QLen(key string) (ready, reserved int, err error) {
+	err = db.View(func(tx *Txn) error {
+		q, err := jobQueueAt(tx, key)
+		if err != nil || q == nil {
+			return err
+		}
+		// lapsed reservations count as ready without requeueing them,
+		// which would need the write lock
+		now := db.now()
+		for _, r := range q.reserved {
+			if now.Before(r.deadline) {
+				reserved++
+			}
+		}
+		ready = q.Len() - reserved
+		return nil
+	})
+	return ready, reserved, err
+}
+
+// jobQueueAt returns the job queue stored at key, or nil if the key
+// doesn't exist
+func jobQueueAt(tx *Txn, key string) (*jobQueue, error) {
+	val, ok := tx.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	if val.Type != TypeQueue {
+		return nil, ErrWrongType
+	}
+	return val.Data.(*jobQueue), nil
+}
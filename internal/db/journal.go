@@ -0,0 +1,364 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Incremental snapshots
+//
+// With WithIncrementalSnapshots, a scheduled save doesn't rewrite the
+// snapshot file. It appends the keys changed since the last save to a
+// journal next to it, "<snapshot>.journal", which loading replays over
+// the snapshot. The journal starts with the checksum of the snapshot it
+// extends, so one left behind by a crash during compaction is recognized
+// as stale and ignored. It holds batches of JSON lines, one per saved or
+// deleted key, each batch followed by its checksum line; a batch cut
+// short by a crash was never reported saved and is dropped.
+//
+// Writing a full snapshot compacts the journal: SAVE, BGSAVE, shutdown,
+// and scheduled saves once the journal outgrows the compaction ratio or
+// a change that can't name its keys, such as FLUSHALL, was made.
+
+// journalHeader starts a journal, followed by the checksum of its snapshot
+const journalHeader = "#FLEXDB-JOURNAL 1 %016x\n"
+
+// maxDirtyKeys is the most changed keys tracked between saves. Past it a
+// full snapshot is written, likely no slower than a journal that large.
+const maxDirtyKeys = 1 << 20
+
+// journal is the state of the journal of a snapshot file
+type journal struct {
+	base     uint64 // checksum of the snapshot the journal extends
+	size     int64  // bytes of complete batches, 0 to start the file over
+	snapshot int64  // size of the snapshot file
+}
+
+// journalLine is a line of the journal: a key and its value, or a deleted key
+type journalLine struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+}
+
+// journalChange is a changed key captured for the journal
+type journalChange struct {
+	key   string
+	entry *snapshotEntry // nil if the key was deleted
+}
+
+// WithIncrementalSnapshots makes scheduled saves append the keys changed
+// since the last save to a journal instead of rewriting the snapshot, so
+// a large dataset that changes little costs little disk I/O. A full
+// snapshot compacts the journal once it's larger than compactRatio times
+// the snapshot.
+func WithIncrementalSnapshots(compactRatio float64) Option {
+	return func(db *FlexDB) {
+		db.compactRatio = compactRatio
+		db.journals = make(map[string]*journal)
+	}
+}
+
+// journalPath returns the journal of a snapshot file
+func journalPath(snapshot string) string {
+	return snapshot + ".journal"
+}
+
+// noteDirty records the keys a change touched for the next incremental
+// save. No keys means any key may have changed. Callers hold persistMu.
+func (db *FlexDB) noteDirty(keys []string) {
+	if db.compactRatio <= 0 || db.dirtyAll {
+		return
+	}
+	if len(keys) == 0 || len(db.dirtyKeys)+len(keys) > maxDirtyKeys {
+		db.dirtyAll = true
+		db.dirtyKeys = nil
+		return
+	}
+	if db.dirtyKeys == nil {
+		db.dirtyKeys = make(map[string]struct{})
+	}
+	for _, key := range keys {
+		db.dirtyKeys[key] = struct{}{}
+	}
+}
+
+// takeDirtyKeys returns the keys changed since the last save, or all set
+// if any may have, and starts collecting them anew
+func (db *FlexDB) takeDirtyKeys() (keys map[string]struct{}, all bool) {
+	db.persistMu.Lock()
+	defer db.persistMu.Unlock()
+	keys, all = db.dirtyKeys, db.dirtyAll
+	db.dirtyKeys, db.dirtyAll = nil, false
+	return keys, all
+}
+
+// markAllDirty makes the next save a full snapshot, after a save that
+// took the changed keys failed
+func (db *FlexDB) markAllDirty() {
+	db.persistMu.Lock()
+	db.noteDirty(nil)
+	db.persistMu.Unlock()
+}
+
+// resetJournal starts the journal of a snapshot over once the snapshot is
+// replaced, sum being its checksum. Callers hold saveMu.
+func (db *FlexDB) resetJournal(snapshot string, sum uint64, size int64) {
+	if err := os.Remove(journalPath(snapshot)); err != nil && !os.IsNotExist(err) {
+		// a stale journal is ignored on load, but shouldn't linger
+		fmt.Printf("Error removing journal %s: %v\n", journalPath(snapshot), err)
+	}
+	if db.journals != nil {
+		db.journals[snapshot] = &journal{base: sum, snapshot: size}
+	}
+}
+
+// journalsReady reports whether every target has a journal that can take
+// another batch without compaction. Callers hold saveMu.
+func (db *FlexDB) journalsReady(targets []snapshotTarget) bool {
+	if db.compactRatio <= 0 {
+		return false
+	}
+	for _, target := range targets {
+		j, ok := db.journals[target.file]
+		if !ok || float64(j.size) > db.compactRatio*float64(j.snapshot) {
+			return false
+		}
+	}
+	return true
+}
+
+// captureKeys copies the changed keys of each snapshot target, in the
+// order of targets. Callers hold the keyspace lock.
+func (db *FlexDB) captureKeys(targets []snapshotTarget, keys map[string]struct{}) [][]journalChange {
+	targetOf := db.targetIndex(targets)
+	sealer := db.snapshotSealer()
+
+	changes := make([][]journalChange, len(targets))
+	for key := range keys {
+		i, ok := targetOf(key)
+		if !ok {
+			continue
+		}
+		v, exists := db.data[key]
+		if !exists {
+			changes[i] = append(changes[i], journalChange{key: key})
+			continue
+		}
+		e := db.captureEntry(key, v)
+		if e.sealer != nil {
+			e.sealer = sealer
+		}
+		changes[i] = append(changes[i], journalChange{key: key, entry: &e})
+	}
+	return changes
+}
+
+// saveJournals appends captured changes to the journals of their targets,
+// settling the changes counted when they were captured
+func (db *FlexDB) saveJournals(targets []snapshotTarget, changes [][]journalChange, start time.Time, count uint64, since time.Time) error {
+	var written int64
+	for i, target := range targets {
+		if len(changes[i]) == 0 {
+			continue
+		}
+		n, err := db.appendJournal(target.file, changes[i])
+		written += n
+		if err != nil {
+			db.stats.recordSave(start, written, err)
+			db.markAllDirty()
+			return err
+		}
+	}
+	db.stats.recordSave(start, written, nil)
+	db.stats.journalSaves.Add(1)
+	db.markSaved(count, since)
+	return nil
+}
+
+// appendJournal appends a batch of changes to the journal of a snapshot
+// and syncs it, returning how many bytes it wrote. Callers hold saveMu.
+func (db *FlexDB) appendJournal(snapshot string, changes []journalChange) (int64, error) {
+	j := db.journals[snapshot]
+	path := journalPath(snapshot)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer file.Close()
+
+	// drops a batch cut short by a crash or a failed write, or the whole
+	// file if it must be started over
+	if err := file.Truncate(j.size); err != nil {
+		return 0, fmt.Errorf("failed to truncate journal %s: %w", path, err)
+	}
+	if _, err := file.Seek(j.size, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to write journal %s: %w", path, err)
+	}
+
+	counter := &countingWriter{w: file}
+	if j.size == 0 {
+		if _, err := fmt.Fprintf(counter, journalHeader, j.base); err != nil {
+			return counter.n, fmt.Errorf("failed to write journal %s: %w", path, err)
+		}
+	}
+	sum := newChecksum()
+	w := bufio.NewWriter(io.MultiWriter(counter, sum))
+	for _, change := range changes {
+		if err := db.writeJournalLine(w, change); err != nil {
+			return counter.n, fmt.Errorf("failed to write journal %s: %w", path, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return counter.n, fmt.Errorf("failed to write journal %s: %w", path, err)
+	}
+	if _, err := fmt.Fprintf(counter, checksumLine, sum.Sum64()); err != nil {
+		return counter.n, fmt.Errorf("failed to write journal %s: %w", path, err)
+	}
+	if err := file.Sync(); err != nil {
+		return counter.n, fmt.Errorf("failed to sync journal %s: %w", path, err)
+	}
+
+	j.size += counter.n
+	return counter.n, nil
+}
+
+// writeJournalLine writes a change as a journalLine
+func (db *FlexDB) writeJournalLine(w *bufio.Writer, change journalChange) error {
+	key, err := json.Marshal(change.key)
+	if err != nil {
+		return err
+	}
+	w.WriteString(`{"key":`)
+	w.Write(key)
+	if change.entry == nil {
+		_, err := w.WriteString(`,"deleted":true}` + "\n")
+		return err
+	}
+
+	e, err := db.encodeSnapshotEntry(*change.entry)
+	if err != nil {
+		return err
+	}
+	w.WriteString(`,"value":`)
+	if e.chunked != nil {
+		if err := writeChunked(w, e.pv, e.chunked); err != nil {
+			return err
+		}
+	} else {
+		w.Write(e.value)
+	}
+	_, err = w.WriteString("}\n")
+	return err
+}
+
+// loadJournal replays the journal of a snapshot just loaded, sum and size
+// being the snapshot's checksum and size. A journal written for another
+// snapshot is ignored, and so is a last batch cut short. Callers hold the
+// keyspace lock.
+func (db *FlexDB) loadJournal(snapshot string, sum uint64, size int64) error {
+	j := &journal{base: sum, snapshot: size}
+	if db.journals != nil {
+		db.journals[snapshot] = j
+	}
+
+	path := journalPath(snapshot)
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	header, err := r.ReadString('\n')
+	if err != nil || header != fmt.Sprintf(journalHeader, sum) {
+		fmt.Printf("Ignoring journal %s, it wasn't written for the snapshot\n", path)
+		return nil
+	}
+
+	offset := int64(len(header))
+	now := time.Now()
+	for {
+		lines, n, err := readJournalBatch(r)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			fmt.Printf("Ignoring the last batch of journal %s, it was cut short\n", path)
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("journal %s is damaged at byte %d: %w", path, offset, err)
+		}
+
+		for _, line := range lines {
+			db.deleteWithoutLogging(line.Key)
+			if line.Deleted {
+				continue
+			}
+			e, ok, err := db.decodeRaw(path, line.Key, line.Value, now)
+			if err != nil {
+				return err
+			}
+			if ok {
+				db.storeLoaded(e)
+			}
+		}
+		offset += n
+	}
+
+	j.size = offset
+	return nil
+}
+
+// readJournalBatch reads a batch of journal lines and its checksum line,
+// returning the lines and the size of the batch. It returns io.EOF at the
+// end of the journal and io.ErrUnexpectedEOF for a batch cut short, whose
+// lines aren't parsed since a crash may have left anything in them.
+func readJournalBatch(r *bufio.Reader) ([]journalLine, int64, error) {
+	var raw []string
+	var size int64
+	sum := newChecksum()
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			if line == "" && raw == nil {
+				return nil, 0, io.EOF
+			}
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		size += int64(len(line))
+		if !strings.HasPrefix(line, checksumPrefix) {
+			sum.Write([]byte(line))
+			raw = append(raw, line)
+			continue
+		}
+
+		expected, err := parseChecksum(line)
+		if err != nil {
+			return nil, 0, err
+		}
+		if expected != sum.Sum64() {
+			return nil, 0, ErrChecksum
+		}
+		lines := make([]journalLine, len(raw))
+		for i, line := range raw {
+			if err := json.Unmarshal([]byte(line), &lines[i]); err != nil {
+				return nil, 0, err
+			}
+		}
+		return lines, size, nil
+	}
+}
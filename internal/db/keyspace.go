@@ -0,0 +1,216 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"flex-db/internal/utils"
+)
+
+// Entry is a key and its value as returned by Entries
+type Entry struct {
+	Key   string
+	Value interface{}
+}
+
+// liveKeys returns the sorted names of unexpired keys matching pattern.
+// An empty pattern matches every key. Callers hold the keyspace lock.
+func (db *FlexDB) liveKeys(pattern string) []string {
+	now := db.now()
+	keys := make([]string, 0, len(db.data))
+	for k, v := range db.data {
+		if v.Expiration != nil && now.After(*v.Expiration) {
+			continue
+		}
+		if pattern != "" && !utils.MatchGlob(pattern, k) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// page returns the part of keys selected by offset and count.
+// A negative count selects everything after offset.
+func page(keys []string, offset, count int) []string {
+	if offset >= len(keys) {
+		return nil
+	}
+	keys = keys[offset:]
+	if count >= 0 && count < len(keys) {
+		keys = keys[:count]
+	}
+	return keys
+}
+
+// Keys returns, in lexicographic order, up to count keys matching the glob
+// pattern after skipping offset of them, along with the total number of
+// matching keys. A negative count returns every key after offset.
+func (db *FlexDB) Keys(pattern string, offset, count int) ([]string, int) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	keys := db.liveKeys(pattern)
+	return page(keys, offset, count), len(keys)
+}
+
+// Entries works like Keys over every key, but also returns the values
+func (db *FlexDB) Entries(offset, count int) ([]Entry, int) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	keys := db.liveKeys("")
+	selected := page(keys, offset, count)
+
+	entries := make([]Entry, len(selected))
+	for i, k := range selected {
+		val, _ := db.lookup(k)
+		value := val.Data
+		if str, ok := stringData(value); ok {
+			value = str
+		}
+		entries[i] = Entry{Key: k, Value: value}
+	}
+	return entries, len(keys)
+}
+
+// patternBatchSize is how many keys bulk pattern operations change while
+// holding the write lock, so other clients run between batches
+const patternBatchSize = 1000
+
+// DeletePattern deletes every key matching the glob pattern in bounded
+// batches and returns how many keys were deleted
+func (db *FlexDB) DeletePattern(pattern string) int {
+	return db.applyPattern(pattern, func(key string) bool {
+		db.deleteWithoutLogging(key)
+		return true
+	}, func(keys []string) {
+		if err := db.logCommand("DEL", keys...); err != nil {
+			fmt.Printf("Error logging to AOF: %v\n", err)
+		}
+	})
+}
+
+// ExpirePattern sets a TTL on every key matching the glob pattern in
+// bounded batches and returns how many keys were changed
+func (db *FlexDB) ExpirePattern(pattern string, duration time.Duration) int {
+	// every key gets the same deadline, logged as such
+	at := db.now().Add(duration)
+	return db.applyPattern(pattern, func(key string) bool {
+		db.expireWithoutLogging(key, at)
+		return true
+	}, func(keys []string) {
+		for _, key := range keys {
+			if err := db.logCommand("PEXPIREAT", key, unixMillis(at)); err != nil {
+				fmt.Printf("Error logging to AOF: %v\n", err)
+			}
+		}
+	})
+}
+
+// applyPattern runs apply on every live key matching pattern, taking the
+// write lock once per batch. apply reports whether it changed the key, and
+// logBatch records the changed keys of each batch in the AOF.
+func (db *FlexDB) applyPattern(pattern string, apply func(key string) bool, logBatch func(keys []string)) int {
+	db.lock.RLock()
+	keys := db.liveKeys(pattern)
+	db.lock.RUnlock()
+
+	return db.applyKeys(keys, apply, logBatch)
+}
+
+// applyKeys is applyPattern for a list of keys. Keys that are gone by
+// the time their batch runs are skipped.
+func (db *FlexDB) applyKeys(keys []string, apply func(key string) bool, logBatch func(keys []string)) int {
+	var changed []string
+	for start := 0; start < len(keys); start += patternBatchSize {
+		end := start + patternBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		db.lock.Lock()
+		now := db.now()
+		batch := make([]string, 0, end-start)
+		for _, key := range keys[start:end] {
+			// the key may have changed since it was listed
+			val, ok := db.data[key]
+			if !ok || (val.Expiration != nil && now.After(*val.Expiration)) {
+				continue
+			}
+			if apply(key) {
+				batch = append(batch, key)
+			}
+		}
+		if len(batch) > 0 && db.logging() {
+			logBatch(batch)
+		}
+		db.lock.Unlock()
+
+		changed = append(changed, batch...)
+	}
+
+	if len(changed) > 0 {
+		db.triggerWrite(changed...)
+	}
+	return len(changed)
+}
+
+// TypeStats counts the keys of one type
+type TypeStats struct {
+	Type   ValueType
+	Keys   int
+	Memory int64 // estimated bytes, see memoryOf
+}
+
+// KeyspaceStats summarizes the keyspace for capacity planning
+type KeyspaceStats struct {
+	Keys    int
+	Expires int           // keys with a TTL
+	AvgTTL  time.Duration // mean remaining TTL of keys with one
+	Types   []TypeStats   // one entry per type present, in type order
+}
+
+// KeyspaceStats counts keys, TTLs and estimated memory per type. It walks
+// the whole keyspace under the read lock.
+func (db *FlexDB) KeyspaceStats() KeyspaceStats {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var stats KeyspaceStats
+	var ttlSum time.Duration
+	byType := make(map[ValueType]*TypeStats)
+	now := db.now()
+
+	for k, v := range db.data {
+		if v.Expiration != nil {
+			if now.After(*v.Expiration) {
+				continue
+			}
+			stats.Expires++
+			ttlSum += v.Expiration.Sub(now)
+		}
+		stats.Keys++
+
+		ts, ok := byType[v.Type]
+		if !ok {
+			ts = &TypeStats{Type: v.Type}
+			byType[v.Type] = ts
+		}
+		ts.Keys++
+		ts.Memory += memoryOf(k, v)
+	}
+
+	if stats.Expires > 0 {
+		stats.AvgTTL = ttlSum / time.Duration(stats.Expires)
+	}
+	for _, ts := range byType {
+		stats.Types = append(stats.Types, *ts)
+	}
+	sort.Slice(stats.Types, func(i, j int) bool {
+		return stats.Types[i].Type < stats.Types[j].Type
+	})
+	return stats
+}
@@ -0,0 +1,248 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lazy values
+//
+// With WithLazyValues, loading a snapshot doesn't decode values of at
+// least the threshold size. Their persisted form is copied as it is to a
+// spill file next to the snapshot, flexdb.json.cold, and the key holds a
+// coldValue giving its place there. The first command reading the key
+// decodes it and keeps the result, so only the large values a client
+// actually uses take memory, and startup skips decoding the rest.
+//
+// Saving writes a value that was never read back from the spill file
+// without decoding it. Encrypted values are always decoded at load, so
+// the spill file never holds plaintext the snapshot didn't.
+
+// WithLazyValues leaves values whose persisted form takes at least
+// threshold bytes on disk when the snapshot is loaded, decoding them on
+// first access. Zero, the default, decodes every value at load.
+func WithLazyValues(threshold int) Option {
+	return func(db *FlexDB) {
+		if threshold > 0 {
+			db.lazy = &lazyValues{threshold: threshold, path: db.file + ".cold"}
+		}
+	}
+}
+
+// lazyValues is the spill file of the values left on disk at load
+type lazyValues struct {
+	threshold int
+	path      string
+
+	mu   sync.Mutex // guards file creation and size
+	file *os.File   // nil until the first value is spilled
+	size int64
+
+	spilled atomic.Int64 // values written to the spill file
+	loaded  atomic.Int64 // spilled values decoded since
+}
+
+// coldValue is the Data of a key whose value is still in the spill file
+type coldValue struct {
+	typ      ValueType
+	encoding string // snapshot encoding of the persisted data
+	offset   int64
+	length   int
+
+	once     sync.Once
+	isLoaded atomic.Bool // set once data and ok are
+	data     interface{}
+	ok       bool // false if the persisted data was corrupted
+}
+
+// coldEntry is a snapshot entry whose data is kept undecoded
+type coldEntry struct {
+	PersistentValue
+	Data json.RawMessage `json:"data"`
+}
+
+// decodeCold decodes a large snapshot entry like decodeRaw, leaving its
+// data undecoded for storeLoaded to spill. Its third result is false for
+// entries to decode as usual instead: small and encrypted ones.
+func (db *FlexDB) decodeCold(path, key string, data json.RawMessage, now time.Time) (loadedEntry, bool, bool, error) {
+	var v coldEntry
+	if err := json.Unmarshal(data, &v); err != nil {
+		return loadedEntry{}, false, false, fmt.Errorf("failed to parse snapshot %s at key %q: %w", path, key, err)
+	}
+	if v.Encoding == encodingEncrypted || len(v.Data) < db.lazy.threshold {
+		return loadedEntry{}, false, false, nil
+	}
+
+	exp := expirationOf(v.PersistentValue)
+	if exp != nil && now.After(*exp) {
+		return loadedEntry{}, false, true, nil
+	}
+	e := loadedEntry{
+		key:        key,
+		value:      Value{Type: v.Type, Expiration: exp},
+		encoding:   v.Encoding,
+		raw:        v.Data,
+		lastAccess: v.LastAccess,
+		history:    v.History,
+		tags:       v.Tags,
+	}
+	return e, true, true, nil
+}
+
+// spill writes the undecoded data of a loaded entry to the spill file and
+// returns the value standing for it. If the spill file can't be written
+// the data is decoded instead. Callers hold the keyspace lock.
+func (db *FlexDB) spill(e loadedEntry) (Value, bool) {
+	cold, err := db.lazy.write(e)
+	if err == nil {
+		e.value.Data = cold
+		return e.value, true
+	}
+	fmt.Printf("Failed to spill key %q, loading it now: %v\n", e.key, err)
+
+	data, ok := decodeData(e.key, e.value.Type, e.encoding, e.raw)
+	e.value.Data = data
+	return e.value, ok
+}
+
+// decodeData decodes the persisted data of a value of type typ. It
+// returns false if the data is corrupted.
+func decodeData(key string, typ ValueType, encoding string, raw json.RawMessage) (interface{}, bool) {
+	var data interface{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		fmt.Printf("Skipping key %q with corrupted value: %v\n", key, err)
+		return nil, false
+	}
+	value, ok := decodeValue(key, PersistentValue{Type: typ, Data: data, Encoding: encoding}, time.Time{})
+	return value.Data, ok
+}
+
+// write appends the data of e to the spill file, creating it first. A
+// spill file left by an earlier run is replaced.
+func (l *lazyValues) write(e loadedEntry) (*coldValue, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		file, err := os.OpenFile(l.path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+		if err != nil {
+			return nil, err
+		}
+		l.file, l.size = file, 0
+	}
+	if _, err := l.file.WriteAt(e.raw, l.size); err != nil {
+		return nil, err
+	}
+	cold := &coldValue{typ: e.value.Type, encoding: e.encoding, offset: l.size, length: len(e.raw)}
+	l.size += int64(len(e.raw))
+	l.spilled.Add(1)
+	return cold, nil
+}
+
+// closeSpill closes and removes the spill file. Values still in it are
+// lost, so it's only called once the final snapshot is written.
+func (db *FlexDB) closeSpill() error {
+	if db.lazy == nil {
+		return nil
+	}
+	db.lazy.mu.Lock()
+	defer db.lazy.mu.Unlock()
+	if db.lazy.file == nil {
+		return nil
+	}
+	err := db.lazy.file.Close()
+	db.lazy.file = nil
+	if rmErr := os.Remove(db.lazy.path); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// readRaw reads the persisted data of a cold value from the spill file
+func (l *lazyValues) readRaw(c *coldValue) (json.RawMessage, error) {
+	l.mu.Lock()
+	file := l.file
+	l.mu.Unlock()
+	if file == nil {
+		return nil, fmt.Errorf("spill file is closed")
+	}
+	raw := make([]byte, c.length)
+	if _, err := file.ReadAt(raw, c.offset); err != nil {
+		return nil, fmt.Errorf("failed to read spill file: %w", err)
+	}
+	return raw, nil
+}
+
+// resolve returns the decoded data of a cold value, decoding it on the
+// first call. It returns false if the value can't be read or is
+// corrupted, and a read that failed is tried again on the next call.
+func (l *lazyValues) resolve(key string, c *coldValue) (interface{}, bool) {
+	if c.isLoaded.Load() {
+		return c.data, c.ok
+	}
+	raw, err := l.readRaw(c)
+	if err != nil {
+		fmt.Printf("Failed to load key %q: %v\n", key, err)
+		return nil, false
+	}
+	c.once.Do(func() {
+		c.data, c.ok = decodeData(key, c.typ, c.encoding, raw)
+		c.isLoaded.Store(true)
+		l.loaded.Add(1)
+	})
+	return c.data, c.ok
+}
+
+// resident returns v with the decoded data of a cold value that was
+// already loaded, leaving other values, and cold values still on disk,
+// as they are
+func resident(v Value) Value {
+	if c, ok := v.Data.(*coldValue); ok && c.isLoaded.Load() && c.ok {
+		v.Data = c.data
+	}
+	return v
+}
+
+// lookup returns the value of key like reading db.data, decoding it first
+// if it's still in the spill file. A cold value that can't be decoded
+// reads as missing. Callers hold the keyspace lock.
+func (db *FlexDB) lookup(key string) (Value, bool) {
+	val, ok := db.data[key]
+	if !ok {
+		return val, false
+	}
+	if c, cold := val.Data.(*coldValue); cold {
+		data, ok := db.lazy.resolve(key, c)
+		if !ok {
+			return Value{}, false
+		}
+		val.Data = data
+	}
+	return val, true
+}
+
+// peek is lookup for reads that shouldn't keep a cold value in memory,
+// like AOF rewrites: a value still in the spill file is decoded into a
+// copy the caller must not modify. Callers hold the keyspace lock.
+func (db *FlexDB) peek(key string) (Value, bool) {
+	val, ok := db.data[key]
+	if !ok {
+		return val, false
+	}
+	c, cold := val.Data.(*coldValue)
+	if !cold || c.isLoaded.Load() {
+		return db.lookup(key)
+	}
+	raw, err := db.lazy.readRaw(c)
+	if err != nil {
+		fmt.Printf("Failed to load key %q: %v\n", key, err)
+		return Value{}, false
+	}
+	if val.Data, ok = decodeData(key, c.typ, c.encoding, raw); !ok {
+		return Value{}, false
+	}
+	return val, true
+}
@@ -0,0 +1,206 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"flex-db/internal/utils"
+)
+
+// ErrShuttingDown is returned by calls interrupted by Shutdown
+var ErrShuttingDown = errors.New("database is shutting down")
+
+// Lease is a named, time limited claim kept alive by its holder, used for
+// service registration and leader election. Leases live outside the
+// keyspace, in memory only: they are not persisted, so they all end with
+// the process, like the sessions of their holders.
+type Lease struct {
+	Name    string
+	ID      string // identifies the holder in KeepAlive and Revoke
+	Owner   string // free-form description of the holder
+	TTL     time.Duration
+	Expires time.Time
+}
+
+// Lease event types
+const (
+	LeaseGranted = "granted"
+	LeaseRevoked = "revoked"
+	LeaseExpired = "expired"
+)
+
+// LeaseEvent reports a change of a lease to its watchers
+type LeaseEvent struct {
+	Type  string // LeaseGranted, LeaseRevoked or LeaseExpired
+	Lease Lease
+}
+
+// leaseTable holds the live leases and the clients watching them
+type leaseTable struct {
+	mu       sync.Mutex
+	leases   map[string]*leaseEntry
+	watchers map[string][]chan LeaseEvent
+}
+
+type leaseEntry struct {
+	Lease
+	timer *time.Timer // expires the lease
+}
+
+// GrantLease grants the lease called name for ttl unless another holder
+// has it. It reports whether the lease was granted.
+func (db *FlexDB) GrantLease(name, owner string, ttl time.Duration) (Lease, bool) {
+	t := &db.leases
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, held := t.leases[name]; held {
+		return Lease{}, false
+	}
+
+	entry := &leaseEntry{Lease: Lease{
+		Name:    name,
+		ID:      NewLockToken(),
+		Owner:   owner,
+		TTL:     ttl,
+		Expires: time.Now().Add(ttl),
+	}}
+	id := entry.ID
+	entry.timer = time.AfterFunc(ttl, func() { db.expireLease(name, id) })
+	t.leases[name] = entry
+	t.notify(LeaseEvent{Type: LeaseGranted, Lease: entry.Lease})
+	return entry.Lease, true
+}
+
+// KeepAlive restarts the TTL of the lease called name if id holds it, and
+// reports whether it did
+func (db *FlexDB) KeepAlive(name, id string) (Lease, bool) {
+	t := &db.leases
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.leases[name]
+	if !ok || entry.ID != id {
+		return Lease{}, false
+	}
+	entry.Expires = time.Now().Add(entry.TTL)
+	entry.timer.Reset(entry.TTL)
+	return entry.Lease, true
+}
+
+// RevokeLease ends the lease called name if id holds it, and reports
+// whether it did
+func (db *FlexDB) RevokeLease(name, id string) bool {
+	t := &db.leases
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.leases[name]
+	if !ok || entry.ID != id {
+		return false
+	}
+	entry.timer.Stop()
+	delete(t.leases, name)
+	t.notify(LeaseEvent{Type: LeaseRevoked, Lease: entry.Lease})
+	return true
+}
+
+// expireLease ends the lease called name when its TTL runs out, unless it
+// was revoked or granted again meanwhile
+func (db *FlexDB) expireLease(name, id string) {
+	t := &db.leases
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.leases[name]
+	// a keepalive may have raced the timer
+	if !ok || entry.ID != id || time.Now().Before(entry.Expires) {
+		return
+	}
+	delete(t.leases, name)
+	t.notify(LeaseEvent{Type: LeaseExpired, Lease: entry.Lease})
+}
+
+// GetLease returns the lease called name, if it is held
+func (db *FlexDB) GetLease(name string) (Lease, bool) {
+	t := &db.leases
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.leases[name]
+	if !ok {
+		return Lease{}, false
+	}
+	return entry.Lease, true
+}
+
+// Leases returns the held leases whose name matches a glob pattern,
+// sorted by name
+func (db *FlexDB) Leases(pattern string) []Lease {
+	t := &db.leases
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var leases []Lease
+	for name, entry := range t.leases {
+		if utils.MatchGlob(pattern, name) {
+			leases = append(leases, entry.Lease)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Name < leases[j].Name })
+	return leases
+}
+
+// WatchLease waits for the next grant, revocation or expiry of the lease
+// called name. It returns ctx's error when ctx ends first, and
+// ErrShuttingDown when the database shuts down.
+func (db *FlexDB) WatchLease(ctx context.Context, name string) (LeaseEvent, error) {
+	t := &db.leases
+	ch := make(chan LeaseEvent, 1)
+	t.mu.Lock()
+	t.watchers[name] = append(t.watchers[name], ch)
+	t.mu.Unlock()
+
+	defer waiting(ctx)()
+	select {
+	case event := <-ch:
+		return event, nil
+	case <-ctx.Done():
+		t.unwatch(name, ch)
+		return LeaseEvent{}, ctx.Err()
+	case <-db.stop:
+		t.unwatch(name, ch)
+		return LeaseEvent{}, ErrShuttingDown
+	}
+}
+
+// notify sends an event to the watchers of its lease, which each get a
+// single event. Callers hold t.mu.
+func (t *leaseTable) notify(event LeaseEvent) {
+	for _, ch := range t.watchers[event.Lease.Name] {
+		ch <- event
+	}
+	delete(t.watchers, event.Lease.Name)
+}
+
+// unwatch removes a watcher that stopped waiting
+func (t *leaseTable) unwatch(name string, ch chan LeaseEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	watchers := t.watchers[name]
+	for i, w := range watchers {
+		if w == ch {
+			watchers = append(watchers[:i], watchers[i+1:]...)
+			break
+		}
+	}
+	if len(watchers) == 0 {
+		delete(t.watchers, name)
+	} else {
+		t.watchers[name] = watchers
+	}
+}
@@ -0,0 +1,49 @@
+package db
+
+import "fmt"
+
+// Limits bounds the size of what clients can store. Zero means unlimited.
+// Limits are checked when a write arrives; data loaded from the snapshot or
+// replayed from the AOF is accepted as is.
+type Limits struct {
+	MaxKeyLength int // longest key, in bytes
+	MaxValueSize int // largest string value, list element or hash field/value, in bytes
+	MaxElements  int // most elements in a list or fields in a hash
+}
+
+// WithLimits enforces limits on every write
+func WithLimits(limits Limits) Option {
+	return func(db *FlexDB) {
+		db.limits = limits
+	}
+}
+
+// checkKey validates a key against the configured key length limit
+func (db *FlexDB) checkKey(key string) error {
+	if limit := db.limits.MaxKeyLength; limit > 0 && len(key) > limit {
+		return fmt.Errorf("%w (limit is %d bytes)", ErrKeyTooLong, limit)
+	}
+	return nil
+}
+
+// checkValues validates values against the configured value size limit
+func (db *FlexDB) checkValues(values ...string) error {
+	limit := db.limits.MaxValueSize
+	if limit <= 0 {
+		return nil
+	}
+	for _, value := range values {
+		if len(value) > limit {
+			return fmt.Errorf("%w (limit is %d bytes)", ErrValueTooLarge, limit)
+		}
+	}
+	return nil
+}
+
+// checkElements validates the size a collection would grow to
+func (db *FlexDB) checkElements(count int) error {
+	if limit := db.limits.MaxElements; limit > 0 && count > limit {
+		return fmt.Errorf("%w (limit is %d)", ErrTooManyElements, limit)
+	}
+	return nil
+}
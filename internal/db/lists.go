@@ -1,26 +1,56 @@
 package db
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"time"
 )
 
 // LPush inserts values at the beginning of a list
 func (db *FlexDB) LPush(key string, values ...string) (int, error) {
+	return db.push(key, values, true, 0)
+}
+
+// RPush appends values to the end of a list
+func (db *FlexDB) RPush(key string, values ...string) (int, error) {
+	return db.push(key, values, false, 0)
+}
+
+// LPushCapped inserts values at the beginning of a list, then trims the
+// tail so the list holds at most maxLen elements
+func (db *FlexDB) LPushCapped(key string, maxLen int, values ...string) (int, error) {
+	return db.push(key, values, true, maxLen)
+}
+
+// RPushCapped appends values to the end of a list, then trims the head so
+// the list holds at most maxLen elements
+func (db *FlexDB) RPushCapped(key string, maxLen int, values ...string) (int, error) {
+	return db.push(key, values, false, maxLen)
+}
+
+// push adds values to the head (left) or tail of a list. A positive maxLen
+// caps the list, dropping elements from the opposite end.
+func (db *FlexDB) push(key string, values []string, left bool, maxLen int) (int, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, err
+	}
+	if err := db.checkValues(values...); err != nil {
+		return 0, err
+	}
+
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
 	// check if key exists in db
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 
 	if exists {
 		// check if key has expired
-		if val.Expiration != nil && time.Now().After(*val.Expiration) {
-			delete(db.data, key)
+		if val.Expiration != nil && db.now().After(*val.Expiration) {
+			db.expireKeys(key)
 			exists = false
 		} else if val.Type != TypeList {
-			return 0, errors.New("value is not a list")
+			return 0, ErrWrongType
 		}
 	}
 
@@ -37,72 +67,58 @@ func (db *FlexDB) LPush(key string, values ...string) (int, error) {
 		}
 	}
 
-	// prepend values in reverse order
-	for i := len(values) - 1; i >= 0; i-- {
-		list = append([]string{values[i]}, list...)
+	length := len(list) + len(values)
+	if maxLen > 0 && length > maxLen {
+		length = maxLen
 	}
-
-	val.Data = list
-	db.data[key] = val
-
-	// Log AOF if enabled
-	if db.aof != nil && db.aof.enabled {
-		args := append([]string{key}, values...)
-		if err := db.aof.LogCommand("LPUSH", args...); err != nil {
-			fmt.Printf("Error logging to AOF: %v\n", err)
-		}
+	if err := db.checkElements(length); err != nil {
+		return 0, err
 	}
 
-	db.triggerWrite()
-	return len(list), nil
-}
-
-// RPush appends values to the end of a list
-func (db *FlexDB) RPush(key string, values ...string) (int, error) {
-	db.lock.Lock()
-	defer db.lock.Unlock()
-
-	// check if key exists in db
-	val, exists := db.data[key]
-
-	if exists {
-		// check if key has expired
-		if val.Expiration != nil && time.Now().After(*val.Expiration) {
-			delete(db.data, key)
-			exists = false
-		} else if val.Type != TypeList {
-			return 0, errors.New("value is not a list")
+	if left {
+		// prepend values in reverse order
+		for i := len(values) - 1; i >= 0; i-- {
+			list = append([]string{values[i]}, list...)
 		}
+	} else {
+		// append values
+		list = append(list, values...)
 	}
 
-	var list []string
-
-	// get existing list or create a new one
-	if exists {
-		list = val.Data.([]string)
-	} else {
-		list = make([]string, 0, len(values))
-		val = Value{
-			Type: TypeList,
-			Data: list,
+	// trim the end opposite to the push
+	if maxLen > 0 && len(list) > maxLen {
+		if left {
+			list = list[:maxLen]
+		} else {
+			list = list[len(list)-maxLen:]
 		}
 	}
 
-	// append values
-	list = append(list, values...)
-
 	val.Data = list
 	db.data[key] = val
+	if !exists {
+		db.indexKey(key)
+	}
 
 	// Log AOF if enabled
-	if db.aof != nil && db.aof.enabled {
-		args := append([]string{key}, values...)
-		if err := db.aof.LogCommand("RPUSH", args...); err != nil {
+	if db.logging() {
+		cmd, args := "RPUSH", []string{key}
+		if left {
+			cmd = "LPUSH"
+		}
+		if maxLen > 0 {
+			cmd += "CAP"
+			args = append(args, fmt.Sprintf("%d", maxLen))
+		}
+		args = append(args, values...)
+		if err := db.logCommand(cmd, args...); err != nil {
 			fmt.Printf("Error logging to AOF: %v\n", err)
 		}
 	}
 
-	db.triggerWrite()
+	db.touch(key)
+	db.triggerWrite(key)
+	db.signalKey(key)
 	return len(list), nil
 }
 
@@ -111,24 +127,24 @@ func (db *FlexDB) LPop(key string) (string, error) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 	if !exists {
-		return "", errors.New("key not found")
+		return "", ErrKeyNotFound
 	}
 
 	// check if key has expired
-	if val.Expiration != nil && time.Now().After(*val.Expiration) {
-		delete(db.data, key)
-		return "", errors.New("key not found")
+	if val.Expiration != nil && db.now().After(*val.Expiration) {
+		db.expireKeys(key)
+		return "", ErrKeyNotFound
 	}
 
 	if val.Type != TypeList {
-		return "", errors.New("value is not a list")
+		return "", ErrWrongType
 	}
 
 	list := val.Data.([]string)
 	if len(list) == 0 {
-		return "", errors.New("list is empty")
+		return "", ErrListEmpty
 	}
 
 	// get first element and remove it
@@ -144,13 +160,14 @@ func (db *FlexDB) LPop(key string) (string, error) {
 	}
 
 	// Log AOF if enabled
-	if db.aof != nil && db.aof.enabled {
-		if err := db.aof.LogCommand("LPOP", key); err != nil {
+	if db.logging() {
+		if err := db.logCommand("LPOP", key); err != nil {
 			fmt.Printf("Error logging to AOF: %v\n", err)
 		}
 	}
 
-	db.triggerWrite()
+	db.touch(key)
+	db.triggerWrite(key)
 	return item, nil
 }
 
@@ -159,24 +176,24 @@ func (db *FlexDB) RPop(key string) (string, error) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 	if !exists {
-		return "", errors.New("key not found")
+		return "", ErrKeyNotFound
 	}
 
 	// check if key has expired
-	if val.Expiration != nil && time.Now().After(*val.Expiration) {
-		delete(db.data, key)
-		return "", errors.New("key not found")
+	if val.Expiration != nil && db.now().After(*val.Expiration) {
+		db.expireKeys(key)
+		return "", ErrKeyNotFound
 	}
 
 	if val.Type != TypeList {
-		return "", errors.New("value is not a list")
+		return "", ErrWrongType
 	}
 
 	list := val.Data.([]string)
 	if len(list) == 0 {
-		return "", errors.New("list is empty")
+		return "", ErrListEmpty
 	}
 
 	// get last element and remove it
@@ -193,13 +210,14 @@ func (db *FlexDB) RPop(key string) (string, error) {
 	}
 
 	// Log AOF if enabled
-	if db.aof != nil && db.aof.enabled {
-		if err := db.aof.LogCommand("RPOP", key); err != nil {
+	if db.logging() {
+		if err := db.logCommand("RPOP", key); err != nil {
 			fmt.Printf("Error logging to AOF: %v\n", err)
 		}
 	}
 
-	db.triggerWrite()
+	db.touch(key)
+	db.triggerWrite(key)
 	return item, nil
 }
 
@@ -208,18 +226,18 @@ func (db *FlexDB) LRange(key string, start, stop int) ([]string, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 	if !exists {
 		return []string{}, nil // Redis returns empty list if key doesn't exist
 	}
 
 	// check if key has expired
-	if val.Expiration != nil && time.Now().After(*val.Expiration) {
+	if val.Expiration != nil && db.now().After(*val.Expiration) {
 		return []string{}, nil
 	}
 
 	if val.Type != TypeList {
-		return nil, errors.New("value is not a list")
+		return nil, ErrWrongType
 	}
 
 	list := val.Data.([]string)
@@ -246,6 +264,7 @@ func (db *FlexDB) LRange(key string, start, stop int) ([]string, error) {
 		return []string{}, nil
 	}
 
+	db.touch(key)
 	return list[start : stop+1], nil
 }
 
@@ -254,21 +273,22 @@ func (db *FlexDB) LLen(key string) (int, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 	if !exists {
 		return 0, nil // Redis returns 0 if key doesn't exist
 	}
 
 	// check if key has expired
-	if val.Expiration != nil && time.Now().After(*val.Expiration) {
+	if val.Expiration != nil && db.now().After(*val.Expiration) {
 		return 0, nil
 	}
 
 	if val.Type != TypeList {
-		return 0, errors.New("value is not a list")
+		return 0, ErrWrongType
 	}
 
 	list := val.Data.([]string)
+	db.touch(key)
 	return len(list), nil
 }
 
@@ -277,18 +297,18 @@ func (db *FlexDB) LIndex(key string, index int) (string, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 	if !exists {
-		return "", errors.New("key not found")
+		return "", ErrKeyNotFound
 	}
 
 	// check if key has expired
-	if val.Expiration != nil && time.Now().After(*val.Expiration) {
-		return "", errors.New("key not found")
+	if val.Expiration != nil && db.now().After(*val.Expiration) {
+		return "", ErrKeyNotFound
 	}
 
 	if val.Type != TypeList {
-		return "", errors.New("value is not a list")
+		return "", ErrWrongType
 	}
 
 	list := val.Data.([]string)
@@ -301,29 +321,34 @@ func (db *FlexDB) LIndex(key string, index int) (string, error) {
 
 	// boundary check
 	if index < 0 || index >= length {
-		return "", errors.New("index out of range")
+		return "", ErrIndexOutOfRange
 	}
 
+	db.touch(key)
 	return list[index], nil
 }
 
 // LSet sets the value of an element in a list by its index
 func (db *FlexDB) LSet(key string, index int, value string) error {
+	if err := db.checkValues(value); err != nil {
+		return err
+	}
+
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 	if !exists {
-		return errors.New("key not found")
+		return ErrKeyNotFound
 	}
 
 	// check if key has expired
-	if val.Expiration != nil && time.Now().After(*val.Expiration) {
-		return errors.New("key not found")
+	if val.Expiration != nil && db.now().After(*val.Expiration) {
+		return ErrKeyNotFound
 	}
 
 	if val.Type != TypeList {
-		return errors.New("value is not a list")
+		return ErrWrongType
 	}
 
 	list := val.Data.([]string)
@@ -336,7 +361,7 @@ func (db *FlexDB) LSet(key string, index int, value string) error {
 
 	// boundary check
 	if index < 0 || index >= length {
-		return errors.New("index out of range")
+		return ErrIndexOutOfRange
 	}
 
 	// set the value
@@ -345,33 +370,176 @@ func (db *FlexDB) LSet(key string, index int, value string) error {
 	db.data[key] = val
 
 	// Log AOF if enabled
-	if db.aof != nil && db.aof.enabled {
-		if err := db.aof.LogCommand("LSET", key, fmt.Sprintf("%d", index), value); err != nil {
+	if db.logging() {
+		if err := db.logCommand("LSET", key, fmt.Sprintf("%d", index), value); err != nil {
 			fmt.Printf("Error logging to AOF: %v\n", err)
 		}
 	}
 
-	db.triggerWrite()
+	db.touch(key)
+	db.triggerWrite(key)
 	return nil
 }
 
+// LInsert inserts value before or after the first element of a list
+// equal to pivot. It returns the new length of the list, -1 if pivot
+// isn't in it, or 0 if the key doesn't exist.
+func (db *FlexDB) LInsert(key string, before bool, pivot, value string) (int, error) {
+	if err := db.checkValues(value); err != nil {
+		return 0, err
+	}
+
+	length := 0
+	err := db.Update(func(tx *Txn) error {
+		val, ok := tx.Get(key)
+		if !ok {
+			return nil
+		}
+		if val.Type != TypeList {
+			return ErrWrongType
+		}
+
+		list := val.Data.([]string)
+		at := -1
+		for i, elem := range list {
+			if elem == pivot {
+				at = i
+				break
+			}
+		}
+		if at < 0 {
+			length = -1
+			return nil
+		}
+		if err := db.checkElements(len(list) + 1); err != nil {
+			return err
+		}
+
+		where := "BEFORE"
+		if !before {
+			at++
+			where = "AFTER"
+		}
+		list = append(list, "")
+		copy(list[at+1:], list[at:])
+		list[at] = value
+		val.Data = list
+		tx.Put(key, val)
+		tx.Log("LINSERT", key, where, pivot, value)
+		length = len(list)
+		return nil
+	})
+	return length, err
+}
+
+// LMove atomically pops an element from the head (fromLeft) or tail of
+// the list at src and pushes it to the head (toLeft) or tail of the list
+// at dst, returning the element. It returns false if src is missing. src
+// and dst may be the same list, which rotates it.
+func (db *FlexDB) LMove(src, dst string, fromLeft, toLeft bool) (string, bool, error) {
+	if err := db.checkKey(dst); err != nil {
+		return "", false, err
+	}
+
+	var elem string
+	moved := false
+	err := db.Update(func(tx *Txn) error {
+		srcVal, ok := tx.Get(src)
+		if !ok {
+			return nil
+		}
+		dstVal, dstExists := tx.Get(dst)
+		if srcVal.Type != TypeList || (dstExists && dstVal.Type != TypeList) {
+			return ErrWrongType
+		}
+		if dstExists && src != dst {
+			if err := db.checkElements(len(dstVal.Data.([]string)) + 1); err != nil {
+				return err
+			}
+		}
+
+		list := srcVal.Data.([]string)
+		if fromLeft {
+			elem, list = list[0], list[1:]
+		} else {
+			elem, list = list[len(list)-1], list[:len(list)-1]
+		}
+
+		var target []string
+		switch {
+		case src == dst:
+			// a rotation, which never empties the list
+			dstVal, target = srcVal, list
+		case len(list) == 0:
+			tx.Delete(src)
+		default:
+			srcVal.Data = list
+			tx.Put(src, srcVal)
+		}
+		if src != dst {
+			if dstExists {
+				target = dstVal.Data.([]string)
+			} else {
+				dstVal = Value{Type: TypeList}
+			}
+		}
+		if toLeft {
+			target = append([]string{elem}, target...)
+		} else {
+			target = append(target, elem)
+		}
+		dstVal.Data = target
+		tx.Put(dst, dstVal)
+
+		tx.Log("LMOVE", src, dst, listEnd(fromLeft), listEnd(toLeft))
+		moved = true
+		return nil
+	})
+	if moved {
+		db.signalKey(dst)
+	}
+	return elem, moved, err
+}
+
+// LMoveWait is LMove waiting for an element to be pushed to src when it
+// is missing. It returns ctx's error when ctx ends first, and
+// ErrShuttingDown when the database shuts down.
+func (db *FlexDB) LMoveWait(ctx context.Context, src, dst string, fromLeft, toLeft bool) (string, error) {
+	var elem string
+	err := db.blockOn(ctx, src, func() (bool, time.Time, error) {
+		var moved bool
+		var err error
+		elem, moved, err = db.LMove(src, dst, fromLeft, toLeft)
+		return moved, time.Time{}, err
+	})
+	return elem, err
+}
+
+// listEnd names the end of a list, as in LMOVE
+func listEnd(left bool) string {
+	if left {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
+
 // LRem removes elements from a list
 func (db *FlexDB) LRem(key string, count int, value string) (int, error) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 	if !exists {
 		return 0, nil // Redis returns 0 if key doesn't exist
 	}
 
 	// check if key has expired
-	if val.Expiration != nil && time.Now().After(*val.Expiration) {
+	if val.Expiration != nil && db.now().After(*val.Expiration) {
 		return 0, nil
 	}
 
 	if val.Type != TypeList {
-		return 0, errors.New("value is not a list")
+		return 0, ErrWrongType
 	}
 
 	list := val.Data.([]string)
@@ -409,15 +577,17 @@ func (db *FlexDB) LRem(key string, count int, value string) (int, error) {
 		db.data[key] = val
 	}
 
+	db.touch(key)
+
 	// Log AOF if enabled and elements were removed
-	if removed > 0 && db.aof != nil && db.aof.enabled {
-		if err := db.aof.LogCommand("LREM", key, fmt.Sprintf("%d", count), value); err != nil {
+	if removed > 0 && db.logging() {
+		if err := db.logCommand("LREM", key, fmt.Sprintf("%d", count), value); err != nil {
 			fmt.Printf("Error logging to AOF: %v\n", err)
 		}
 	}
 
 	if removed > 0 {
-		db.triggerWrite()
+		db.triggerWrite(key)
 	}
 
 	return removed, nil
@@ -428,19 +598,19 @@ func (db *FlexDB) LTrim(key string, start, stop int) error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
-	val, exists := db.data[key]
+	val, exists := db.lookup(key)
 	if !exists {
 		return nil // Redis returns OK if key doesn't exist
 	}
 
 	// check if key has expired
-	if val.Expiration != nil && time.Now().After(*val.Expiration) {
-		delete(db.data, key)
+	if val.Expiration != nil && db.now().After(*val.Expiration) {
+		db.expireKeys(key)
 		return nil
 	}
 
 	if val.Type != TypeList {
-		return errors.New("value is not a list")
+		return ErrWrongType
 	}
 
 	list := val.Data.([]string)
@@ -474,12 +644,13 @@ func (db *FlexDB) LTrim(key string, start, stop int) error {
 	}
 
 	// Log AOF if enabled
-	if db.aof != nil && db.aof.enabled {
-		if err := db.aof.LogCommand("LTRIM", key, fmt.Sprintf("%d", start), fmt.Sprintf("%d", stop)); err != nil {
+	if db.logging() {
+		if err := db.logCommand("LTRIM", key, fmt.Sprintf("%d", start), fmt.Sprintf("%d", stop)); err != nil {
 			fmt.Printf("Error logging to AOF: %v\n", err)
 		}
 	}
 
-	db.triggerWrite()
+	db.touch(key)
+	db.triggerWrite(key)
 	return nil
 }
@@ -0,0 +1,268 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrLoadAborted is returned when Shutdown interrupts a background load
+var ErrLoadAborted = errors.New("loading aborted by shutdown")
+
+// loadProgressInterval is how often progress is logged during a load
+const loadProgressInterval = time.Second
+
+// loadState tracks the startup load of the snapshot and the AOF
+type loadState struct {
+	done chan struct{} // closed once loading finished, successfully or not
+	err  error         // set before done is closed
+
+	mu         sync.Mutex
+	phase      string // "snapshot" or "aof"
+	started    time.Time
+	phaseStart time.Time
+	bytesDone  int64
+	bytesTotal int64
+	keys       int64 // entries read in the current phase
+	duration   time.Duration
+}
+
+// LoadProgress describes a load in progress
+type LoadProgress struct {
+	Loading    bool
+	Phase      string // "snapshot" or "aof"
+	Started    time.Time
+	BytesDone  int64
+	BytesTotal int64
+	Keys       int64         // entries read in the current phase
+	Duration   time.Duration // how long the finished load took
+}
+
+// Percent returns how much of the current file has been read
+func (p LoadProgress) Percent() float64 {
+	if p.BytesTotal <= 0 {
+		return 0
+	}
+	return float64(p.BytesDone) * 100 / float64(p.BytesTotal)
+}
+
+// ETA estimates the time left in the current phase
+func (p LoadProgress) ETA() time.Duration {
+	elapsed := time.Since(p.Started)
+	if p.BytesDone <= 0 || elapsed <= 0 {
+		return 0
+	}
+	rate := float64(p.BytesDone) / elapsed.Seconds()
+	return time.Duration(float64(p.BytesTotal-p.BytesDone) / rate * float64(time.Second))
+}
+
+// WithBackgroundLoad makes NewFlexDB return before the snapshot and AOF
+// are loaded, so the server can accept connections and answer them with
+// a LOADING error instead of being unreachable during a long load.
+func WithBackgroundLoad() Option {
+	return func(db *FlexDB) {
+		db.backgroundLoad = true
+	}
+}
+
+// begin starts a load phase over a file of total bytes
+func (l *loadState) begin(phase string, total int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.phase = phase
+	l.phaseStart = time.Now()
+	l.bytesDone = 0
+	l.bytesTotal = total
+	l.keys = 0
+}
+
+// advance records one more entry read, up to offset bytes into the file.
+// It returns ErrLoadAborted once stop is closed.
+func (l *loadState) advance(offset int64, stop <-chan struct{}) error {
+	l.mu.Lock()
+	l.bytesDone = offset
+	l.keys++
+	keys := l.keys
+	l.mu.Unlock()
+
+	if keys%1024 == 0 {
+		select {
+		case <-stop:
+			return ErrLoadAborted
+		default:
+		}
+	}
+	return nil
+}
+
+// progress returns a copy of the load state
+func (l *loadState) progress() LoadProgress {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return LoadProgress{
+		Phase:      l.phase,
+		Started:    l.phaseStart,
+		BytesDone:  l.bytesDone,
+		BytesTotal: l.bytesTotal,
+		Keys:       l.keys,
+		Duration:   l.duration,
+	}
+}
+
+// logProgress prints the load progress every loadProgressInterval until
+// done is closed
+func (l *loadState) logProgress(done <-chan struct{}) {
+	ticker := time.NewTicker(loadProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		p := l.progress()
+		rate := float64(p.Keys) / time.Since(p.Started).Seconds()
+		fmt.Printf("Loading %s: %.1f%% (%d entries, %.0f entries/sec, about %s left)\n",
+			p.Phase, p.Percent(), p.Keys, rate, p.ETA().Round(time.Second))
+	}
+}
+
+// loadAll loads the snapshot and the AOF, then rewrites the AOFs that
+// need it
+func (db *FlexDB) loadAll() error {
+	if err := db.loadFiles(); err != nil {
+		return err
+	}
+	return db.rebaseAOFs()
+}
+
+// loadFiles loads the snapshot, then replays the AOF over it, holding the
+// keyspace lock throughout
+func (db *FlexDB) loadFiles() error {
+	db.loading.mu.Lock()
+	db.loading.started = time.Now()
+	db.loading.mu.Unlock()
+
+	logged := make(chan struct{})
+	defer close(logged)
+	go db.loading.logProgress(logged)
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	// Load data from JSON first -> snapshot loads faster
+	for _, target := range db.snapshotTargets() {
+		if err := db.load(target.file); err != nil {
+			return err
+		}
+	}
+
+	// if AOF is enabled and exists, replay it to get the latest state
+	for _, aof := range db.aofs() {
+		if !aof.enabled {
+			continue
+		}
+		if err := aof.LoadAOF(); err != nil {
+			// a damaged AOF stops the load like an unreadable snapshot,
+			// or later writes would be appended after the damage
+			// so does any failure while recovering to a point in time
+			var damage *AOFError
+			if errors.Is(err, ErrLoadAborted) || errors.As(err, &damage) || !db.recoverTo.IsZero() {
+				return err
+			}
+			fmt.Printf("Error loading AOF %s: %v\n", aof.filePath, err)
+			continue
+		}
+		if !aof.base {
+			aof.rebase = true
+		}
+	}
+
+	db.loading.mu.Lock()
+	db.loading.duration = time.Since(db.loading.started)
+	elapsed := db.loading.duration
+	db.loading.mu.Unlock()
+	fmt.Printf("Loaded %d keys in %s\n", len(db.data), elapsed.Round(time.Millisecond))
+	return nil
+}
+
+// Loading reports whether the snapshot and AOF are still being loaded
+func (db *FlexDB) Loading() bool {
+	select {
+	case <-db.loading.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Loaded returns a channel that is closed once loading finished. Check
+// LoadError afterwards to know whether it succeeded.
+func (db *FlexDB) Loaded() <-chan struct{} {
+	return db.loading.done
+}
+
+// LoadError returns why loading failed, or nil. It is only meaningful
+// once Loaded is closed.
+func (db *FlexDB) LoadError() error {
+	select {
+	case <-db.loading.done:
+		return db.loading.err
+	default:
+		return nil
+	}
+}
+
+// loadSucceeded reports whether loading finished without error
+func (db *FlexDB) loadSucceeded() bool {
+	select {
+	case <-db.loading.done:
+		return db.loading.err == nil
+	default:
+		return false
+	}
+}
+
+// LoadProgress reports how far loading has got
+func (db *FlexDB) LoadProgress() LoadProgress {
+	p := db.loading.progress()
+	p.Loading = db.Loading()
+	return p
+}
+
+// rebaseAOFs rewrites the AOFs loaded without a BASE, which rely on the
+// snapshot for what they don't log, so each is whole on its own. AOFs
+// recovered to a point in time must be rewritten, or the commands left
+// out would be replayed again on the next start, and the snapshot is
+// saved too.
+func (db *FlexDB) rebaseAOFs() error {
+	for _, aof := range db.aofs() {
+		if !aof.rebase {
+			continue
+		}
+		if err := aof.RewriteAOF(); err != nil {
+			if db.recovered {
+				return err
+			}
+			fmt.Printf("Error rewriting AOF %s: %v\n", aof.filePath, err)
+		}
+	}
+	if !db.recovered {
+		return nil
+	}
+
+	// save refuses to until the load is finished
+	db.saveMu.Lock()
+	defer db.saveMu.Unlock()
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	for _, target := range db.snapshotTargets() {
+		if _, err := db.saveTarget(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
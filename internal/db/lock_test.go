@@ -0,0 +1,73 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	db := newTestDB(t)
+	if ok, err := db.Lock("l", "a", time.Minute); err != nil || !ok {
+		t.Fatalf("Lock: %v, %v", ok, err)
+	}
+	if ok, _ := db.Lock("l", "b", time.Minute); ok {
+		t.Error("Lock acquired a held lock")
+	}
+	if ok, _ := db.Unlock("l", "b"); ok {
+		t.Error("Unlock released a lock owned by another token")
+	}
+	if ok, _ := db.ExtendLock("l", "b", time.Hour); ok {
+		t.Error("ExtendLock extended a lock owned by another token")
+	}
+	if ok, _ := db.ExtendLock("l", "a", time.Hour); !ok {
+		t.Error("ExtendLock didn't extend the owner's lock")
+	}
+	if ttl, _ := db.TTL("l"); ttl <= time.Minute {
+		t.Errorf("TTL after ExtendLock: %v", ttl)
+	}
+	if ok, _ := db.Unlock("l", "a"); !ok {
+		t.Error("Unlock didn't release the owner's lock")
+	}
+	if ok, _ := db.Lock("l", "b", time.Minute); !ok {
+		t.Error("Lock didn't acquire a released lock")
+	}
+}
+
+func TestAcquireLock(t *testing.T) {
+	db := newTestDB(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	token, err := db.AcquireLock(ctx, "l", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := db.Get("l"); owner != token {
+		t.Errorf("lock owner %v, want %s", owner, token)
+	}
+	if _, err := db.AcquireLock(ctx, "l", time.Minute); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("AcquireLock on a held lock: %v", err)
+	}
+}
+
+func TestLockReplay(t *testing.T) {
+	dir := t.TempDir()
+	aof := WithAOF(filepath.Join(dir, "flex.aof"), AOFSyncAlways)
+	db := openTestDB(t, filepath.Join(dir, "first.db"), aof)
+	if ok, err := db.Lock("l", "a", 1500*time.Millisecond); err != nil || !ok {
+		t.Fatalf("Lock: %v, %v", ok, err)
+	}
+	db.Close()
+
+	// a new snapshot file leaves the AOF alone to restore the lock
+	db = openTestDB(t, filepath.Join(dir, "second.db"), aof)
+	if owner, _ := db.Get("l"); owner != "a" {
+		t.Errorf("lock owner after replay %v, want a", owner)
+	}
+	if ttl, err := db.TTL("l"); err != nil || ttl <= 0 || ttl > 2*time.Second {
+		t.Errorf("lock TTL after replay %v, %v", ttl, err)
+	}
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrLockHeld is returned by AcquireLock when ctx ends before the lock is free
+var ErrLockHeld = errors.New("lock is held by another owner")
+
+// Locks are plain string keys holding their owner's token, with the lock
+// TTL as expiration. Acquiring is SET NX with a TTL and releasing or
+// extending only succeeds with the token that acquired the lock, the usual
+// single-instance pattern done under the keyspace lock so clients can't
+// get the check-and-act wrong.
+
+// lockRetryInterval is how often AcquireLock retries a held lock
+const lockRetryInterval = 50 * time.Millisecond
+
+// NewLockToken returns a random lock token
+func NewLockToken() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic("flexdb: no randomness for lock tokens: " + err.Error())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Lock acquires the lock called key for ttl if nobody holds it, storing
+// token as its owner. It reports whether the lock was acquired.
+func (db *FlexDB) Lock(key, token string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, fmt.Errorf("lock TTL must be positive")
+	}
+	if err := db.checkKey(key); err != nil {
+		return false, err
+	}
+	if err := db.checkValues(token); err != nil {
+		return false, err
+	}
+
+	acquired := false
+	err := db.Update(func(tx *Txn) error {
+		if _, held := tx.Get(key); held {
+			return nil
+		}
+		exp := time.Now().Add(ttl)
+		tx.Put(key, Value{Type: TypeString, Data: token, Expiration: &exp})
+		tx.Log("SET", key, token, "PXAT", unixMillis(exp))
+		acquired = true
+		return nil
+	})
+	return acquired, err
+}
+
+// Unlock releases the lock called key if token owns it, and reports
+// whether it did
+func (db *FlexDB) Unlock(key, token string) (bool, error) {
+	released := false
+	err := db.Update(func(tx *Txn) error {
+		owned, err := ownsLock(tx, key, token)
+		if err != nil || !owned {
+			return err
+		}
+		tx.Delete(key)
+		tx.Log("DEL", key)
+		released = true
+		return nil
+	})
+	return released, err
+}
+
+// ExtendLock resets the TTL of the lock called key to ttl if token owns
+// it, and reports whether it did
+func (db *FlexDB) ExtendLock(key, token string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, fmt.Errorf("lock TTL must be positive")
+	}
+
+	extended := false
+	err := db.Update(func(tx *Txn) error {
+		owned, err := ownsLock(tx, key, token)
+		if err != nil || !owned {
+			return err
+		}
+		val, _ := tx.Get(key)
+		exp := time.Now().Add(ttl)
+		val.Expiration = &exp
+		tx.Put(key, val)
+		tx.Log("PEXPIREAT", key, unixMillis(exp))
+		extended = true
+		return nil
+	})
+	return extended, err
+}
+
+// ownsLock reports whether key is a live lock held by token
+func ownsLock(tx *Txn, key, token string) (bool, error) {
+	val, ok := tx.Get(key)
+	if !ok {
+		return false, nil
+	}
+	owner, ok := stringData(val.Data)
+	if !ok {
+		return false, ErrWrongType
+	}
+	return owner == token, nil
+}
+
+// AcquireLock waits until it gets the lock called key for ttl, retrying
+// until ctx is done, and returns the token that owns it. Release it with
+// Unlock and keep it with ExtendLock.
+func (db *FlexDB) AcquireLock(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	token := NewLockToken()
+	ticker := time.NewTicker(lockRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		acquired, err := db.Lock(key, token, ttl)
+		if err != nil {
+			return "", err
+		}
+		if acquired {
+			return token, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("%w: %v", ErrLockHeld, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"runtime"
+	"sync"
+)
+
+// snapshotBatchSize is how many keys a snapshot worker handles at once
+const snapshotBatchSize = 1024
+
+// WithSnapshotWorkers sets how many goroutines encode the snapshot on save
+// and decode it on load. Zero, the default, uses one per CPU.
+func WithSnapshotWorkers(n int) Option {
+	return func(db *FlexDB) {
+		db.snapshotWorkers = n
+	}
+}
+
+// workerCount returns the number of snapshot workers to run
+func (db *FlexDB) workerCount() int {
+	if db.snapshotWorkers > 0 {
+		return db.snapshotWorkers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// pipeline runs work over batches on several goroutines while keeping
+// their order: produce emits batches, and consume receives the results in
+// the order they were emitted. emit returns false once the pipeline is
+// stopping, and produce should then return. The first error returned by
+// produce or consume stops the pipeline and is returned.
+//
+// At most twice as many batches as workers are in flight, which bounds
+// the memory the pipeline holds.
+func pipeline[In, Out any](workers int, produce func(emit func(In) bool) error, work func(In) Out, consume func(Out) error) error {
+	type job struct {
+		in  In
+		out chan Out
+	}
+
+	jobs := make(chan job)
+	ordered := make(chan chan Out, workers*2)
+	quit := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				j.out <- work(j.in)
+			}
+		}()
+	}
+
+	var produceErr error
+	go func() {
+		defer close(ordered)
+		defer close(jobs)
+		produceErr = produce(func(in In) bool {
+			j := job{in: in, out: make(chan Out, 1)}
+			select {
+			case ordered <- j.out:
+			case <-quit:
+				return false
+			}
+			select {
+			case jobs <- j:
+				return true
+			case <-quit:
+				return false
+			}
+		})
+	}()
+
+	var err error
+	for out := range ordered {
+		if err != nil {
+			// drain so the producer can finish
+			continue
+		}
+		if err = consume(<-out); err != nil {
+			close(quit)
+		}
+	}
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+	return produceErr
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Partition gives the keys starting with Prefix their own persistence, so
+// one instance can hold data with different durability needs, such as
+// sessions on an always synced AOF next to a cache that is never saved.
+// Keys outside every partition use the main snapshot and AOF.
+type Partition struct {
+	Prefix   string
+	Snapshot string // snapshot file, empty to never snapshot these keys
+	AOF      string // AOF file, empty to not log these keys
+	AOFSync  AOFSyncPolicy
+}
+
+// partition is a configured Partition with its open AOF
+type partition struct {
+	Partition
+	aof *AOFPersistence // nil without an AOF
+}
+
+// WithPartition routes the keys starting with p.Prefix to p's snapshot and
+// AOF instead of the main ones. When prefixes overlap, the longest wins.
+// Keys found in another partition's files on load are moved to the right
+// files by the next snapshot and AOF rewrite.
+func WithPartition(p Partition) Option {
+	return func(db *FlexDB) {
+		part := &partition{Partition: p}
+		if p.AOF != "" {
+			aof, err := NewAOFPersistence(db, p.AOF, p.AOFSync)
+			if err != nil {
+				fmt.Printf("Failed to initialize AOF for partition %q: %v\n", p.Prefix, err)
+			} else {
+				part.aof = aof
+			}
+		}
+		db.partitions = append(db.partitions, part)
+	}
+}
+
+// partitionOf returns the partition a key belongs to, or nil for keys
+// persisted by the main snapshot and AOF
+func (db *FlexDB) partitionOf(key string) *partition {
+	var found *partition
+	for _, p := range db.partitions {
+		if strings.HasPrefix(key, p.Prefix) && (found == nil || len(p.Prefix) > len(found.Prefix)) {
+			found = p
+		}
+	}
+	return found
+}
+
+// snapshotTarget is a snapshot file and the partition whose keys it holds
+type snapshotTarget struct {
+	file string
+	part *partition // nil for the main snapshot
+}
+
+// snapshotTargets returns the snapshot files to write, the main one first
+func (db *FlexDB) snapshotTargets() []snapshotTarget {
+	targets := []snapshotTarget{{file: db.file}}
+	for _, p := range db.partitions {
+		if p.Snapshot != "" {
+			targets = append(targets, snapshotTarget{file: p.Snapshot, part: p})
+		}
+	}
+	return targets
+}
+
+// aofFor returns the AOF logging a key, or nil if the key isn't logged
+func (db *FlexDB) aofFor(key string) *AOFPersistence {
+	if p := db.partitionOf(key); p != nil {
+		return p.aof
+	}
+	return db.aof
+}
+
+// aofs returns every open AOF, the main one first
+func (db *FlexDB) aofs() []*AOFPersistence {
+	var all []*AOFPersistence
+	if db.aof != nil {
+		all = append(all, db.aof)
+	}
+	for _, p := range db.partitions {
+		if p.aof != nil {
+			all = append(all, p.aof)
+		}
+	}
+	return all
+}
+
+// logging reports whether commands are logged, to an AOF or to the
+// replication stream
+func (db *FlexDB) logging() bool {
+	return db.aofEnabled() || db.repl.recording()
+}
+
+// aofEnabled reports whether any AOF is logging commands
+func (db *FlexDB) aofEnabled() bool {
+	for _, aof := range db.aofs() {
+		if aof.enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// logCommand appends a command to the replication stream and to the AOF
+// of the keys it changes. Callers hold the keyspace lock.
+func (db *FlexDB) logCommand(cmd string, args ...string) error {
+	db.feedReplicas(cmd, args)
+	return db.logToAOF(cmd, args...)
+}
+
+// logToAOF appends a command to the AOF of the keys it changes. Most
+// commands change the key in their first argument. A multi-key DEL is
+// split across the AOFs of its keys and FLUSHALL goes to every AOF.
+func (db *FlexDB) logToAOF(cmd string, args ...string) error {
+	switch {
+	case len(db.partitions) == 0:
+		return db.logTo(db.aof, cmd, args...)
+	case cmd == "FLUSHALL" || len(args) == 0:
+		var firstErr error
+		for _, aof := range db.aofs() {
+			if err := aof.LogCommand(cmd, args...); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	case cmd == "DEL":
+		var order []*AOFPersistence
+		keys := make(map[*AOFPersistence][]string)
+		for _, key := range args {
+			aof := db.aofFor(key)
+			if aof == nil {
+				continue
+			}
+			if _, ok := keys[aof]; !ok {
+				order = append(order, aof)
+			}
+			keys[aof] = append(keys[aof], key)
+		}
+		var firstErr error
+		for _, aof := range order {
+			if err := aof.LogCommand(cmd, keys[aof]...); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	default:
+		return db.logTo(db.aofFor(args[0]), cmd, args...)
+	}
+}
+
+// logTo appends a command changing the key in its first argument to aof,
+// which may be nil. Commands on encrypted keys are logged encrypted.
+func (db *FlexDB) logTo(aof *AOFPersistence, cmd string, args ...string) error {
+	if aof == nil {
+		return nil
+	}
+	if len(args) > 0 && db.encrypted(args[0]) {
+		cmd, args = db.sealCommand(args[0], cmd, args)
+	}
+	return aof.LogCommand(cmd, args...)
+}
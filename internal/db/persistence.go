@@ -1,6 +1,7 @@
 package db
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,127 +11,777 @@ import (
 
 // PersistentValue is used for serialization
 type PersistentValue struct {
-	Type       ValueType   `json:"type"`
-	Data       interface{} `json:"data"`
-	Expiration int64       `json:"exp,omitempty"` // Unix timestamp
+	Type        ValueType          `json:"type"`
+	Data        interface{}        `json:"data"`
+	Encoding    string             `json:"enc,omitempty"`   // "deflate" or "chunked" for large strings, "aes-gcm" for encrypted values
+	KeyID       string             `json:"kid,omitempty"`   // encryption key of an encrypted value
+	Expiration  int64              `json:"exp,omitempty"`   // Unix timestamp, only in snapshots written before pexp
+	PExpiration int64              `json:"pexp,omitempty"`  // Unix timestamp in milliseconds
+	LastAccess  int64              `json:"atime,omitempty"` // Unix timestamp, only with access tracking
+	History     []persistedVersion `json:"hist,omitempty"`  // recent versions, only with key history
+	Tags        []string           `json:"tags,omitempty"`
 }
 
-// load reads data from the file into memory
-func (db *FlexDB) load() {
-	db.lock.Lock()
-	defer db.lock.Unlock()
+// Snapshot encodings of string values that are not stored as plain strings
+const (
+	// encodingDeflate marks a base64 encoded DEFLATE stream
+	encodingDeflate = "deflate"
+	// encodingChunked marks an array of base64 encoded chunks. Chunks may
+	// split multi-byte characters, so they can't be stored as JSON strings.
+	encodingChunked = "chunked"
+)
+
+// persistentData returns what the snapshot stores for a value. Compressed
+// strings stay compressed; encoding/json base64 encodes the bytes.
+func persistentData(v Value) interface{} {
+	switch data := v.Data.(type) {
+	case *compressedString:
+		return data.data
+	case *chunkedString:
+		return data.chunks
+	case *sortedSet:
+		return data.persisted()
+	case *priorityQueue:
+		return data.persisted()
+	case stringSet:
+		return data.members()
+	case *timeSeries:
+		return data.persisted()
+	case *jobQueue:
+		return data.persisted()
+	default:
+		return v.Data
+	}
+}
+
+// persistentEncoding returns the snapshot encoding of a value
+func persistentEncoding(v Value) string {
+	switch v.Data.(type) {
+	case *compressedString:
+		return encodingDeflate
+	case *chunkedString:
+		return encodingChunked
+	default:
+		return ""
+	}
+}
+
+// rawEntry is a snapshot entry waiting to be decoded
+type rawEntry struct {
+	key  string
+	data json.RawMessage
+}
+
+// loadedEntry is a decoded snapshot entry, ready to be stored
+type loadedEntry struct {
+	key        string
+	value      Value
+	encoding   string          // snapshot encoding of raw
+	raw        json.RawMessage // undecoded data to spill, see WithLazyValues
+	lastAccess int64
+	history    []persistedVersion
+	tags       []string
+}
 
-	file, err := os.Open(db.file)
+// loadedBatch holds the decoded entries of a batch, or why it failed
+type loadedBatch struct {
+	entries []loadedEntry
+	err     error
+}
+
+// load streams a snapshot file into memory, reporting progress as it goes.
+// A gzip compressed file is decompressed as it's read, and a file with a
+// header is checked against its checksum once read, then its journal is
+// replayed. The file is split into entries on one goroutine and the
+// entries are decoded by the snapshot workers.
+// A missing file is an empty database; any other failure is returned so a
+// snapshot that can't be read is never overwritten with an empty one.
+// Callers hold the keyspace lock.
+func (db *FlexDB) load(path string) error {
+	file, err := os.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return
+			return nil
 		}
-		return
+		return fmt.Errorf("failed to open snapshot: %w", err)
 	}
 	defer file.Close()
 
-	bytes, err := io.ReadAll(file)
-	if err != nil {
-		return
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
 	}
+	db.loading.begin("snapshot", size)
 
-	// Temporary map for deserialization
-	tempData := make(map[string]PersistentValue)
-	if err := json.Unmarshal(bytes, &tempData); err != nil {
-		return
+	// progress is counted in file bytes, which differ from what the
+	// decoder reads if the snapshot is compressed
+	counter := &countingReader{r: file}
+	input, err := decompressed(bufio.NewReaderSize(counter, 64*1024))
+	if err != nil {
+		return fmt.Errorf("failed to decompress snapshot %s: %w", path, err)
+	}
+	check := newChecksumReader(input)
+	body := bufio.NewReader(check)
+	versioned, err := readSnapshotHeader(body)
+	if err != nil {
+		return fmt.Errorf("failed to parse snapshot %s: %w", path, err)
+	}
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return fmt.Errorf("failed to parse snapshot %s: not a JSON object", path)
 	}
 
-	// Convert to runtime format
 	now := time.Now()
-	for k, v := range tempData {
-		var exp *time.Time
-		if v.Expiration > 0 {
-			t := time.Unix(v.Expiration, 0)
-			exp = &t
-			// Skip expired keys
-			if now.After(t) {
-				continue
+
+	produce := func(emit func([]rawEntry) bool) error {
+		batch := make([]rawEntry, 0, snapshotBatchSize)
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return fmt.Errorf("failed to parse snapshot %s: %w", path, err)
+			}
+			key, _ := tok.(string)
+
+			var data json.RawMessage
+			if err := dec.Decode(&data); err != nil {
+				return fmt.Errorf("failed to parse snapshot %s at key %q: %w", path, key, err)
+			}
+			batch = append(batch, rawEntry{key: key, data: data})
+
+			if err := db.loading.advance(counter.n, db.stop); err != nil {
+				return err
+			}
+			if len(batch) == snapshotBatchSize {
+				if !emit(batch) {
+					return nil
+				}
+				batch = make([]rawEntry, 0, snapshotBatchSize)
 			}
 		}
+		if _, err := dec.Token(); err != nil {
+			return fmt.Errorf("failed to parse snapshot %s: %w", path, err)
+		}
+		if len(batch) > 0 {
+			emit(batch)
+		}
+		return nil
+	}
 
-		// When unmarshaling the data, we need to handle type conversions
-		switch v.Type {
-		case TypeList:
-			// Convert []interface{} to []string
-			if list, ok := v.Data.([]interface{}); ok {
-				stringList := make([]string, len(list))
-				for i, v := range list {
-					if str, ok := v.(string); ok {
-						stringList[i] = str
-					} else {
-						// Handle non-string values if needed
-						stringList[i] = fmt.Sprintf("%v", v)
-					}
+	decode := func(batch []rawEntry) loadedBatch {
+		entries := make([]loadedEntry, 0, len(batch))
+		for _, raw := range batch {
+			e, ok, err := db.decodeRaw(path, raw.key, raw.data, now)
+			if err != nil {
+				return loadedBatch{err: err}
+			}
+			if ok {
+				entries = append(entries, e)
+			}
+		}
+		return loadedBatch{entries: entries}
+	}
+
+	store := func(batch loadedBatch) error {
+		if batch.err != nil {
+			return batch.err
+		}
+		for _, e := range batch.entries {
+			db.storeLoaded(e)
+		}
+		return nil
+	}
+
+	if err := pipeline(db.workerCount(), produce, decode, store); err != nil {
+		return err
+	}
+	if versioned {
+		if err := check.verify(); err != nil {
+			return fmt.Errorf("snapshot %s is damaged: %w", path, err)
+		}
+		return db.loadJournal(path, check.hash.Sum64(), size)
+	}
+	return nil
+}
+
+// decodeRaw decodes the persisted value of a key read from path. It
+// returns false for keys decodeValue skips.
+func (db *FlexDB) decodeRaw(path, key string, data json.RawMessage, now time.Time) (loadedEntry, bool, error) {
+	if db.lazy != nil && len(data) >= db.lazy.threshold {
+		if e, ok, cold, err := db.decodeCold(path, key, data, now); cold || err != nil {
+			return e, ok, err
+		}
+	}
+
+	var v PersistentValue
+	if err := json.Unmarshal(data, &v); err != nil {
+		return loadedEntry{}, false, fmt.Errorf("failed to parse snapshot %s at key %q: %w", path, key, err)
+	}
+	if v.Encoding == encodingEncrypted {
+		inner, err := db.decryptValue(key, v)
+		if err != nil {
+			return loadedEntry{}, false, fmt.Errorf("failed to decrypt snapshot %s: %w", path, err)
+		}
+		v = inner
+	}
+	value, ok := decodeValue(key, v, now)
+	if !ok {
+		return loadedEntry{}, false, nil
+	}
+	return loadedEntry{key: key, value: value, lastAccess: v.LastAccess, history: v.History, tags: v.Tags}, true, nil
+}
+
+// storeLoaded stores a decoded key. Callers hold the keyspace lock.
+func (db *FlexDB) storeLoaded(e loadedEntry) {
+	if e.raw != nil {
+		value, ok := db.spill(e)
+		if !ok {
+			return
+		}
+		e.value = value
+	}
+	db.data[e.key] = e.value
+	db.indexKey(e.key)
+	if e.lastAccess > 0 {
+		db.restoreAccess(e.key, time.Unix(e.lastAccess, 0))
+	}
+	db.restoreHistory(e.key, e.history)
+	db.restoreTags(e.key, e.tags)
+}
+
+// expirationOf returns the expiration of a snapshot entry, nil if it has
+// none
+func expirationOf(v PersistentValue) *time.Time {
+	if v.PExpiration == 0 && v.Expiration == 0 {
+		return nil
+	}
+	t := time.UnixMilli(v.PExpiration)
+	if v.PExpiration == 0 {
+		t = time.Unix(v.Expiration, 0)
+	}
+	return &t
+}
+
+// decodeValue converts a snapshot entry to its runtime form. It returns
+// false for expired and corrupted entries, which are skipped.
+func decodeValue(k string, v PersistentValue, now time.Time) (Value, bool) {
+	exp := expirationOf(v)
+	// Skip expired keys
+	if exp != nil && now.After(*exp) {
+		return Value{}, false
+	}
+
+	// When unmarshaling the data, we need to handle type conversions
+	switch v.Type {
+	case TypeList:
+		// Convert []interface{} to []string
+		if list, ok := v.Data.([]interface{}); ok {
+			stringList := make([]string, len(list))
+			for i, v := range list {
+				if str, ok := v.(string); ok {
+					stringList[i] = str
+				} else {
+					// Handle non-string values if needed
+					stringList[i] = fmt.Sprintf("%v", v)
 				}
-				v.Data = stringList
-			}
-		case TypeString:
-			// Handle string type
-			if str, ok := v.Data.(string); ok {
-				v.Data = str
-			}
-		case TypeHash:
-			// Handle hash type
-			if hash, ok := v.Data.(map[string]interface{}); ok {
-				stringHash := make(map[string]string)
-				for k, v := range hash {
-					stringHash[k] = fmt.Sprintf("%v", v)
+			}
+			v.Data = stringList
+		}
+	case TypeString:
+		// Handle string type
+		if v.Encoding == encodingChunked {
+			chunked, err := loadChunked(v.Data)
+			if err != nil {
+				fmt.Printf("Skipping key %q with corrupted chunked value: %v\n", k, err)
+				return Value{}, false
+			}
+			v.Data = chunked
+		} else if str, ok := v.Data.(string); ok {
+			v.Data = str
+			if v.Encoding == encodingDeflate {
+				compressed, err := loadCompressed(str)
+				if err != nil {
+					fmt.Printf("Skipping key %q with corrupted compressed value: %v\n", k, err)
+					return Value{}, false
 				}
-				v.Data = stringHash
+				v.Data = compressed
 			}
 		}
-
-		db.data[k] = Value{
-			Type:       v.Type,
-			Data:       v.Data,
-			Expiration: exp,
+	case TypeHash:
+		// Handle hash type
+		if hash, ok := v.Data.(map[string]interface{}); ok {
+			stringHash := make(map[string]string)
+			for k, v := range hash {
+				stringHash[k] = fmt.Sprintf("%v", v)
+			}
+			v.Data = stringHash
 		}
+	case TypeZSet:
+		zset, err := loadSortedSet(v.Data)
+		if err != nil {
+			fmt.Printf("Skipping key %q with corrupted sorted set: %v\n", k, err)
+			return Value{}, false
+		}
+		v.Data = zset
+	case TypePQ:
+		pq, err := loadPriorityQueue(v.Data)
+		if err != nil {
+			fmt.Printf("Skipping key %q with corrupted priority queue: %v\n", k, err)
+			return Value{}, false
+		}
+		v.Data = pq
+	case TypeSet:
+		set, err := loadSet(v.Data)
+		if err != nil {
+			fmt.Printf("Skipping key %q with corrupted set: %v\n", k, err)
+			return Value{}, false
+		}
+		v.Data = set
+	case TypeTimeSeries:
+		ts, err := loadTimeSeries(v.Data)
+		if err != nil {
+			fmt.Printf("Skipping key %q with corrupted time series: %v\n", k, err)
+			return Value{}, false
+		}
+		v.Data = ts
+	case TypeQueue:
+		q, err := loadJobQueue(v.Data)
+		if err != nil {
+			fmt.Printf("Skipping key %q with corrupted job queue: %v\n", k, err)
+			return Value{}, false
+		}
+		v.Data = q
 	}
+
+	return Value{
+		Type:       v.Type,
+		Data:       v.Data,
+		Expiration: exp,
+	}, true
 }
 
-// save writes data to disk
-func (db *FlexDB) save() {
+// save writes data to disk, holding the keyspace lock throughout. The
+// result is recorded for PersistenceError and INFO persistence.
+func (db *FlexDB) save() error {
+	db.saveMu.Lock()
+	defer db.saveMu.Unlock()
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	// Convert to serializable format
-	tempData := make(map[string]PersistentValue)
-	for k, v := range db.data {
-		pv := PersistentValue{
-			Type: v.Type,
-			Data: v.Data,
+	// a partial keyspace must never replace the snapshot
+	if !db.loadSucceeded() {
+		return ErrLoading
+	}
+
+	start := time.Now()
+	changes, since := db.pendingChanges()
+	db.takeDirtyKeys()
+
+	var written int64
+	for _, target := range db.snapshotTargets() {
+		n, err := db.saveTarget(target)
+		written += n
+		if err != nil {
+			db.stats.recordSave(start, written, err)
+			db.markAllDirty()
+			return err
 		}
+	}
+	db.stats.recordSave(start, written, nil)
+	db.markSaved(changes, since)
+	return nil
+}
+
+// saveTarget writes the keys of a snapshot target to its file and returns
+// how many bytes it wrote. Callers hold saveMu and the keyspace lock.
+func (db *FlexDB) saveTarget(target snapshotTarget) (int64, error) {
+	return db.saveTo(target.file, func(w *bufio.Writer) error {
+		return db.writeSnapshot(w, target.part)
+	})
+}
+
+// saveTo replaces a snapshot file with what write writes and returns how
+// many bytes it wrote, starting its journal over. Callers hold saveMu,
+// since saves share the temporary file.
+func (db *FlexDB) saveTo(path string, write func(w *bufio.Writer) error) (int64, error) {
+	// Use atomic file write to prevent corruption
+	tempFile := path + ".tmp"
+	file, err := os.Create(tempFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+
+	n, sum, err := db.encodeSnapshot(file, write)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return n, fmt.Errorf("failed to write snapshot %s: %w", path, err)
+	}
+	if err := os.Rename(tempFile, path); err != nil {
+		os.Remove(tempFile)
+		return n, fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	db.resetJournal(path, sum, n)
+	return n, nil
+}
 
-		if v.Expiration != nil {
-			pv.Expiration = v.Expiration.Unix()
+// encodeSnapshot writes a snapshot to w: the header, what write writes and
+// the checksum line, compressed as configured. It returns how many bytes
+// it wrote and the checksum.
+func (db *FlexDB) encodeSnapshot(w io.Writer, write func(w *bufio.Writer) error) (int64, uint64, error) {
+	counter := &countingWriter{w: w}
+	compressed := db.compressedWriter(counter)
+	sum := newChecksum()
+	writer := bufio.NewWriter(io.MultiWriter(compressed, sum))
+	writer.WriteString(snapshotHeader)
+	err := write(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		_, err = fmt.Fprintf(compressed, checksumLine, sum.Sum64())
+	}
+	if err == nil {
+		err = compressed.Close()
+	}
+	return counter.n, sum.Sum64(), err
+}
+
+// backgroundSave writes a snapshot for the write loop, incrementally,
+// and BGSAVE without blocking writes, see bgsave. Failures are logged
+// when they start and when they stop, not on every retry. A failed AOF
+// fsync is retried too, since with the always policy nothing else would
+// retry it until the next write, and writes may be refused meanwhile.
+func (db *FlexDB) backgroundSave(incremental bool) {
+	failing := db.stats.saveError() != nil
+	err := db.bgsave(incremental)
+	switch {
+	case err != nil && !failing:
+		fmt.Printf("Error saving snapshot: %v\n", err)
+	case err == nil && failing:
+		fmt.Println("Snapshot saved again after failures")
+	}
+
+	if db.stats.fsyncError() != nil {
+		for _, aof := range db.aofs() {
+			aof.mu.Lock()
+			if aof.enabled {
+				aof.sync()
+			}
+			aof.mu.Unlock()
+		}
+	}
+}
+
+// keyValue is a key waiting to be encoded into the snapshot
+type keyValue struct {
+	key   string
+	value Value
+}
+
+// encodedEntry is a snapshot entry ready to be written. Chunked strings
+// are left for the writer, which streams them one chunk at a time.
+type encodedEntry struct {
+	key     []byte
+	value   []byte
+	pv      PersistentValue
+	chunked *chunkedString
+}
+
+// encodedBatch holds the encoded entries of a batch, or why it failed
+type encodedBatch struct {
+	entries []encodedEntry
+	err     error
+}
+
+// writeSnapshot streams the keyspace as a JSON object, one key per line.
+// The snapshot workers encode batches of keys, which are written in
+// order. Only a few batches are held at once and chunked strings are
+// written one chunk at a time, so saving never holds a second copy of the
+// whole keyspace. Only the keys of part are written, part being nil for
+// the main snapshot. Callers hold the keyspace lock.
+func (db *FlexDB) writeSnapshot(w *bufio.Writer, part *partition) error {
+	produce := func(emit func([]keyValue) bool) error {
+		batch := make([]keyValue, 0, snapshotBatchSize)
+		for k, v := range db.data {
+			if len(db.partitions) > 0 && db.partitionOf(k) != part {
+				continue
+			}
+			batch = append(batch, keyValue{key: k, value: v})
+			if len(batch) == snapshotBatchSize {
+				if !emit(batch) {
+					return nil
+				}
+				batch = make([]keyValue, 0, snapshotBatchSize)
+			}
+		}
+		if len(batch) > 0 {
+			emit(batch)
+		}
+		return nil
+	}
+
+	encode := func(batch []keyValue) encodedBatch {
+		entries := make([]encodedEntry, len(batch))
+		for i, kv := range batch {
+			entry, err := db.encodeEntry(kv.key, kv.value)
+			if err != nil {
+				return encodedBatch{err: err}
+			}
+			entries[i] = entry
+		}
+		return encodedBatch{entries: entries}
+	}
+
+	return writeEntries(w, db.workerCount(), produce, encode)
+}
+
+// writeEntries writes the snapshot JSON object. produce emits batches of
+// entries, which the snapshot workers encode and which are written in
+// order.
+func writeEntries[In any](w *bufio.Writer, workers int, produce func(emit func(In) bool) error, encode func(In) encodedBatch) error {
+	first := true
+	write := func(batch encodedBatch) error {
+		if batch.err != nil {
+			return batch.err
+		}
+		for _, e := range batch.entries {
+			if !first {
+				w.WriteString(",")
+			}
+			first = false
+
+			w.WriteString("\n  ")
+			w.Write(e.key)
+			w.WriteString(": ")
+			if e.chunked != nil {
+				if err := writeChunked(w, e.pv, e.chunked); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := w.Write(e.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w.WriteString("{")
+	if err := pipeline(workers, produce, encode, write); err != nil {
+		return err
+	}
+	_, err := w.WriteString("\n}\n")
+	return err
+}
+
+// snapshotEntry is a key described for the snapshot, ready to be encoded
+type snapshotEntry struct {
+	key     string
+	pv      PersistentValue // without Data for chunked strings
+	chunked *chunkedString  // written one chunk at a time, unless encrypted
+	cold    *coldValue      // data read from the spill file when encoded
+	sealer  *encryption     // encrypts the entry, nil if it isn't encrypted
+}
+
+// encodeEntry encodes a key and its value for the snapshot
+func (db *FlexDB) encodeEntry(k string, v Value) (encodedEntry, error) {
+	return db.encodeSnapshotEntry(db.snapshotEntryOf(k, v))
+}
+
+// snapshotEntryOf describes a key and its value for the snapshot. Callers
+// hold the keyspace lock.
+func (db *FlexDB) snapshotEntryOf(k string, v Value) snapshotEntry {
+	v = resident(v)
+	pv := PersistentValue{
+		Type:     v.Type,
+		Encoding: persistentEncoding(v),
+	}
+	if v.Expiration != nil {
+		pv.PExpiration = v.Expiration.UnixMilli()
+	}
+	pv.LastAccess = db.lastAccessUnix(k)
+	pv.History = db.persistedHistory(k)
+	pv.Tags = db.persistedTags(k)
+
+	if cold, ok := v.Data.(*coldValue); ok {
+		// never decoded, so it's written back as it was loaded
+		pv.Encoding = cold.encoding
+		e := snapshotEntry{key: k, pv: pv, cold: cold}
+		if db.encrypted(k) {
+			e.sealer = db.encryption
 		}
+		return e
+	}
+	if db.encrypted(k) {
+		pv.Data = persistentData(v)
+		return snapshotEntry{key: k, pv: pv, sealer: db.encryption}
+	}
+	if chunked, ok := v.Data.(*chunkedString); ok {
+		return snapshotEntry{key: k, pv: pv, chunked: chunked}
+	}
+	pv.Data = persistentData(v)
+	return snapshotEntry{key: k, pv: pv}
+}
 
-		tempData[k] = pv
+// encodeSnapshotEntry encodes an entry, encrypting it if it has a sealer
+func (db *FlexDB) encodeSnapshotEntry(e snapshotEntry) (encodedEntry, error) {
+	key, err := json.Marshal(e.key)
+	if err != nil {
+		return encodedEntry{}, err
+	}
+	if e.chunked != nil {
+		return encodedEntry{key: key, pv: e.pv, chunked: e.chunked}, nil
 	}
 
-	bytes, err := json.MarshalIndent(tempData, "", "  ")
+	pv := e.pv
+	if e.cold != nil {
+		raw, err := db.lazy.readRaw(e.cold)
+		if err != nil {
+			return encodedEntry{}, fmt.Errorf("key %q: %w", e.key, err)
+		}
+		pv.Data = raw
+	}
+	if e.sealer != nil {
+		if pv, err = e.sealer.encryptValue(e.key, pv); err != nil {
+			return encodedEntry{}, err
+		}
+	}
+	value, err := json.Marshal(pv)
 	if err != nil {
+		return encodedEntry{}, err
+	}
+	return encodedEntry{key: key, value: value}, nil
+}
+
+// writeChunked writes a chunked string value without joining its chunks
+func writeChunked(w *bufio.Writer, pv PersistentValue, chunked *chunkedString) error {
+	fmt.Fprintf(w, `{"type":%d,"enc":%q,`, pv.Type, pv.Encoding)
+	if pv.PExpiration != 0 {
+		fmt.Fprintf(w, `"pexp":%d,`, pv.PExpiration)
+	}
+	if pv.LastAccess != 0 {
+		fmt.Fprintf(w, `"atime":%d,`, pv.LastAccess)
+	}
+	if len(pv.History) > 0 {
+		history, err := json.Marshal(pv.History)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, `"hist":%s,`, history)
+	}
+	if len(pv.Tags) > 0 {
+		tags, err := json.Marshal(pv.Tags)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, `"tags":%s,`, tags)
+	}
+	w.WriteString(`"data":[`)
+
+	for i, chunk := range chunked.chunks {
+		if i > 0 {
+			w.WriteString(",")
+		}
+		encoded, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(encoded); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.WriteString("]}")
+	return err
+}
+
+// saveRetryInterval is how long writeLoop waits after a failed snapshot
+const saveRetryInterval = 2 * time.Second
+
+// WithWriteBackpressure throttles write commands while more than
+// maxUnsaved changes wait for a snapshot, so writers slow down to the
+// pace persistence can keep up with. A writer waits at most maxWait.
+func WithWriteBackpressure(maxUnsaved int, maxWait time.Duration) Option {
+	return func(db *FlexDB) {
+		db.maxUnsaved = uint64(maxUnsaved)
+		db.maxThrottle = maxWait
+	}
+}
+
+// triggerWrite records a change to keys, or to any key if none are given,
+// and wakes writeLoop once the change count reaches a save rule. Changes
+// are counted, never dropped, so a burst is always followed by a snapshot
+// when a rule covers it.
+func (db *FlexDB) triggerWrite(keys ...string) {
+	db.persistMu.Lock()
+	if db.dirty == 0 {
+		db.dirtySince = time.Now()
+	}
+	db.dirty++
+	db.noteDirty(keys)
+	reached := db.saveRuleReached(db.dirty)
+	db.persistMu.Unlock()
+
+	db.stats.triggers.Add(1)
+	if reached {
+		db.needsSave.Signal()
+	}
+}
+
+// pendingChanges returns the unsaved change count and when the oldest of
+// them was made, for save to settle once the snapshot is written
+func (db *FlexDB) pendingChanges() (uint64, time.Time) {
+	db.persistMu.Lock()
+	defer db.persistMu.Unlock()
+	return db.dirty, db.dirtySince
+}
+
+// markSaved settles changes covered by a snapshot and wakes throttled writers
+func (db *FlexDB) markSaved(changes uint64, since time.Time) {
+	db.persistMu.Lock()
+	db.dirty -= changes
+	if db.dirty > 0 {
+		// the changes made while saving are the oldest now
+		db.dirtySince = time.Now()
+	}
+	db.persistMu.Unlock()
+
+	if changes > 0 {
+		db.stats.lastLagNanos.Store(int64(time.Since(since)))
+	}
+	db.saved.Broadcast()
+}
+
+// WaitForPersistence applies write backpressure: while more changes than
+// the WithWriteBackpressure limit wait for a snapshot, it blocks until a
+// snapshot catches up or the wait limit passes. Callers must not hold the
+// keyspace lock, since the snapshot needs it.
+func (db *FlexDB) WaitForPersistence() {
+	if db.maxUnsaved == 0 {
 		return
 	}
 
-	// Use atomic file write to prevent corruption
-	tempFile := db.file + ".tmp"
-	if err := os.WriteFile(tempFile, bytes, 0644); err != nil {
+	db.persistMu.Lock()
+	defer db.persistMu.Unlock()
+	if db.dirty <= db.maxUnsaved || db.stopping {
 		return
 	}
-	os.Rename(tempFile, db.file)
-}
 
-func (db *FlexDB) triggerWrite() {
-	select {
-	case db.writeQueue <- struct{}{}:
-		// successfully queued
-	default:
-		// queue is full — skip
+	start := time.Now()
+	expired := false
+	timer := time.AfterFunc(db.maxThrottle, func() {
+		db.persistMu.Lock()
+		expired = true
+		db.persistMu.Unlock()
+		db.saved.Broadcast()
+	})
+	defer timer.Stop()
+
+	for db.dirty > db.maxUnsaved && !expired && !db.stopping {
+		db.saved.Wait()
 	}
+	db.stats.throttled.Add(1)
+	db.stats.throttleNanos.Add(int64(time.Since(start)))
 }
@@ -0,0 +1,242 @@
+package db
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// PQItem is a value waiting in a priority queue
+type PQItem struct {
+	Priority int64
+	Value    string
+}
+
+// pqEntry is a queued item with its arrival order, which breaks ties
+// between equal priorities so they pop first in, first out
+type pqEntry struct {
+	PQItem
+	seq uint64
+}
+
+// priorityQueue is the in-memory form of a priority queue: a binary heap
+// popping the highest priority first
+type priorityQueue struct {
+	entries []pqEntry
+	nextSeq uint64
+}
+
+func (q *priorityQueue) Len() int { return len(q.entries) }
+
+func (q *priorityQueue) Less(i, j int) bool {
+	a, b := q.entries[i], q.entries[j]
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.seq < b.seq
+}
+
+func (q *priorityQueue) Swap(i, j int) { q.entries[i], q.entries[j] = q.entries[j], q.entries[i] }
+
+func (q *priorityQueue) Push(x interface{}) { q.entries = append(q.entries, x.(pqEntry)) }
+
+func (q *priorityQueue) Pop() interface{} {
+	last := q.entries[len(q.entries)-1]
+	q.entries = q.entries[:len(q.entries)-1]
+	return last
+}
+
+// push queues an item behind those of the same priority
+func (q *priorityQueue) push(item PQItem) {
+	heap.Push(q, pqEntry{PQItem: item, seq: q.nextSeq})
+	q.nextSeq++
+}
+
+// pop removes the item to serve next
+func (q *priorityQueue) pop() PQItem {
+	return heap.Pop(q).(pqEntry).PQItem
+}
+
+// ordered returns the items in the order they would pop
+func (q *priorityQueue) ordered() []PQItem {
+	entries := append([]pqEntry(nil), q.entries...)
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Priority != entries[j].Priority {
+			return entries[i].Priority > entries[j].Priority
+		}
+		return entries[i].seq < entries[j].seq
+	})
+	items := make([]PQItem, len(entries))
+	for i, e := range entries {
+		items[i] = e.PQItem
+	}
+	return items
+}
+
+// persisted returns the snapshot form of the queue: its items in pop order
+// as [priority, value] pairs
+func (q *priorityQueue) persisted() [][2]interface{} {
+	items := q.ordered()
+	pairs := make([][2]interface{}, len(items))
+	for i, item := range items {
+		pairs[i] = [2]interface{}{item.Priority, item.Value}
+	}
+	return pairs
+}
+
+// aofCommands returns the PQ.PUSH commands that recreate the queue,
+// pushing the items in pop order so equal priorities keep their order
+func (q *priorityQueue) aofCommands(key string) [][]string {
+	var cmds [][]string
+	for _, item := range q.ordered() {
+		cmds = append(cmds, []string{"PQ.PUSH", key, strconv.FormatInt(item.Priority, 10), item.Value})
+	}
+	return cmds
+}
+
+// String formats the queue for ALL
+func (q *priorityQueue) String() string {
+	return fmt.Sprintf("%v", q.ordered())
+}
+
+// loadPriorityQueue restores a priority queue from its snapshot form
+func loadPriorityQueue(data interface{}) (*priorityQueue, error) {
+	pairs, ok := data.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("priority queue is not an array")
+	}
+	q := &priorityQueue{}
+	for _, p := range pairs {
+		pair, ok := p.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("priority queue item is not a pair")
+		}
+		priority, ok := pair[0].(float64)
+		if !ok {
+			return nil, fmt.Errorf("priority is not a number")
+		}
+		value, ok := pair[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("priority queue value is not a string")
+		}
+		q.push(PQItem{Priority: int64(priority), Value: value})
+	}
+	return q, nil
+}
+
+// PQPush queues value on the priority queue at key with priority, behind
+// the values already queued with the same priority, and returns the new
+// length of the queue
+func (db *FlexDB) PQPush(key string, priority int64, value string) (int, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, err
+	}
+	if err := db.checkValues(value); err != nil {
+		return 0, err
+	}
+
+	length := 0
+	err := db.Update(func(tx *Txn) error {
+		q, err := priorityQueueAt(tx, key)
+		if err != nil {
+			return err
+		}
+		if q == nil {
+			q = &priorityQueue{}
+			tx.Put(key, Value{Type: TypePQ, Data: q})
+		} else if err := db.checkElements(q.Len() + 1); err != nil {
+			return err
+		}
+
+		q.push(PQItem{Priority: priority, Value: value})
+		tx.markChanged(key)
+		tx.Log("PQ.PUSH", key, strconv.FormatInt(priority, 10), value)
+		length = q.Len()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	db.signalKey(key)
+	return length, nil
+}
+
+// PQPop removes and returns up to count items of the priority queue at
+// key, highest priority first
+func (db *FlexDB) PQPop(key string, count int) ([]PQItem, error) {
+	var items []PQItem
+	err := db.Update(func(tx *Txn) error {
+		q, err := priorityQueueAt(tx, key)
+		if err != nil || q == nil {
+			return err
+		}
+		for len(items) < count && q.Len() > 0 {
+			items = append(items, q.pop())
+		}
+		if q.Len() == 0 {
+			tx.Delete(key)
+		}
+		tx.markChanged(key)
+		tx.Log("PQ.POP", key, strconv.Itoa(len(items)))
+		return nil
+	})
+	return items, err
+}
+
+// PQPopWait is PQPop waiting for an item to be pushed when the queue is
+// empty. It returns ctx's error when ctx ends first, and ErrShuttingDown
+// when the database shuts down.
+func (db *FlexDB) PQPopWait(ctx context.Context, key string, count int) ([]PQItem, error) {
+	var items []PQItem
+	err := db.blockOn(ctx, key, func() (bool, time.Time, error) {
+		var err error
+		items, err = db.PQPop(key, count)
+		return len(items) > 0, time.Time{}, err
+	})
+	return items, err
+}
+
+// PQPeek returns the item the priority queue at key would pop next
+func (db *FlexDB) PQPeek(key string) (PQItem, bool, error) {
+	var item PQItem
+	found := false
+	err := db.View(func(tx *Txn) error {
+		q, err := priorityQueueAt(tx, key)
+		if err != nil || q == nil {
+			return err
+		}
+		item, found = q.entries[0].PQItem, true
+		return nil
+	})
+	return item, found, err
+}
+
+// PQLen returns the number of items in the priority queue at key
+func (db *FlexDB) PQLen(key string) (int, error) {
+	length := 0
+	err := db.View(func(tx *Txn) error {
+		q, err := priorityQueueAt(tx, key)
+		if err != nil || q == nil {
+			return err
+		}
+		length = q.Len()
+		return nil
+	})
+	return length, err
+}
+
+// priorityQueueAt returns the priority queue stored at key, or nil if the
+// key doesn't exist
+func priorityQueueAt(tx *Txn, key string) (*priorityQueue, error) {
+	val, ok := tx.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	if val.Type != TypePQ {
+		return nil, ErrWrongType
+	}
+	return val.Data.(*priorityQueue), nil
+}
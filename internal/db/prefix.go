@@ -0,0 +1,222 @@
+package db
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// keyIndex keeps the key names sorted so a prefix is a binary search and
+// a contiguous run instead of a keyspace scan. It is built by the first
+// prefix read, so servers that never ask pay nothing. After that new keys
+// are queued in pending and merged in by the next read; deleted keys are
+// skipped by reads and dropped by merges.
+type keyIndex struct {
+	mu      sync.Mutex
+	less    func(a, b string) bool // the order of sorted, by name when nil
+	built   bool
+	sorted  []string
+	pending []string // keys created since the last merge, unsorted
+}
+
+// indexKey records a key that was just created. Callers hold the keyspace
+// write lock.
+func (db *FlexDB) indexKey(key string) {
+	db.keyIndex.add(key)
+	db.scanIndex.add(key)
+}
+
+// before reports whether key a sorts before key b in the index
+func (idx *keyIndex) before(a, b string) bool {
+	if idx.less == nil {
+		return a < b
+	}
+	return idx.less(a, b)
+}
+
+// sort puts keys in the order of the index
+func (idx *keyIndex) sort(keys []string) {
+	if idx.less == nil {
+		sort.Strings(keys)
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool { return idx.less(keys[i], keys[j]) })
+}
+
+// add queues a created key for the next merge
+func (idx *keyIndex) add(key string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if !idx.built {
+		return
+	}
+	idx.pending = append(idx.pending, key)
+	// with no reads to merge them, pending would grow without bound;
+	// past the size of the index a rebuild is cheaper anyway
+	if len(idx.pending) > len(idx.sorted)+1024 {
+		idx.built = false
+		idx.sorted = nil
+		idx.pending = nil
+	}
+}
+
+// prefixKeys returns up to count live keys starting with prefix that sort
+// after the key after, in order. A negative count returns them all. It
+// also reports whether more keys follow. Callers hold the keyspace lock.
+func (db *FlexDB) prefixKeys(prefix, after string, count int) ([]string, bool) {
+	idx := &db.keyIndex
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.refresh(db.data)
+
+	start := prefix
+	if after > start {
+		start = after
+	}
+	i := sort.SearchStrings(idx.sorted, start)
+
+	now := db.now()
+	var keys []string
+	for ; i < len(idx.sorted); i++ {
+		key := idx.sorted[i]
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		if key == after {
+			continue
+		}
+		val, ok := db.data[key]
+		if !ok || (val.Expiration != nil && now.After(*val.Expiration)) {
+			continue
+		}
+		if count >= 0 && len(keys) == count {
+			return keys, true
+		}
+		keys = append(keys, key)
+	}
+	return keys, false
+}
+
+// refresh builds the index on first use and merges the pending keys
+// afterwards, so it holds every key of data. Callers hold idx.mu.
+func (idx *keyIndex) refresh(data map[string]Value) {
+	if !idx.built {
+		idx.sorted = make([]string, 0, len(data))
+		for key := range data {
+			idx.sorted = append(idx.sorted, key)
+		}
+		idx.sort(idx.sorted)
+		idx.built = true
+	} else if len(idx.pending) > 0 {
+		idx.merge(data)
+	}
+}
+
+// randomKeyAttempts bounds how many expired keys randomKey redraws
+// before falling back to a scan
+const randomKeyAttempts = 64
+
+// randomKey picks a live key uniformly at random from the index, and
+// returns false if there is none. Keys that expired but weren't removed
+// yet are redrawn; when too many are drawn in a row, the first live key
+// after a random position is taken instead. Callers hold the keyspace
+// lock.
+func (db *FlexDB) randomKey() (string, bool) {
+	idx := &db.keyIndex
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.refresh(db.data)
+
+	n := len(idx.sorted)
+	if n == 0 {
+		return "", false
+	}
+	now := db.now()
+	live := func(key string) bool {
+		val, ok := db.data[key]
+		return ok && (val.Expiration == nil || !now.After(*val.Expiration))
+	}
+	for i := 0; i < randomKeyAttempts; i++ {
+		if key := idx.sorted[rand.Intn(n)]; live(key) {
+			return key, true
+		}
+	}
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		if key := idx.sorted[(start+i)%n]; live(key) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// merge folds the pending keys into the sorted ones, dropping duplicates
+// and keys that no longer exist
+func (idx *keyIndex) merge(data map[string]Value) {
+	idx.sort(idx.pending)
+	merged := make([]string, 0, len(idx.sorted)+len(idx.pending))
+	add := func(key string) {
+		if _, ok := data[key]; !ok {
+			return
+		}
+		if n := len(merged); n > 0 && merged[n-1] == key {
+			return
+		}
+		merged = append(merged, key)
+	}
+
+	a, b := idx.sorted, idx.pending
+	for len(a) > 0 || len(b) > 0 {
+		if len(b) == 0 || (len(a) > 0 && !idx.before(b[0], a[0])) {
+			add(a[0])
+			a = a[1:]
+		} else {
+			add(b[0])
+			b = b[1:]
+		}
+	}
+	idx.sorted = merged
+	idx.pending = nil
+}
+
+// RandomKey returns a key picked uniformly at random among the live ones,
+// and false when there are none. Keys are drawn from the sorted key
+// index, so picking one doesn't walk the keyspace. The key doesn't count
+// as accessed, so sampling leaves access statistics alone.
+func (db *FlexDB) RandomKey() (string, bool) {
+	// like PrefixGet, index changes only need the index lock
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.randomKey()
+}
+
+// PrefixGet returns, in key order, up to count keys starting with prefix
+// with their values, resuming after the key cursor when it isn't empty. A
+// negative count returns them all. Values of keys that aren't strings are
+// nil. The returned cursor is the last key returned when more follow, to
+// be passed to the next call, and empty once the prefix is exhausted.
+func (db *FlexDB) PrefixGet(prefix, cursor string, count int) ([]Entry, string) {
+	// merging pending keys changes only the index, which has its own lock
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	keys, more := db.prefixKeys(prefix, cursor, count)
+	entries := make([]Entry, len(keys))
+	for i, key := range keys {
+		entries[i].Key = key
+		val, _ := db.lookup(key)
+		if str, ok := stringData(val.Data); ok {
+			entries[i].Value = str
+		}
+		db.touch(key)
+	}
+
+	next := ""
+	if more && len(keys) > 0 {
+		next = keys[len(keys)-1]
+	}
+	return entries, next
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Comparison operators supported in query conditions
+var queryOperators = map[string]bool{
+	"=": true, "!=": true, ">": true, ">=": true, "<": true, "<=": true,
+}
+
+// ErrInvalidOperator is returned for a condition with an unknown operator
+var ErrInvalidOperator = errors.New("invalid query operator")
+
+// Condition compares a hash field against a value. Values that both parse
+// as numbers are compared numerically, anything else as strings. A hash
+// without the field never matches.
+type Condition struct {
+	Field string
+	Op    string
+	Value string
+}
+
+// Query selects hashes whose key matches Pattern and that satisfy every
+// condition in Where
+type Query struct {
+	Pattern string
+	Where   []Condition
+	Fields  []string // fields to return; none returns only keys
+	Limit   int      // most results to return, negative for no limit
+}
+
+// QueryResult is a matching key and the requested fields it has
+type QueryResult struct {
+	Key    string
+	Fields map[string]string
+}
+
+// IsQueryOperator reports whether op can be used in a Condition
+func IsQueryOperator(op string) bool {
+	return queryOperators[op]
+}
+
+// matches evaluates the condition against a hash
+func (c Condition) matches(hash map[string]string) bool {
+	actual, ok := hash[c.Field]
+	if !ok {
+		return false
+	}
+
+	var cmp int
+	a, errA := strconv.ParseFloat(actual, 64)
+	b, errB := strconv.ParseFloat(c.Value, 64)
+	switch {
+	case errA == nil && errB == nil:
+		if a < b {
+			cmp = -1
+		} else if a > b {
+			cmp = 1
+		}
+	case actual < c.Value:
+		cmp = -1
+	case actual > c.Value:
+		cmp = 1
+	}
+
+	switch c.Op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	default:
+		return false
+	}
+}
+
+// Query scans the hashes matching q.Pattern in key order and returns those
+// satisfying every condition. Keys holding other types are skipped.
+func (db *FlexDB) Query(q Query) ([]QueryResult, error) {
+	for _, c := range q.Where {
+		if !IsQueryOperator(c.Op) {
+			return nil, ErrInvalidOperator
+		}
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var results []QueryResult
+	for _, key := range db.liveKeys(q.Pattern) {
+		if q.Limit >= 0 && len(results) >= q.Limit {
+			break
+		}
+
+		val, _ := db.lookup(key)
+		if val.Type != TypeHash {
+			continue
+		}
+		hash := val.Data.(map[string]string)
+
+		matched := true
+		for _, c := range q.Where {
+			if !c.matches(hash) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		result := QueryResult{Key: key}
+		if len(q.Fields) > 0 {
+			result.Fields = make(map[string]string, len(q.Fields))
+			for _, f := range q.Fields {
+				if v, ok := hash[f]; ok {
+					result.Fields[f] = v
+				}
+			}
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
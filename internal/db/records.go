@@ -0,0 +1,377 @@
+package db
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Records are the keys IMPORT and the import and export tools move in and
+// out of FlexDB, one per JSONL line or CSV row:
+//
+//	{"key":"user:1","value":"alice","ttl":60}
+//	{"key":"cart:1","type":"list","value":["a","b"]}
+//
+// Without a type, JSON strings, numbers and booleans become strings,
+// arrays lists and objects hashes. Sets are arrays and sorted sets objects
+// of member to score. A CSV file starts with a header naming its key and
+// value columns and optionally type and ttl; values of other types than
+// string are written in their JSON form.
+
+// RecordFormat is the file format of records
+type RecordFormat int
+
+const (
+	// RecordJSONL is one JSON object per line
+	RecordJSONL RecordFormat = iota
+	// RecordCSV is comma separated values with a header row
+	RecordCSV
+)
+
+// String returns the name ParseRecordFormat reads
+func (f RecordFormat) String() string {
+	if f == RecordCSV {
+		return "csv"
+	}
+	return "jsonl"
+}
+
+// ParseRecordFormat parses a record format name: jsonl or csv
+func ParseRecordFormat(name string) (RecordFormat, error) {
+	switch strings.ToLower(name) {
+	case "jsonl":
+		return RecordJSONL, nil
+	case "csv":
+		return RecordCSV, nil
+	default:
+		return 0, fmt.Errorf("invalid record format %q, expected jsonl or csv", name)
+	}
+}
+
+// Record is a key with its value, as imported and exported
+type Record struct {
+	Key   string      `json:"key"`
+	Type  string      `json:"type,omitempty"` // a TYPE name, inferred from Value if empty
+	Value interface{} `json:"value"`
+	TTL   int64       `json:"ttl,omitempty"` // seconds, 0 for no expiration
+}
+
+// ErrBadRecord is returned for a record that can't be imported
+var ErrBadRecord = errors.New("invalid record")
+
+// RecordReader reads records from a JSONL or CSV stream
+type RecordReader struct {
+	format  RecordFormat
+	lines   *bufio.Reader
+	csv     *csv.Reader
+	columns map[string]int // CSV column of each field
+	line    int
+}
+
+// NewRecordReader returns a reader of records in format from r
+func NewRecordReader(r io.Reader, format RecordFormat) *RecordReader {
+	rr := &RecordReader{format: format}
+	if format == RecordCSV {
+		rr.csv = csv.NewReader(r)
+		rr.csv.FieldsPerRecord = -1
+	} else {
+		rr.lines = bufio.NewReaderSize(r, 64*1024)
+	}
+	return rr
+}
+
+// Line returns the line of the record Next last returned
+func (rr *RecordReader) Line() int {
+	return rr.line
+}
+
+// Next returns the next record, or io.EOF after the last one
+func (rr *RecordReader) Next() (Record, error) {
+	if rr.format == RecordCSV {
+		return rr.nextCSV()
+	}
+	for {
+		line, err := rr.lines.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return Record{}, err
+		}
+		rr.line++
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var rec Record
+		dec := json.NewDecoder(strings.NewReader(line))
+		dec.UseNumber()
+		if err := dec.Decode(&rec); err != nil {
+			return Record{}, fmt.Errorf("%w at line %d: %v", ErrBadRecord, rr.line, err)
+		}
+		return rec, nil
+	}
+}
+
+func (rr *RecordReader) nextCSV() (Record, error) {
+	if rr.columns == nil {
+		header, err := rr.csv.Read()
+		if err != nil {
+			return Record{}, err
+		}
+		rr.line, _ = rr.csv.FieldPos(0)
+		rr.columns = make(map[string]int, len(header))
+		for i, name := range header {
+			rr.columns[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+		if _, ok := rr.columns["key"]; !ok {
+			return Record{}, fmt.Errorf("%w: the CSV header has no key column", ErrBadRecord)
+		}
+		if _, ok := rr.columns["value"]; !ok {
+			return Record{}, fmt.Errorf("%w: the CSV header has no value column", ErrBadRecord)
+		}
+	}
+
+	row, err := rr.csv.Read()
+	if err != nil {
+		return Record{}, err
+	}
+	rr.line, _ = rr.csv.FieldPos(0)
+	field := func(name string) string {
+		if i, ok := rr.columns[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	rec := Record{Key: field("key"), Type: field("type"), Value: field("value")}
+	if rec.Type != "" && rec.Type != TypeString.String() {
+		dec := json.NewDecoder(strings.NewReader(field("value")))
+		dec.UseNumber()
+		if err := dec.Decode(&rec.Value); err != nil {
+			return Record{}, fmt.Errorf("%w at line %d: %s value: %v", ErrBadRecord, rr.line, rec.Type, err)
+		}
+	}
+	if ttl := field("ttl"); ttl != "" {
+		if rec.TTL, err = strconv.ParseInt(ttl, 10, 64); err != nil {
+			return Record{}, fmt.Errorf("%w at line %d: invalid ttl %q", ErrBadRecord, rr.line, ttl)
+		}
+	}
+	return rec, nil
+}
+
+// RecordWriter writes records as JSONL or CSV
+type RecordWriter struct {
+	format RecordFormat
+	w      *bufio.Writer
+	csv    *csv.Writer
+	header bool
+}
+
+// NewRecordWriter returns a writer of records in format to w. Flush must
+// be called once done.
+func NewRecordWriter(w io.Writer, format RecordFormat) *RecordWriter {
+	rw := &RecordWriter{format: format, w: bufio.NewWriter(w)}
+	if format == RecordCSV {
+		rw.csv = csv.NewWriter(rw.w)
+	}
+	return rw
+}
+
+// Write writes a record
+func (rw *RecordWriter) Write(rec Record) error {
+	if rw.format == RecordJSONL {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		rw.w.Write(line)
+		return rw.w.WriteByte('\n')
+	}
+
+	if !rw.header {
+		rw.header = true
+		if err := rw.csv.Write([]string{"key", "type", "value", "ttl"}); err != nil {
+			return err
+		}
+	}
+	value, ok := rec.Value.(string)
+	if !ok || (rec.Type != "" && rec.Type != TypeString.String()) {
+		encoded, err := json.Marshal(rec.Value)
+		if err != nil {
+			return err
+		}
+		value = string(encoded)
+	}
+	ttl := ""
+	if rec.TTL > 0 {
+		ttl = strconv.FormatInt(rec.TTL, 10)
+	}
+	return rw.csv.Write([]string{rec.Key, rec.Type, value, ttl})
+}
+
+// Flush writes buffered records to the underlying writer
+func (rw *RecordWriter) Flush() error {
+	if rw.csv != nil {
+		rw.csv.Flush()
+		if err := rw.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return rw.w.Flush()
+}
+
+// recordValue converts the value of a record to its runtime form
+func (db *FlexDB) recordValue(rec Record) (Value, error) {
+	typ := rec.Type
+	if typ == "" {
+		switch rec.Value.(type) {
+		case []interface{}:
+			typ = TypeList.String()
+		case map[string]interface{}:
+			typ = TypeHash.String()
+		default:
+			typ = TypeString.String()
+		}
+	}
+
+	switch typ {
+	case TypeString.String():
+		str, ok := scalarString(rec.Value)
+		if !ok {
+			return Value{}, fmt.Errorf("a string value can't be %T", rec.Value)
+		}
+		if err := db.checkValues(str); err != nil {
+			return Value{}, err
+		}
+		return Value{Type: TypeString, Data: db.encodeString(str)}, nil
+	case TypeList.String(), TypeSet.String():
+		items, ok := rec.Value.([]interface{})
+		if !ok {
+			return Value{}, fmt.Errorf("a %s value must be an array", typ)
+		}
+		members := make([]string, len(items))
+		for i, item := range items {
+			if members[i], ok = scalarString(item); !ok {
+				return Value{}, fmt.Errorf("%s elements can't be %T", typ, item)
+			}
+		}
+		if err := db.checkElements(len(members)); err != nil {
+			return Value{}, err
+		}
+		if err := db.checkValues(members...); err != nil {
+			return Value{}, err
+		}
+		if typ == TypeList.String() {
+			return Value{Type: TypeList, Data: members}, nil
+		}
+		set := make(stringSet, len(members))
+		for _, member := range members {
+			set[member] = struct{}{}
+		}
+		return Value{Type: TypeSet, Data: set}, nil
+	case TypeHash.String():
+		fields, ok := rec.Value.(map[string]interface{})
+		if !ok {
+			return Value{}, errors.New("a hash value must be an object")
+		}
+		if err := db.checkElements(len(fields)); err != nil {
+			return Value{}, err
+		}
+		hash := make(map[string]string, len(fields))
+		for field, v := range fields {
+			if hash[field], ok = scalarString(v); !ok {
+				return Value{}, fmt.Errorf("hash values can't be %T", v)
+			}
+			if err := db.checkValues(field, hash[field]); err != nil {
+				return Value{}, err
+			}
+		}
+		return Value{Type: TypeHash, Data: hash}, nil
+	case TypeZSet.String():
+		members, ok := rec.Value.(map[string]interface{})
+		if !ok {
+			return Value{}, errors.New("a zset value must be an object of member to score")
+		}
+		z := newSortedSet()
+		for member, v := range members {
+			str, _ := scalarString(v)
+			score, err := strconv.ParseFloat(str, 64)
+			if err != nil || math.IsNaN(score) {
+				return Value{}, fmt.Errorf("score of %q is not a number", member)
+			}
+			if err := db.checkValues(member); err != nil {
+				return Value{}, err
+			}
+			z.Add(member, score)
+		}
+		return Value{Type: TypeZSet, Data: z}, nil
+	default:
+		return Value{}, fmt.Errorf("can't import values of type %q", typ)
+	}
+}
+
+// scalarString returns a JSON string, number or boolean as a string
+func scalarString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+// Import stores records atomically and returns how many it stored.
+// Existing keys are skipped unless replace is set. Every record is checked
+// before any is stored, so a bad one stores nothing and the error names
+// it.
+func (db *FlexDB) Import(records []Record, replace bool) (int, error) {
+	values := make([]Value, len(records))
+	now := time.Now()
+	for i, rec := range records {
+		if rec.Key == "" {
+			return 0, fmt.Errorf("%w %d: no key", ErrBadRecord, i+1)
+		}
+		if err := db.checkKey(rec.Key); err != nil {
+			return 0, fmt.Errorf("%w %d (%q): %w", ErrBadRecord, i+1, rec.Key, err)
+		}
+		val, err := db.recordValue(rec)
+		if err != nil {
+			return 0, fmt.Errorf("%w %d (%q): %w", ErrBadRecord, i+1, rec.Key, err)
+		}
+		if rec.TTL > 0 {
+			exp := now.Add(time.Duration(rec.TTL) * time.Second)
+			val.Expiration = &exp
+		}
+		values[i] = val
+	}
+
+	imported := 0
+	err := db.Update(func(tx *Txn) error {
+		for i, rec := range records {
+			if _, exists := tx.Get(rec.Key); exists && !replace {
+				continue
+			}
+			if tx.Delete(rec.Key) {
+				tx.Log("DEL", rec.Key)
+			}
+			tx.Put(rec.Key, values[i])
+			for _, cmd := range valueCommands(rec.Key, values[i]) {
+				tx.Log(cmd[0], cmd[1:]...)
+			}
+			imported++
+		}
+		return nil
+	})
+	return imported, err
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// aofStampInterval is how often the AOF is stamped with the time. A stamp
+// is written before the first command logged once the interval passed
+// since the last, so every command happened less than this after the
+// stamp before it.
+const aofStampInterval = time.Second
+
+// stampCommand returns the AOF command stamping the time now
+func stampCommand(now time.Time) (string, []string) {
+	return "TIMESTAMP", []string{unixMillis(now)}
+}
+
+// stampTime returns the time of a TIMESTAMP command
+func stampTime(parts []string) (time.Time, bool) {
+	if len(parts) != 2 || parts[0] != "TIMESTAMP" {
+		return time.Time{}, false
+	}
+	ms, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms), true
+}
+
+// WithRecoverTo replays the AOFs at startup only up to t, to undo an
+// accidental FLUSHALL or a bad deploy. Replay stops at the first time
+// stamp within aofStampInterval of t, so nothing logged after t is
+// replayed, but up to that much before it may be left out. Each AOF must
+// have been rewritten before t. A recovered AOF is copied aside with all
+// its commands and rewritten with the recovered keyspace, which is also
+// saved to the snapshot.
+func WithRecoverTo(t time.Time) Option {
+	return func(db *FlexDB) {
+		db.recoverTo = t
+	}
+}
+
+// recoveryCutoff reports whether a command read from the AOF is a time
+// stamp past which replay stops to recover to db.recoverTo
+func (db *FlexDB) recoveryCutoff(parts []string) (time.Time, bool) {
+	stamp, ok := stampTime(parts)
+	if !ok || db.recoverTo.IsZero() {
+		return time.Time{}, false
+	}
+	return stamp, stamp.After(db.recoverTo.Add(-aofStampInterval))
+}
+
+// stopRecovery ends the replay of an AOF recovered to the time stamp
+// stamp: the file is copied aside and marked to be rewritten once the
+// load finishes. The keys must have been rebuilt from a BASE by then, or
+// the snapshot's newer copies would be kept.
+func (aof *AOFPersistence) stopRecovery(stamp time.Time) error {
+	if !aof.base {
+		return fmt.Errorf("can't recover AOF %s to %s: it was rewritten later, at %s",
+			aof.filePath, aof.db.recoverTo.Format(time.RFC3339), stamp.Format(time.RFC3339))
+	}
+
+	// segments are copied too, the rewrite deletes them
+	now := time.Now().Unix()
+	var backups []string
+	for _, path := range aof.files() {
+		backup := fmt.Sprintf("%s.%d.bak", path, now)
+		if err := copyFile(path, backup); err != nil {
+			return fmt.Errorf("failed to keep a copy of AOF %s: %w", path, err)
+		}
+		backups = append(backups, backup)
+	}
+	aof.rebase = true
+	aof.db.recovered = true
+	fmt.Printf("Recovered AOF %s to %s, leaving out the commands logged from %s on; the whole AOF is kept as %s\n",
+		aof.filePath, aof.db.recoverTo.Format(time.RFC3339), stamp.Format(time.RFC3339), strings.Join(backups, ", "))
+	return nil
+}
+
+// errNoStamps is returned when recovering an AOF logged without time
+// stamps, by a version that didn't write them
+var errNoStamps = errors.New("the AOF has no time stamps to recover by")
+
+// copyFile copies the file at src to a new file at dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrBadRenamePattern is returned by RenamePattern for patterns it can't
+// map onto each other
+var ErrBadRenamePattern = errors.New("rename patterns must each contain exactly one '*' and no other wildcards")
+
+// renameMapping maps the keys matching a pattern with a single * to the
+// names given by another such pattern, keeping what the * matched
+type renameMapping struct {
+	srcPrefix, srcSuffix string
+	dstPrefix, dstSuffix string
+}
+
+func newRenameMapping(src, dst string) (renameMapping, error) {
+	srcPrefix, srcSuffix, ok := splitRenamePattern(src)
+	if !ok {
+		return renameMapping{}, ErrBadRenamePattern
+	}
+	dstPrefix, dstSuffix, ok := splitRenamePattern(dst)
+	if !ok {
+		return renameMapping{}, ErrBadRenamePattern
+	}
+	return renameMapping{srcPrefix, srcSuffix, dstPrefix, dstSuffix}, nil
+}
+
+// splitRenamePattern splits a pattern around its only *
+func splitRenamePattern(pattern string) (string, string, bool) {
+	if strings.Count(pattern, "*") != 1 || strings.ContainsAny(pattern, `?[\`) {
+		return "", "", false
+	}
+	prefix, suffix, _ := strings.Cut(pattern, "*")
+	return prefix, suffix, true
+}
+
+// target returns the new name of a key matching the source pattern
+func (m renameMapping) target(key string) string {
+	middle := key[len(m.srcPrefix) : len(key)-len(m.srcSuffix)]
+	return m.dstPrefix + middle + m.dstSuffix
+}
+
+// renameKey moves the value of src to dst with its TTL, tags and history,
+// replacing dst. Callers hold the keyspace write lock and have checked
+// that src is live.
+func (db *FlexDB) renameKey(src, dst string) {
+	val := db.data[src]
+	tags := db.tags.tagsOf(src)
+	var history *keyHistory
+	if db.history != nil {
+		db.history.mu.Lock()
+		history = db.history.keys[src]
+		db.history.mu.Unlock()
+	}
+
+	db.deleteWithoutLogging(dst)
+	db.deleteWithoutLogging(src)
+
+	db.data[dst] = val
+	db.indexKey(dst)
+	db.touch(dst)
+	db.restoreTags(dst, tags)
+	if history != nil {
+		db.history.mu.Lock()
+		db.history.keys[dst] = history
+		db.history.mu.Unlock()
+	}
+}
+
+// RenamePattern renames every key matching src, a glob pattern with a
+// single *, to dst, whose * is replaced by what src's matched. It works in
+// bounded batches like DeletePattern, each batch atomic. Existing keys
+// with the new names are replaced, or skipped along with their source
+// when nx is set. Keys created by the rename are not renamed again even
+// if they match src. It returns how many keys were renamed.
+func (db *FlexDB) RenamePattern(src, dst string, nx bool) (int, error) {
+	m, err := newRenameMapping(src, dst)
+	if err != nil {
+		return 0, err
+	}
+
+	renamed := make(map[string]bool)
+	return db.applyPattern(src, func(key string) bool {
+		target := m.target(key)
+		if renamed[key] || target == key {
+			return false
+		}
+		if existing, ok := db.data[target]; ok && nx {
+			if existing.Expiration == nil || db.now().Before(*existing.Expiration) {
+				return false
+			}
+		}
+		// names over the key length limit are left alone
+		if db.checkKey(target) != nil {
+			return false
+		}
+		db.renameKey(key, target)
+		renamed[target] = true
+		return true
+	}, func(keys []string) {
+		for _, key := range keys {
+			db.logRename(key, m.target(key))
+		}
+	}), nil
+}
+
+// logRename appends a rename to the replication stream and the AOF. A key
+// moving between partitions is deleted from the old AOF and written to the
+// new one with its tags.
+func (db *FlexDB) logRename(src, dst string) {
+	db.feedReplicas("RENAME", []string{src, dst})
+	from, to := db.aofFor(src), db.aofFor(dst)
+	if from == to {
+		if err := db.logToAOF("RENAME", src, dst); err != nil {
+			fmt.Printf("Error logging to AOF: %v\n", err)
+		}
+		return
+	}
+
+	if err := db.logTo(from, "DEL", src); err != nil {
+		fmt.Printf("Error logging to AOF: %v\n", err)
+	}
+	val, _ := db.peek(dst)
+	cmds := valueCommands(dst, val)
+	if tags := db.tags.tagsOf(dst); len(tags) > 0 {
+		cmds = append(cmds, append([]string{"TAG", dst}, tags...))
+	}
+	for _, cmd := range cmds {
+		if err := db.logTo(to, cmd[0], cmd[1:]...); err != nil {
+			fmt.Printf("Error logging to AOF: %v\n", err)
+		}
+	}
+}
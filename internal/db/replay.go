@@ -0,0 +1,600 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errReplayArgs is returned for an AOF command with malformed arguments
+var errReplayArgs = errors.New("wrong number of arguments")
+
+// builtinReplays apply the commands the server logs, besides SET and
+// expirations, which replay handles itself. They run under the keyspace
+// lock with a replaying Txn and mirror the commands that logged them:
+// arguments are logged as they applied, with indexes resolved and only
+// the elements that changed, so they don't need the checks the commands
+// make against the configured limits.
+var builtinReplays = map[string]ReplayFunc{
+	"APPEND":    replayAppend,
+	"DEL":       replayDel,
+	"RENAME":    replayRename,
+	"TAG":       replayTag,
+	"UNTAG":     replayUntag,
+	"HSET":      replayHSet,
+	"HDEL":      replayHDel,
+	"LPUSH":     replayPush(true, false),
+	"RPUSH":     replayPush(false, false),
+	"LPUSHCAP":  replayPush(true, true),
+	"RPUSHCAP":  replayPush(false, true),
+	"LPOP":      replayPop(true),
+	"RPOP":      replayPop(false),
+	"LSET":      replayLSet,
+	"LINSERT":   replayLInsert,
+	"LMOVE":     replayLMove,
+	"LREM":      replayLRem,
+	"LTRIM":     replayLTrim,
+	"SADD":      replaySAdd,
+	"SREM":      replaySRem,
+	"ZADD":      replayZAdd,
+	"ZREM":      replayZRem,
+	"TS.CREATE": replayTSCreate,
+	"TS.ADD":    replayTSAdd,
+	"QADD":      replayQAdd,
+	"QRESERVE":  replayQReserve,
+	"QACK":      replayQAck,
+	"PQ.PUSH":   replayPQPush,
+	"PQ.POP":    replayPQPop,
+}
+
+// applyReplay runs fn for an AOF command, reporting and skipping it if it
+// fails
+func (db *FlexDB) applyReplay(cmd string, args []string, fn ReplayFunc) {
+	tx := &Txn{db: db, writable: true, replaying: true}
+	if err := fn(tx, args); err != nil {
+		fmt.Printf("Error replaying %s from AOF: %v\n", cmd, err)
+	}
+}
+
+// dropKeysOf removes the keys logged by aof. Callers hold the keyspace
+// lock.
+func (db *FlexDB) dropKeysOf(aof *AOFPersistence) {
+	for key := range db.data {
+		if db.aofFor(key) == aof {
+			db.deleteWithoutLogging(key)
+		}
+	}
+}
+
+func replayAppend(tx *Txn, args []string) error {
+	if len(args) != 2 {
+		return errReplayArgs
+	}
+	_, err := tx.db.appendWithoutLogging(args[0], args[1], true)
+	return err
+}
+
+func replayDel(tx *Txn, args []string) error {
+	for _, key := range args {
+		tx.db.deleteWithoutLogging(key)
+	}
+	return nil
+}
+
+func replayRename(tx *Txn, args []string) error {
+	if len(args) != 2 {
+		return errReplayArgs
+	}
+	if _, ok := tx.Get(args[0]); !ok {
+		return ErrKeyNotFound
+	}
+	tx.db.renameKey(args[0], args[1])
+	return nil
+}
+
+func replayTag(tx *Txn, args []string) error {
+	if len(args) < 2 {
+		return errReplayArgs
+	}
+	if _, ok := tx.Get(args[0]); !ok {
+		return ErrKeyNotFound
+	}
+	tx.db.restoreTags(args[0], args[1:])
+	return nil
+}
+
+func replayUntag(tx *Txn, args []string) error {
+	if len(args) < 2 {
+		return errReplayArgs
+	}
+	for _, tag := range args[1:] {
+		tx.db.tags.remove(args[0], tag)
+	}
+	return nil
+}
+
+func replayHSet(tx *Txn, args []string) error {
+	if len(args) < 3 || len(args)%2 == 0 {
+		return errReplayArgs
+	}
+	val, ok := tx.Get(args[0])
+	if !ok {
+		val = Value{Type: TypeHash, Data: make(map[string]string)}
+	} else if val.Type != TypeHash {
+		return ErrWrongType
+	}
+	hash := val.Data.(map[string]string)
+	for i := 1; i < len(args); i += 2 {
+		hash[args[i]] = args[i+1]
+	}
+	tx.Put(args[0], val)
+	return nil
+}
+
+func replayHDel(tx *Txn, args []string) error {
+	if len(args) < 2 {
+		return errReplayArgs
+	}
+	val, ok := tx.Get(args[0])
+	if !ok {
+		return nil
+	}
+	if val.Type != TypeHash {
+		return ErrWrongType
+	}
+	hash := val.Data.(map[string]string)
+	for _, field := range args[1:] {
+		delete(hash, field)
+	}
+	if len(hash) == 0 {
+		tx.Delete(args[0])
+	}
+	return nil
+}
+
+// replayList returns the list at key, which is empty if the key doesn't
+// exist
+func replayList(tx *Txn, key string) (Value, []string, error) {
+	val, ok := tx.Get(key)
+	if !ok {
+		return Value{Type: TypeList}, nil, nil
+	}
+	if val.Type != TypeList {
+		return val, nil, ErrWrongType
+	}
+	return val, val.Data.([]string), nil
+}
+
+// storeList stores list at key, deleting the key once the list is empty
+func storeList(tx *Txn, key string, val Value, list []string) {
+	if len(list) == 0 {
+		tx.Delete(key)
+		return
+	}
+	val.Data = list
+	tx.Put(key, val)
+}
+
+// replayPush replays LPUSH and RPUSH, and with capped LPUSHCAP and
+// RPUSHCAP, whose first argument after the key is the maximum length
+func replayPush(left, capped bool) ReplayFunc {
+	return func(tx *Txn, args []string) error {
+		if len(args) < 2 {
+			return errReplayArgs
+		}
+		key, values, maxLen := args[0], args[1:], 0
+		if capped {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || len(args) < 3 {
+				return errReplayArgs
+			}
+			values, maxLen = args[2:], n
+		}
+
+		val, list, err := replayList(tx, key)
+		if err != nil {
+			return err
+		}
+		// LPUSH puts the values at the head in the order given
+		if left {
+			list = append(append([]string(nil), values...), list...)
+		} else {
+			list = append(list, values...)
+		}
+		if maxLen > 0 && len(list) > maxLen {
+			if left {
+				list = list[:maxLen]
+			} else {
+				list = list[len(list)-maxLen:]
+			}
+		}
+		storeList(tx, key, val, list)
+		return nil
+	}
+}
+
+// replayPop replays LPOP and RPOP
+func replayPop(left bool) ReplayFunc {
+	return func(tx *Txn, args []string) error {
+		if len(args) != 1 {
+			return errReplayArgs
+		}
+		val, list, err := replayList(tx, args[0])
+		if err != nil || len(list) == 0 {
+			return err
+		}
+		if left {
+			list = list[1:]
+		} else {
+			list = list[:len(list)-1]
+		}
+		storeList(tx, args[0], val, list)
+		return nil
+	}
+}
+
+func replayLSet(tx *Txn, args []string) error {
+	if len(args) != 3 {
+		return errReplayArgs
+	}
+	index, err := strconv.Atoi(args[1])
+	if err != nil {
+		return errReplayArgs
+	}
+	val, list, err := replayList(tx, args[0])
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(list) {
+		return ErrIndexOutOfRange
+	}
+	list[index] = args[2]
+	storeList(tx, args[0], val, list)
+	return nil
+}
+
+func replayLInsert(tx *Txn, args []string) error {
+	if len(args) != 4 {
+		return errReplayArgs
+	}
+	val, list, err := replayList(tx, args[0])
+	if err != nil {
+		return err
+	}
+	for at, elem := range list {
+		if elem != args[2] {
+			continue
+		}
+		if strings.ToUpper(args[1]) == "AFTER" {
+			at++
+		}
+		list = append(list, "")
+		copy(list[at+1:], list[at:])
+		list[at] = args[3]
+		storeList(tx, args[0], val, list)
+		return nil
+	}
+	return nil
+}
+
+func replayLMove(tx *Txn, args []string) error {
+	if len(args) != 4 {
+		return errReplayArgs
+	}
+	src, dst := args[0], args[1]
+	fromLeft, toLeft := strings.ToUpper(args[2]) == "LEFT", strings.ToUpper(args[3]) == "LEFT"
+
+	srcVal, list, err := replayList(tx, src)
+	if err != nil || len(list) == 0 {
+		return err
+	}
+	var elem string
+	if fromLeft {
+		elem, list = list[0], list[1:]
+	} else {
+		elem, list = list[len(list)-1], list[:len(list)-1]
+	}
+	storeList(tx, src, srcVal, list)
+
+	dstVal, target, err := replayList(tx, dst)
+	if err != nil {
+		return err
+	}
+	if toLeft {
+		target = append([]string{elem}, target...)
+	} else {
+		target = append(target, elem)
+	}
+	storeList(tx, dst, dstVal, target)
+	return nil
+}
+
+func replayLRem(tx *Txn, args []string) error {
+	if len(args) != 3 {
+		return errReplayArgs
+	}
+	count, err := strconv.Atoi(args[1])
+	if err != nil {
+		return errReplayArgs
+	}
+	val, list, err := replayList(tx, args[0])
+	if err != nil {
+		return err
+	}
+
+	// as in LREM: from the head for a positive count, from the tail for
+	// a negative one, every occurrence for 0
+	limit, step, i := count, 1, 0
+	if count < 0 {
+		limit, step, i = -count, -1, len(list)-1
+	}
+	drop := make([]bool, len(list))
+	for removed := 0; i >= 0 && i < len(list) && (limit == 0 || removed < limit); i += step {
+		if list[i] == args[2] {
+			drop[i] = true
+			removed++
+		}
+	}
+	kept := make([]string, 0, len(list))
+	for i, elem := range list {
+		if !drop[i] {
+			kept = append(kept, elem)
+		}
+	}
+	storeList(tx, args[0], val, kept)
+	return nil
+}
+
+func replayLTrim(tx *Txn, args []string) error {
+	if len(args) != 3 {
+		return errReplayArgs
+	}
+	start, err1 := strconv.Atoi(args[1])
+	stop, err2 := strconv.Atoi(args[2])
+	if err1 != nil || err2 != nil {
+		return errReplayArgs
+	}
+	val, list, err := replayList(tx, args[0])
+	if err != nil {
+		return err
+	}
+
+	// LTRIM logs the range it resolved
+	if start < 0 {
+		start = 0
+	}
+	if stop >= len(list) {
+		stop = len(list) - 1
+	}
+	if start > stop {
+		list = nil
+	} else {
+		list = list[start : stop+1]
+	}
+	storeList(tx, args[0], val, list)
+	return nil
+}
+
+func replaySAdd(tx *Txn, args []string) error {
+	if len(args) < 2 {
+		return errReplayArgs
+	}
+	s, err := setAt(tx, args[0])
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		s = make(stringSet)
+		tx.Put(args[0], Value{Type: TypeSet, Data: s})
+	}
+	for _, member := range args[1:] {
+		s[member] = struct{}{}
+	}
+	return nil
+}
+
+func replaySRem(tx *Txn, args []string) error {
+	if len(args) < 2 {
+		return errReplayArgs
+	}
+	s, err := setAt(tx, args[0])
+	if err != nil || s == nil {
+		return err
+	}
+	for _, member := range args[1:] {
+		delete(s, member)
+	}
+	if len(s) == 0 {
+		tx.Delete(args[0])
+	}
+	return nil
+}
+
+func replayZAdd(tx *Txn, args []string) error {
+	if len(args) < 3 || len(args)%2 == 0 {
+		return errReplayArgs
+	}
+	zset, err := sortedSetAt(tx, args[0])
+	if err != nil {
+		return err
+	}
+	if zset == nil {
+		zset = newSortedSet()
+		tx.Put(args[0], Value{Type: TypeZSet, Data: zset})
+	}
+	for i := 1; i < len(args); i += 2 {
+		score, err := strconv.ParseFloat(args[i], 64)
+		if err != nil {
+			return errReplayArgs
+		}
+		zset.Add(args[i+1], score)
+	}
+	return nil
+}
+
+func replayZRem(tx *Txn, args []string) error {
+	if len(args) < 2 {
+		return errReplayArgs
+	}
+	zset, err := sortedSetAt(tx, args[0])
+	if err != nil || zset == nil {
+		return err
+	}
+	for _, member := range args[1:] {
+		zset.Remove(member)
+	}
+	if zset.Len() == 0 {
+		tx.Delete(args[0])
+	}
+	return nil
+}
+
+func replayTSCreate(tx *Txn, args []string) error {
+	if len(args) != 3 || strings.ToUpper(args[1]) != "RETENTION" {
+		return errReplayArgs
+	}
+	retention, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errReplayArgs
+	}
+	if _, ok := tx.Get(args[0]); ok {
+		return nil
+	}
+	tx.Put(args[0], Value{Type: TypeTimeSeries, Data: &timeSeries{retention: retention}})
+	return nil
+}
+
+func replayTSAdd(tx *Txn, args []string) error {
+	if len(args) != 3 {
+		return errReplayArgs
+	}
+	timestamp, err1 := strconv.ParseInt(args[1], 10, 64)
+	value, err2 := strconv.ParseFloat(args[2], 64)
+	if err1 != nil || err2 != nil {
+		return errReplayArgs
+	}
+	ts, err := timeSeriesAt(tx, args[0])
+	if err != nil {
+		return err
+	}
+	if ts == nil {
+		ts = &timeSeries{}
+		tx.Put(args[0], Value{Type: TypeTimeSeries, Data: ts})
+	}
+	return ts.add(Sample{Timestamp: timestamp, Value: value})
+}
+
+func replayQAdd(tx *Txn, args []string) error {
+	if len(args) < 3 || len(args)%2 == 0 {
+		return errReplayArgs
+	}
+	q, err := jobQueueAt(tx, args[0])
+	if err != nil {
+		return err
+	}
+	if q == nil {
+		q = newJobQueue()
+		tx.Put(args[0], Value{Type: TypeQueue, Data: q})
+	}
+	for i := 1; i < len(args); i += 2 {
+		q.ready = append(q.ready, Job{ID: args[i], Payload: args[i+1]})
+		// new jobs must not reuse the ids
+		if order := jobOrder(args[i]); order >= q.nextID {
+			q.nextID = order + 1
+		}
+	}
+	return nil
+}
+
+func replayQReserve(tx *Txn, args []string) error {
+	if len(args) < 3 {
+		return errReplayArgs
+	}
+	ms, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errReplayArgs
+	}
+	q, err := jobQueueAt(tx, args[0])
+	if err != nil || q == nil {
+		return err
+	}
+
+	deadline := time.UnixMilli(ms)
+	for _, id := range args[2:] {
+		// a job reserved again after its reservation lapsed is still in
+		// reserved, as nothing requeues it while replaying
+		if r, ok := q.reserved[id]; ok {
+			r.deadline = deadline
+			q.reserved[id] = r
+			continue
+		}
+		for i, job := range q.ready {
+			if job.ID == id {
+				q.ready = append(q.ready[:i], q.ready[i+1:]...)
+				q.reserved[id] = reservation{Job: job, deadline: deadline}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func replayQAck(tx *Txn, args []string) error {
+	if len(args) < 2 {
+		return errReplayArgs
+	}
+	q, err := jobQueueAt(tx, args[0])
+	if err != nil || q == nil {
+		return err
+	}
+	for _, id := range args[1:] {
+		delete(q.reserved, id)
+	}
+	if q.Len() == 0 {
+		tx.Delete(args[0])
+	}
+	return nil
+}
+
+func replayPQPush(tx *Txn, args []string) error {
+	if len(args) != 3 {
+		return errReplayArgs
+	}
+	priority, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errReplayArgs
+	}
+	q, err := priorityQueueAt(tx, args[0])
+	if err != nil {
+		return err
+	}
+	if q == nil {
+		q = &priorityQueue{}
+		tx.Put(args[0], Value{Type: TypePQ, Data: q})
+	}
+	q.push(PQItem{Priority: priority, Value: args[2]})
+	return nil
+}
+
+func replayPQPop(tx *Txn, args []string) error {
+	if len(args) != 2 {
+		return errReplayArgs
+	}
+	count, err := strconv.Atoi(args[1])
+	if err != nil {
+		return errReplayArgs
+	}
+	q, err := priorityQueueAt(tx, args[0])
+	if err != nil || q == nil {
+		return err
+	}
+	for i := 0; i < count && q.Len() > 0; i++ {
+		q.pop()
+	}
+	if q.Len() == 0 {
+		tx.Delete(args[0])
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeReplayKeys writes a key of each type through the commands the AOF
+// has to replay
+func writeReplayKeys(t *testing.T, db *FlexDB) {
+	t.Helper()
+	exp := time.Now().Add(time.Hour)
+	if err := db.Set("s", "v", &exp); err != nil {
+		t.Fatal(err)
+	}
+	db.RPush("l", "a", "b", "c")
+	db.LPop("l")
+	db.HSet("h", "f", "1")
+	db.HSet("h", "g", "2")
+	db.HDel("h", "f")
+	db.SAdd("set", "x", "y")
+	db.ZAdd("z", []ZEntry{{Member: "m", Score: 1.5}, {Member: "n", Score: -2}}, ZAddFlags{})
+	if err := db.Expire("l", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Tag("h", "t1", "t2"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkReplayKeys checks the keys written by writeReplayKeys
+func checkReplayKeys(t *testing.T, db *FlexDB) {
+	t.Helper()
+	if val, err := db.Get("s"); err != nil || val != "v" {
+		t.Errorf("string: %v, %v", val, err)
+	}
+	if list, err := db.LRange("l", 0, -1); err != nil || !reflect.DeepEqual(list, []string{"b", "c"}) {
+		t.Errorf("list: %v, %v", list, err)
+	}
+	if hash, err := db.HGetAll("h"); err != nil || !reflect.DeepEqual(hash, map[string]string{"g": "2"}) {
+		t.Errorf("hash: %v, %v", hash, err)
+	}
+	if members, err := db.SMembers("set"); err != nil || !reflect.DeepEqual(members, []string{"x", "y"}) {
+		t.Errorf("set: %v, %v", members, err)
+	}
+	want := []ZEntry{{Member: "n", Score: -2}, {Member: "m", Score: 1.5}}
+	if entries, err := db.ZRange("z", 0, -1); err != nil || !reflect.DeepEqual(entries, want) {
+		t.Errorf("sorted set: %v, %v", entries, err)
+	}
+	for _, key := range []string{"s", "l"} {
+		if ttl, err := db.TTL(key); err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+			t.Errorf("TTL of %s: %v, %v", key, ttl, err)
+		}
+	}
+	if tags, err := db.Tags("h"); err != nil || !reflect.DeepEqual(tags, []string{"t1", "t2"}) {
+		t.Errorf("tags: %v, %v", tags, err)
+	}
+}
+
+func TestAOFReplay(t *testing.T) {
+	dir := t.TempDir()
+	aof := WithAOF(filepath.Join(dir, "flex.aof"), AOFSyncAlways)
+	db := openTestDB(t, filepath.Join(dir, "first.db"), aof)
+	writeReplayKeys(t, db)
+	db.Close()
+
+	// a new snapshot file leaves the AOF alone to restore the keys
+	checkReplayKeys(t, openTestDB(t, filepath.Join(dir, "second.db"), aof))
+}
+
+func TestAOFRewriteReplay(t *testing.T) {
+	dir := t.TempDir()
+	aof := WithAOF(filepath.Join(dir, "flex.aof"), AOFSyncAlways)
+	db := openTestDB(t, filepath.Join(dir, "first.db"), aof)
+	writeReplayKeys(t, db)
+	if err := db.RewriteAOF(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	checkReplayKeys(t, openTestDB(t, filepath.Join(dir, "second.db"), aof))
+}
+
+func TestAOFReplayExpiredBetweenWrites(t *testing.T) {
+	dir := t.TempDir()
+	aof := WithAOF(filepath.Join(dir, "flex.aof"), AOFSyncAlways)
+	db := openTestDB(t, filepath.Join(dir, "first.db"), aof)
+	// no DEL is logged for the keys once they expire, as after a crash
+	db.SetActiveExpire(false)
+	db.RPush("l", "a")
+	db.Expire("l", 200*time.Millisecond)
+	db.RPush("l", "b")
+	db.HSet("h", "f", "1")
+	db.Expire("h", 200*time.Millisecond)
+	db.HSet("h", "g", "2")
+	if _, err := db.Tag("h", "t1"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	time.Sleep(300 * time.Millisecond)
+
+	// the replayed writes keep the TTL of the keys they extend, so the
+	// keys are gone rather than rebuilt from the writes after the EXPIRE
+	db = openTestDB(t, filepath.Join(dir, "second.db"), aof)
+	if list, err := db.LRange("l", 0, -1); err != nil || len(list) != 0 {
+		t.Errorf("expired list after replay: %v, %v", list, err)
+	}
+	if hash, err := db.HGetAll("h"); err != nil || len(hash) != 0 {
+		t.Errorf("expired hash after replay: %v, %v", hash, err)
+	}
+	if keys := db.TaggedKeys("t1"); len(keys) != 0 {
+		t.Errorf("expired hash still tagged after replay: %v", keys)
+	}
+}
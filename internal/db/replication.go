@@ -0,0 +1,560 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replication
+//
+// A master sends its replicas the commands it logs, encoded as in the AOF.
+// Every byte of that stream has an offset, and the stream is numbered by
+// a random replication ID. From the first time a replica attaches, the
+// end of the stream is kept in a circular backlog.
+//
+// A replica remembers the ID of its master and the offset it has applied.
+// When it reconnects after a brief disconnect, it asks for the stream
+// from there (PSYNC). If the ID matches and the backlog still holds that
+// offset, the master sends only the missing part. Otherwise the master
+// sends a snapshot taken at a known offset and the stream after it: a
+// full resynchronization.
+//
+// A replica records the stream it applies in its own backlog, byte for
+// byte and under its master's ID, so once promoted it can continue the
+// other replicas of its old master. Promotion keeps the old ID as the
+// previous one, valid up to the offset the replica had reached.
+
+// DefaultReplicationBacklog is the size of the replication backlog unless
+// set with WithReplicationBacklog
+const DefaultReplicationBacklog = 1 << 20
+
+// ErrBacklogOverrun is returned by a ReplicationStream that fell further
+// behind than the backlog reaches
+var ErrBacklogOverrun = errors.New("the replica fell behind the replication backlog")
+
+// WithReplicationBacklog sets how many bytes of the replication stream
+// are kept for replicas to catch up on after a disconnect. It must also
+// cover what's written while a full resynchronization transfers its
+// snapshot.
+func WithReplicationBacklog(size int) Option {
+	return func(db *FlexDB) {
+		if size > 0 {
+			db.repl.size = size
+		}
+	}
+}
+
+// replicationLog is the replication stream and its backlog. Commands are
+// fed under the keyspace lock, so holding it keeps the stream still.
+type replicationLog struct {
+	mu      sync.Mutex
+	id      string        // replication ID of the stream
+	prevID  string        // ID the stream had before the last promotion
+	prevEnd int64         // offset up to which the stream continues prevID's
+	offset  int64         // offset past the last byte of the stream
+	count   int64         // commands added to the stream since the server started
+	size    int           // capacity of the backlog
+	backlog []byte        // circular, nil until the first replica attaches
+	held    int           // bytes of the stream in the backlog
+	grown   chan struct{} // closed and replaced when the stream grows
+	replica bool          // the stream comes from a master, see ApplyReplicated
+
+	acks  map[*ReplicationStream]int64 // offset each attached replica acknowledged
+	acked chan struct{}                // closed and replaced on every acknowledgement
+}
+
+// newReplicationID returns a random replication ID, 40 hex digits like
+// those of Redis
+func newReplicationID() string {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		panic("flexdb: no randomness for replication IDs: " + err.Error())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// init gives the stream a fresh ID
+func (r *replicationLog) init() {
+	r.id = newReplicationID()
+	r.size = DefaultReplicationBacklog
+	r.grown = make(chan struct{})
+	r.acks = make(map[*ReplicationStream]int64)
+	r.acked = make(chan struct{})
+}
+
+// recording reports whether the stream is kept, which it is from the
+// first time a replica attaches
+func (r *replicationLog) recording() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.backlog != nil
+}
+
+// start keeps the stream from now on if it isn't yet
+func (r *replicationLog) start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.backlog == nil {
+		r.backlog = make([]byte, r.size)
+		r.held = 0
+	}
+}
+
+// append adds data to the stream
+func (r *replicationLog) append(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.backlog == nil {
+		return
+	}
+	// only the tail of data fits if it's bigger than the backlog
+	if len(data) > r.size {
+		r.offset += int64(len(data) - r.size)
+		data = data[len(data)-r.size:]
+	}
+	at := int(r.offset % int64(r.size))
+	n := copy(r.backlog[at:], data)
+	copy(r.backlog, data[n:])
+	r.offset += int64(len(data))
+	r.count++
+	r.held += len(data)
+	if r.held > r.size {
+		r.held = r.size
+	}
+	close(r.grown)
+	r.grown = make(chan struct{})
+}
+
+// readFrom returns the stream from offset on, at most max bytes of it.
+// With nothing past offset yet, it returns a channel closed once there
+// is.
+func (r *replicationLog) readFrom(offset int64, max int) ([]byte, <-chan struct{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if offset < r.offset-int64(r.held) || offset > r.offset {
+		return nil, nil, ErrBacklogOverrun
+	}
+	if offset == r.offset {
+		return nil, r.grown, nil
+	}
+	n := int(r.offset - offset)
+	if n > max {
+		n = max
+	}
+	data := make([]byte, n)
+	at := int(offset % int64(r.size))
+	copied := copy(data, r.backlog[at:])
+	copy(data[copied:], r.backlog)
+	return data, nil, nil
+}
+
+// continues reports whether the stream holds everything past offset of
+// the stream called id
+func (r *replicationLog) continues(id string, offset int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.backlog == nil || offset < r.offset-int64(r.held) || offset > r.offset {
+		return false
+	}
+	return id == r.id || (id == r.prevID && offset <= r.prevEnd)
+}
+
+// feedReplicas appends a command to the replication stream, encrypted as
+// it would be in the AOF. A replica only records the stream of its
+// master. Callers hold the keyspace lock.
+func (db *FlexDB) feedReplicas(cmd string, args []string) {
+	db.repl.mu.Lock()
+	skip := db.repl.backlog == nil || db.repl.replica
+	db.repl.mu.Unlock()
+	if skip {
+		return
+	}
+	if len(args) > 0 && db.encrypted(args[0]) {
+		cmd, args = db.sealCommand(args[0], cmd, args)
+	}
+	db.repl.append(encodeCommand(cmd, args))
+}
+
+// ReplicationStream reads the replication stream from an offset on
+type ReplicationStream struct {
+	db      *FlexDB
+	id      string
+	offset  int64
+	lastAck time.Time // when the replica last acknowledged, under repl.mu
+}
+
+// ID returns the replication ID of the stream
+func (s *ReplicationStream) ID() string {
+	return s.id
+}
+
+// Offset returns the offset of the next byte Next returns
+func (s *ReplicationStream) Offset() int64 {
+	return s.offset
+}
+
+// Next returns the next bytes of the stream, at most max of them, waiting
+// until there are some or ctx is done. It fails with ErrBacklogOverrun
+// once the reader fell behind the backlog.
+func (s *ReplicationStream) Next(ctx context.Context, max int) ([]byte, error) {
+	for {
+		data, grown, err := s.db.repl.readFrom(s.offset, max)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			s.offset += int64(len(data))
+			return data, nil
+		}
+		select {
+		case <-grown:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Ack records that the replica reading the stream applied it up to
+// offset, see WaitForReplicas
+func (s *ReplicationStream) Ack(offset int64) {
+	r := &s.db.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.acks[s]; !ok {
+		return
+	}
+	r.acks[s] = offset
+	s.lastAck = time.Now()
+	close(r.acked)
+	r.acked = make(chan struct{})
+}
+
+// Acked returns the offset the replica reading the stream acknowledged
+func (s *ReplicationStream) Acked() int64 {
+	r := &s.db.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.acks[s]
+}
+
+// LastAck returns when the replica reading the stream last acknowledged
+// it, or attached if it hasn't yet
+func (s *ReplicationStream) LastAck() time.Time {
+	r := &s.db.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return s.lastAck
+}
+
+// Close stops counting the replica reading the stream as attached
+func (s *ReplicationStream) Close() {
+	r := &s.db.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.acks, s)
+}
+
+// attach returns a stream from offset on and counts its reader as an
+// attached replica until the stream is closed. Callers hold repl.mu.
+func (db *FlexDB) attach(offset int64) *ReplicationStream {
+	stream := &ReplicationStream{db: db, id: db.repl.id, offset: offset, lastAck: time.Now()}
+	db.repl.acks[stream] = 0
+	return stream
+}
+
+// PartialSync returns the stream past offset for a replica that applied
+// the stream called id up to there, and false if a full resynchronization
+// is needed instead: the ID is unknown or the backlog doesn't reach back
+// to offset.
+func (db *FlexDB) PartialSync(id string, offset int64) (*ReplicationStream, bool) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if !db.repl.continues(id, offset) {
+		return nil, false
+	}
+	db.repl.mu.Lock()
+	defer db.repl.mu.Unlock()
+	return db.attach(offset), true
+}
+
+// FullSync is Backup for a replica's full resynchronization: it writes a
+// snapshot of the keyspace to w and returns the stream of the commands
+// logged after the snapshot was taken, and how many bytes it wrote.
+func (db *FlexDB) FullSync(w io.Writer) (*ReplicationStream, int64, error) {
+	var stream *ReplicationStream
+	n, err := db.backup(w, func() {
+		db.repl.start()
+		db.repl.mu.Lock()
+		stream = db.attach(db.repl.offset)
+		db.repl.mu.Unlock()
+	})
+	if err != nil {
+		return nil, n, err
+	}
+	return stream, n, nil
+}
+
+// FeedPing adds a PING to the replication stream if it's recorded, so
+// replicas can tell an idle master from a lost one. Replicas apply it as
+// a no-op.
+func (db *FlexDB) FeedPing() {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.feedReplicas("PING", nil)
+}
+
+// WaitForReplicas waits until n of the attached replicas acknowledged the
+// stream up to its current end, or until ctx is done, and returns how many
+// did. Replicas are asked to acknowledge right away if some haven't yet.
+func (db *FlexDB) WaitForReplicas(ctx context.Context, n int) int {
+	db.lock.RLock()
+	db.repl.mu.Lock()
+	target := db.repl.offset
+	db.repl.mu.Unlock()
+	db.lock.RUnlock()
+
+	asked := false
+	for {
+		db.repl.mu.Lock()
+		count := 0
+		for _, offset := range db.repl.acks {
+			if offset >= target {
+				count++
+			}
+		}
+		acked := db.repl.acked
+		behind := count < len(db.repl.acks)
+		db.repl.mu.Unlock()
+		if count >= n || ctx.Err() != nil {
+			return count
+		}
+
+		if behind && !asked {
+			db.requestAcks()
+			asked = true
+		}
+		after := waiting(ctx)
+		select {
+		case <-acked:
+		case <-ctx.Done():
+		}
+		after()
+	}
+}
+
+// requestAcks adds REPLCONF GETACK to the replication stream, which makes
+// replicas acknowledge the offset they reached at once. It's never sealed,
+// as replicas need to recognize it.
+func (db *FlexDB) requestAcks() {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.repl.append(encodeCommand("REPLCONF", []string{"GETACK", "*"}))
+}
+
+// ReplicationID returns the replication ID of the stream
+func (db *FlexDB) ReplicationID() string {
+	db.repl.mu.Lock()
+	defer db.repl.mu.Unlock()
+	return db.repl.id
+}
+
+// ReplicationOffset returns the offset past the end of the stream: for a
+// master, every byte it logged for replicas, for a replica every byte it
+// applied
+func (db *FlexDB) ReplicationOffset() int64 {
+	db.repl.mu.Lock()
+	defer db.repl.mu.Unlock()
+	return db.repl.offset
+}
+
+// ReplicationStats describes the replication stream, see INFO replication
+type ReplicationStats struct {
+	ID            string // replication ID of the stream
+	PrevID        string // ID the stream had before the last promotion
+	PrevEnd       int64  // offset up to which the stream continues PrevID's
+	Offset        int64  // offset past the last byte of the stream
+	Commands      int64  // commands added to the stream since the server started
+	BacklogActive bool   // the stream is kept, since a replica attached
+	BacklogSize   int    // capacity of the backlog in bytes
+	BacklogFirst  int64  // offset of the oldest byte in the backlog
+	BacklogHeld   int    // bytes of the stream in the backlog
+}
+
+// ReplicationStats returns the state of the replication stream
+func (db *FlexDB) ReplicationStats() ReplicationStats {
+	db.repl.mu.Lock()
+	defer db.repl.mu.Unlock()
+	return ReplicationStats{
+		ID:            db.repl.id,
+		PrevID:        db.repl.prevID,
+		PrevEnd:       db.repl.prevEnd,
+		Offset:        db.repl.offset,
+		Commands:      db.repl.count,
+		BacklogActive: db.repl.backlog != nil,
+		BacklogSize:   db.repl.size,
+		BacklogFirst:  db.repl.offset - int64(db.repl.held),
+		BacklogHeld:   db.repl.held,
+	}
+}
+
+// ChangeReplicationID gives the stream a new ID, so replicas can't
+// continue it and resynchronize fully
+func (db *FlexDB) ChangeReplicationID() {
+	db.repl.mu.Lock()
+	defer db.repl.mu.Unlock()
+	db.repl.id = newReplicationID()
+	db.repl.prevID, db.repl.prevEnd = "", 0
+}
+
+// isReplica reports whether the keyspace follows a master's stream
+func (db *FlexDB) isReplica() bool {
+	db.repl.mu.Lock()
+	defer db.repl.mu.Unlock()
+	return db.repl.replica
+}
+
+// BecomeReplica stops logging commands to the replication stream, which
+// records only what ApplyReplicated applies from then on
+func (db *FlexDB) BecomeReplica() {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.repl.mu.Lock()
+	defer db.repl.mu.Unlock()
+	db.repl.replica = true
+}
+
+// Promote turns a replica into a master. The stream gets a new ID and
+// keeps the old one as its previous ID, so replicas of the same master
+// can continue from it.
+func (db *FlexDB) Promote() {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.repl.mu.Lock()
+	defer db.repl.mu.Unlock()
+	if !db.repl.replica {
+		return
+	}
+	db.repl.replica = false
+	db.repl.prevID, db.repl.prevEnd = db.repl.id, db.repl.offset
+	db.repl.id = newReplicationID()
+}
+
+// ContinueReplication records that the master continued the stream of
+// this replica under id, after a partial resynchronization. A master
+// promoted since gives its stream a new ID.
+func (db *FlexDB) ContinueReplication(id string) {
+	db.repl.mu.Lock()
+	defer db.repl.mu.Unlock()
+	if id != db.repl.id {
+		db.repl.prevID, db.repl.prevEnd = db.repl.id, db.repl.offset
+		db.repl.id = id
+	}
+	if db.repl.backlog == nil {
+		db.repl.backlog = make([]byte, db.repl.size)
+	}
+}
+
+// LoadFullSync replaces the keyspace with the snapshot at path, sent by
+// the master for a full resynchronization, and continues the stream
+// called id from offset, see ReplaceKeyspace.
+func (db *FlexDB) LoadFullSync(path, id string, offset int64) error {
+	err := db.replaceKeyspace(path, func() {
+		db.repl.mu.Lock()
+		db.repl.id, db.repl.offset = id, offset
+		db.repl.prevID, db.repl.prevEnd = "", 0
+		db.repl.backlog = make([]byte, db.repl.size)
+		db.repl.held = 0
+		db.repl.mu.Unlock()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load the master's snapshot: %w", err)
+	}
+	return nil
+}
+
+// ApplyReplicated applies a command of the master's stream, logs it to the
+// AOF like the command that logged it on the master, and records it in the
+// replication stream.
+func (db *FlexDB) ApplyReplicated(parts []string) error {
+	if len(parts) == 0 {
+		return nil
+	}
+	db.lock.Lock()
+	keys, all, err := db.applyReplicated(strings.ToUpper(parts[0]), parts[1:])
+	db.repl.append(encodeCommand(parts[0], parts[1:]))
+	db.lock.Unlock()
+
+	if all {
+		db.triggerWrite()
+	} else if len(keys) > 0 {
+		db.triggerWrite(keys...)
+	}
+	return err
+}
+
+// applyReplicated applies a command of the master's stream and returns
+// the keys it changed, or true if it may have changed any. Callers hold
+// the keyspace lock.
+func (db *FlexDB) applyReplicated(cmd string, args []string) ([]string, bool, error) {
+	switch cmd {
+	case "PING", "REPLCONF":
+		return nil, false, nil
+	case "ENC":
+		inner, err := db.openCommand(args)
+		if err != nil {
+			return nil, false, fmt.Errorf("error decrypting replicated command: %w", err)
+		}
+		parts, err := decodeCommand(inner)
+		if err != nil || len(parts) == 0 {
+			return nil, false, fmt.Errorf("error in parsing encrypted replicated command: %v", err)
+		}
+		return db.applyReplicated(strings.ToUpper(parts[0]), parts[1:])
+	case "FLUSHALL":
+		for key := range db.data {
+			db.deleteWithoutLogging(key)
+		}
+		db.logReplicated(cmd, args)
+		return nil, true, nil
+	}
+
+	switch fn, builtin := builtinReplays[cmd]; {
+	case cmd == "SET" || cmd == "PEXPIREAT":
+		if err := db.replayExpiring(cmd, args); err != nil {
+			return nil, false, err
+		}
+	case builtin:
+		tx := &Txn{db: db, writable: true, replaying: true}
+		if err := fn(tx, args); err != nil {
+			return nil, false, fmt.Errorf("error applying replicated %s: %w", cmd, err)
+		}
+	case !db.replayExtension(cmd, args):
+		return nil, false, fmt.Errorf("unknown replicated command %s", cmd)
+	}
+	db.logReplicated(cmd, args)
+
+	switch {
+	case len(args) == 0:
+		return nil, true, nil
+	case cmd == "DEL":
+		return args, false, nil
+	case (cmd == "RENAME" || cmd == "LMOVE") && len(args) >= 2:
+		return args[:2], false, nil
+	default:
+		return args[:1], false, nil
+	}
+}
+
+// logReplicated logs a command applied from the master's stream to the
+// AOF
+func (db *FlexDB) logReplicated(cmd string, args []string) {
+	if err := db.logToAOF(cmd, args...); err != nil {
+		fmt.Printf("Error logging to AOF: %v\n", err)
+	}
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SaveRule schedules a snapshot once at least Changes changes are unsaved
+// and the oldest of them was made at least After ago, like Redis's
+// "save <seconds> <changes>". A burst of writes is saved once, when the
+// first rule it satisfies comes due.
+type SaveRule struct {
+	After   time.Duration
+	Changes uint64
+}
+
+// String returns the rule as "<seconds> <changes>"
+func (r SaveRule) String() string {
+	seconds := strconv.FormatFloat(r.After.Seconds(), 'f', -1, 64)
+	return seconds + " " + strconv.FormatUint(r.Changes, 10)
+}
+
+// DefaultSaveRules saves every change half a second after it was made,
+// letting a burst of writes collect into one snapshot
+var DefaultSaveRules = []SaveRule{{After: 500 * time.Millisecond, Changes: 1}}
+
+// WithSaveRules sets when snapshots are written: as soon as any of the
+// rules is satisfied. Without rules, snapshots are only written by SAVE,
+// on shutdown and when write backpressure needs one, which suits a
+// database relying on its AOF. The default is DefaultSaveRules.
+func WithSaveRules(rules ...SaveRule) Option {
+	return func(db *FlexDB) {
+		db.saveRules = make([]SaveRule, 0, len(rules))
+		for _, rule := range rules {
+			if rule.Changes == 0 {
+				rule.Changes = 1
+			}
+			db.saveRules = append(db.saveRules, rule)
+		}
+	}
+}
+
+// SaveRules returns the rules snapshots are written by
+func (db *FlexDB) SaveRules() []SaveRule {
+	return append([]SaveRule(nil), db.saveRules...)
+}
+
+// FormatSaveRules returns rules the way ParseSaveRules reads them
+func FormatSaveRules(rules []SaveRule) string {
+	parts := make([]string, len(rules))
+	for i, rule := range rules {
+		parts[i] = rule.String()
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParseSaveRules parses "<seconds> <changes>" pairs separated by spaces,
+// such as "900 1 300 10 60 10000". Seconds may be fractional. An empty
+// string returns no rules.
+func ParseSaveRules(s string) ([]SaveRule, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, errSaveRules(s)
+	}
+
+	rules := make([]SaveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil || seconds < 0 {
+			return nil, errSaveRules(s)
+		}
+		changes, err := strconv.ParseUint(fields[i+1], 10, 64)
+		if err != nil || changes == 0 {
+			return nil, errSaveRules(s)
+		}
+		rules = append(rules, SaveRule{
+			After:   time.Duration(seconds * float64(time.Second)),
+			Changes: changes,
+		})
+	}
+	return rules, nil
+}
+
+func errSaveRules(s string) error {
+	return fmt.Errorf("invalid save rules %q, expected '<seconds> <changes>' pairs", s)
+}
+
+// nextSave returns when writeLoop should write the next snapshot, and
+// false if none is due yet. A failed snapshot is retried at retryAt, and
+// throttled writers are waiting when writes are behind, so those come
+// first. Callers hold persistMu.
+func (db *FlexDB) nextSave(retryAt time.Time) (time.Time, bool) {
+	if !retryAt.IsZero() {
+		return retryAt, true
+	}
+	if db.maxUnsaved > 0 && db.dirty > db.maxUnsaved {
+		return time.Now(), true
+	}
+	if db.dirty == 0 {
+		return time.Time{}, false
+	}
+	return db.saveDue(db.dirty, db.dirtySince)
+}
+
+// saveDue returns when the next snapshot is due for changes unsaved
+// changes, the oldest made at since, and false if no rule is satisfied
+// yet. Callers hold persistMu.
+func (db *FlexDB) saveDue(changes uint64, since time.Time) (time.Time, bool) {
+	var due time.Time
+	found := false
+	for _, rule := range db.saveRules {
+		if changes < rule.Changes {
+			continue
+		}
+		at := since.Add(rule.After)
+		if !found || at.Before(due) {
+			due, found = at, true
+		}
+	}
+	return due, found
+}
+
+// saveRuleReached reports whether the change count just reached the
+// threshold of a rule, or of write backpressure, so writeLoop must
+// recompute when to save. Callers hold persistMu.
+func (db *FlexDB) saveRuleReached(changes uint64) bool {
+	if db.maxUnsaved > 0 && changes == db.maxUnsaved+1 {
+		return true
+	}
+	for _, rule := range db.saveRules {
+		if changes == rule.Changes {
+			return true
+		}
+	}
+	return false
+}
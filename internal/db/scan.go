@@ -0,0 +1,184 @@
+package db
+
+import (
+	"hash/fnv"
+	"sort"
+
+	"flex-db/internal/utils"
+)
+
+// Scan walks the keyspace a page at a time. It looks at about count keys
+// from cursor on, 0 starting the scan, and returns those matching the
+// glob pattern and, unless typeName is empty, holding that type. Pages
+// can therefore be short or even empty while more keys follow. It also
+// returns the cursor to pass to the next call, 0 once every key was seen.
+//
+// Keys are walked in scan order, by the hash of their name, and the
+// cursor is the hash to resume from. A key keeps its place however many
+// keys are created or deleted around it, so keys that exist for the whole
+// scan are returned exactly once; keys created or deleted meanwhile may or
+// may not be. Keys come from an index kept in scan order, so a page costs
+// a binary search rather than a pass over the keyspace.
+func (db *FlexDB) Scan(cursor uint64, pattern, typeName string, count int) ([]string, uint64) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	idx := &db.scanIndex
+	idx.mu.Lock()
+	idx.refresh(db.data)
+	now := db.now()
+	seen, next := scanPage(idx.sorted, cursor, count, func(key string) bool {
+		val, ok := db.data[key]
+		return ok && (val.Expiration == nil || !now.After(*val.Expiration))
+	})
+	idx.mu.Unlock()
+
+	keys := make([]string, 0, len(seen))
+	for _, key := range seen {
+		if pattern != "" && !utils.MatchGlob(pattern, key) {
+			continue
+		}
+		if typeName != "" && db.data[key].Type.String() != typeName {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, next
+}
+
+// scanHash places a name in scan order
+func scanHash(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64()
+}
+
+// scanLess orders names for scans: by hash, then by name
+func scanLess(a, b string) bool {
+	ha, hb := scanHash(a), scanHash(b)
+	if ha != hb {
+		return ha < hb
+	}
+	return a < b
+}
+
+// scanPage returns, from names in scan order, up to about count of those
+// whose hash is at least cursor and that live reports as existing, with
+// the cursor of the next page, 0 once names run out. A nil live takes
+// every name. Names sharing a hash always end up on the same page, so the
+// next page can start at the hash of the first name left out.
+func scanPage(names []string, cursor uint64, count int, live func(string) bool) ([]string, uint64) {
+	i := sort.Search(len(names), func(i int) bool {
+		return scanHash(names[i]) >= cursor
+	})
+
+	var page []string
+	last := uint64(0)
+	for ; i < len(names); i++ {
+		name := names[i]
+		hash := scanHash(name)
+		if len(page) >= count && hash != last {
+			return page, hash
+		}
+		if live != nil && !live(name) {
+			continue
+		}
+		page = append(page, name)
+		last = hash
+	}
+	return page, 0
+}
+
+// scanNames is scanPage over names in any order, for collections that
+// have no index in scan order
+func scanNames(names []string, cursor uint64, count int) ([]string, uint64) {
+	sort.Slice(names, func(i, j int) bool { return scanLess(names[i], names[j]) })
+	return scanPage(names, cursor, count, nil)
+}
+
+// HScan walks the hash at key like Scan walks the keyspace. Entries hold
+// the fields matching pattern and their values.
+func (db *FlexDB) HScan(key string, cursor uint64, pattern string, count int) ([]Entry, uint64, error) {
+	var entries []Entry
+	next := uint64(0)
+	err := db.View(func(tx *Txn) error {
+		val, ok := tx.Get(key)
+		if !ok {
+			return nil
+		}
+		if val.Type != TypeHash {
+			return ErrWrongType
+		}
+
+		hash := val.Data.(map[string]string)
+		fields := make([]string, 0, len(hash))
+		for field := range hash {
+			fields = append(fields, field)
+		}
+		var page []string
+		page, next = scanNames(fields, cursor, count)
+		for _, field := range page {
+			if pattern == "" || utils.MatchGlob(pattern, field) {
+				entries = append(entries, Entry{Key: field, Value: hash[field]})
+			}
+		}
+		return nil
+	})
+	return entries, next, err
+}
+
+// SScan walks the set at key like Scan walks the keyspace, returning the
+// members matching pattern
+func (db *FlexDB) SScan(key string, cursor uint64, pattern string, count int) ([]string, uint64, error) {
+	var members []string
+	next := uint64(0)
+	err := db.View(func(tx *Txn) error {
+		s, err := setAt(tx, key)
+		if err != nil || s == nil {
+			return err
+		}
+
+		names := make([]string, 0, len(s))
+		for member := range s {
+			names = append(names, member)
+		}
+		var page []string
+		page, next = scanNames(names, cursor, count)
+		for _, member := range page {
+			if pattern == "" || utils.MatchGlob(pattern, member) {
+				members = append(members, member)
+			}
+		}
+		return nil
+	})
+	return members, next, err
+}
+
+// ZScan walks the sorted set at key like Scan walks the keyspace, in scan
+// rather than score order, so members whose score changes during the scan
+// are still returned once. It returns the members matching pattern with
+// their scores.
+func (db *FlexDB) ZScan(key string, cursor uint64, pattern string, count int) ([]ZEntry, uint64, error) {
+	var entries []ZEntry
+	next := uint64(0)
+	err := db.View(func(tx *Txn) error {
+		z, err := sortedSetAt(tx, key)
+		if err != nil || z == nil {
+			return err
+		}
+
+		names := make([]string, 0, len(z.scores))
+		for member := range z.scores {
+			names = append(names, member)
+		}
+		var page []string
+		page, next = scanNames(names, cursor, count)
+		for _, member := range page {
+			if pattern == "" || utils.MatchGlob(pattern, member) {
+				entries = append(entries, ZEntry{Member: member, Score: z.scores[member]})
+			}
+		}
+		return nil
+	})
+	return entries, next, err
+}
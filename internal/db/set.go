@@ -0,0 +1,334 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// stringSet is the in-memory form of a set: unique, unordered members
+type stringSet map[string]struct{}
+
+// members returns the members of the set, sorted
+func (s stringSet) members() []string {
+	members := make([]string, 0, len(s))
+	for member := range s {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// String formats the set for ALL
+func (s stringSet) String() string {
+	return "[" + strings.Join(s.members(), " ") + "]"
+}
+
+// aofCommands returns the SADD commands that recreate the set
+func (s stringSet) aofCommands(key string) [][]string {
+	return batchedCommands("SADD", key, s.members(), 1)
+}
+
+// loadSet restores a set from its snapshot form, an array of members
+func loadSet(data interface{}) (stringSet, error) {
+	members, ok := data.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("set is not an array")
+	}
+	s := make(stringSet, len(members))
+	for _, m := range members {
+		member, ok := m.(string)
+		if !ok {
+			return nil, fmt.Errorf("set member is not a string")
+		}
+		s[member] = struct{}{}
+	}
+	return s, nil
+}
+
+// SAdd adds members to the set at key, creating it if needed, and returns
+// how many members are new
+func (db *FlexDB) SAdd(key string, members ...string) (int, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, err
+	}
+	if err := db.checkValues(members...); err != nil {
+		return 0, err
+	}
+
+	added := 0
+	err := db.Update(func(tx *Txn) error {
+		s, err := setAt(tx, key)
+		if err != nil {
+			return err
+		}
+		var fresh []string
+		seen := make(map[string]bool, len(members))
+		for _, member := range members {
+			if _, ok := s[member]; !ok && !seen[member] {
+				fresh = append(fresh, member)
+				seen[member] = true
+			}
+		}
+		if len(fresh) == 0 {
+			return nil
+		}
+		if err := db.checkElements(len(s) + len(fresh)); err != nil {
+			return err
+		}
+
+		if s == nil {
+			s = make(stringSet)
+			tx.Put(key, Value{Type: TypeSet, Data: s})
+		}
+		for _, member := range fresh {
+			s[member] = struct{}{}
+		}
+		added = len(fresh)
+		tx.markChanged(key)
+		tx.Log("SADD", append([]string{key}, fresh...)...)
+		return nil
+	})
+	return added, err
+}
+
+// SRem removes members from the set at key and returns how many it had.
+// The key is deleted once the set is empty.
+func (db *FlexDB) SRem(key string, members ...string) (int, error) {
+	removed := 0
+	err := db.Update(func(tx *Txn) error {
+		s, err := setAt(tx, key)
+		if err != nil || s == nil {
+			return err
+		}
+		var gone []string
+		for _, member := range members {
+			if _, ok := s[member]; ok {
+				delete(s, member)
+				gone = append(gone, member)
+			}
+		}
+		if len(gone) == 0 {
+			return nil
+		}
+		if len(s) == 0 {
+			tx.Delete(key)
+		}
+		tx.markChanged(key)
+		tx.Log("SREM", append([]string{key}, gone...)...)
+		removed = len(gone)
+		return nil
+	})
+	return removed, err
+}
+
+// SMembers returns the members of the set at key, sorted
+func (db *FlexDB) SMembers(key string) ([]string, error) {
+	var members []string
+	err := db.View(func(tx *Txn) error {
+		s, err := setAt(tx, key)
+		if err != nil {
+			return err
+		}
+		members = s.members()
+		return nil
+	})
+	return members, err
+}
+
+// SIsMember reports whether member is in the set at key
+func (db *FlexDB) SIsMember(key, member string) (bool, error) {
+	found := false
+	err := db.View(func(tx *Txn) error {
+		s, err := setAt(tx, key)
+		if err != nil {
+			return err
+		}
+		_, found = s[member]
+		return nil
+	})
+	return found, err
+}
+
+// SCard returns the number of members of the set at key
+func (db *FlexDB) SCard(key string) (int, error) {
+	length := 0
+	err := db.View(func(tx *Txn) error {
+		s, err := setAt(tx, key)
+		if err != nil {
+			return err
+		}
+		length = len(s)
+		return nil
+	})
+	return length, err
+}
+
+// setOp combines the sets at some keys into a new set. Missing keys are
+// empty sets.
+type setOp func(sets []stringSet) stringSet
+
+func intersectSets(sets []stringSet) stringSet {
+	result := make(stringSet)
+	if len(sets) == 0 {
+		return result
+	}
+	// walk the smallest set, probing the others
+	smallest := 0
+	for i, s := range sets {
+		if len(s) < len(sets[smallest]) {
+			smallest = i
+		}
+	}
+	for member := range sets[smallest] {
+		inAll := true
+		for _, s := range sets {
+			if _, ok := s[member]; !ok {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			result[member] = struct{}{}
+		}
+	}
+	return result
+}
+
+func unionSets(sets []stringSet) stringSet {
+	result := make(stringSet)
+	for _, s := range sets {
+		for member := range s {
+			result[member] = struct{}{}
+		}
+	}
+	return result
+}
+
+// diffSets returns the members of the first set missing from the others
+func diffSets(sets []stringSet) stringSet {
+	result := make(stringSet)
+	if len(sets) == 0 {
+		return result
+	}
+	for member := range sets[0] {
+		result[member] = struct{}{}
+	}
+	for _, s := range sets[1:] {
+		for member := range s {
+			delete(result, member)
+		}
+	}
+	return result
+}
+
+// combineSets applies op to the sets at keys. Callers hold the keyspace
+// lock through tx.
+func combineSets(tx *Txn, op setOp, keys []string) (stringSet, error) {
+	sets := make([]stringSet, len(keys))
+	for i, key := range keys {
+		s, err := setAt(tx, key)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = s
+	}
+	return op(sets), nil
+}
+
+// readSetOp returns the sorted members op combines from the sets at keys
+func (db *FlexDB) readSetOp(op setOp, keys []string) ([]string, error) {
+	var members []string
+	err := db.View(func(tx *Txn) error {
+		s, err := combineSets(tx, op, keys)
+		if err != nil {
+			return err
+		}
+		members = s.members()
+		return nil
+	})
+	return members, err
+}
+
+// storeSetOp stores the set op combines from the sets at keys under dst,
+// replacing whatever dst held, and returns its size. An empty result
+// deletes dst.
+func (db *FlexDB) storeSetOp(op setOp, dst string, keys []string) (int, error) {
+	if err := db.checkKey(dst); err != nil {
+		return 0, err
+	}
+
+	size := 0
+	err := db.Update(func(tx *Txn) error {
+		s, err := combineSets(tx, op, keys)
+		if err != nil {
+			return err
+		}
+		if err := db.checkElements(len(s)); err != nil {
+			return err
+		}
+
+		if len(s) == 0 {
+			if tx.Delete(dst) {
+				tx.Log("DEL", dst)
+			}
+		} else {
+			// replaced like SET does, so dst keeps its tags
+			_, existed := tx.Get(dst)
+			tx.Put(dst, Value{Type: TypeSet, Data: s})
+			if existed {
+				tx.Log("DEL", dst)
+			}
+			tx.Log("SADD", append([]string{dst}, s.members()...)...)
+		}
+		size = len(s)
+		return nil
+	})
+	return size, err
+}
+
+// SInter returns the members present in every set at keys, sorted
+func (db *FlexDB) SInter(keys ...string) ([]string, error) {
+	return db.readSetOp(intersectSets, keys)
+}
+
+// SUnion returns the members present in any set at keys, sorted
+func (db *FlexDB) SUnion(keys ...string) ([]string, error) {
+	return db.readSetOp(unionSets, keys)
+}
+
+// SDiff returns the members of the first set at keys missing from the
+// others, sorted
+func (db *FlexDB) SDiff(keys ...string) ([]string, error) {
+	return db.readSetOp(diffSets, keys)
+}
+
+// SInterStore stores the intersection of the sets at keys under dst and
+// returns its size
+func (db *FlexDB) SInterStore(dst string, keys ...string) (int, error) {
+	return db.storeSetOp(intersectSets, dst, keys)
+}
+
+// SUnionStore stores the union of the sets at keys under dst and returns
+// its size
+func (db *FlexDB) SUnionStore(dst string, keys ...string) (int, error) {
+	return db.storeSetOp(unionSets, dst, keys)
+}
+
+// SDiffStore stores the difference of the sets at keys under dst and
+// returns its size
+func (db *FlexDB) SDiffStore(dst string, keys ...string) (int, error) {
+	return db.storeSetOp(diffSets, dst, keys)
+}
+
+// setAt returns the set stored at key, or nil if the key doesn't exist
+func setAt(tx *Txn, key string) (stringSet, error) {
+	val, ok := tx.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	if val.Type != TypeSet {
+		return nil, ErrWrongType
+	}
+	return val.Data.(stringSet), nil
+}
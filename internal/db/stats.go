@@ -0,0 +1,206 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// persistStats counts what the persistence pipeline does. The counters are
+// atomics so the writers never wait on a reader.
+type persistStats struct {
+	triggers      atomic.Uint64 // changes recorded for the snapshot writer
+	lastLagNanos  atomic.Int64  // age of the oldest change the last snapshot saved
+	throttled     atomic.Uint64 // writes delayed by backpressure
+	throttleNanos atomic.Int64  // time writers spent throttled
+
+	saves         atomic.Uint64
+	saveFailures  atomic.Uint64
+	lastSaveNanos atomic.Int64
+	saveNanos     atomic.Int64
+	lastSaveBytes atomic.Int64
+	saveBytes     atomic.Int64
+	lastSaveUnix  atomic.Int64
+	journalSaves  atomic.Uint64 // saves appended to a journal, see WithIncrementalSnapshots
+
+	aofBytes       atomic.Int64
+	fsyncs         atomic.Uint64
+	fsyncFailures  atomic.Uint64
+	lastFsyncNanos atomic.Int64
+	fsyncNanos     atomic.Int64
+	groupedWrites  atomic.Uint64 // commands synced by group commit
+
+	errMu    sync.Mutex
+	saveErr  error // result of the last snapshot
+	fsyncErr error // result of the last AOF fsync
+}
+
+// PersistenceStats describes the state of the snapshot writer and the AOF
+type PersistenceStats struct {
+	// UnsavedChanges counts changes not yet in a snapshot. A count that
+	// keeps growing means the writer is falling behind.
+	UnsavedChanges      uint64
+	OldestUnsavedChange time.Time // zero when everything is saved
+	Changes             uint64    // changes recorded since startup
+	LastPersistLag      time.Duration
+	WritesThrottled     uint64
+	ThrottleTime        time.Duration
+
+	Snapshots             uint64
+	SnapshotFailures      uint64
+	LastSnapshot          time.Time // zero before the first snapshot
+	LastSnapshotDuration  time.Duration
+	TotalSnapshotDuration time.Duration
+	LastSnapshotBytes     int64
+	SnapshotBytesWritten  int64
+	LastSnapshotError     error  // nil if the last snapshot succeeded
+	JournalWrites         uint64 // snapshots appended to a journal instead
+
+	AOFEnabled        bool
+	AOFBufferSize     int // bytes logged but not yet written to the file
+	AOFSegments       int // segment files after the AOF files, see WithAOFMaxSegmentSize
+	AOFBytesWritten   int64
+	Fsyncs            uint64
+	FsyncFailures     uint64
+	LastFsyncLatency  time.Duration
+	TotalFsyncLatency time.Duration
+	LastFsyncError    error // nil if the last fsync succeeded
+	// GroupCommitWrites counts commands synced by group commit with
+	// AOFSyncAlways; divided by Fsyncs, how many share an fsync
+	GroupCommitWrites uint64
+
+	// ColdValues counts values left on disk at load by WithLazyValues,
+	// and ColdValuesLoaded those of them read back since
+	ColdValues       int64
+	ColdValuesLoaded int64
+}
+
+// PersistenceStats returns counters of the persistence pipeline
+func (db *FlexDB) PersistenceStats() PersistenceStats {
+	s := &db.stats
+	stats := PersistenceStats{
+		Changes:               s.triggers.Load(),
+		LastPersistLag:        time.Duration(s.lastLagNanos.Load()),
+		WritesThrottled:       s.throttled.Load(),
+		ThrottleTime:          time.Duration(s.throttleNanos.Load()),
+		Snapshots:             s.saves.Load(),
+		SnapshotFailures:      s.saveFailures.Load(),
+		LastSnapshotDuration:  time.Duration(s.lastSaveNanos.Load()),
+		TotalSnapshotDuration: time.Duration(s.saveNanos.Load()),
+		LastSnapshotBytes:     s.lastSaveBytes.Load(),
+		SnapshotBytesWritten:  s.saveBytes.Load(),
+		JournalWrites:         s.journalSaves.Load(),
+		AOFBytesWritten:       s.aofBytes.Load(),
+		Fsyncs:                s.fsyncs.Load(),
+		FsyncFailures:         s.fsyncFailures.Load(),
+		LastFsyncLatency:      time.Duration(s.lastFsyncNanos.Load()),
+		TotalFsyncLatency:     time.Duration(s.fsyncNanos.Load()),
+		GroupCommitWrites:     s.groupedWrites.Load(),
+	}
+	if unix := s.lastSaveUnix.Load(); unix > 0 {
+		stats.LastSnapshot = time.Unix(unix, 0)
+	}
+	stats.UnsavedChanges, stats.OldestUnsavedChange = db.pendingChanges()
+	if stats.UnsavedChanges == 0 {
+		stats.OldestUnsavedChange = time.Time{}
+	}
+	s.errMu.Lock()
+	stats.LastSnapshotError = s.saveErr
+	stats.LastFsyncError = s.fsyncErr
+	s.errMu.Unlock()
+
+	for _, aof := range db.aofs() {
+		aof.mu.Lock()
+		if aof.enabled {
+			stats.AOFEnabled = true
+			stats.AOFBufferSize += aof.writer.Buffered()
+			stats.AOFSegments += len(aof.segments)
+		}
+		aof.mu.Unlock()
+	}
+	if db.lazy != nil {
+		stats.ColdValues = db.lazy.spilled.Load()
+		stats.ColdValuesLoaded = db.lazy.loaded.Load()
+	}
+	return stats
+}
+
+// PersistenceError returns why persistence is failing, or nil if the last
+// snapshot and the last AOF fsync both succeeded. It clears itself once
+// the next attempt succeeds.
+func (db *FlexDB) PersistenceError() error {
+	s := &db.stats
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+
+	if s.saveErr != nil {
+		return fmt.Errorf("last snapshot failed: %w", s.saveErr)
+	}
+	if s.fsyncErr != nil {
+		return fmt.Errorf("last AOF fsync failed: %w", s.fsyncErr)
+	}
+	return nil
+}
+
+// saveError returns the result of the last snapshot
+func (s *persistStats) saveError() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.saveErr
+}
+
+// fsyncError returns the result of the last AOF fsync
+func (s *persistStats) fsyncError() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.fsyncErr
+}
+
+// recordSave records a snapshot attempt that started at start
+func (s *persistStats) recordSave(start time.Time, bytes int64, err error) {
+	s.errMu.Lock()
+	s.saveErr = err
+	s.errMu.Unlock()
+
+	if err != nil {
+		s.saveFailures.Add(1)
+		return
+	}
+	elapsed := time.Since(start)
+	s.saves.Add(1)
+	s.lastSaveNanos.Store(int64(elapsed))
+	s.saveNanos.Add(int64(elapsed))
+	s.lastSaveBytes.Store(bytes)
+	s.saveBytes.Add(bytes)
+	s.lastSaveUnix.Store(time.Now().Unix())
+}
+
+// recordFsync records an AOF fsync that started at start
+func (s *persistStats) recordFsync(start time.Time, err error) {
+	s.errMu.Lock()
+	s.fsyncErr = err
+	s.errMu.Unlock()
+
+	if err != nil {
+		s.fsyncFailures.Add(1)
+		return
+	}
+	elapsed := time.Since(start)
+	s.fsyncs.Add(1)
+	s.lastFsyncNanos.Store(int64(elapsed))
+	s.fsyncNanos.Add(int64(elapsed))
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
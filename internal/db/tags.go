@@ -0,0 +1,223 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// tagIndex maps keys to their tags and back, so keys can be found and
+// changed by tag without scanning the keyspace. It is guarded by the
+// keyspace lock. Tags belong to the key rather than its value: they stay
+// when the value is overwritten and go when the key is deleted or expires.
+type tagIndex struct {
+	byKey map[string]map[string]struct{}
+	byTag map[string]map[string]struct{}
+}
+
+func newTagIndex() tagIndex {
+	return tagIndex{
+		byKey: make(map[string]map[string]struct{}),
+		byTag: make(map[string]map[string]struct{}),
+	}
+}
+
+// add tags key with tag and reports whether it wasn't already
+func (idx *tagIndex) add(key, tag string) bool {
+	tags, ok := idx.byKey[key]
+	if !ok {
+		tags = make(map[string]struct{})
+		idx.byKey[key] = tags
+	}
+	if _, ok := tags[tag]; ok {
+		return false
+	}
+	tags[tag] = struct{}{}
+
+	keys, ok := idx.byTag[tag]
+	if !ok {
+		keys = make(map[string]struct{})
+		idx.byTag[tag] = keys
+	}
+	keys[key] = struct{}{}
+	return true
+}
+
+// remove untags key and reports whether it had tag
+func (idx *tagIndex) remove(key, tag string) bool {
+	tags := idx.byKey[key]
+	if _, ok := tags[tag]; !ok {
+		return false
+	}
+	delete(tags, tag)
+	if len(tags) == 0 {
+		delete(idx.byKey, key)
+	}
+
+	keys := idx.byTag[tag]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(idx.byTag, tag)
+	}
+	return true
+}
+
+// tagsOf returns the tags of key, sorted
+func (idx *tagIndex) tagsOf(key string) []string {
+	tags := make([]string, 0, len(idx.byKey[key]))
+	for tag := range idx.byKey[key] {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// forgetTags drops the tags of a deleted key. Callers hold the keyspace
+// lock.
+func (db *FlexDB) forgetTags(key string) {
+	for _, tag := range db.tags.tagsOf(key) {
+		db.tags.remove(key, tag)
+	}
+}
+
+// pruneTags drops the tags of keys that no longer exist. Callers hold the
+// keyspace lock.
+func (db *FlexDB) pruneTags() {
+	for key := range db.tags.byKey {
+		if _, ok := db.data[key]; !ok {
+			db.forgetTags(key)
+		}
+	}
+}
+
+// restoreTags sets the tags of a key loaded from the snapshot. Callers
+// hold the keyspace lock.
+func (db *FlexDB) restoreTags(key string, tags []string) {
+	for _, tag := range tags {
+		db.tags.add(key, tag)
+	}
+}
+
+// persistedTags returns the tags the snapshot stores for key, or nil if it
+// has none. Callers hold the keyspace lock.
+func (db *FlexDB) persistedTags(key string) []string {
+	if _, ok := db.tags.byKey[key]; !ok {
+		return nil
+	}
+	return db.tags.tagsOf(key)
+}
+
+// Tag attaches tags to an existing key and returns how many it didn't
+// already have
+func (db *FlexDB) Tag(key string, tags ...string) (int, error) {
+	if err := db.checkValues(tags...); err != nil {
+		return 0, err
+	}
+
+	added := 0
+	err := db.Update(func(tx *Txn) error {
+		if _, ok := tx.Get(key); !ok {
+			return ErrKeyNotFound
+		}
+		var logged []string
+		for _, tag := range tags {
+			if db.tags.add(key, tag) {
+				logged = append(logged, tag)
+			}
+		}
+		if len(logged) > 0 {
+			tx.markChanged(key)
+			tx.Log("TAG", append([]string{key}, logged...)...)
+		}
+		added = len(logged)
+		return nil
+	})
+	return added, err
+}
+
+// Untag removes tags from a key and returns how many it had
+func (db *FlexDB) Untag(key string, tags ...string) int {
+	removed := 0
+	db.Update(func(tx *Txn) error {
+		var logged []string
+		for _, tag := range tags {
+			if db.tags.remove(key, tag) {
+				logged = append(logged, tag)
+			}
+		}
+		if len(logged) > 0 {
+			tx.markChanged(key)
+			tx.Log("UNTAG", append([]string{key}, logged...)...)
+		}
+		removed = len(logged)
+		return nil
+	})
+	return removed
+}
+
+// Tags returns the tags of a key, sorted
+func (db *FlexDB) Tags(key string) ([]string, error) {
+	var tags []string
+	err := db.View(func(tx *Txn) error {
+		if _, ok := tx.Get(key); !ok {
+			return ErrKeyNotFound
+		}
+		tags = db.tags.tagsOf(key)
+		return nil
+	})
+	return tags, err
+}
+
+// TaggedKeys returns the live keys carrying tag, sorted
+func (db *FlexDB) TaggedKeys(tag string) []string {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.taggedKeys(tag)
+}
+
+// taggedKeys returns the live keys carrying tag, sorted. Callers hold the
+// keyspace lock.
+func (db *FlexDB) taggedKeys(tag string) []string {
+	now := db.now()
+	keys := make([]string, 0, len(db.tags.byTag[tag]))
+	for key := range db.tags.byTag[tag] {
+		val, ok := db.data[key]
+		if !ok || (val.Expiration != nil && now.After(*val.Expiration)) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DeleteTagged deletes every key carrying tag in bounded batches, like
+// DeletePattern, and returns how many keys were deleted
+func (db *FlexDB) DeleteTagged(tag string) int {
+	return db.applyKeys(db.TaggedKeys(tag), func(key string) bool {
+		db.deleteWithoutLogging(key)
+		return true
+	}, func(keys []string) {
+		if err := db.logCommand("DEL", keys...); err != nil {
+			fmt.Printf("Error logging to AOF: %v\n", err)
+		}
+	})
+}
+
+// ExpireTagged sets a TTL on every key carrying tag in bounded batches,
+// like ExpirePattern, and returns how many keys were changed
+func (db *FlexDB) ExpireTagged(tag string, duration time.Duration) int {
+	// every key gets the same deadline, logged as such
+	at := db.now().Add(duration)
+	return db.applyKeys(db.TaggedKeys(tag), func(key string) bool {
+		db.expireWithoutLogging(key, at)
+		return true
+	}, func(keys []string) {
+		for _, key := range keys {
+			if err := db.logCommand("PEXPIREAT", key, unixMillis(at)); err != nil {
+				fmt.Printf("Error logging to AOF: %v\n", err)
+			}
+		}
+	})
+}
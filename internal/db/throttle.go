@@ -0,0 +1,73 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ThrottleResult is the outcome of a Throttle call
+type ThrottleResult struct {
+	Allowed    bool
+	Limit      int64         // most requests allowed at once, max burst + 1
+	Remaining  int64         // requests still allowed right now
+	RetryAfter time.Duration // when a refused request would be allowed, 0 if allowed
+	ResetAfter time.Duration // when the limit is fully available again
+}
+
+// Throttle applies a rate limit of rate requests per period, allowing
+// bursts of maxBurst extra requests, to quantity requests against key.
+// It uses the generic cell rate algorithm (GCRA): key holds the
+// theoretical arrival time of the next request as Unix nanoseconds and
+// expires once the limit is fully available again. Refused requests don't
+// change it.
+func (db *FlexDB) Throttle(key string, maxBurst, rate int64, period time.Duration, quantity int64) (ThrottleResult, error) {
+	if maxBurst < 0 || rate <= 0 || period <= 0 || quantity < 0 {
+		return ThrottleResult{}, fmt.Errorf("invalid rate limit")
+	}
+	if err := db.checkKey(key); err != nil {
+		return ThrottleResult{}, err
+	}
+
+	interval := period / time.Duration(rate)
+	tolerance := interval * time.Duration(maxBurst+1)
+	result := ThrottleResult{Limit: maxBurst + 1}
+
+	err := db.Update(func(tx *Txn) error {
+		now := db.now()
+		tat := now
+		if val, ok := tx.Get(key); ok {
+			str, ok := stringData(val.Data)
+			if !ok {
+				return ErrWrongType
+			}
+			stored, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				return ErrWrongType
+			}
+			if t := time.Unix(0, stored); t.After(now) {
+				tat = t
+			}
+		}
+
+		next := tat.Add(interval * time.Duration(quantity))
+		allowAt := next.Add(-tolerance)
+		if now.Before(allowAt) {
+			result.RetryAfter = allowAt.Sub(now)
+			result.ResetAfter = tat.Sub(now)
+			result.Remaining = int64(now.Sub(tat.Add(-tolerance)) / interval)
+			return nil
+		}
+
+		result.Allowed = true
+		result.ResetAfter = next.Sub(now)
+		result.Remaining = int64(now.Sub(allowAt) / interval)
+		if quantity > 0 {
+			value := strconv.FormatInt(next.UnixNano(), 10)
+			tx.Put(key, Value{Type: TypeString, Data: value, Expiration: &next})
+			tx.Log("SET", key, value, "PXAT", unixMillis(next))
+		}
+		return nil
+	})
+	return result, err
+}
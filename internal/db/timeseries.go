@@ -0,0 +1,298 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrSampleTooOld is returned when a sample falls before the retention
+// window of its series
+var ErrSampleTooOld = errors.New("timestamp is older than the retention period")
+
+// Sample is a timestamped value of a time series. Timestamps are unix
+// milliseconds.
+type Sample struct {
+	Timestamp int64
+	Value     float64
+}
+
+// timeSeries is the in-memory form of a time series: samples ordered by
+// timestamp, one per timestamp. With a retention, samples older than the
+// newest minus the retention are dropped as new ones arrive.
+type timeSeries struct {
+	samples   []Sample
+	retention int64 // milliseconds, 0 keeps every sample
+}
+
+// add stores a sample, replacing one with the same timestamp
+func (ts *timeSeries) add(s Sample) error {
+	if n := len(ts.samples); ts.retention > 0 && n > 0 && s.Timestamp < ts.samples[n-1].Timestamp-ts.retention {
+		return ErrSampleTooOld
+	}
+
+	i := ts.search(s.Timestamp)
+	if i < len(ts.samples) && ts.samples[i].Timestamp == s.Timestamp {
+		ts.samples[i] = s
+		return nil
+	}
+	ts.samples = append(ts.samples, Sample{})
+	copy(ts.samples[i+1:], ts.samples[i:])
+	ts.samples[i] = s
+	ts.trim()
+	return nil
+}
+
+// trim drops the samples that fell out of the retention window
+func (ts *timeSeries) trim() {
+	n := len(ts.samples)
+	if ts.retention <= 0 || n == 0 {
+		return
+	}
+	cut := ts.search(ts.samples[n-1].Timestamp - ts.retention)
+	ts.samples = append(ts.samples[:0], ts.samples[cut:]...)
+}
+
+// search returns the position of the first sample at or after timestamp
+func (ts *timeSeries) search(timestamp int64) int {
+	return sort.Search(len(ts.samples), func(i int) bool {
+		return ts.samples[i].Timestamp >= timestamp
+	})
+}
+
+// between returns the samples from from to to, both inclusive
+func (ts *timeSeries) between(from, to int64) []Sample {
+	start := ts.search(from)
+	end := start
+	for end < len(ts.samples) && ts.samples[end].Timestamp <= to {
+		end++
+	}
+	return append([]Sample(nil), ts.samples[start:end]...)
+}
+
+// persisted returns the snapshot form of the series
+func (ts *timeSeries) persisted() map[string]interface{} {
+	samples := make([][2]interface{}, len(ts.samples))
+	for i, s := range ts.samples {
+		samples[i] = [2]interface{}{s.Timestamp, s.Value}
+	}
+	return map[string]interface{}{"retention": ts.retention, "samples": samples}
+}
+
+// aofCommands returns the TS.CREATE and TS.ADD commands that recreate the
+// series
+func (ts *timeSeries) aofCommands(key string) [][]string {
+	cmds := [][]string{{"TS.CREATE", key, "RETENTION", strconv.FormatInt(ts.retention, 10)}}
+	for _, s := range ts.samples {
+		cmds = append(cmds, []string{"TS.ADD", key, strconv.FormatInt(s.Timestamp, 10), strconv.FormatFloat(s.Value, 'f', -1, 64)})
+	}
+	return cmds
+}
+
+// String formats the series for ALL
+func (ts *timeSeries) String() string {
+	parts := make([]string, len(ts.samples))
+	for i, s := range ts.samples {
+		parts[i] = strconv.FormatInt(s.Timestamp, 10) + ":" + strconv.FormatFloat(s.Value, 'f', -1, 64)
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// loadTimeSeries restores a time series from its snapshot form
+func loadTimeSeries(data interface{}) (*timeSeries, error) {
+	obj, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("time series is not an object")
+	}
+	retention, ok := obj["retention"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("retention is not a number")
+	}
+	samples, ok := obj["samples"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("samples are not an array")
+	}
+
+	ts := &timeSeries{retention: int64(retention)}
+	for _, s := range samples {
+		pair, ok := s.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("sample is not a pair")
+		}
+		timestamp, ok1 := pair[0].(float64)
+		value, ok2 := pair[1].(float64)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("sample is not a pair of numbers")
+		}
+		ts.samples = append(ts.samples, Sample{Timestamp: int64(timestamp), Value: value})
+	}
+	sort.Slice(ts.samples, func(i, j int) bool {
+		return ts.samples[i].Timestamp < ts.samples[j].Timestamp
+	})
+	return ts, nil
+}
+
+// Aggregation reduces the samples of a bucket to one value
+type Aggregation func(values []float64) float64
+
+// Aggregations are the TS.RANGE aggregation functions by name
+var Aggregations = map[string]Aggregation{
+	"avg": func(values []float64) float64 {
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	},
+	"sum": func(values []float64) float64 {
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	},
+	"min": func(values []float64) float64 {
+		lowest := values[0]
+		for _, v := range values[1:] {
+			if v < lowest {
+				lowest = v
+			}
+		}
+		return lowest
+	},
+	"max": func(values []float64) float64 {
+		highest := values[0]
+		for _, v := range values[1:] {
+			if v > highest {
+				highest = v
+			}
+		}
+		return highest
+	},
+	"count": func(values []float64) float64 {
+		return float64(len(values))
+	},
+}
+
+// aggregate groups samples into buckets of bucket milliseconds, aligned to
+// the epoch, and reduces each non-empty bucket with agg. Each result is
+// stamped with the start of its bucket.
+func aggregate(samples []Sample, bucket int64, agg Aggregation) []Sample {
+	var result []Sample
+	var values []float64
+	start := int64(0)
+	flush := func() {
+		if len(values) > 0 {
+			result = append(result, Sample{Timestamp: start, Value: agg(values)})
+			values = values[:0]
+		}
+	}
+	for _, s := range samples {
+		if b := s.Timestamp - s.Timestamp%bucket; b != start || len(values) == 0 {
+			flush()
+			start = b
+		}
+		values = append(values, s.Value)
+	}
+	flush()
+	return result
+}
+
+// TSCreate creates an empty time series at key keeping samples for
+// retention, or forever if retention is 0. It returns ErrKeyExists if the
+// key exists.
+func (db *FlexDB) TSCreate(key string, retention time.Duration) error {
+	if err := db.checkKey(key); err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *Txn) error {
+		if _, ok := tx.Get(key); ok {
+			return ErrKeyExists
+		}
+		tx.Put(key, Value{Type: TypeTimeSeries, Data: &timeSeries{retention: retention.Milliseconds()}})
+		tx.Log("TS.CREATE", key, "RETENTION", strconv.FormatInt(retention.Milliseconds(), 10))
+		return nil
+	})
+}
+
+// TSAdd adds a sample to the time series at key, replacing any sample with
+// the same timestamp. A missing series is created with retention.
+func (db *FlexDB) TSAdd(key string, sample Sample, retention time.Duration) error {
+	if err := db.checkKey(key); err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *Txn) error {
+		ts, err := timeSeriesAt(tx, key)
+		if err != nil {
+			return err
+		}
+		if ts == nil {
+			ts = &timeSeries{retention: retention.Milliseconds()}
+			tx.Put(key, Value{Type: TypeTimeSeries, Data: ts})
+			tx.Log("TS.CREATE", key, "RETENTION", strconv.FormatInt(ts.retention, 10))
+		} else if i := ts.search(sample.Timestamp); i == len(ts.samples) || ts.samples[i].Timestamp != sample.Timestamp {
+			if err := db.checkElements(len(ts.samples) + 1); err != nil {
+				return err
+			}
+		}
+
+		if err := ts.add(sample); err != nil {
+			return err
+		}
+		tx.markChanged(key)
+		tx.Log("TS.ADD", key, strconv.FormatInt(sample.Timestamp, 10), strconv.FormatFloat(sample.Value, 'f', -1, 64))
+		return nil
+	})
+}
+
+// TSGet returns the newest sample of the time series at key
+func (db *FlexDB) TSGet(key string) (Sample, bool, error) {
+	var sample Sample
+	found := false
+	err := db.View(func(tx *Txn) error {
+		ts, err := timeSeriesAt(tx, key)
+		if err != nil || ts == nil || len(ts.samples) == 0 {
+			return err
+		}
+		sample, found = ts.samples[len(ts.samples)-1], true
+		return nil
+	})
+	return sample, found, err
+}
+
+// TSRange returns the samples of the time series at key from from to to,
+// both inclusive. With an aggregation the samples are grouped into
+// buckets of bucket and each bucket is reduced to one sample.
+func (db *FlexDB) TSRange(key string, from, to int64, agg Aggregation, bucket time.Duration) ([]Sample, error) {
+	samples := []Sample{}
+	err := db.View(func(tx *Txn) error {
+		ts, err := timeSeriesAt(tx, key)
+		if err != nil || ts == nil {
+			return err
+		}
+		samples = ts.between(from, to)
+		if agg != nil {
+			samples = aggregate(samples, bucket.Milliseconds(), agg)
+		}
+		return nil
+	})
+	return samples, err
+}
+
+// timeSeriesAt returns the time series stored at key, or nil if the key
+// doesn't exist
+func timeSeriesAt(tx *Txn, key string) (*timeSeries, error) {
+	val, ok := tx.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	if val.Type != TypeTimeSeries {
+		return nil, ErrWrongType
+	}
+	return val.Data.(*timeSeries), nil
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"flex-db/internal/utils"
+)
+
+// ErrTrashDisabled is returned by UNDELETE and TRASH without WithTrash
+var ErrTrashDisabled = errors.New("trash not enabled")
+
+// TrashEntry describes a deleted key waiting in the trash
+type TrashEntry struct {
+	Key     string
+	Type    ValueType
+	Deleted time.Time
+	Purge   time.Time // when the key leaves the trash for good
+}
+
+// trash holds the values removed by DEL for a while, so they can be
+// restored with UNDELETE. It is guarded by the keyspace lock and kept in
+// memory only.
+type trash struct {
+	retention time.Duration
+	entries   map[string]trashedValue
+}
+
+type trashedValue struct {
+	value   Value
+	tags    []string
+	deleted time.Time
+}
+
+// WithTrash makes DEL move keys to a hidden trash for retention instead
+// of dropping them, so UNDELETE can bring them back. Only DEL and UNLINK
+// are covered: values removed by expiry, overwrites, DELPATTERN, DELBYTAG
+// or FLUSHALL are gone right away. The trash isn't persisted and a restart empties it.
+func WithTrash(retention time.Duration) Option {
+	return func(db *FlexDB) {
+		if retention <= 0 {
+			return
+		}
+		db.trash = &trash{
+			retention: retention,
+			entries:   make(map[string]trashedValue),
+		}
+	}
+}
+
+// trashKey moves the live value of key to the trash, replacing an older
+// deletion of the same key. Callers hold the keyspace write lock and
+// delete the key afterwards.
+func (db *FlexDB) trashKey(key string) {
+	if db.trash == nil {
+		return
+	}
+	val, ok := db.peek(key)
+	if !ok || (val.Expiration != nil && db.now().After(*val.Expiration)) {
+		return
+	}
+	db.trash.entries[key] = trashedValue{value: val, tags: db.persistedTags(key), deleted: time.Now()}
+}
+
+// purgeTrash drops the trashed keys past their retention or TTL
+func (db *FlexDB) purgeTrash() {
+	if db.trash == nil {
+		return
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	now := time.Now()
+	for key, tv := range db.trash.entries {
+		if db.trash.expired(tv, now) {
+			delete(db.trash.entries, key)
+		}
+	}
+}
+
+// expired reports whether a trashed value can no longer be restored
+func (t *trash) expired(tv trashedValue, now time.Time) bool {
+	if now.Sub(tv.deleted) >= t.retention {
+		return true
+	}
+	return tv.value.Expiration != nil && now.After(*tv.value.Expiration)
+}
+
+// Undelete restores key from the trash with the value, TTL and tags it
+// had when it was deleted. It reports whether the key was in the trash, and fails
+// with ErrKeyExists if the key was written again since.
+func (db *FlexDB) Undelete(key string) (bool, error) {
+	if db.trash == nil {
+		return false, ErrTrashDisabled
+	}
+
+	restored := false
+	err := db.Update(func(tx *Txn) error {
+		tv, ok := db.trash.entries[key]
+		if !ok {
+			return nil
+		}
+		now := time.Now()
+		if db.trash.expired(tv, now) {
+			delete(db.trash.entries, key)
+			return nil
+		}
+		if _, exists := tx.Get(key); exists {
+			return ErrKeyExists
+		}
+
+		tx.Put(key, tv.value)
+		for _, cmd := range valueCommands(key, tv.value) {
+			tx.Log(cmd[0], cmd[1:]...)
+		}
+		if len(tv.tags) > 0 {
+			db.restoreTags(key, tv.tags)
+			tx.Log("TAG", append([]string{key}, tv.tags...)...)
+		}
+		delete(db.trash.entries, key)
+		restored = true
+		return nil
+	})
+	return restored, err
+}
+
+// Trash lists the trashed keys matching a glob pattern, sorted by key
+func (db *FlexDB) Trash(pattern string) ([]TrashEntry, error) {
+	if db.trash == nil {
+		return nil, ErrTrashDisabled
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	now := time.Now()
+	var entries []TrashEntry
+	for key, tv := range db.trash.entries {
+		if db.trash.expired(tv, now) || !utils.MatchGlob(pattern, key) {
+			continue
+		}
+		entries = append(entries, TrashEntry{
+			Key:     key,
+			Type:    tv.value.Type,
+			Deleted: tv.deleted,
+			Purge:   tv.deleted.Add(db.trash.retention),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, nil
+}
+
+// EmptyTrash drops the trashed keys matching a glob pattern for good and
+// returns how many it dropped
+func (db *FlexDB) EmptyTrash(pattern string) (int, error) {
+	if db.trash == nil {
+		return 0, ErrTrashDisabled
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	dropped := 0
+	for key := range db.trash.entries {
+		if utils.MatchGlob(pattern, key) {
+			delete(db.trash.entries, key)
+			dropped++
+		}
+	}
+	return dropped, nil
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUndelete(t *testing.T) {
+	db := newTestDB(t, WithTrash(time.Hour))
+	exp := time.Now().Add(time.Hour)
+	if err := db.Set("k", "v", &exp); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("k"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get after Delete: %v", err)
+	}
+
+	entries, err := db.Trash("*")
+	if err != nil || len(entries) != 1 || entries[0].Key != "k" || entries[0].Type != TypeString {
+		t.Fatalf("Trash: %+v, %v", entries, err)
+	}
+	if ok, err := db.Undelete("k"); err != nil || !ok {
+		t.Fatalf("Undelete: %v, %v", ok, err)
+	}
+	if val, _ := db.Get("k"); val != "v" {
+		t.Errorf("value after Undelete %v, want v", val)
+	}
+	if ttl, _ := db.TTL("k"); ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("TTL after Undelete %v, want about an hour", ttl)
+	}
+	if ok, _ := db.Undelete("k"); ok {
+		t.Error("Undelete restored a key twice")
+	}
+
+	db.Delete("k")
+	db.Set("k", "w", nil)
+	if _, err := db.Undelete("k"); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Undelete over a new value: %v", err)
+	}
+}
+
+func TestUndeleteReplay(t *testing.T) {
+	dir := t.TempDir()
+	aof := WithAOF(filepath.Join(dir, "flex.aof"), AOFSyncAlways)
+	db := openTestDB(t, filepath.Join(dir, "first.db"), aof, WithTrash(time.Hour))
+	exp := time.Now().Add(time.Hour)
+	if err := db.Set("k", "v", &exp); err != nil {
+		t.Fatal(err)
+	}
+	db.DeleteKeys("k")
+	if ok, err := db.Undelete("k"); err != nil || !ok {
+		t.Fatalf("Undelete: %v, %v", ok, err)
+	}
+	db.Close()
+
+	// a new snapshot file leaves the AOF alone to restore the key
+	db = openTestDB(t, filepath.Join(dir, "second.db"), aof)
+	if val, err := db.Get("k"); err != nil || val != "v" {
+		t.Errorf("value after replay %v, %v", val, err)
+	}
+	if ttl, _ := db.TTL("k"); ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("TTL after replay %v, want about an hour", ttl)
+	}
+}
+
+func TestUndeleteTags(t *testing.T) {
+	dir := t.TempDir()
+	aof := WithAOF(filepath.Join(dir, "flex.aof"), AOFSyncAlways)
+	db := openTestDB(t, filepath.Join(dir, "first.db"), aof, WithTrash(time.Hour))
+	db.Set("d1", "v", nil)
+	if _, err := db.Tag("d1", "t1", "t2"); err != nil {
+		t.Fatal(err)
+	}
+	db.DeleteKeys("d1")
+	if keys := db.TaggedKeys("t1"); len(keys) != 0 {
+		t.Fatalf("deleted key still tagged: %v", keys)
+	}
+	if ok, err := db.Undelete("d1"); err != nil || !ok {
+		t.Fatalf("Undelete: %v, %v", ok, err)
+	}
+	if tags, _ := db.Tags("d1"); !reflect.DeepEqual(tags, []string{"t1", "t2"}) {
+		t.Errorf("tags after Undelete %v, want [t1 t2]", tags)
+	}
+	db.Close()
+
+	// a new snapshot file leaves the AOF alone to restore the tags
+	db = openTestDB(t, filepath.Join(dir, "second.db"), aof)
+	if keys := db.TaggedKeys("t1"); !reflect.DeepEqual(keys, []string{"d1"}) {
+		t.Errorf("keys tagged t1 after replay %v, want [d1]", keys)
+	}
+}
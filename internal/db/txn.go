@@ -0,0 +1,234 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Atomicity model
+//
+// The keyspace is guarded by a single lock, db.lock. Every command runs
+// under exactly one acquisition of it, so no other command can observe a
+// multi-key command half done. Commands that touch more than one key must
+// go through Update or View instead of calling several single-key methods,
+// each of which would take and release the lock on its own.
+//
+// Locks are always taken in this order: db.lock, then aof.syncMu, then
+// aof.mu, then the access tracker lock. Nothing holding aof.mu or
+// aof.syncMu may wait for db.lock.
+// persistMu, which schedules snapshots, is taken last and never held while
+// waiting for another lock.
+//
+// Bulk pattern and tag commands (DELPATTERN, EXPIREPATTERN, RENAMEPATTERN,
+// DELBYTAG, EXPIREBYTAG) are the deliberate exception: they apply in
+// batches, each batch atomic on its own.
+
+// Txn is a view of the keyspace held under the keyspace lock for the
+// duration of an Update or View call. It must not be used after the
+// callback returns.
+type Txn struct {
+	db        *FlexDB
+	writable  bool
+	changed   bool       // any key may have changed, so all are saved
+	dirty     []string   // keys changed, see markChanged
+	replaying bool       // applying an AOF line, see WithReplay
+	log       [][]string // commands to append to the AOF on success
+}
+
+// Update runs fn with exclusive access to the keyspace. Commands fn logs
+// are appended to the AOF once it returns without error, still under the
+// lock, so the AOF records multi-key commands in the order they applied.
+func (db *FlexDB) Update(fn func(tx *Txn) error) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	tx := &Txn{db: db, writable: true}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if db.logging() {
+		for _, entry := range tx.log {
+			if err := db.logCommand(entry[0], entry[1:]...); err != nil {
+				fmt.Printf("Error logging to AOF: %v\n", err)
+			}
+		}
+	}
+	if tx.changed {
+		db.triggerWrite()
+	} else if len(tx.dirty) > 0 {
+		db.triggerWrite(tx.dirty...)
+	}
+	return nil
+}
+
+// View runs fn with shared access to the keyspace. Writes through the
+// Txn panic.
+func (db *FlexDB) View(fn func(tx *Txn) error) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return fn(&Txn{db: db})
+}
+
+// Get returns the value of a live key. A write removes an expired key
+// with a logged DEL first, so replicas drop it before applying the write.
+// Replayed commands, from the AOF or from a replica's master, see expired
+// keys: they rebuild values as they were written, TTL included, and the
+// logged DEL, the master's or active expiration removes them.
+func (tx *Txn) Get(key string) (Value, bool) {
+	val, ok := tx.db.lookup(key)
+	if !ok {
+		return Value{}, false
+	}
+	if val.Expiration != nil && tx.db.now().After(*val.Expiration) && !tx.replaying {
+		if tx.writable && len(tx.db.expireKeys(key)) > 0 {
+			tx.markChanged(key)
+		}
+		return Value{}, false
+	}
+	tx.db.touch(key)
+	return val, true
+}
+
+// Put stores val under key, replacing any previous value
+func (tx *Txn) Put(key string, val Value) {
+	tx.mustWrite()
+	val.Expiration = persistedExpiration(val.Expiration)
+	if _, exists := tx.db.data[key]; !exists {
+		tx.db.indexKey(key)
+	}
+	tx.db.data[key] = val
+	tx.db.touch(key)
+	tx.db.recordVersion(key, val)
+	tx.markChanged(key)
+}
+
+// Delete removes key and reports whether it existed
+func (tx *Txn) Delete(key string) bool {
+	tx.mustWrite()
+	if _, ok := tx.Get(key); !ok {
+		return false
+	}
+	tx.db.deleteWithoutLogging(key)
+	tx.markChanged(key)
+	return true
+}
+
+// markChanged records that key changed, for commands that change a value
+// in place rather than through Put
+func (tx *Txn) markChanged(key string) {
+	tx.mustWrite()
+	tx.dirty = append(tx.dirty, key)
+}
+
+// Log queues a command for the AOF
+func (tx *Txn) Log(cmd string, args ...string) {
+	tx.mustWrite()
+	if tx.replaying {
+		return
+	}
+	tx.log = append(tx.log, append([]string{cmd}, args...))
+}
+
+func (tx *Txn) mustWrite() {
+	if !tx.writable {
+		panic("flexdb: write in a read-only transaction")
+	}
+}
+
+// DeleteKeys removes all given keys atomically and returns how many existed
+func (db *FlexDB) DeleteKeys(keys ...string) int {
+	deleted := 0
+	db.Update(func(tx *Txn) error {
+		var removed []string
+		for _, key := range keys {
+			tx.db.trashKey(key)
+			if tx.Delete(key) {
+				removed = append(removed, key)
+			}
+		}
+		if len(removed) > 0 {
+			tx.Log("DEL", removed...)
+		}
+		deleted = len(removed)
+		return nil
+	})
+	return deleted
+}
+
+// FlushAll deletes every key atomically
+func (db *FlexDB) FlushAll() {
+	db.Update(func(tx *Txn) error {
+		for key := range tx.db.data {
+			tx.db.deleteWithoutLogging(key)
+		}
+		tx.changed = true
+		tx.Log("FLUSHALL")
+		return nil
+	})
+}
+
+// MSet stores all given string values atomically, clearing their TTLs
+func (db *FlexDB) MSet(pairs map[string]string) error {
+	return db.mset(pairs, false)
+}
+
+// MSetNX stores all given string values atomically if none of the keys
+// exists, and reports whether it did
+func (db *FlexDB) MSetNX(pairs map[string]string) (bool, error) {
+	err := db.mset(pairs, true)
+	if errors.Is(err, ErrKeyExists) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (db *FlexDB) mset(pairs map[string]string, nx bool) error {
+	keys := make([]string, 0, len(pairs))
+	for key, value := range pairs {
+		if err := db.checkKey(key); err != nil {
+			return err
+		}
+		if err := db.checkValues(value); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	// logged in key order, so the AOF doesn't depend on map order
+	sort.Strings(keys)
+
+	return db.Update(func(tx *Txn) error {
+		if nx {
+			for _, key := range keys {
+				if _, ok := tx.Get(key); ok {
+					return ErrKeyExists
+				}
+			}
+		}
+		for _, key := range keys {
+			tx.Put(key, Value{Type: TypeString, Data: db.encodeString(pairs[key])})
+			tx.Log("SET", key, pairs[key])
+		}
+		return nil
+	})
+}
+
+// MGet returns the values of keys in order. Values of missing keys and of
+// keys that aren't strings are nil.
+func (db *FlexDB) MGet(keys ...string) []Entry {
+	entries := make([]Entry, len(keys))
+	db.View(func(tx *Txn) error {
+		for i, key := range keys {
+			entries[i].Key = key
+			if val, ok := tx.Get(key); ok {
+				if str, ok := stringData(val.Data); ok {
+					entries[i].Value = str
+				}
+			}
+		}
+		return nil
+	})
+	return entries
+}
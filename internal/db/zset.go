@@ -0,0 +1,581 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ZEntry is a member of a sorted set with its score
+type ZEntry struct {
+	Member string
+	Score  float64
+}
+
+// sortedSet is the in-memory form of a sorted set: unique members ordered
+// by score, then by member. Members are kept in a sorted slice, so lookups
+// by rank and score are binary searches and inserts shift the tail.
+type sortedSet struct {
+	scores  map[string]float64
+	entries []ZEntry // ordered by score, then member
+}
+
+func newSortedSet() *sortedSet {
+	return &sortedSet{scores: make(map[string]float64)}
+}
+
+// less orders sorted set entries
+func (e ZEntry) less(other ZEntry) bool {
+	if e.Score != other.Score {
+		return e.Score < other.Score
+	}
+	return e.Member < other.Member
+}
+
+// search returns the position of e, or where it would be inserted
+func (z *sortedSet) search(e ZEntry) int {
+	return sort.Search(len(z.entries), func(i int) bool {
+		return !z.entries[i].less(e)
+	})
+}
+
+// Len returns the number of members
+func (z *sortedSet) Len() int {
+	return len(z.entries)
+}
+
+// Score returns the score of member
+func (z *sortedSet) Score(member string) (float64, bool) {
+	score, ok := z.scores[member]
+	return score, ok
+}
+
+// Add sets the score of member, adding it if needed. It reports whether
+// the member is new.
+func (z *sortedSet) Add(member string, score float64) bool {
+	old, exists := z.scores[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		z.removeEntry(ZEntry{Member: member, Score: old})
+	}
+
+	e := ZEntry{Member: member, Score: score}
+	i := z.search(e)
+	z.entries = append(z.entries, ZEntry{})
+	copy(z.entries[i+1:], z.entries[i:])
+	z.entries[i] = e
+	z.scores[member] = score
+	return !exists
+}
+
+// Remove deletes member and reports whether it was present
+func (z *sortedSet) Remove(member string) bool {
+	score, ok := z.scores[member]
+	if !ok {
+		return false
+	}
+	z.removeEntry(ZEntry{Member: member, Score: score})
+	delete(z.scores, member)
+	return true
+}
+
+func (z *sortedSet) removeEntry(e ZEntry) {
+	i := z.search(e)
+	z.entries = append(z.entries[:i], z.entries[i+1:]...)
+}
+
+// First returns the member with the lowest score
+func (z *sortedSet) First() (ZEntry, bool) {
+	if len(z.entries) == 0 {
+		return ZEntry{}, false
+	}
+	return z.entries[0], true
+}
+
+// Entries returns the members in order. The slice must not be modified.
+func (z *sortedSet) Entries() []ZEntry {
+	return z.entries
+}
+
+// String formats the set for ALL
+func (z *sortedSet) String() string {
+	parts := make([]string, len(z.entries))
+	for i, e := range z.entries {
+		parts[i] = e.Member + ":" + strconv.FormatFloat(e.Score, 'f', -1, 64)
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// persisted returns the snapshot form of the set, an object of members
+// and their scores. JSON has no infinities, so those are stored as the
+// strings "inf" and "-inf".
+func (z *sortedSet) persisted() map[string]interface{} {
+	scores := make(map[string]interface{}, len(z.scores))
+	for member, score := range z.scores {
+		switch {
+		case math.IsInf(score, 1):
+			scores[member] = "inf"
+		case math.IsInf(score, -1):
+			scores[member] = "-inf"
+		default:
+			scores[member] = score
+		}
+	}
+	return scores
+}
+
+// aofCommands returns the ZADD commands that recreate the set
+func (z *sortedSet) aofCommands(key string) [][]string {
+	args := make([]string, 0, 2*len(z.entries))
+	for _, e := range z.entries {
+		args = append(args, strconv.FormatFloat(e.Score, 'f', -1, 64), e.Member)
+	}
+	return batchedCommands("ZADD", key, args, 2)
+}
+
+// loadSortedSet restores a sorted set from its snapshot form
+func loadSortedSet(data interface{}) (*sortedSet, error) {
+	members, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("sorted set is not an object")
+	}
+	z := newSortedSet()
+	for member, v := range members {
+		var score float64
+		switch v {
+		case "inf":
+			score = math.Inf(1)
+		case "-inf":
+			score = math.Inf(-1)
+		default:
+			f, ok := v.(float64)
+			if !ok {
+				return nil, fmt.Errorf("score of %q is not a number", member)
+			}
+			score = f
+		}
+		z.Add(member, score)
+	}
+	return z, nil
+}
+
+// Rank returns the position of member, lowest score first
+func (z *sortedSet) Rank(member string) (int, bool) {
+	score, ok := z.scores[member]
+	if !ok {
+		return 0, false
+	}
+	return z.search(ZEntry{Member: member, Score: score}), true
+}
+
+// ScoreRange is an interval of sorted set scores. Either end may be
+// exclusive and infinite.
+type ScoreRange struct {
+	Min, Max                   float64
+	MinExclusive, MaxExclusive bool
+}
+
+func (r ScoreRange) aboveMin(score float64) bool {
+	if r.MinExclusive {
+		return score > r.Min
+	}
+	return score >= r.Min
+}
+
+func (r ScoreRange) belowMax(score float64) bool {
+	if r.MaxExclusive {
+		return score < r.Max
+	}
+	return score <= r.Max
+}
+
+// RangeByScore returns the members scored within r, skipping offset of
+// them and returning at most count, or all of them if count is negative
+func (z *sortedSet) RangeByScore(r ScoreRange, offset, count int) []ZEntry {
+	start := sort.Search(len(z.entries), func(i int) bool {
+		return r.aboveMin(z.entries[i].Score)
+	})
+	entries := []ZEntry{}
+	for i := start + offset; i < len(z.entries) && r.belowMax(z.entries[i].Score); i++ {
+		if count >= 0 && len(entries) == count {
+			break
+		}
+		entries = append(entries, z.entries[i])
+	}
+	return entries
+}
+
+// Range returns the members from rank start to stop, both inclusive.
+// Negative ranks count from the highest score, as in LRANGE.
+func (z *sortedSet) Range(start, stop int) []ZEntry {
+	length := len(z.entries)
+	if start < 0 {
+		start = length + start
+	}
+	if stop < 0 {
+		stop = length + stop
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop || start >= length {
+		return []ZEntry{}
+	}
+	return append([]ZEntry(nil), z.entries[start:stop+1]...)
+}
+
+// ZAddFlags are the options of ZADD
+type ZAddFlags struct {
+	NX bool // only add new members
+	XX bool // only update existing members
+	GT bool // only update scores that increase
+	LT bool // only update scores that decrease
+	CH bool // count updated scores as well as new members
+}
+
+// blocks reports whether the flags keep member from being set to score,
+// given its old score and whether it exists. GT and LT never keep a new
+// member out.
+func (f ZAddFlags) blocks(exists bool, old, score float64) bool {
+	if !exists {
+		return f.XX
+	}
+	return f.NX || (f.GT && score <= old) || (f.LT && score >= old)
+}
+
+// ZAdd sets the scores of members of the sorted set at key, creating it
+// if needed. It returns how many members were added, or with CH how many
+// were added or had their score changed.
+func (db *FlexDB) ZAdd(key string, entries []ZEntry, flags ZAddFlags) (int, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if err := db.checkValues(e.Member); err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	err := db.Update(func(tx *Txn) error {
+		zset, err := sortedSetAt(tx, key)
+		if err != nil {
+			return err
+		}
+		created := zset == nil
+		if created {
+			if flags.XX {
+				return nil
+			}
+			zset = newSortedSet()
+		}
+
+		// check the size limit before changing anything
+		if !flags.XX {
+			fresh := make(map[string]bool)
+			for _, e := range entries {
+				if _, exists := zset.Score(e.Member); !exists {
+					fresh[e.Member] = true
+				}
+			}
+			if err := db.checkElements(zset.Len() + len(fresh)); err != nil {
+				return err
+			}
+		}
+
+		var logged []string
+		added := 0
+		for _, e := range entries {
+			old, exists := zset.Score(e.Member)
+			if flags.blocks(exists, old, e.Score) || (exists && old == e.Score) {
+				continue
+			}
+			if zset.Add(e.Member, e.Score) {
+				added++
+			}
+			logged = append(logged, strconv.FormatFloat(e.Score, 'f', -1, 64), e.Member)
+		}
+		if len(logged) == 0 {
+			return nil
+		}
+
+		if created {
+			tx.Put(key, Value{Type: TypeZSet, Data: zset})
+		}
+		tx.markChanged(key)
+		tx.Log("ZADD", append([]string{key}, logged...)...)
+		count = added
+		if flags.CH {
+			count = len(logged) / 2
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	db.signalKey(key)
+	return count, nil
+}
+
+// ZScore returns the score of member in the sorted set at key
+func (db *FlexDB) ZScore(key, member string) (float64, bool, error) {
+	var score float64
+	found := false
+	err := db.View(func(tx *Txn) error {
+		zset, err := sortedSetAt(tx, key)
+		if err != nil || zset == nil {
+			return err
+		}
+		score, found = zset.Score(member)
+		return nil
+	})
+	return score, found, err
+}
+
+// ZCard returns the number of members of the sorted set at key
+func (db *FlexDB) ZCard(key string) (int, error) {
+	length := 0
+	err := db.View(func(tx *Txn) error {
+		zset, err := sortedSetAt(tx, key)
+		if err != nil || zset == nil {
+			return err
+		}
+		length = zset.Len()
+		return nil
+	})
+	return length, err
+}
+
+// ZRange returns the members of the sorted set at key from rank start to
+// stop, lowest score first. Negative ranks count from the end.
+func (db *FlexDB) ZRange(key string, start, stop int) ([]ZEntry, error) {
+	entries := []ZEntry{}
+	err := db.View(func(tx *Txn) error {
+		zset, err := sortedSetAt(tx, key)
+		if err != nil || zset == nil {
+			return err
+		}
+		entries = zset.Range(start, stop)
+		return nil
+	})
+	return entries, err
+}
+
+// ZRem removes members from the sorted set at key and returns how many it
+// had. The key is deleted once the set is empty.
+func (db *FlexDB) ZRem(key string, members ...string) (int, error) {
+	removed := 0
+	err := db.Update(func(tx *Txn) error {
+		zset, err := sortedSetAt(tx, key)
+		if err != nil || zset == nil {
+			return err
+		}
+		var gone []string
+		for _, member := range members {
+			if zset.Remove(member) {
+				gone = append(gone, member)
+			}
+		}
+		if len(gone) == 0 {
+			return nil
+		}
+		if zset.Len() == 0 {
+			tx.Delete(key)
+		}
+		tx.markChanged(key)
+		tx.Log("ZREM", append([]string{key}, gone...)...)
+		removed = len(gone)
+		return nil
+	})
+	return removed, err
+}
+
+// ZPopMin removes and returns up to count members of the sorted set at key
+// with the lowest scores, lowest first. The key is deleted once the set is
+// empty.
+func (db *FlexDB) ZPopMin(key string, count int) ([]ZEntry, error) {
+	return db.zpop(key, count, false)
+}
+
+// ZPopMax is ZPopMin for the members with the highest scores, highest
+// first
+func (db *FlexDB) ZPopMax(key string, count int) ([]ZEntry, error) {
+	return db.zpop(key, count, true)
+}
+
+func (db *FlexDB) zpop(key string, count int, highest bool) ([]ZEntry, error) {
+	var popped []ZEntry
+	err := db.Update(func(tx *Txn) error {
+		zset, err := sortedSetAt(tx, key)
+		if err != nil || zset == nil || count <= 0 {
+			return err
+		}
+		if count > zset.Len() {
+			count = zset.Len()
+		}
+		if highest {
+			for i := zset.Len() - 1; len(popped) < count; i-- {
+				popped = append(popped, zset.entries[i])
+			}
+		} else {
+			popped = append(popped, zset.entries[:count]...)
+		}
+
+		// logged as ZREM, so replay doesn't depend on the order
+		logged := []string{key}
+		for _, e := range popped {
+			zset.Remove(e.Member)
+			logged = append(logged, e.Member)
+		}
+		if zset.Len() == 0 {
+			tx.Delete(key)
+		}
+		tx.markChanged(key)
+		tx.Log("ZREM", logged...)
+		return nil
+	})
+	return popped, err
+}
+
+// ZPopWait pops the member with the lowest score, or the highest one if
+// highest is set, from the first of keys holding a non-empty sorted set,
+// waiting for one to get a member when they are all empty. It returns the key popped from
+// with the member, ctx's error when ctx ends first, and ErrShuttingDown
+// when the database shuts down.
+func (db *FlexDB) ZPopWait(ctx context.Context, keys []string, highest bool) (string, ZEntry, error) {
+	var key string
+	var entry ZEntry
+	err := db.blockOnKeys(ctx, keys, func() (bool, time.Time, error) {
+		for _, k := range keys {
+			popped, err := db.zpop(k, 1, highest)
+			if err != nil {
+				return false, time.Time{}, err
+			}
+			if len(popped) > 0 {
+				key, entry = k, popped[0]
+				return true, time.Time{}, nil
+			}
+		}
+		return false, time.Time{}, nil
+	})
+	return key, entry, err
+}
+
+// ZIncrBy adds increment to the score of member in the sorted set at key,
+// adding the member with score increment if needed, and returns the new
+// score
+func (db *FlexDB) ZIncrBy(key, member string, increment float64) (float64, error) {
+	score, _, err := db.ZAddIncr(key, member, increment, ZAddFlags{})
+	return score, err
+}
+
+// ZAddIncr is ZADD with INCR: it adds increment to the score of member
+// under flags, like ZIncrBy. It returns the new score, or false if the
+// flags blocked the update.
+func (db *FlexDB) ZAddIncr(key, member string, increment float64, flags ZAddFlags) (float64, bool, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, false, err
+	}
+	if err := db.checkValues(member); err != nil {
+		return 0, false, err
+	}
+
+	var score float64
+	updated := false
+	err := db.Update(func(tx *Txn) error {
+		zset, err := sortedSetAt(tx, key)
+		if err != nil {
+			return err
+		}
+		created := zset == nil
+		if created {
+			zset = newSortedSet()
+		}
+		old, exists := zset.Score(member)
+		// adding -inf to inf
+		if math.IsNaN(old + increment) {
+			return ErrScoreNaN
+		}
+		if flags.blocks(exists, old, old+increment) {
+			return nil
+		}
+		if !exists {
+			if err := db.checkElements(zset.Len() + 1); err != nil {
+				return err
+			}
+		}
+
+		score = old + increment
+		updated = true
+		zset.Add(member, score)
+		if created {
+			tx.Put(key, Value{Type: TypeZSet, Data: zset})
+		}
+		tx.markChanged(key)
+		// logged as the resulting score, so replay doesn't depend on the old one
+		tx.Log("ZADD", key, strconv.FormatFloat(score, 'f', -1, 64), member)
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	db.signalKey(key)
+	return score, updated, nil
+}
+
+// ZRank returns the rank of member in the sorted set at key, lowest score
+// first, or highest first if reverse is set
+func (db *FlexDB) ZRank(key, member string, reverse bool) (int, bool, error) {
+	rank := 0
+	found := false
+	err := db.View(func(tx *Txn) error {
+		zset, err := sortedSetAt(tx, key)
+		if err != nil || zset == nil {
+			return err
+		}
+		rank, found = zset.Rank(member)
+		if found && reverse {
+			rank = zset.Len() - 1 - rank
+		}
+		return nil
+	})
+	return rank, found, err
+}
+
+// ZRangeByScore returns the members of the sorted set at key scored within
+// r, lowest score first, skipping offset of them and returning at most
+// count, or all of them if count is negative
+func (db *FlexDB) ZRangeByScore(key string, r ScoreRange, offset, count int) ([]ZEntry, error) {
+	entries := []ZEntry{}
+	err := db.View(func(tx *Txn) error {
+		zset, err := sortedSetAt(tx, key)
+		if err != nil || zset == nil {
+			return err
+		}
+		entries = zset.RangeByScore(r, offset, count)
+		return nil
+	})
+	return entries, err
+}
+
+// sortedSetAt returns the sorted set stored at key, or nil if the key
+// doesn't exist
+func sortedSetAt(tx *Txn, key string) (*sortedSet, error) {
+	val, ok := tx.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	if val.Type != TypeZSet {
+		return nil, ErrWrongType
+	}
+	return val.Data.(*sortedSet), nil
+}
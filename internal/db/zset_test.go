@@ -0,0 +1,126 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestZAddGTLT(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := db.ZAdd("z", []ZEntry{{Member: "a", Score: 5}}, ZAddFlags{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		flags   ZAddFlags
+		entries []ZEntry
+		count   int
+		scores  map[string]float64
+	}{
+		{"GT lower", ZAddFlags{GT: true, CH: true}, []ZEntry{{"a", 3}}, 0, map[string]float64{"a": 5}},
+		{"GT higher", ZAddFlags{GT: true, CH: true}, []ZEntry{{"a", 7}}, 1, map[string]float64{"a": 7}},
+		{"LT higher", ZAddFlags{LT: true, CH: true}, []ZEntry{{"a", 9}}, 0, map[string]float64{"a": 7}},
+		{"LT lower", ZAddFlags{LT: true, CH: true}, []ZEntry{{"a", 2}}, 1, map[string]float64{"a": 2}},
+		{"GT adds new", ZAddFlags{GT: true}, []ZEntry{{"b", -1}}, 1, map[string]float64{"b": -1}},
+		{"LT adds new", ZAddFlags{LT: true}, []ZEntry{{"c", 100}}, 1, map[string]float64{"c": 100}},
+		{"GT XX skips new", ZAddFlags{GT: true, XX: true}, []ZEntry{{"d", 1}}, 0, map[string]float64{}},
+	}
+	for _, tt := range tests {
+		count, err := db.ZAdd("z", tt.entries, tt.flags)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if count != tt.count {
+			t.Errorf("%s: got count %d, want %d", tt.name, count, tt.count)
+		}
+		for member, want := range tt.scores {
+			if got, _, _ := db.ZScore("z", member); got != want {
+				t.Errorf("%s: score of %s is %v, want %v", tt.name, member, got, want)
+			}
+		}
+	}
+	if _, found, _ := db.ZScore("z", "d"); found {
+		t.Error("GT XX added a new member")
+	}
+}
+
+func TestZAddIncr(t *testing.T) {
+	db := newTestDB(t)
+
+	score, ok, err := db.ZAddIncr("z", "a", 2, ZAddFlags{})
+	if err != nil || !ok || score != 2 {
+		t.Fatalf("INCR on a new member: got %v %v %v", score, ok, err)
+	}
+	score, ok, _ = db.ZAddIncr("z", "a", 1.5, ZAddFlags{})
+	if !ok || score != 3.5 {
+		t.Fatalf("INCR: got %v %v, want 3.5", score, ok)
+	}
+
+	blocked := []struct {
+		name      string
+		member    string
+		increment float64
+		flags     ZAddFlags
+	}{
+		{"NX existing", "a", 1, ZAddFlags{NX: true}},
+		{"XX missing", "b", 1, ZAddFlags{XX: true}},
+		{"GT decrement", "a", -1, ZAddFlags{GT: true}},
+		{"LT increment", "a", 1, ZAddFlags{LT: true}},
+	}
+	for _, tt := range blocked {
+		if _, ok, err := db.ZAddIncr("z", tt.member, tt.increment, tt.flags); err != nil || ok {
+			t.Errorf("%s: got %v %v, want blocked", tt.name, ok, err)
+		}
+	}
+	if got, _, _ := db.ZScore("z", "a"); got != 3.5 {
+		t.Errorf("blocked increments changed the score to %v", got)
+	}
+	if _, found, _ := db.ZScore("z", "b"); found {
+		t.Error("INCR XX added a new member")
+	}
+
+	score, ok, _ = db.ZAddIncr("z", "a", 1, ZAddFlags{GT: true})
+	if !ok || score != 4.5 {
+		t.Errorf("GT increment: got %v %v, want 4.5", score, ok)
+	}
+}
+
+func TestZPop(t *testing.T) {
+	db := newTestDB(t)
+	db.ZAdd("z", []ZEntry{{"a", 1}, {"b", 2}, {"c", 3}}, ZAddFlags{})
+
+	popped, err := db.ZPopMax("z", 2)
+	if err != nil || len(popped) != 2 || popped[0].Member != "c" || popped[1].Member != "b" {
+		t.Fatalf("ZPopMax: got %v %v", popped, err)
+	}
+	popped, _ = db.ZPopMin("z", 5)
+	if len(popped) != 1 || popped[0] != (ZEntry{"a", 1}) {
+		t.Fatalf("ZPopMin: got %v", popped)
+	}
+	if db.Exists("z") != 0 {
+		t.Error("the emptied set wasn't deleted")
+	}
+}
+
+func TestZPopWait(t *testing.T) {
+	db := newTestDB(t)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		db.ZAdd("second", []ZEntry{{"m", 4}}, ZAddFlags{})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	key, entry, err := db.ZPopWait(ctx, []string{"first", "second"}, false)
+	if err != nil || key != "second" || entry != (ZEntry{"m", 4}) {
+		t.Fatalf("got %q %v %v", key, entry, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := db.ZPopWait(ctx, []string{"first"}, false); err != context.DeadlineExceeded {
+		t.Errorf("got %v on timeout", err)
+	}
+}
@@ -0,0 +1,152 @@
+// Package metrics exposes server statistics in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"flex-db/internal/db"
+	"flex-db/internal/protocol"
+)
+
+// Handler serves the metrics of the server handled by handler at any
+// path, usually /metrics
+func Handler(handler *protocol.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		out := bufio.NewWriter(w)
+		writePersistence(out, handler.DB.PersistenceStats())
+		writeReplication(out, handler.ReplicationStatus())
+		out.Flush()
+	})
+}
+
+// metric writes a single sample with its HELP and TYPE lines
+func metric(w *bufio.Writer, name, kind, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+// labeledMetric writes the HELP and TYPE lines of a metric and a sample
+// for each value of label
+func labeledMetric(w *bufio.Writer, name, kind, help, label string, labels []string, values []interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for i, value := range values {
+		fmt.Fprintf(w, "%s{%s=%q} %v\n", name, label, labels[i], value)
+	}
+}
+
+func writePersistence(w *bufio.Writer, stats db.PersistenceStats) {
+	failing := 0
+	if stats.LastSnapshotError != nil || stats.LastFsyncError != nil {
+		failing = 1
+	}
+	metric(w, "flexdb_persistence_failing", "gauge",
+		"Whether the last snapshot or AOF fsync failed.", failing)
+	oldestUnsaved := 0.0
+	if !stats.OldestUnsavedChange.IsZero() {
+		oldestUnsaved = time.Since(stats.OldestUnsavedChange).Seconds()
+	}
+	metric(w, "flexdb_unsaved_changes", "gauge",
+		"Changes not yet written to a snapshot.", stats.UnsavedChanges)
+	metric(w, "flexdb_oldest_unsaved_change_seconds", "gauge",
+		"Age of the oldest change not yet written to a snapshot.", oldestUnsaved)
+	metric(w, "flexdb_changes_total", "counter",
+		"Changes recorded for the snapshot writer.", stats.Changes)
+	metric(w, "flexdb_last_persist_lag_seconds", "gauge",
+		"Age of the oldest change saved by the last snapshot.", stats.LastPersistLag.Seconds())
+	metric(w, "flexdb_writes_throttled_total", "counter",
+		"Write commands delayed by backpressure.", stats.WritesThrottled)
+	metric(w, "flexdb_write_throttle_seconds_total", "counter",
+		"Time write commands spent throttled.", stats.ThrottleTime.Seconds())
+
+	metric(w, "flexdb_snapshots_total", "counter",
+		"Snapshots written.", stats.Snapshots)
+	metric(w, "flexdb_snapshot_failures_total", "counter",
+		"Snapshots that failed.", stats.SnapshotFailures)
+	lastSave := int64(0)
+	if !stats.LastSnapshot.IsZero() {
+		lastSave = stats.LastSnapshot.Unix()
+	}
+	metric(w, "flexdb_last_snapshot_timestamp_seconds", "gauge",
+		"Unix time of the last successful snapshot.", lastSave)
+	metric(w, "flexdb_last_snapshot_duration_seconds", "gauge",
+		"Duration of the last successful snapshot.", stats.LastSnapshotDuration.Seconds())
+	metric(w, "flexdb_snapshot_duration_seconds_total", "counter",
+		"Time spent writing snapshots.", stats.TotalSnapshotDuration.Seconds())
+	metric(w, "flexdb_last_snapshot_bytes", "gauge",
+		"Size of the last successful snapshot.", stats.LastSnapshotBytes)
+	metric(w, "flexdb_snapshot_bytes_total", "counter",
+		"Bytes written by successful snapshots.", stats.SnapshotBytesWritten)
+
+	aofEnabled := 0
+	if stats.AOFEnabled {
+		aofEnabled = 1
+	}
+	metric(w, "flexdb_aof_enabled", "gauge",
+		"Whether the append-only file is enabled.", aofEnabled)
+	metric(w, "flexdb_aof_buffer_bytes", "gauge",
+		"Bytes logged to the AOF but not yet written to the file.", stats.AOFBufferSize)
+	metric(w, "flexdb_aof_bytes_total", "counter",
+		"Bytes logged to the AOF.", stats.AOFBytesWritten)
+	metric(w, "flexdb_aof_fsyncs_total", "counter",
+		"Successful AOF fsyncs.", stats.Fsyncs)
+	metric(w, "flexdb_aof_fsync_failures_total", "counter",
+		"Failed AOF fsyncs.", stats.FsyncFailures)
+	metric(w, "flexdb_aof_last_fsync_seconds", "gauge",
+		"Latency of the last successful AOF fsync.", stats.LastFsyncLatency.Seconds())
+	metric(w, "flexdb_aof_fsync_seconds_total", "counter",
+		"Time spent in successful AOF fsyncs.", stats.TotalFsyncLatency.Seconds())
+}
+
+func writeReplication(w *bufio.Writer, status protocol.ReplicationStatus) {
+	replica, linkUp := 0, 0
+	if status.Master != "" {
+		replica = 1
+		if status.LinkUp() {
+			linkUp = 1
+		}
+	}
+	metric(w, "flexdb_replica", "gauge",
+		"Whether the server is a replica.", replica)
+	metric(w, "flexdb_repl_offset_bytes", "gauge",
+		"Offset of the replication stream: bytes logged for replicas, or applied from the master.", status.Stream.Offset)
+	metric(w, "flexdb_repl_commands_total", "counter",
+		"Commands added to the replication stream.", status.Stream.Commands)
+	metric(w, "flexdb_connected_replicas", "gauge",
+		"Replicas streaming from the server.", len(status.Replicas))
+
+	if status.Master != "" {
+		metric(w, "flexdb_master_link_up", "gauge",
+			"Whether the replica is connected to its master and applying its stream.", linkUp)
+		lastIO := -1.0
+		if !status.LastIO.IsZero() {
+			lastIO = time.Since(status.LastIO).Seconds()
+		}
+		metric(w, "flexdb_master_last_io_seconds", "gauge",
+			"Time since the master last sent a command, -1 if it never did.", lastIO)
+	}
+
+	if len(status.Replicas) == 0 {
+		return
+	}
+	addrs := make([]string, len(status.Replicas))
+	acked := make([]interface{}, len(status.Replicas))
+	lag := make([]interface{}, len(status.Replicas))
+	lastAck := make([]interface{}, len(status.Replicas))
+	for i, r := range status.Replicas {
+		addrs[i] = net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+		acked[i] = r.Acked
+		lag[i] = status.Stream.Offset - r.Acked
+		lastAck[i] = time.Since(r.LastAck).Seconds()
+	}
+	labeledMetric(w, "flexdb_replica_acked_offset_bytes", "gauge",
+		"Offset of the stream the replica acknowledged.", "replica", addrs, acked)
+	labeledMetric(w, "flexdb_replica_lag_bytes", "gauge",
+		"Bytes of the stream the replica hasn't acknowledged yet.", "replica", addrs, lag)
+	labeledMetric(w, "flexdb_replica_last_ack_seconds", "gauge",
+		"Time since the replica last acknowledged the stream.", "replica", addrs, lastAck)
+}
@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+
+	"flex-db/internal/resp"
+)
+
+// registerAdminCommands registers commands that change the server as a
+// whole. Together with DEBUG and BGREWRITEAOF they are refused on the
+// public port when the server runs with an admin port.
+func (r *CommandRegistry) registerAdminCommands() {
+	r.RegisterAdmin("SHUTDOWN", shutdownCommand)
+	r.RegisterAdmin("FLUSHALL", flushallCommand)
+	r.writes["FLUSHALL"] = true // refused like any write, on replicas too
+	r.RegisterAdmin("ENCRYPTION", encryptionCommand)
+}
+
+// shutdownCommand handles the SHUTDOWN command.
+// Syntax: SHUTDOWN [SAVE]
+// Starts a graceful shutdown: connections are drained, a final snapshot
+// is written and the AOF is closed, exactly as on SIGTERM.
+// Example: SHUTDOWN
+func shutdownCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) > 1 || (len(args) == 1 && strings.ToUpper(args[0].Str) != "SAVE") {
+		return resp.NewError("ERR syntax error")
+	}
+	if h.shutdown == nil {
+		return resp.NewError("ERR SHUTDOWN is not available on this server")
+	}
+
+	h.shutdown()
+	return resp.NewSimpleString("OK")
+}
+
+// flushallCommand handles the FLUSHALL command.
+// Syntax: FLUSHALL
+// Deletes every key.
+// Example: FLUSHALL
+func flushallCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 0 {
+		return wrongArgsError("flushall")
+	}
+
+	h.DB.FlushAll()
+	return resp.NewSimpleString("OK")
+}
+
+// encryptionCommand handles the ENCRYPTION command.
+// Syntax: ENCRYPTION STATUS | RELOAD | REENCRYPT
+// STATUS lists the encrypted key patterns and the known keys, the active
+// one first. RELOAD reads the key file again and REENCRYPT rewrites the
+// snapshot and AOF with the active key, after which older keys can be
+// removed from the file.
+// Example: ENCRYPTION RELOAD
+func encryptionCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("encryption")
+	}
+
+	switch strings.ToUpper(args[0].Str) {
+	case "STATUS":
+		status, err := h.DB.EncryptionStatus()
+		if err != nil {
+			return errorReply(err)
+		}
+		patterns := make([]resp.Value, len(status.Patterns))
+		for i, p := range status.Patterns {
+			patterns[i] = resp.NewBulkString(p)
+		}
+		keys := make([]resp.Value, len(status.Keys))
+		for i, k := range status.Keys {
+			keys[i] = resp.NewBulkString(k)
+		}
+		return resp.NewArray([]resp.Value{
+			resp.NewBulkString("patterns"), resp.NewArray(patterns),
+			resp.NewBulkString("active-key"), resp.NewBulkString(status.ActiveKey),
+			resp.NewBulkString("keys"), resp.NewArray(keys),
+		})
+	case "RELOAD":
+		if err := h.DB.ReloadEncryptionKeys(); err != nil {
+			return errorReply(err)
+		}
+		return resp.NewSimpleString("OK")
+	case "REENCRYPT":
+		if err := h.DB.Reencrypt(); err != nil {
+			return errorReply(err)
+		}
+		return resp.NewSimpleString("OK")
+	default:
+		return resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try ENCRYPTION STATUS, RELOAD or REENCRYPT.", args[0].Str))
+	}
+}
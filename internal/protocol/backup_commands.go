@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"flex-db/internal/resp"
+)
+
+// registerBackupCommands registers SYNC
+func (r *CommandRegistry) registerBackupCommands() {
+	r.RegisterAdmin("SYNC", syncCommand)
+}
+
+// syncCommand handles the SYNC command.
+// Syntax: SYNC
+// Streams a consistent snapshot of the whole keyspace to the client as a
+// single bulk string, so backups can be pulled over the network; flexdb
+// backup saves it to a file. The payload is a snapshot file as --db loads
+// it, compressed and encrypted as the server's own. Unlike Redis's SYNC it
+// starts no replication: the connection serves commands again afterwards.
+// Example: SYNC
+func syncCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 0 {
+		return wrongArgsError("sync")
+	}
+	if c.Protocol != RESPProtocol {
+		return resp.NewError("ERR SYNC needs the RESP protocol")
+	}
+
+	// the snapshot is spooled to disk, since a bulk string needs its
+	// length up front
+	spool, err := os.CreateTemp("", "flexdb-sync-*")
+	if err != nil {
+		return errorReply(fmt.Errorf("failed to create backup: %w", err))
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	// only the copy of the keyspace has to wait for scripts, not the
+	// transfer
+	h.scriptGate.RLock()
+	size, err := h.DB.Backup(spool)
+	h.scriptGate.RUnlock()
+	if err != nil {
+		return errorReply(err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return errorReply(err)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.replyQueued = true
+	if err := c.writer.Flush(); err != nil {
+		c.Conn.Close()
+		return resp.Value{}
+	}
+	w := bufio.NewWriterSize(&deadlineWriter{conn: c.Conn, timeout: h.output.WriteTimeout}, 64*1024)
+	fmt.Fprintf(w, "$%d\r\n", size)
+	io.Copy(w, spool)
+	w.WriteString("\r\n")
+	if err := w.Flush(); err != nil {
+		// the client can't tell where the payload ends anymore
+		fmt.Printf("Closing client %s: backup transfer failed: %v\n", c.Addr, err)
+		c.Conn.Close()
+	}
+	return resp.Value{}
+}
+
+// deadlineWriter writes to a connection, giving each write its own
+// deadline so a long transfer only fails if the client stops reading
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration // 0 for no deadline
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	if d.timeout > 0 {
+		d.conn.SetWriteDeadline(time.Now().Add(d.timeout))
+	}
+	return d.conn.Write(p)
+}
@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"flex-db/internal/resp"
+)
+
+// nextClientID hands out unique, increasing connection ids
+var nextClientID int64
+
+// Client holds the state of a single client connection.
+// It is only touched by the goroutine serving that connection, except
+// for its output, which publishers queue messages to.
+type Client struct {
+	ID            int64
+	Conn          net.Conn
+	Addr          string
+	Protocol      ProtocolType
+	RespVersion   int    // RESP version negotiated with HELLO
+	Name          string // set with HELLO SETNAME or CLIENT SETNAME
+	LibName       string // set with CLIENT SETINFO LIB-NAME
+	LibVersion    string // set with CLIENT SETINFO LIB-VER
+	Authenticated bool
+	Admin         bool // connected through the admin port
+	CreatedAt     time.Time
+	LastCommand   string    // lowercase name of the last command run
+	LastActive    time.Time // when the last command started
+
+	inScript    bool // running the commands of a script
+	repliesOff  bool // set with CLIENT REPLY OFF
+	skipReplies int  // replies still to drop, set with CLIENT REPLY SKIP
+	replyQueued bool // the command queued its own replies, see SUBSCRIBE
+	replicaPort int  // port a replica listens on, see REPLCONF listening-port
+	asking      bool // sent ASKING, so the next command may use an importing slot
+
+	channels map[string]struct{} // subscribed to, changed under the broker lock
+	patterns map[string]struct{} // subscribed to with PSUBSCRIBE, likewise
+
+	out          clientOutput  // unread output, checked against the output limits
+	writer       *bufio.Writer // the connection's output, written under writeMu
+	writeMu      sync.Mutex    // serialises writes from the connection and its pushes
+	pushes       chan []byte   // encoded output queued once subscribed, see startPushing
+	pushOverflow atomic.Bool   // the queued output fell too far behind and the client was closed
+}
+
+// newClient creates the state for a freshly accepted connection
+func newClient(conn net.Conn, authenticated bool) *Client {
+	return &Client{
+		ID:            atomic.AddInt64(&nextClientID, 1),
+		Conn:          conn,
+		Addr:          conn.RemoteAddr().String(),
+		RespVersion:   2,
+		Authenticated: authenticated,
+		CreatedAt:     time.Now(),
+		LastActive:    time.Now(),
+	}
+}
+
+// commandsWithSubcommands are recorded as "command|subcommand" in
+// LastCommand, matching how CLIENT INFO reports them
+var commandsWithSubcommands = map[string]bool{
+	"CLIENT": true,
+	"DEBUG":  true,
+	"OBJECT": true,
+}
+
+// recordCommand notes the command the client is about to run
+func (c *Client) recordCommand(cmd string, args []resp.Value) {
+	name := strings.ToLower(cmd)
+	if commandsWithSubcommands[cmd] && len(args) > 0 {
+		name += "|" + strings.ToLower(args[0].Str)
+	}
+	c.LastCommand = name
+	c.LastActive = time.Now()
+}
+
+// takeReply reports whether the reply to the command that just ran should
+// be sent, consuming a pending CLIENT REPLY SKIP
+func (c *Client) takeReply() bool {
+	if c.replyQueued {
+		c.replyQueued = false
+		return false
+	}
+	if c.skipReplies > 0 {
+		c.skipReplies--
+		return false
+	}
+	return !c.repliesOff
+}
+
+// subscriptions returns how many channels and patterns the client is
+// subscribed to
+func (c *Client) subscriptions() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+// subscribed returns the channels or the patterns the client is
+// subscribed to
+func (c *Client) subscribed(pattern bool) map[string]struct{} {
+	if c.channels == nil {
+		c.channels = make(map[string]struct{})
+		c.patterns = make(map[string]struct{})
+	}
+	if pattern {
+		return c.patterns
+	}
+	return c.channels
+}
+
+// info describes the connection as a single line of key=value pairs
+func (c *Client) info() string {
+	proto := "text"
+	if c.Protocol == RESPProtocol {
+		proto = "resp"
+	}
+
+	now := time.Now()
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d proto=%s resp=%d lib-name=%s lib-ver=%s omem=%d cmd=%s",
+		c.ID, c.Addr, c.Conn.LocalAddr(), c.Name,
+		int64(now.Sub(c.CreatedAt).Seconds()), int64(now.Sub(c.LastActive).Seconds()),
+		proto, c.RespVersion, c.LibName, c.LibVersion, c.out.size(), c.LastCommand)
+}
+
+// reset returns the connection to the state it had right after connecting.
+// Anything added to Client that a pooled connection must not leak to its
+// next user belongs here.
+func (c *Client) reset(authenticated bool) {
+	c.RespVersion = 2
+	c.Name = ""
+	c.LibName = ""
+	c.LibVersion = ""
+	c.Authenticated = authenticated
+	c.repliesOff = false
+	c.skipReplies = 0
+	c.asking = false
+}
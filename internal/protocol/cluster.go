@@ -0,0 +1,770 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"flex-db/internal/resp"
+)
+
+// Cluster mode
+//
+// The keyspace is split into 16384 hash slots as in Redis Cluster: a key
+// belongs to slot CRC16(key) mod 16384, and if the key holds a {hash tag}
+// only the tag is hashed, so related keys can share a slot. Every slot is
+// served by one node. A command for a slot served elsewhere is answered
+// with MOVED slot host:port, and cluster-aware clients retry it there.
+//
+// There is no gossip: every node reads the layout of the cluster from its
+// own nodes file, one node per line:
+//
+//	<id> <host:port> <flags> [<slot>|<first>-<last> ...]
+//
+// The flags are myself on the line of the node reading the file and - on
+// the others. While a slot moves between nodes, the node giving it away
+// lists [<slot>->-<id>] and the node receiving it [<slot>-<-<id>]. The
+// giving node answers ASK slot host:port for the keys it no longer has,
+// and the receiving node serves them to clients that sent ASKING first.
+
+// clusterSlots is how many hash slots the keyspace is split into
+const clusterSlots = 16384
+
+// cluster is the layout of the cluster as one node sees it
+type cluster struct {
+	mu        sync.RWMutex
+	path      string                  // the nodes file
+	myself    *clusterNode            // this node
+	nodes     map[string]*clusterNode // by ID
+	slots     [clusterSlots]*clusterNode
+	migrating map[int]*clusterNode // slots moving from this node to another
+	importing map[int]*clusterNode // slots moving from another node to this one
+}
+
+// clusterNode is a node of the cluster
+type clusterNode struct {
+	id   string
+	addr string // host:port clients connect to
+}
+
+// WithCluster enables cluster mode with the layout in the nodes file at
+// path, see the start of cluster.go
+func WithCluster(path string) (HandlerOption, error) {
+	cl, err := loadCluster(path)
+	if err != nil {
+		return nil, err
+	}
+	return func(h *Handler) {
+		h.cluster = cl
+	}, nil
+}
+
+// loadCluster reads a nodes file
+func loadCluster(path string) (*cluster, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	cl := &cluster{
+		path:      path,
+		nodes:     make(map[string]*clusterNode),
+		migrating: make(map[int]*clusterNode),
+		importing: make(map[int]*clusterNode),
+	}
+	type pending struct {
+		node   *clusterNode
+		ranges []string
+		line   int
+	}
+	var lines []pending
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected '<id> <host:port> <flags> [slots...]'", path, n)
+		}
+		if _, _, err := net.SplitHostPort(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		if _, dup := cl.nodes[fields[0]]; dup {
+			return nil, fmt.Errorf("%s:%d: node %s is listed twice", path, n, fields[0])
+		}
+		node := &clusterNode{id: fields[0], addr: fields[1]}
+		cl.nodes[node.id] = node
+		for _, flag := range strings.Split(fields[2], ",") {
+			if flag == "myself" {
+				if cl.myself != nil {
+					return nil, fmt.Errorf("%s:%d: only one node can be myself", path, n)
+				}
+				cl.myself = node
+			}
+		}
+		lines = append(lines, pending{node, fields[3:], n})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if cl.myself == nil {
+		return nil, fmt.Errorf("%s: no node is flagged myself", path)
+	}
+
+	// slots are read once every node is known, as migrations name others
+	for _, p := range lines {
+		for _, r := range p.ranges {
+			if err := cl.assign(p.node, r); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, p.line, err)
+			}
+		}
+	}
+	return cl, nil
+}
+
+// assign gives node the slots of a nodes file entry: a slot, a range or
+// a migration
+func (cl *cluster) assign(node *clusterNode, entry string) error {
+	if strings.HasPrefix(entry, "[") && strings.HasSuffix(entry, "]") {
+		inner := entry[1 : len(entry)-1]
+		states := []struct {
+			sep   string
+			slots map[int]*clusterNode
+		}{{"->-", cl.migrating}, {"-<-", cl.importing}}
+		for _, state := range states {
+			slotStr, id, ok := strings.Cut(inner, state.sep)
+			if !ok {
+				continue
+			}
+			slot, err := parseSlot(slotStr)
+			if err != nil {
+				return err
+			}
+			other, ok := cl.nodes[id]
+			if !ok {
+				return fmt.Errorf("unknown node %s in %s", id, entry)
+			}
+			if node == cl.myself {
+				state.slots[slot] = other
+			}
+			return nil
+		}
+		return fmt.Errorf("invalid slot migration %s", entry)
+	}
+
+	first, last := entry, entry
+	if a, b, ok := strings.Cut(entry, "-"); ok {
+		first, last = a, b
+	}
+	from, err := parseSlot(first)
+	if err != nil {
+		return err
+	}
+	to, err := parseSlot(last)
+	if err != nil {
+		return err
+	}
+	if from > to {
+		return fmt.Errorf("invalid slot range %s", entry)
+	}
+	for slot := from; slot <= to; slot++ {
+		if owner := cl.slots[slot]; owner != nil {
+			return fmt.Errorf("slot %d is assigned to both %s and %s", slot, owner.id, node.id)
+		}
+		cl.slots[slot] = node
+	}
+	return nil
+}
+
+// parseSlot parses a hash slot number
+func parseSlot(s string) (int, error) {
+	slot, err := strconv.Atoi(s)
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return 0, fmt.Errorf("invalid hash slot %q", s)
+	}
+	return slot, nil
+}
+
+// keySlot returns the hash slot of key
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % clusterSlots
+}
+
+// crc16 is CRC-16/XMODEM, the checksum Redis Cluster hashes keys with
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// keylessCommands take no keys, or patterns or tags that each node
+// resolves against its own keys, so they run on any node
+var keylessCommands = map[string]bool{
+	"AUTH":          true,
+	"HELLO":         true,
+	"RESET":         true,
+	"CLIENT":        true,
+	"PING":          true,
+	"ALL":           true,
+	"FLUSH":         true,
+	"SAVE":          true,
+	"BGSAVE":        true,
+	"BGREWRITEAOF":  true,
+	"BGREWRITE":     true,
+	"HELP":          true,
+	"DEBUG":         true,
+	"IMPORT":        true,
+	"INFO":          true,
+	"TIME":          true,
+	"KEYS":          true,
+	"SCAN":          true,
+	"RANDOMKEY":     true,
+	"PREFIXGET":     true,
+	"DELPATTERN":    true,
+	"EXPIREPATTERN": true,
+	"RENAMEPATTERN": true,
+	"KEYSTATS":      true,
+	"IDLEKEYS":      true,
+	"LEASE":         true,
+	"SUBSCRIBE":     true,
+	"UNSUBSCRIBE":   true,
+	"PSUBSCRIBE":    true,
+	"PUNSUBSCRIBE":  true,
+	"PUBLISH":       true,
+	"PUBSUB":        true,
+	"QUERY":         true,
+	"PSYNC":         true,
+	"REPLCONF":      true,
+	"REPLICAOF":     true,
+	"SLAVEOF":       true,
+	"WAIT":          true,
+	"ROLE":          true,
+	"SCRIPT":        true,
+	"KEYSBYTAG":     true,
+	"DELBYTAG":      true,
+	"EXPIREBYTAG":   true,
+	"TRASH":         true,
+	"SHUTDOWN":      true,
+	"FLUSHALL":      true,
+	"ENCRYPTION":    true,
+	"SYNC":          true,
+	"CLUSTER":       true,
+	"ASKING":        true,
+}
+
+// commandKeys returns the keys a command reads or writes. Commands not
+// listed take a single key as their first argument.
+func commandKeys(cmd string, args []resp.Value) []string {
+	if keylessCommands[cmd] {
+		return nil
+	}
+	var keys []resp.Value
+	switch cmd {
+	case "DEL", "UNLINK", "EXISTS", "MGET", "SINTER", "SUNION", "SDIFF",
+		"SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE":
+		keys = args
+	case "MSET", "MSETNX":
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+	case "LMOVE", "RPOPLPUSH", "BLMOVE", "BRPOPLPUSH":
+		if len(args) >= 2 {
+			keys = args[:2]
+		}
+	case "BZPOPMIN", "BZPOPMAX":
+		if len(args) >= 1 {
+			keys = args[:len(args)-1]
+		}
+	case "MIGRATE":
+		if len(args) < 5 {
+			break
+		}
+		keys = args[2:3]
+		for i := 5; i < len(args); i++ {
+			if strings.ToUpper(args[i].Str) == "KEYS" {
+				keys = args[i+1:]
+				break
+			}
+		}
+	case "OBJECT", "MEMORY":
+		if len(args) >= 2 {
+			keys = args[1:2]
+		}
+	case "EVAL", "EVALSHA":
+		if len(args) >= 2 {
+			if n, err := strconv.Atoi(args[1].Str); err == nil && n >= 0 && n <= len(args)-2 {
+				keys = args[2 : 2+n]
+			}
+		}
+	default:
+		if len(args) >= 1 {
+			keys = args[:1]
+		}
+	}
+
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = key.Str
+	}
+	return names
+}
+
+// route returns the redirection for a command whose keys aren't all
+// served by this node, or nil if it runs here. ASKING only lasts for the
+// command following it.
+func (h *Handler) route(c *Client, cmd string, args []resp.Value) *resp.Value {
+	asking := c.asking
+	if cmd != "ASKING" {
+		c.asking = false
+	}
+	keys := commandKeys(cmd, args)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	slot := keySlot(keys[0])
+	for _, key := range keys[1:] {
+		if keySlot(key) != slot {
+			reply := resp.NewError("CROSSSLOT Keys in request don't hash to the same slot")
+			return &reply
+		}
+	}
+
+	cl := h.cluster
+	cl.mu.RLock()
+	owner := cl.slots[slot]
+	migratingTo := cl.migrating[slot]
+	importing := cl.importing[slot] != nil
+	cl.mu.RUnlock()
+
+	var reply resp.Value
+	switch {
+	case owner == cl.myself && migratingTo != nil:
+		// keys that are still here are served here, the others moved
+		switch found := h.DB.Exists(keys...); {
+		case found == len(keys):
+			return nil
+		case found == 0:
+			reply = resp.NewError(fmt.Sprintf("ASK %d %s", slot, migratingTo.addr))
+		default:
+			reply = resp.NewError("TRYAGAIN Multiple keys request during rehashing of slot")
+		}
+	case owner == cl.myself, importing && asking:
+		return nil
+	case owner == nil:
+		reply = resp.NewError("CLUSTERDOWN Hash slot not served")
+	default:
+		reply = resp.NewError(fmt.Sprintf("MOVED %d %s", slot, owner.addr))
+	}
+	return &reply
+}
+
+// registerClusterCommands registers CLUSTER and ASKING
+func (r *CommandRegistry) registerClusterCommands() {
+	r.Register("CLUSTER", clusterCommand)
+	r.Register("ASKING", askingCommand)
+}
+
+var clusterHelp = []string{
+	"CLUSTER <subcommand> [<arg> ...]. Subcommands are:",
+	"KEYSLOT <key>",
+	"    Return the hash slot of <key>.",
+	"MYID",
+	"    Return the ID of this node.",
+	"SLOTS",
+	"    Return the slot ranges and the node serving each.",
+	"NODES",
+	"    Return the nodes of the cluster in the nodes file format of Redis.",
+	"INFO",
+	"    Return the state of the cluster.",
+	"COUNTKEYSINSLOT <slot>",
+	"    Return how many keys of <slot> this node holds.",
+	"GETKEYSINSLOT <slot> <count>",
+	"    Return up to <count> keys of <slot> this node holds.",
+	"SETSLOT <slot> MIGRATING <id> | IMPORTING <id> | STABLE | NODE <id>",
+	"    Move <slot> between nodes, see the README. Saved to the nodes file.",
+	"HELP",
+	"    Print this help.",
+}
+
+// clusterCommand handles the CLUSTER command.
+// Syntax: CLUSTER subcommand [arg ...]
+// Inspects the layout of the cluster, see the start of cluster.go, and
+// moves slots between nodes with SETSLOT. KEYSLOT works without cluster
+// mode too.
+// Example: CLUSTER SLOTS
+func clusterCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("cluster")
+	}
+	name := strings.ToUpper(args[0].Str)
+	args = args[1:]
+
+	switch name {
+	case "HELP":
+		lines := make([]resp.Value, len(clusterHelp))
+		for i, line := range clusterHelp {
+			lines[i] = resp.NewSimpleString(line)
+		}
+		return resp.NewArray(lines)
+	case "KEYSLOT":
+		if len(args) != 1 {
+			return wrongArgsError("cluster|keyslot")
+		}
+		return resp.NewInteger(int64(keySlot(args[0].Str)))
+	}
+
+	cl := h.cluster
+	if cl == nil {
+		return resp.NewError("ERR This instance has cluster support disabled")
+	}
+
+	switch name {
+	case "COUNTKEYSINSLOT":
+		if len(args) != 1 {
+			return wrongArgsError("cluster|countkeysinslot")
+		}
+		slot, err := parseSlot(args[0].Str)
+		if err != nil {
+			return resp.NewError("ERR Invalid slot")
+		}
+		return resp.NewInteger(int64(len(h.keysInSlot(slot, -1))))
+
+	case "GETKEYSINSLOT":
+		if len(args) != 2 {
+			return wrongArgsError("cluster|getkeysinslot")
+		}
+		slot, err := parseSlot(args[0].Str)
+		if err != nil {
+			return resp.NewError("ERR Invalid slot")
+		}
+		count, err := strconv.Atoi(args[1].Str)
+		if err != nil || count < 0 {
+			return resp.NewError("ERR Invalid number of keys")
+		}
+		keys := h.keysInSlot(slot, count)
+		items := make([]resp.Value, len(keys))
+		for i, key := range keys {
+			items[i] = resp.NewBulkString(key)
+		}
+		return resp.NewArray(items)
+
+	case "SETSLOT":
+		return h.setSlot(args)
+	}
+
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+
+	switch name {
+	case "MYID":
+		return resp.NewBulkString(cl.myself.id)
+
+	case "SLOTS":
+		var ranges []resp.Value
+		for _, r := range cl.ranges() {
+			host, port, _ := net.SplitHostPort(r.node.addr)
+			ranges = append(ranges, resp.NewArray([]resp.Value{
+				resp.NewInteger(int64(r.first)),
+				resp.NewInteger(int64(r.last)),
+				resp.NewArray([]resp.Value{
+					resp.NewBulkString(host),
+					resp.NewInteger(parsePort(port)),
+					resp.NewBulkString(r.node.id),
+				}),
+			}))
+		}
+		return resp.NewArray(ranges)
+
+	case "NODES":
+		return resp.NewBulkString(cl.nodesText())
+
+	case "INFO":
+		assigned := 0
+		for _, node := range cl.slots {
+			if node != nil {
+				assigned++
+			}
+		}
+		state := "ok"
+		if assigned < clusterSlots {
+			state = "fail"
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "cluster_enabled:1\r\n")
+		fmt.Fprintf(&b, "cluster_state:%s\r\n", state)
+		fmt.Fprintf(&b, "cluster_slots_assigned:%d\r\n", assigned)
+		fmt.Fprintf(&b, "cluster_known_nodes:%d\r\n", len(cl.nodes))
+		fmt.Fprintf(&b, "cluster_size:%d\r\n", len(cl.servingNodes()))
+		return resp.NewBulkString(b.String())
+	}
+	return resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CLUSTER HELP.", name))
+}
+
+// askingCommand handles the ASKING command.
+// Syntax: ASKING
+// Lets the next command use a slot this node is importing, as a client
+// does after an ASK redirection.
+// Example: ASKING
+func askingCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 0 {
+		return wrongArgsError("asking")
+	}
+	if h.cluster == nil {
+		return resp.NewError("ERR This instance has cluster support disabled")
+	}
+	c.asking = true
+	return resp.NewSimpleString("OK")
+}
+
+// keysInSlot returns up to count keys of slot, or all of them if count
+// is negative. It looks at every key, as keys aren't indexed by slot.
+func (h *Handler) keysInSlot(slot, count int) []string {
+	all, _ := h.DB.Keys("", 0, -1)
+	var keys []string
+	for _, key := range all {
+		if count >= 0 && len(keys) == count {
+			break
+		}
+		if keySlot(key) == slot {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// setSlot runs CLUSTER SETSLOT, which moves a slot in steps:
+//
+//  1. SETSLOT <slot> IMPORTING <source> on the receiving node
+//  2. SETSLOT <slot> MIGRATING <target> on the giving node
+//  3. MIGRATE the keys of the slot from the giving node, found with
+//     GETKEYSINSLOT, until it has none left
+//  4. SETSLOT <slot> NODE <target> on every node
+//
+// STABLE cancels a move. Every change is saved to the nodes file.
+func (h *Handler) setSlot(args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("cluster|setslot")
+	}
+	slot, err := parseSlot(args[0].Str)
+	if err != nil {
+		return resp.NewError("ERR Invalid slot")
+	}
+	action := strings.ToUpper(args[1].Str)
+	var node *clusterNode
+	if action != "STABLE" {
+		if len(args) != 3 {
+			return resp.NewError("ERR syntax error")
+		}
+	} else if len(args) != 2 {
+		return resp.NewError("ERR syntax error")
+	}
+
+	// checked before locking the layout, as it reads the keyspace
+	holdsKeys := action == "NODE" && len(h.keysInSlot(slot, 1)) > 0
+
+	cl := h.cluster
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if len(args) == 3 {
+		var ok bool
+		if node, ok = cl.nodes[args[2].Str]; !ok {
+			return resp.NewError(fmt.Sprintf("ERR I don't know about node %s", args[2].Str))
+		}
+	}
+
+	switch action {
+	case "MIGRATING":
+		if cl.slots[slot] != cl.myself {
+			return resp.NewError(fmt.Sprintf("ERR I'm not the owner of hash slot %d", slot))
+		}
+		if node == cl.myself {
+			return resp.NewError("ERR I can't migrate a slot to myself")
+		}
+		cl.migrating[slot] = node
+	case "IMPORTING":
+		if cl.slots[slot] == cl.myself {
+			return resp.NewError(fmt.Sprintf("ERR I'm already the owner of hash slot %d", slot))
+		}
+		if node == cl.myself {
+			return resp.NewError("ERR I can't import a slot from myself")
+		}
+		cl.importing[slot] = node
+	case "STABLE":
+		delete(cl.migrating, slot)
+		delete(cl.importing, slot)
+	case "NODE":
+		if cl.slots[slot] == cl.myself && node != cl.myself && holdsKeys {
+			return resp.NewError(fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+		}
+		cl.slots[slot] = node
+		delete(cl.migrating, slot)
+		if node == cl.myself {
+			delete(cl.importing, slot)
+		}
+	default:
+		return resp.NewError("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+
+	if err := cl.save(); err != nil {
+		return resp.NewError("ERR failed to save the nodes file: " + err.Error())
+	}
+	return resp.NewSimpleString("OK")
+}
+
+// save writes the layout to the nodes file, through a temporary file so
+// a crash never leaves it half written. Callers hold cl.mu.
+func (cl *cluster) save() error {
+	ids := make([]string, 0, len(cl.nodes))
+	for id := range cl.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	ranges := cl.ranges()
+
+	var b strings.Builder
+	b.WriteString("# FlexDB cluster nodes: <id> <host:port> <flags> [<slots> ...]\n")
+	for _, id := range ids {
+		node := cl.nodes[id]
+		flags := "-"
+		if node == cl.myself {
+			flags = "myself"
+		}
+		fmt.Fprintf(&b, "%s %s %s%s", node.id, node.addr, flags, cl.slotsText(node, ranges))
+		b.WriteString("\n")
+	}
+
+	tempFile := cl.path + ".tmp"
+	file, err := os.Create(tempFile)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(b.String()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, cl.path)
+}
+
+// slotsText returns the slots of node as the nodes file lists them, each
+// preceded by a space. Callers hold cl.mu.
+func (cl *cluster) slotsText(node *clusterNode, ranges []slotRange) string {
+	var b strings.Builder
+	for _, r := range ranges {
+		if r.node != node {
+			continue
+		}
+		if r.first == r.last {
+			fmt.Fprintf(&b, " %d", r.first)
+		} else {
+			fmt.Fprintf(&b, " %d-%d", r.first, r.last)
+		}
+	}
+	if node == cl.myself {
+		for _, slot := range sortedSlots(cl.migrating) {
+			fmt.Fprintf(&b, " [%d->-%s]", slot, cl.migrating[slot].id)
+		}
+		for _, slot := range sortedSlots(cl.importing) {
+			fmt.Fprintf(&b, " [%d-<-%s]", slot, cl.importing[slot].id)
+		}
+	}
+	return b.String()
+}
+
+// slotRange is a run of consecutive slots served by one node
+type slotRange struct {
+	first, last int
+	node        *clusterNode
+}
+
+// ranges returns the assigned slots as ranges, in slot order. Callers
+// hold cl.mu.
+func (cl *cluster) ranges() []slotRange {
+	var ranges []slotRange
+	for slot, node := range cl.slots {
+		if node == nil {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].node == node && ranges[n-1].last == slot-1 {
+			ranges[n-1].last = slot
+			continue
+		}
+		ranges = append(ranges, slotRange{slot, slot, node})
+	}
+	return ranges
+}
+
+// servingNodes returns the nodes that serve at least one slot. Callers
+// hold cl.mu.
+func (cl *cluster) servingNodes() map[*clusterNode]bool {
+	serving := make(map[*clusterNode]bool)
+	for _, node := range cl.slots {
+		if node != nil {
+			serving[node] = true
+		}
+	}
+	return serving
+}
+
+// nodesText returns the layout in the format of the nodes file, with the
+// fields of CLUSTER NODES in Redis:
+// <id> <host:port@cport> <flags> <master> <ping-sent> <pong-recv> <epoch> <link-state> <slots...>
+// Callers hold cl.mu.
+func (cl *cluster) nodesText() string {
+	ids := make([]string, 0, len(cl.nodes))
+	for id := range cl.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	ranges := cl.ranges()
+
+	var b strings.Builder
+	for _, id := range ids {
+		node := cl.nodes[id]
+		flags := "master"
+		if node == cl.myself {
+			flags = "myself,master"
+		}
+		host, port, _ := net.SplitHostPort(node.addr)
+		fmt.Fprintf(&b, "%s %s@%d %s - 0 0 0 connected%s\n", node.id, net.JoinHostPort(host, port), parsePort(port)+10000, flags, cl.slotsText(node, ranges))
+	}
+	return b.String()
+}
+
+// sortedSlots returns the slots of a migration map in order
+func sortedSlots(m map[int]*clusterNode) []int {
+	slots := make([]int, 0, len(m))
+	for slot := range m {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	return slots
+}
@@ -3,21 +3,52 @@ package protocol
 import "flex-db/internal/resp"
 
 
-type CommandHandler func(h *Handler, args []resp.Value) resp.Value
+type CommandHandler func(h *Handler, c *Client, args []resp.Value) resp.Value
 
 type CommandRegistry struct {
 	commands map[string]CommandHandler
+	admin    map[string]bool // commands reserved for the admin port
+	writes   map[string]bool // commands that change the keyspace
 }
 
 func NewCommandRegistry() *CommandRegistry {
 	registry := &CommandRegistry{
 		commands: make(map[string]CommandHandler),
+		admin:    make(map[string]bool),
+		writes:   make(map[string]bool),
 	}
 
 	// register all commands
 	registry.registerCoreCommands()
+	registry.registerCounterCommands()
 	registry.registerListCommands()
 	registry.registerHashCommands()
+	registry.registerSetCommands()
+	registry.registerZSetCommands()
+	registry.registerTimeSeriesCommands()
+	registry.registerKeyspaceCommands()
+	registry.registerQueryCommands()
+	registry.registerScriptCommands()
+	registry.registerLockCommands()
+	registry.registerThrottleCommands()
+	registry.registerLeaseCommands()
+	registry.registerDelayCommands()
+	registry.registerPQCommands()
+	registry.registerQueueCommands()
+	registry.registerHistoryCommands()
+	registry.registerTrashCommands()
+	registry.registerDumpCommands()
+	registry.registerImportCommands()
+	registry.registerBackupCommands()
+	registry.registerReplicationCommands()
+	registry.registerClusterCommands()
+	registry.registerRaftCommands()
+	registry.registerTagCommands()
+	registry.registerPubSubCommands()
+	registry.registerConnectionCommands()
+	registry.registerInfoCommands()
+	registry.registerDebugCommands()
+	registry.registerAdminCommands()
 
 	return registry
 }
@@ -27,6 +58,30 @@ func (r *CommandRegistry) Register(name string, handler CommandHandler) {
 	r.commands[name] = handler
 }
 
+// RegisterAdmin adds an administrative command. When the server runs with
+// an admin port, these commands are refused on the public port.
+func (r *CommandRegistry) RegisterAdmin(name string, handler CommandHandler) {
+	r.Register(name, handler)
+	r.admin[name] = true
+}
+
+// IsAdmin reports whether name was registered with RegisterAdmin
+func (r *CommandRegistry) IsAdmin(name string) bool {
+	return r.admin[name]
+}
+
+// RegisterWrite adds a command that changes the keyspace. Write commands
+// are refused while persistence is failing, if the server is configured to.
+func (r *CommandRegistry) RegisterWrite(name string, handler CommandHandler) {
+	r.Register(name, handler)
+	r.writes[name] = true
+}
+
+// IsWrite reports whether name was registered with RegisterWrite
+func (r *CommandRegistry) IsWrite(name string) bool {
+	return r.writes[name]
+}
+
 // returns a command handler if exitsts
 func (r *CommandRegistry) Get(name string) (CommandHandler, bool) {
 	handler, exists := r.commands[name]
@@ -2,13 +2,39 @@ package protocol
 
 var AVAILABLE_COMMANDS = []string{
 	"SET key value [ttl]  - Set a key with optional TTL in seconds",
+	"SETNX key value      - Set a key only if it doesn't exist",
 	"GET key              - Get value for a key",
-	"DEL key              - Delete a key",
-	"EXPIRE key seconds   - Set expiration time for a key",
-	"TTL key              - Get remaining time for a key",
-	"ALL                  - List all keys and values",
+	"GETSET key value     - Set a key and return its previous value",
+	"CAS key old new      - Set a key to new only if it holds old",
+	"MSET k v [k v ...]   - Set several keys atomically (also MSETNX)",
+	"MGET key [key ...]   - Get several values",
+	"APPEND key value     - Append to the string stored at key",
+	"INCRBY key n         - Add n to the integer at key (also INCR, DECR, DECRBY)",
+	"DEL key [key ...]    - Delete keys and count them (also UNLINK)",
+	"EXPIRE key seconds   - Set expiration time for a key (also PEXPIRE in ms)",
+	"EXPIREAT key unix-s  - Expire a key at a Unix time (also PEXPIREAT in ms)",
+	"TTL key              - Get remaining time for a key (also PTTL in ms)",
+	"EXISTS key [key ...] - Count how many of the keys exist",
+	"TYPE key             - Get the type of the value stored at a key",
+	"DUMP key             - Serialize a key for RESTORE key ttl payload [REPLACE]",
+	"MIGRATE host port key 0 ms - Move a key with its TTL to another server",
+	"IMPORT fmt data      - Store JSONL or CSV records, see flexdb import",
+	"ALL [LIMIT off cnt]  - List keys and values, paged with LIMIT",
+	"KEYS pattern         - List keys matching a glob pattern",
+	"SCAN cursor [MATCH p] [COUNT n] [TYPE t] - Iterate keys a page at a time",
+	"EVAL script n k.. a.. - Run a Lua script with n keys (also EVALSHA, SCRIPT)",
+	"PUBLISH channel msg  - Send a message to subscribers (also SUBSCRIBE, PSUBSCRIBE, PUBSUB)",
 	"FLUSH                - Force save to disk",
-	"BGREWRITE 			  - Rewrite the AOF file in the background", 
+	"BGSAVE               - Save to disk in the background",
+	"BGREWRITE            - Rewrite the AOF file in the background",
+	"SYNC                 - Stream a snapshot for backups, see flexdb backup",
+	"REPLICAOF host port  - Replicate from a master, REPLICAOF NO ONE to stop",
+	"WAIT numreplicas ms  - Wait for replicas to acknowledge the writes so far",
+	"ROLE                 - Show whether the server is a master or a replica",
+	"CLUSTER subcommand   - Inspect the cluster and move slots, see CLUSTER HELP",
+	"RAFT subcommand      - Manage the Raft group, see RAFT HELP",
+	"INFO [section]       - Show server information, e.g. INFO persistence",
+	"TIME                 - Show the server clock",
 	"HELP                 - Show this help message",
 	"EXIT                 - Close connection",
 }
\ No newline at end of file
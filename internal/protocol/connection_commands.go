@@ -0,0 +1,250 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"flex-db/internal/resp"
+)
+
+const (
+	serverName    = "flexdb"
+	serverVersion = "0.1.0"
+)
+
+// registerConnectionCommands registers commands that inspect or change the
+// state of the calling connection rather than the keyspace.
+func (r *CommandRegistry) registerConnectionCommands() {
+	r.Register("AUTH", authCommand)
+	r.Register("HELLO", helloCommand)
+	r.Register("RESET", resetCommand)
+	r.Register("CLIENT", clientCommand)
+}
+
+// checkPassword validates credentials sent with AUTH or HELLO AUTH.
+// FlexDB has a single user, so the username must be "default".
+func (h *Handler) checkPassword(c *Client, username, password string) resp.Value {
+	if h.password == "" {
+		return resp.NewError("ERR AUTH called without any password configured for the default user")
+	}
+
+	if username != "default" || password != h.password {
+		return newClassError(errClassWrongPass, "invalid username-password pair or user is disabled.")
+	}
+
+	c.Authenticated = true
+	return resp.NewSimpleString("OK")
+}
+
+// authCommand handles the AUTH command.
+// Syntax: AUTH [username] password
+// Authenticates the connection against the server password.
+// Example: AUTH s3cret
+func authCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	switch len(args) {
+	case 1:
+		return h.checkPassword(c, "default", args[0].Str)
+	case 2:
+		return h.checkPassword(c, args[0].Str, args[1].Str)
+	default:
+		return wrongArgsError("auth")
+	}
+}
+
+// helloCommand handles the HELLO command.
+// Syntax: HELLO [protover [AUTH username password] [SETNAME clientname]]
+// Negotiates the protocol version, optionally authenticates and names the
+// connection, and returns a map describing the server.
+// Only RESP2 is spoken, so asking for any other version fails with NOPROTO.
+// Example: HELLO 2 AUTH default s3cret SETNAME worker-1
+func helloCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) > 0 {
+		version, err := strconv.Atoi(args[0].Str)
+		if err != nil {
+			return resp.NewError("ERR Protocol version is not an integer or out of range")
+		}
+		if version != 2 {
+			return newClassError(errClassNoProto, "unsupported protocol version")
+		}
+
+		name := c.Name
+		for i := 1; i < len(args); i++ {
+			option := strings.ToUpper(args[i].Str)
+			switch {
+			case option == "AUTH" && i+2 < len(args):
+				if reply := h.checkPassword(c, args[i+1].Str, args[i+2].Str); reply.Type == resp.Error {
+					return reply
+				}
+				i += 2
+			case option == "SETNAME" && i+1 < len(args):
+				name = args[i+1].Str
+				i++
+			default:
+				return resp.NewError("ERR Syntax error in HELLO option '" + args[i].Str + "'")
+			}
+		}
+
+		if !c.Authenticated {
+			return resp.NewError("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		}
+
+		c.RespVersion = version
+		c.Name = name
+	} else if !c.Authenticated {
+		return resp.NewError("NOAUTH Authentication required.")
+	}
+
+	// RESP2 has no map type, so the reply is a flat list of field/value pairs
+	return resp.NewArray([]resp.Value{
+		resp.NewBulkString("server"), resp.NewBulkString(serverName),
+		resp.NewBulkString("version"), resp.NewBulkString(serverVersion),
+		resp.NewBulkString("proto"), resp.NewInteger(int64(c.RespVersion)),
+		resp.NewBulkString("id"), resp.NewInteger(c.ID),
+		resp.NewBulkString("mode"), resp.NewBulkString("standalone"),
+		resp.NewBulkString("role"), resp.NewBulkString("master"),
+		resp.NewBulkString("modules"), resp.NewArray([]resp.Value{}),
+	})
+}
+
+// resetCommand handles the RESET command.
+// Syntax: RESET
+// Clears the connection state (protocol version, client name and
+// library, authentication, reply mode, ASKING and subscriptions) so
+// pooled connections can be handed to a new user.
+// Example: RESET
+func resetCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 0 {
+		return wrongArgsError("reset")
+	}
+
+	c.reset(h.password == "")
+	h.unsubscribeAll(c)
+	return resp.NewSimpleString("RESET")
+}
+
+var clientHelp = []string{
+	"CLIENT <subcommand> [<arg> ...]. Subcommands are:",
+	"ID",
+	"    Return the id of the current connection.",
+	"INFO",
+	"    Return information about the current connection.",
+	"GETNAME",
+	"    Return the name of the current connection.",
+	"SETNAME <name>",
+	"    Name the current connection.",
+	"SETINFO <LIB-NAME|LIB-VER> <value>",
+	"    Record the client library name or version.",
+	"REPLY <ON|OFF|SKIP>",
+	"    Control the replies sent to the current connection. OFF drops every",
+	"    reply until REPLY ON; SKIP drops the reply to the next command only.",
+	"HELP",
+	"    Print this help.",
+}
+
+// clientCommand handles the CLIENT command.
+// Syntax: CLIENT subcommand [arg ...]
+// Inspects and labels the current connection so mixed client fleets can be
+// told apart in CLIENT INFO.
+// Example: CLIENT SETINFO LIB-NAME go-redis
+func clientCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("client")
+	}
+
+	name := args[0].Str
+	subcommand := strings.ToUpper(name)
+	args = args[1:]
+
+	switch subcommand {
+	case "HELP":
+		lines := make([]resp.Value, len(clientHelp))
+		for i, line := range clientHelp {
+			lines[i] = resp.NewSimpleString(line)
+		}
+		return resp.NewArray(lines)
+
+	case "ID":
+		if len(args) != 0 {
+			return wrongArgsError("client|id")
+		}
+		return resp.NewInteger(c.ID)
+
+	case "INFO":
+		if len(args) != 0 {
+			return wrongArgsError("client|info")
+		}
+		return resp.NewBulkString(c.info())
+
+	case "GETNAME":
+		if len(args) != 0 {
+			return wrongArgsError("client|getname")
+		}
+		if c.Name == "" {
+			return resp.NewNullBulkString()
+		}
+		return resp.NewBulkString(c.Name)
+
+	case "SETNAME":
+		if len(args) != 1 {
+			return wrongArgsError("client|setname")
+		}
+		if !validClientLabel(args[0].Str) {
+			return resp.NewError("ERR Client names cannot contain spaces, newlines or special characters.")
+		}
+		c.Name = args[0].Str
+		return resp.NewSimpleString("OK")
+
+	case "SETINFO":
+		if len(args) != 2 {
+			return wrongArgsError("client|setinfo")
+		}
+		attr := strings.ToLower(args[0].Str)
+		value := args[1].Str
+		if !validClientLabel(value) {
+			return resp.NewError(fmt.Sprintf("ERR %s cannot contain spaces, newlines or special characters.", attr))
+		}
+		switch attr {
+		case "lib-name":
+			c.LibName = value
+		case "lib-ver":
+			c.LibVersion = value
+		default:
+			return resp.NewError(fmt.Sprintf("ERR Unrecognized option '%s'", args[0].Str))
+		}
+		return resp.NewSimpleString("OK")
+
+	case "REPLY":
+		if len(args) != 1 {
+			return wrongArgsError("client|reply")
+		}
+		// takeReply runs right after this command, so OFF and SKIP
+		// drop the reply to CLIENT REPLY itself as well
+		switch strings.ToUpper(args[0].Str) {
+		case "ON":
+			c.repliesOff = false
+			c.skipReplies = 0
+		case "OFF":
+			c.repliesOff = true
+		case "SKIP":
+			c.skipReplies = 2
+		default:
+			return resp.NewError("ERR syntax error")
+		}
+		return resp.NewSimpleString("OK")
+
+	default:
+		return resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CLIENT HELP.", name))
+	}
+}
+
+// validClientLabel reports whether s can be shown in CLIENT INFO without
+// breaking its space separated format
+func validClientLabel(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
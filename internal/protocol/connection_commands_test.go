@@ -0,0 +1,28 @@
+package protocol
+
+import "testing"
+
+func TestReset(t *testing.T) {
+	h, c := newTestHandler(t)
+	run(h, c, "CLIENT", "SETNAME", "worker")
+	run(h, c, "CLIENT", "SETINFO", "LIB-NAME", "redis-py")
+	run(h, c, "CLIENT", "SETINFO", "LIB-VER", "5.0.0")
+	if c.Name != "worker" || c.LibName != "redis-py" || c.LibVersion != "5.0.0" {
+		t.Fatalf("CLIENT SETNAME and SETINFO didn't apply: %q %q %q", c.Name, c.LibName, c.LibVersion)
+	}
+	// as ASKING leaves it on a cluster node
+	c.asking = true
+
+	if reply := resetCommand(h, c, nil); reply.Str != "RESET" {
+		t.Fatalf("got %+v", reply)
+	}
+	if c.Name != "" || c.LibName != "" || c.LibVersion != "" {
+		t.Errorf("the name and library survived: %q %q %q", c.Name, c.LibName, c.LibVersion)
+	}
+	if c.asking {
+		t.Error("ASKING survived")
+	}
+	if !c.Authenticated || c.RespVersion != 2 {
+		t.Errorf("got authenticated %v and RESP %d", c.Authenticated, c.RespVersion)
+	}
+}
@@ -1,27 +1,56 @@
 package protocol
 
 import (
+	"errors"
+	"flex-db/internal/db"
 	"flex-db/internal/resp"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // adds all the core commands to the registry
 func (r *CommandRegistry) registerCoreCommands() {
 	r.Register("PING", pingCommand)
-	r.Register("SET", setCommand)
+	r.RegisterWrite("SET", setCommand)
+	r.RegisterWrite("SETNX", setnxCommand)
+	r.RegisterWrite("GETSET", getsetCommand)
+	r.RegisterWrite("CAS", casCommand)
+	r.RegisterWrite("MSET", msetCommand)
+	r.RegisterWrite("MSETNX", msetnxCommand)
+	r.Register("MGET", mgetCommand)
 	r.Register("GET", getCommand)
-	r.Register("DEL", deleteCommand)
-	r.Register("EXPIRE", expireCommand)
+	r.RegisterWrite("APPEND", appendCommand)
+	r.RegisterWrite("DEL", deleteCommand)
+	r.RegisterWrite("UNLINK", unlinkCommand)
+	r.RegisterWrite("EXPIRE", expireCommand)
+	r.RegisterWrite("PEXPIRE", pexpireCommand)
+	r.RegisterWrite("EXPIREAT", expireatCommand)
+	r.RegisterWrite("PEXPIREAT", pexpireatCommand)
 	r.Register("TTL", ttlCommand)
+	r.Register("PTTL", pttlCommand)
+	r.Register("TYPE", typeCommand)
+	r.Register("EXISTS", existsCommand)
 	r.Register("ALL", allCommand)
 	r.Register("FLUSH", flushCommand)
-	r.Register("BGREWRITEAOF", bgrewriteCommand)
+	r.Register("SAVE", flushCommand)
+	r.Register("BGSAVE", bgsaveCommand)
+	r.RegisterAdmin("BGREWRITEAOF", bgrewriteCommand)
+	r.RegisterAdmin("BGREWRITE", bgrewriteCommand)
 	r.Register("HELP", helpCommand)
 }
 
-func pingCommand(h *Handler, args []resp.Value) resp.Value {
+func pingCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	// subscribed connections get a reply shaped like their messages
+	if c.subscriptions() > 0 {
+		message := resp.NewBulkString("")
+		if len(args) > 0 {
+			message = args[0]
+		}
+		return resp.NewArray([]resp.Value{resp.NewBulkString("pong"), message})
+	}
+
 	if len(args) == 0 {
 		return resp.NewSimpleString("PONG")
 	}
@@ -29,134 +58,513 @@ func pingCommand(h *Handler, args []resp.Value) resp.Value {
 	return args[0]
 }
 
-func setCommand(h *Handler, args []resp.Value) resp.Value {
+func setCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) < 2 {
-		return resp.NewError("ERR wrong number of arguments")
+		return wrongArgsError("set")
 	}
 
 	key := args[0].Str
 	value := args[1].Str
 
-	var expiry *time.Time
+	var opts db.SetOptions
+
+	// the text protocol form "SET key value seconds" passes a bare TTL;
+	// RESP clients only get the Redis options
+	if len(args) == 3 && c.Protocol == TextProtocol {
+		if seconds, err := strconv.ParseInt(args[2].Str, 10, 64); err == nil {
+			t := time.Now().Add(time.Duration(seconds) * time.Second)
+			if err := h.DB.Set(key, value, &t); err != nil {
+				return errorReply(err)
+			}
+			return resp.NewSimpleString("OK")
+		}
+	}
 
-	// now check for expiry argument
+	// now check for expiry and condition arguments
 	i := 2
 	for i < len(args) {
-		if i+1 >= len(args) {
-			break
+		option := strings.ToUpper(args[i].Str)
+		if option == "NX" {
+			opts.NX = true
+			i++
+			continue
+		} else if option == "XX" {
+			opts.XX = true
+			i++
+			continue
+		} else if option == "GET" {
+			opts.Get = true
+			i++
+			continue
+		} else if option == "KEEPTTL" {
+			opts.KeepTTL = true
+			i++
+			continue
 		}
 
-		option := args[2].Str
-		if option == "EX" {
-			seconds, err := strconv.ParseInt(args[i+1].Str, 10, 64)
-			if err != nil {
-				return resp.NewError("ERR in valid expire time in 'set' command")
-			}
-			t :=  time.Now().Add(time.Duration(seconds) * time.Second)
-			expiry = &t
-			i += 2
-		} else if option == "PX" {
-			millis, err := strconv.ParseInt(args[i+1].Str, 10, 64)
-			if err != nil {
-				return resp.NewError("ERR invalid expire time in 'set' command")
-			}
-			t := time.Now().Add(time.Duration(millis) * time.Millisecond)
-			expiry = &t
-			i += 2
-		} else {
-			break
+		if i+1 >= len(args) {
+			return resp.NewError("ERR syntax error")
+		}
+		if option != "EX" && option != "PX" && option != "EXAT" && option != "PXAT" {
+			return resp.NewError("ERR syntax error")
+		}
+		// a single expiry option, as Redis
+		if opts.Expiration != nil {
+			return resp.NewError("ERR syntax error")
+		}
+		n, err := strconv.ParseInt(args[i+1].Str, 10, 64)
+		if err != nil || n <= 0 {
+			return resp.NewError("ERR invalid expire time in 'set' command")
+		}
+		var t time.Time
+		switch option {
+		case "EX":
+			t = time.Now().Add(time.Duration(n) * time.Second)
+		case "PX":
+			t = time.Now().Add(time.Duration(n) * time.Millisecond)
+		case "EXAT":
+			t = time.Unix(n, 0)
+		case "PXAT":
+			t = time.UnixMilli(n)
 		}
+		opts.Expiration = &t
+		i += 2
+	}
+	if (opts.NX && opts.XX) || (opts.KeepTTL && opts.Expiration != nil) {
+		return resp.NewError("ERR syntax error")
 	}
 
-	h.DB.Set(key, value, expiry)
+	res, err := h.DB.SetWithOptions(key, value, opts)
+	if err != nil {
+		return errorReply(err)
+	}
+	// with GET the reply is the old value, whether or not the value was set
+	if opts.Get {
+		if !res.Existed {
+			return resp.NewNullBulkString()
+		}
+		return resp.NewBulkString(res.Old)
+	}
+	// a condition that didn't hold is answered with nil, as in Redis
+	if !res.Stored {
+		return resp.NewNullBulkString()
+	}
 	return resp.NewSimpleString("OK")
 }
 
+// getsetCommand handles the GETSET command.
+// Syntax: GETSET key value
+// Sets key and returns its previous value atomically.
+// Returns the old value, nil if the key didn't exist, or an error if the
+// old value isn't a string.
+// Example: GETSET counter 0
+func getsetCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("getset")
+	}
 
-func getCommand(h *Handler, args []resp.Value) resp.Value {
-	if len(args) < 1 {
-		return resp.NewError("ERR key is required to access the data")
+	old, existed, err := h.DB.GetSet(args[0].Str, args[1].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !existed {
+		return resp.NewNullBulkString()
+	}
+	return resp.NewBulkString(old)
+}
+
+// setnxCommand handles the SETNX command.
+// Syntax: SETNX key value
+// Sets key only if it doesn't exist.
+// Returns 1 if the key was set, 0 otherwise.
+// Example: SETNX lock:report worker-3
+func setnxCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("setnx")
+	}
+
+	res, err := h.DB.SetWithOptions(args[0].Str, args[1].Str, db.SetOptions{NX: true})
+	if err != nil {
+		return errorReply(err)
+	}
+	if res.Stored {
+		return resp.NewInteger(1)
+	}
+	return resp.NewInteger(0)
+}
+
+
+func getCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("get")
 	}
 
 	key := args[0].Str
 
 	val, err := h.DB.Get(key)
 	if err != nil {
-		return resp.NewError(err.Error())
+		return nullOrErrorReply(err)
 	}
 
 	return resp.NewBulkString(fmt.Sprintf("%v", val))
 
 }
 
-func deleteCommand(h *Handler, args []resp.Value) resp.Value {
-	if len(args) < 1 {
-		return resp.NewError("ERR key is required to delete the data")
+// casCommand handles the CAS command.
+// Syntax: CAS key expected value
+// Sets key to value only if it currently holds expected, checking and
+// setting atomically. The key keeps its TTL.
+// Returns 1 if the value was swapped, 0 if the key is missing or holds
+// something else.
+// Example: CAS config:version 41 42
+func casCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 3 {
+		return wrongArgsError("cas")
 	}
 
-	key := args[0].Str
-
-	err := h.DB.Delete(key)
+	swapped, err := h.DB.CompareAndSwap(args[0].Str, args[1].Str, args[2].Str)
 	if err != nil {
-		return resp.NewError(err.Error())
+		return errorReply(err)
+	}
+	if swapped {
+		return resp.NewInteger(1)
+	}
+	return resp.NewInteger(0)
+}
+
+// msetCommand handles the MSET command.
+// Syntax: MSET key value [key value ...]
+// Sets all keys atomically, clearing their TTLs.
+// Example: MSET user:1:name alice user:1:email alice@example.com
+func msetCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	pairs, ok := keyValuePairs(args)
+	if !ok {
+		return wrongArgsError("mset")
 	}
 
+	if err := h.DB.MSet(pairs); err != nil {
+		return errorReply(err)
+	}
 	return resp.NewSimpleString("OK")
 }
 
-func expireCommand(h *Handler, args []resp.Value) resp.Value {
-	if len(args) < 2 {
-		return resp.NewError("ERR key and expire time is required")
+// msetnxCommand handles the MSETNX command.
+// Syntax: MSETNX key value [key value ...]
+// Sets all keys atomically if none of them exists.
+// Returns 1 if the keys were set, 0 if none was.
+// Example: MSETNX lock:a me lock:b me
+func msetnxCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	pairs, ok := keyValuePairs(args)
+	if !ok {
+		return wrongArgsError("msetnx")
 	}
 
-	key := args[0].Str
-	duration, err := strconv.ParseInt(args[1].Str, 10, 64)
+	set, err := h.DB.MSetNX(pairs)
+	if err != nil {
+		return errorReply(err)
+	}
+	if set {
+		return resp.NewInteger(1)
+	}
+	return resp.NewInteger(0)
+}
+
+// keyValuePairs collects the key value arguments of MSET and MSETNX, the
+// last value winning for a repeated key
+func keyValuePairs(args []resp.Value) (map[string]string, bool) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, false
+	}
+	pairs := make(map[string]string, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		pairs[args[i].Str] = args[i+1].Str
+	}
+	return pairs, true
+}
+
+// mgetCommand handles the MGET command.
+// Syntax: MGET key [key ...]
+// Returns the values of the keys in order, with nil for keys that don't
+// exist or don't hold strings.
+// Example: MGET user:1:name user:2:name
+func mgetCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("mget")
+	}
+
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = arg.Str
+	}
+	entries := h.DB.MGet(keys...)
+	result := make([]resp.Value, len(entries))
+	for i, e := range entries {
+		if e.Value == nil {
+			result[i] = resp.NewNullBulkString()
+		} else {
+			result[i] = resp.NewBulkString(e.Value.(string))
+		}
+	}
+	return resp.NewArray(result)
+}
+
+// appendCommand handles the APPEND command.
+// Syntax: APPEND key value
+// Appends value to the string at key, creating the key if it doesn't exist.
+// Returns the length of the string after the append.
+// Example: APPEND log "line 1\n"
+func appendCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("append")
+	}
 
+	length, err := h.DB.Append(args[0].Str, args[1].Str)
 	if err != nil {
-		return resp.NewError("ERR invalid duration format")
+		return errorReply(err)
 	}
 
-	h.DB.Expire(key, time.Duration(duration) * time.Second)
-	return resp.NewSimpleString("OK")
+	return resp.NewInteger(int64(length))
+}
+
+// deleteCommand handles the DEL command.
+// Syntax: DEL key [key ...]
+// Deletes keys atomically; missing keys are ignored.
+// Returns the number of keys deleted.
+// Example: DEL session:1 session:2
+func deleteCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return wrongArgsError("del")
+	}
+
+	return resp.NewInteger(int64(h.DB.DeleteKeys(argStrings(args)...)))
 }
 
-func ttlCommand(h *Handler, args []resp.Value) resp.Value {
+// unlinkCommand handles the UNLINK command.
+// Syntax: UNLINK key [key ...]
+// Works like DEL. Removing a key only unhooks its value from the
+// keyspace and the garbage collector reclaims the memory concurrently, so
+// even big values are already freed off the command path.
+// Returns the number of keys deleted.
+// Example: UNLINK cache:big
+func unlinkCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) < 1 {
-		return resp.NewError("ERR specify key to fetch its TTL")
+		return wrongArgsError("unlink")
+	}
+
+	return resp.NewInteger(int64(h.DB.DeleteKeys(argStrings(args)...)))
+}
+
+func expireCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	return expireWith(h, "expire", args, func(n int64) time.Time {
+		return time.Now().Add(time.Duration(n) * time.Second)
+	})
+}
+
+// pexpireCommand handles the PEXPIRE command.
+// Syntax: PEXPIRE key milliseconds
+// Works like EXPIRE with the TTL in milliseconds.
+// Example: PEXPIRE session:1 1500
+func pexpireCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	return expireWith(h, "pexpire", args, func(n int64) time.Time {
+		return time.Now().Add(time.Duration(n) * time.Millisecond)
+	})
+}
+
+// expireatCommand handles the EXPIREAT command.
+// Syntax: EXPIREAT key unix-time-seconds
+// Makes a key expire at an absolute Unix time; a time in the past expires
+// it right away.
+// Example: EXPIREAT session:1 1767225600
+func expireatCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	return expireWith(h, "expireat", args, func(n int64) time.Time {
+		return time.Unix(n, 0)
+	})
+}
+
+// pexpireatCommand handles the PEXPIREAT command.
+// Syntax: PEXPIREAT key unix-time-milliseconds
+// Works like EXPIREAT with the time in milliseconds.
+// Example: PEXPIREAT session:1 1767225600000
+func pexpireatCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	return expireWith(h, "pexpireat", args, func(n int64) time.Time {
+		return time.UnixMilli(n)
+	})
+}
+
+// expireWith sets the expiration of a key to the time at returns for the
+// integer argument of an EXPIRE style command, followed by the optional
+// NX, XX, GT or LT condition. It replies 1 when the expiration was set
+// and 0 when the key doesn't exist or the condition failed.
+func expireWith(h *Handler, name string, args []resp.Value, at func(n int64) time.Time) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError(name)
+	}
+
+	n, err := strconv.ParseInt(args[1].Str, 10, 64)
+	if err != nil {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+
+	var opts db.ExpireOptions
+	for _, arg := range args[2:] {
+		switch strings.ToUpper(arg.Str) {
+		case "NX":
+			opts.NX = true
+		case "XX":
+			opts.XX = true
+		case "GT":
+			opts.GT = true
+		case "LT":
+			opts.LT = true
+		default:
+			return resp.NewError("ERR Unsupported option " + arg.Str)
+		}
+	}
+	if opts.NX && (opts.XX || opts.GT || opts.LT) {
+		return resp.NewError("ERR NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if opts.GT && opts.LT {
+		return resp.NewError("ERR GT and LT options at the same time are not compatible")
+	}
+
+	set, err := h.DB.ExpireAtWithOptions(args[0].Str, at(n), opts)
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return resp.NewInteger(0)
+	} else if err != nil {
+		return errorReply(err)
+	}
+	if !set {
+		return resp.NewInteger(0)
+	}
+	return resp.NewInteger(1)
+}
+
+func ttlCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("ttl")
 	}
 
 	key := args[0].Str
 
 	duration, err :=  h.DB.TTL(key)
 	if err != nil {
-		return resp.NewSimpleString(err.Error())
+		// -2 means the key does not exist
+		return resp.NewInteger(-2)
+	}
+
+	// -1 means the key exists but has no expiration
+	if duration < 0 {
+		return resp.NewInteger(-1)
 	}
 
 	return resp.NewInteger(int64(duration.Seconds()))
 }
 
-func allCommand(h *Handler, args []resp.Value) resp.Value {
-	all := h.DB.All()
+// pttlCommand handles the PTTL command.
+// Syntax: PTTL key
+// Returns the remaining time to live of a key in milliseconds, -1 if it
+// has no expiration, or -2 if it doesn't exist.
+// Example: PTTL session:1
+func pttlCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("pttl")
+	}
+
+	duration, err := h.DB.TTL(args[0].Str)
+	if err != nil {
+		return resp.NewInteger(-2)
+	}
+	if duration < 0 {
+		return resp.NewInteger(-1)
+	}
+	return resp.NewInteger(duration.Milliseconds())
+}
+
+// typeCommand handles the TYPE command.
+// Syntax: TYPE key
+// Returns the type of the value stored at key, e.g. string, list or
+// hash, or none if the key doesn't exist.
+// Example: TYPE user:1
+func typeCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("type")
+	}
+
+	t, ok := h.DB.Type(args[0].Str)
+	if !ok {
+		return resp.NewSimpleString("none")
+	}
+	return resp.NewSimpleString(t.String())
+}
+
+// existsCommand handles the EXISTS command.
+// Syntax: EXISTS key [key ...]
+// Returns how many of the keys exist; a key given twice counts twice.
+// Example: EXISTS user:1 user:2
+func existsCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return wrongArgsError("exists")
+	}
+
+	return resp.NewInteger(int64(h.DB.Exists(argStrings(args)...)))
+}
+
+// allCommand handles the ALL command.
+// Syntax: ALL [LIMIT offset count]
+// Lists keys and values in key order. Without LIMIT the reply may hold at
+// most the server's key reply cap; bigger keyspaces must be paged.
+// Example: ALL LIMIT 0 100
+func allCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	offset, count, errReply := h.parseKeysLimit("all", args)
+	if errReply != nil {
+		return *errReply
+	}
+
+	entries, total := h.DB.Entries(offset, h.fetchCount(count))
+	if count < 0 && h.maxKeys > 0 && len(entries) > h.maxKeys {
+		return h.tooManyKeysError("ALL", "ALL LIMIT <offset> <count>", total)
+	}
 
 	result := resp.Value{
 		Type: resp.Array,
-		Array: make([]resp.Value, 0, len(all)*2),
+		Array: make([]resp.Value, 0, len(entries)),
 	}
 
-	for k,v := range all {
-		formattedString := fmt.Sprintf("%s : %v", k, v)
+	for _, e := range entries {
+		formattedString := fmt.Sprintf("%s : %v", e.Key, e.Value)
 		result.Array = append(result.Array, resp.NewBulkString(formattedString))
 	}
 
 	return result
 }
 
-func flushCommand(h *Handler, args []resp.Value) resp.Value {
-	h.DB.Flush()
+// flushCommand handles the FLUSH and SAVE commands.
+// Syntax: FLUSH
+// Writes a snapshot and syncs the AOF, replying with the error if either fails.
+// Example: SAVE
+func flushCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if err := h.DB.Flush(); err != nil {
+		return errorReply(err)
+	}
 	return resp.NewSimpleString("OK")
 }
 
-func bgrewriteCommand(h *Handler, args []resp.Value) resp.Value {
+// bgsaveCommand handles the BGSAVE command.
+// Syntax: BGSAVE
+// Starts writing a snapshot without blocking other commands. INFO
+// persistence reports when it is done and whether it failed.
+// Example: BGSAVE
+func bgsaveCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 0 {
+		return wrongArgsError("bgsave")
+	}
+	if err := h.DB.BGSave(); err != nil {
+		return errorReply(err)
+	}
+	return resp.NewSimpleString("Background saving started")
+}
+
+func bgrewriteCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	go func () {
 		if err := h.DB.RewriteAOF(); err != nil {
 			fmt.Printf("Error rewriting AOF: %v\n", err)
@@ -165,7 +573,7 @@ func bgrewriteCommand(h *Handler, args []resp.Value) resp.Value {
 	return resp.NewSimpleString("Background Rewrite started")
 }
 
-func helpCommand(h *Handler, args []resp.Value) resp.Value {
+func helpCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	helpArray := resp.Value{
 		Type: resp.Array,
 		Array: make([]resp.Value, len(AVAILABLE_COMMANDS)),
@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"testing"
+
+	"flex-db/internal/resp"
+)
+
+func TestExpireReplies(t *testing.T) {
+	h, c := newTestHandler(t)
+	run(h, c, "SET", "k", "v")
+
+	tests := []struct {
+		args []string
+		want int64
+	}{
+		{[]string{"k", "100", "XX"}, 0},
+		{[]string{"k", "100", "NX"}, 1},
+		{[]string{"k", "200", "NX"}, 0},
+		{[]string{"k", "50", "GT"}, 0},
+		{[]string{"k", "300", "GT"}, 1},
+		{[]string{"k", "400", "LT"}, 0},
+		{[]string{"k", "60", "LT"}, 1},
+		{[]string{"k", "70"}, 1},
+	}
+	for _, tt := range tests {
+		reply := run(h, c, "EXPIRE", tt.args...)
+		if reply.Type != resp.Integer || reply.Int != tt.want {
+			t.Errorf("EXPIRE %v: got %+v, want :%d", tt.args, reply, tt.want)
+		}
+	}
+}
+
+func TestExpireMissingKey(t *testing.T) {
+	h, c := newTestHandler(t)
+	for _, cmd := range []string{"EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT"} {
+		reply := run(h, c, cmd, "missing", "100")
+		if reply.Type != resp.Integer || reply.Int != 0 {
+			t.Errorf("%s on a missing key: got %+v, want :0", cmd, reply)
+		}
+	}
+	if reply := run(h, c, "EXISTS", "missing"); reply.Int != 0 {
+		t.Error("EXPIRE created the key")
+	}
+}
+
+func TestSetBareTTL(t *testing.T) {
+	h, c := newTestHandler(t)
+
+	c.Protocol = TextProtocol
+	if reply := run(h, c, "SET", "k", "v", "60"); reply.Str != "OK" {
+		t.Fatalf("text protocol SET k v 60: got %+v", reply)
+	}
+	if reply := run(h, c, "TTL", "k"); reply.Int <= 0 || reply.Int > 60 {
+		t.Errorf("got TTL %d, want up to 60", reply.Int)
+	}
+
+	c.Protocol = RESPProtocol
+	reply := run(h, c, "SET", "r", "v", "60")
+	if reply.Type != resp.Error || reply.Str != "ERR syntax error" {
+		t.Errorf("RESP SET r v 60: got %+v, want a syntax error", reply)
+	}
+	if reply := run(h, c, "EXISTS", "r"); reply.Int != 0 {
+		t.Error("RESP SET r v 60 set the key")
+	}
+}
+
+func TestSetInvalidExpiry(t *testing.T) {
+	h, c := newTestHandler(t)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"EX", "0"}, "ERR invalid expire time in 'set' command"},
+		{[]string{"EX", "-5"}, "ERR invalid expire time in 'set' command"},
+		{[]string{"PX", "0"}, "ERR invalid expire time in 'set' command"},
+		{[]string{"PXAT", "-1"}, "ERR invalid expire time in 'set' command"},
+		{[]string{"EX", "10", "EX", "20"}, "ERR syntax error"},
+		{[]string{"EX", "10", "PX", "20"}, "ERR syntax error"},
+		{[]string{"PX", "10", "EXAT", "2000000000"}, "ERR syntax error"},
+		{[]string{"EX", "10", "KEEPTTL"}, "ERR syntax error"},
+	}
+	for _, tt := range tests {
+		args := append([]string{"k", "v"}, tt.args...)
+		reply := run(h, c, "SET", args...)
+		if reply.Type != resp.Error || reply.Str != tt.want {
+			t.Errorf("SET %v: got %+v, want %q", args, reply, tt.want)
+		}
+	}
+	if reply := run(h, c, "EXISTS", "k"); reply.Int != 0 {
+		t.Error("SET with an invalid expiry set the key")
+	}
+}
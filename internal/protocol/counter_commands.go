@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"math"
+	"strconv"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+)
+
+// registerCounterCommands registers the atomic counter commands
+func (r *CommandRegistry) registerCounterCommands() {
+	r.RegisterWrite("INCR", incrCommand)
+	r.RegisterWrite("DECR", decrCommand)
+	r.RegisterWrite("INCRBY", incrbyCommand)
+	r.RegisterWrite("DECRBY", decrbyCommand)
+	r.RegisterWrite("INCRBYFLOAT", incrbyfloatCommand)
+}
+
+// incrCommand handles the INCR command.
+// Syntax: INCR key
+// Adds 1 to the integer stored at key, a missing key counting as 0.
+// Returns the new value.
+// Example: INCR page:views
+func incrCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("incr")
+	}
+	return incrByReply(h, args[0].Str, 1)
+}
+
+// decrCommand handles the DECR command.
+// Syntax: DECR key
+// Subtracts 1 from the integer stored at key, a missing key counting as 0.
+// Returns the new value.
+// Example: DECR stock:item:7
+func decrCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("decr")
+	}
+	return incrByReply(h, args[0].Str, -1)
+}
+
+// incrbyCommand handles the INCRBY command.
+// Syntax: INCRBY key increment
+// Adds increment to the integer stored at key, a missing key counting as 0.
+// Returns the new value.
+// Example: INCRBY bytes:sent 1500
+func incrbyCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("incrby")
+	}
+	delta, err := strconv.ParseInt(args[1].Str, 10, 64)
+	if err != nil {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+	return incrByReply(h, args[0].Str, delta)
+}
+
+// decrbyCommand handles the DECRBY command.
+// Syntax: DECRBY key decrement
+// Subtracts decrement from the integer stored at key, a missing key
+// counting as 0.
+// Returns the new value.
+// Example: DECRBY stock:item:7 3
+func decrbyCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("decrby")
+	}
+	delta, err := strconv.ParseInt(args[1].Str, 10, 64)
+	if err != nil || delta == math.MinInt64 {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+	return incrByReply(h, args[0].Str, -delta)
+}
+
+// incrbyfloatCommand handles the INCRBYFLOAT command.
+// Syntax: INCRBYFLOAT key increment
+// Adds a floating point increment to the number stored at key, a missing
+// key counting as 0. Like Redis, the result is rounded to 17 significant
+// digits and stored without trailing zeros or an exponent.
+// Returns the new value.
+// Example: INCRBYFLOAT balance:42 -12.5
+func incrbyfloatCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("incrbyfloat")
+	}
+	delta, err := parseIncrement(args[1].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	value, err := h.DB.IncrByFloat(args[0].Str, delta)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewBulkString(value)
+}
+
+// parseIncrement parses the increment of INCRBYFLOAT and HINCRBYFLOAT,
+// which must be finite
+func parseIncrement(s string) (float64, error) {
+	delta, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return 0, db.ErrNotFloat
+	}
+	return delta, nil
+}
+
+// incrByReply applies an increment and answers with the new value
+func incrByReply(h *Handler, key string, delta int64) resp.Value {
+	n, err := h.DB.IncrBy(key, delta)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(n)
+}
@@ -0,0 +1,17 @@
+package protocol
+
+import "testing"
+
+func TestIncrByFloatFormat(t *testing.T) {
+	h, c := newTestHandler(t)
+	run(h, c, "SET", "f", "1.1")
+	if reply := run(h, c, "INCRBYFLOAT", "f", "2.2"); reply.Str != "3.3" {
+		t.Errorf("INCRBYFLOAT f 2.2: got %+v, want 3.3", reply)
+	}
+	if reply := run(h, c, "HINCRBYFLOAT", "h", "x", "0.1"); reply.Str != "0.1" {
+		t.Fatalf("HINCRBYFLOAT h x 0.1: got %+v", reply)
+	}
+	if reply := run(h, c, "HINCRBYFLOAT", "h", "x", "0.2"); reply.Str != "0.3" {
+		t.Errorf("HINCRBYFLOAT h x 0.2: got %+v, want 0.3", reply)
+	}
+}
@@ -0,0 +1,191 @@
+package protocol
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"flex-db/internal/resp"
+)
+
+// registerDebugCommands registers the DEBUG command family used for
+// operational testing.
+func (r *CommandRegistry) registerDebugCommands() {
+	r.RegisterAdmin("DEBUG", debugCommand)
+}
+
+var debugHelp = []string{
+	"DEBUG <subcommand> [<arg> ...]. Subcommands are:",
+	"OBJECT <key>",
+	"    Show low-level information about the key.",
+	"SLEEP <seconds>",
+	"    Block the server for <seconds>. Decimals are allowed.",
+	"SET-ACTIVE-EXPIRE <0|1>",
+	"    Turn the background removal of expired keys off or on.",
+	"RUNTIME",
+	"    Show Go runtime statistics: goroutines, heap and garbage collection.",
+	"GC",
+	"    Run a garbage collection and return memory to the OS.",
+	"CHANGE-REPL-ID",
+	"    Change the replication id, so replicas resync fully.",
+	"FAULT LATENCY <ms> [<jitter-ms>]",
+	"    Delay every command. Needs --fault-injection.",
+	"FAULT DROP <probability>",
+	"    Close connections instead of running a command. Needs --fault-injection.",
+	"FAULT FSYNC <probability>",
+	"    Make AOF fsyncs fail. Needs --fault-injection.",
+	"FAULT STATUS | FAULT RESET",
+	"    Show or clear the injected faults.",
+	"HELP",
+	"    Print this help.",
+}
+
+// debugCommand handles the DEBUG command.
+// Syntax: DEBUG subcommand [arg ...]
+// Example: DEBUG SLEEP 0.5
+func debugCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("debug")
+	}
+
+	name := args[0].Str
+	subcommand := strings.ToUpper(name)
+	args = args[1:]
+
+	switch subcommand {
+	case "HELP":
+		lines := make([]resp.Value, len(debugHelp))
+		for i, line := range debugHelp {
+			lines[i] = resp.NewSimpleString(line)
+		}
+		return resp.NewArray(lines)
+
+	case "OBJECT":
+		if len(args) != 1 {
+			return wrongArgsError("debug|object")
+		}
+		info, err := h.DB.Inspect(args[0].Str)
+		if err != nil {
+			return errorReply(err)
+		}
+
+		ttl := int64(-1)
+		if info.Expiration != nil {
+			ttl = time.Until(*info.Expiration).Milliseconds()
+		}
+		return resp.NewSimpleString(fmt.Sprintf("Value type:%s encoding:%s length:%d serializedlength:%d ttl:%d",
+			info.Type, info.Encoding, info.Length, info.SerializedLength, ttl))
+
+	case "SLEEP":
+		if len(args) != 1 {
+			return wrongArgsError("debug|sleep")
+		}
+		seconds, err := strconv.ParseFloat(args[0].Str, 64)
+		if err != nil || seconds < 0 {
+			return resp.NewError("ERR value is not a valid float")
+		}
+		h.DB.DebugSleep(time.Duration(seconds * float64(time.Second)))
+		return resp.NewSimpleString("OK")
+
+	case "SET-ACTIVE-EXPIRE":
+		if len(args) != 1 {
+			return wrongArgsError("debug|set-active-expire")
+		}
+		switch args[0].Str {
+		case "0":
+			h.DB.SetActiveExpire(false)
+		case "1":
+			h.DB.SetActiveExpire(true)
+		default:
+			return resp.NewError("ERR value must be 0 or 1")
+		}
+		return resp.NewSimpleString("OK")
+
+	case "FAULT":
+		return debugFault(h, args)
+
+	case "RUNTIME":
+		if len(args) != 0 {
+			return wrongArgsError("debug|runtime")
+		}
+		var b infoBuilder
+		runtimeInfo(&b)
+		return resp.NewBulkString(b.String())
+
+	case "GC":
+		if len(args) != 0 {
+			return wrongArgsError("debug|gc")
+		}
+		debug.FreeOSMemory()
+		return resp.NewSimpleString("OK")
+
+	case "CHANGE-REPL-ID":
+		h.DB.ChangeReplicationID()
+		return resp.NewSimpleString("OK")
+
+	default:
+		return resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try DEBUG HELP.", name))
+	}
+}
+
+// debugFault handles DEBUG FAULT, which configures fault injection
+func debugFault(h *Handler, args []resp.Value) resp.Value {
+	if h.faults == nil {
+		return resp.NewError("ERR fault injection is disabled, start the server with --fault-injection")
+	}
+	if len(args) == 0 {
+		return wrongArgsError("debug|fault")
+	}
+
+	switch strings.ToUpper(args[0].Str) {
+	case "LATENCY":
+		if len(args) != 2 && len(args) != 3 {
+			return wrongArgsError("debug|fault")
+		}
+		latency, err := strconv.Atoi(args[1].Str)
+		if err != nil || latency < 0 {
+			return resp.NewError("ERR value is not an integer or out of range")
+		}
+		jitter := 0
+		if len(args) == 3 {
+			jitter, err = strconv.Atoi(args[2].Str)
+			if err != nil || jitter < 0 {
+				return resp.NewError("ERR value is not an integer or out of range")
+			}
+		}
+		h.faults.setLatency(time.Duration(latency)*time.Millisecond, time.Duration(jitter)*time.Millisecond)
+
+	case "DROP", "FSYNC":
+		if len(args) != 2 {
+			return wrongArgsError("debug|fault")
+		}
+		rate, err := strconv.ParseFloat(args[1].Str, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return resp.NewError("ERR probability must be between 0 and 1")
+		}
+		if strings.ToUpper(args[0].Str) == "DROP" {
+			h.faults.setDropRate(rate)
+		} else {
+			h.DB.SetFsyncFailureRate(rate)
+		}
+
+	case "RESET":
+		h.faults.setLatency(0, 0)
+		h.faults.setDropRate(0)
+		h.DB.SetFsyncFailureRate(0)
+
+	case "STATUS":
+		h.faults.mu.Lock()
+		status := fmt.Sprintf("latency_ms:%d jitter_ms:%d drop_rate:%g fsync_failure_rate:%g",
+			h.faults.latency.Milliseconds(), h.faults.jitter.Milliseconds(), h.faults.dropRate, h.DB.FsyncFailureRate())
+		h.faults.mu.Unlock()
+		return resp.NewBulkString(status)
+
+	default:
+		return resp.NewError(fmt.Sprintf("ERR unknown fault '%s'", args[0].Str))
+	}
+
+	return resp.NewSimpleString("OK")
+}
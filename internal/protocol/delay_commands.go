@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+	"flex-db/internal/utils"
+)
+
+// registerDelayCommands registers the delayed queue commands
+func (r *CommandRegistry) registerDelayCommands() {
+	r.RegisterWrite("DELAY.PUSH", delayPushCommand)
+	r.RegisterWrite("DELAY.POP", delayPopCommand)
+	r.Register("DELAY.LEN", delayLenCommand)
+	r.RegisterWrite("DELAY.CANCEL", delayCancelCommand)
+}
+
+// delayPushCommand handles the DELAY.PUSH command.
+// Syntax: DELAY.PUSH queue payload delay_ms
+// Queues payload to become due after delay_ms milliseconds. Queues are
+// sorted sets scored by due time, so a payload already queued is
+// rescheduled instead of queued twice.
+// Returns 1 if the payload is new, 0 if it was rescheduled.
+// Example: DELAY.PUSH jobs:retry order:42 30000
+func delayPushCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 3 {
+		return wrongArgsError("delay.push")
+	}
+	ms, err := utils.ParseInt(args[2].Str)
+	if err != nil || ms < 0 {
+		return resp.NewError("ERR delay is not an integer or out of range")
+	}
+
+	added, err := h.DB.DelayPush(args[0].Str, args[1].Str, time.Duration(ms)*time.Millisecond)
+	if err != nil {
+		return errorReply(err)
+	}
+	if added {
+		return resp.NewInteger(1)
+	}
+	return resp.NewInteger(0)
+}
+
+// delayPopCommand handles the DELAY.POP command.
+// Syntax: DELAY.POP queue [COUNT count] [BLOCK ms]
+// Removes and returns up to count due payloads, earliest first. With
+// BLOCK it waits up to ms milliseconds, 0 meaning forever, for a payload
+// to become due.
+// Returns an array of payloads, or nil if none is due.
+// Example: DELAY.POP jobs:retry COUNT 10 BLOCK 5000
+func delayPopCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("delay.pop")
+	}
+
+	count, block, timeout, errReply := parsePopOptions(args[1:])
+	if errReply != nil {
+		return *errReply
+	}
+
+	var items []string
+	var err error
+	if block {
+		ctx, cancel := h.blockingContext(c, timeout)
+		defer cancel()
+		items, err = h.DB.DelayPopWait(ctx, args[0].Str, count)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return resp.NewNullArray()
+		}
+		if errors.Is(err, context.Canceled) {
+			err = db.ErrShuttingDown
+		}
+	} else {
+		items, err = h.DB.DelayPop(args[0].Str, count)
+	}
+	if err != nil {
+		return errorReply(err)
+	}
+	if len(items) == 0 {
+		return resp.NewNullArray()
+	}
+
+	values := make([]resp.Value, len(items))
+	for i, item := range items {
+		values[i] = resp.NewBulkString(item)
+	}
+	return resp.NewArray(values)
+}
+
+// parsePopOptions parses the "[COUNT count] [BLOCK ms]" options of the
+// queue pop commands. count defaults to 1 and a zero timeout blocks forever.
+func parsePopOptions(args []resp.Value) (count int, block bool, timeout time.Duration, errReply *resp.Value) {
+	fail := func(v resp.Value) (int, bool, time.Duration, *resp.Value) {
+		return 0, false, 0, &v
+	}
+
+	count = 1
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return fail(resp.NewError("ERR syntax error"))
+		}
+		n, err := utils.ParseInt(args[i+1].Str)
+		switch strings.ToUpper(args[i].Str) {
+		case "COUNT":
+			if err != nil || n <= 0 {
+				return fail(resp.NewError("ERR count must be positive"))
+			}
+			count = int(n)
+		case "BLOCK":
+			if err != nil || n < 0 {
+				return fail(resp.NewError("ERR timeout is not an integer or out of range"))
+			}
+			block = true
+			timeout = time.Duration(n) * time.Millisecond
+		default:
+			return fail(resp.NewError("ERR syntax error"))
+		}
+	}
+	return count, block, timeout, nil
+}
+
+// delayLenCommand handles the DELAY.LEN command.
+// Syntax: DELAY.LEN queue
+// Returns the number of queued payloads, due or not.
+// Example: DELAY.LEN jobs:retry
+func delayLenCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("delay.len")
+	}
+
+	length, err := h.DB.DelayLen(args[0].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(length))
+}
+
+// delayCancelCommand handles the DELAY.CANCEL command.
+// Syntax: DELAY.CANCEL queue payload
+// Removes a payload before it is popped.
+// Returns 1 if the payload was queued, 0 otherwise.
+// Example: DELAY.CANCEL jobs:retry order:42
+func delayCancelCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("delay.cancel")
+	}
+
+	removed, err := h.DB.DelayCancel(args[0].Str, args[1].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	if removed {
+		return resp.NewInteger(1)
+	}
+	return resp.NewInteger(0)
+}
@@ -0,0 +1,226 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+)
+
+// errClassBusyKey is the error class of RESTORE onto an existing key
+const errClassBusyKey = "BUSYKEY"
+
+// registerDumpCommands registers DUMP, RESTORE and MIGRATE
+func (r *CommandRegistry) registerDumpCommands() {
+	r.Register("DUMP", dumpCommand)
+	r.RegisterWrite("RESTORE", restoreCommand)
+	r.RegisterWrite("MIGRATE", migrateCommand)
+}
+
+// dumpCommand handles the DUMP command.
+// Syntax: DUMP key
+// Serializes the value of a key, of any type, with its tags into an opaque
+// payload carrying a checksum, for RESTORE on this or another server. The
+// TTL isn't included.
+// Returns the payload, or nil if the key doesn't exist.
+// Example: DUMP user:42
+func dumpCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("dump")
+	}
+
+	payload, err := h.DB.Dump(args[0].Str)
+	if err != nil {
+		return nullOrErrorReply(err)
+	}
+	return resp.NewBulkString(string(payload))
+}
+
+// restoreCommand handles the RESTORE command.
+// Syntax: RESTORE key ttl payload [REPLACE] [ABSTTL]
+// Creates a key from a DUMP payload. ttl is in milliseconds, 0 for no
+// expiration, or a Unix time in milliseconds with ABSTTL. REPLACE
+// overwrites an existing key, which is otherwise a BUSYKEY error.
+// Example: RESTORE user:42 0 "<payload>" REPLACE
+func restoreCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 3 {
+		return wrongArgsError("restore")
+	}
+
+	ttl, err := strconv.ParseInt(args[1].Str, 10, 64)
+	if err != nil {
+		return newClassError(errClassGeneric, "value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return newClassError(errClassGeneric, "Invalid TTL value, must be >= 0")
+	}
+
+	var opts db.RestoreOptions
+	absolute := false
+	for _, arg := range args[3:] {
+		switch strings.ToUpper(arg.Str) {
+		case "REPLACE":
+			opts.Replace = true
+		case "ABSTTL":
+			absolute = true
+		default:
+			return resp.NewError("ERR syntax error")
+		}
+	}
+	if ttl > 0 {
+		if absolute {
+			opts.Expiration = time.UnixMilli(ttl)
+		} else {
+			opts.Expiration = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+	}
+
+	if err := h.DB.Restore(args[0].Str, []byte(args[2].Str), opts); err != nil {
+		if errors.Is(err, db.ErrKeyExists) {
+			return newClassError(errClassBusyKey, "Target key name already exists.")
+		}
+		return errorReply(err)
+	}
+	return resp.NewSimpleString("OK")
+}
+
+// migrateCommand handles the MIGRATE command.
+// Syntax: MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key [key ...]]
+// Moves keys of any type, with their TTLs, to another server: they are
+// sent with RESTORE and deleted here once the other server stored them.
+// Writes to the keys wait meanwhile, so the move is atomic. COPY keeps
+// the keys here, REPLACE overwrites existing keys there. With KEYS the
+// key argument is "" and several keys move at once. FlexDB has a single
+// database, so destination-db must be 0. timeout is in milliseconds.
+// Returns OK, or NOKEY if none of the keys exist.
+// Example: MIGRATE 10.0.0.2 9000 "" 0 5000 KEYS {user:1}:cart {user:1}:orders
+func migrateCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 5 {
+		return wrongArgsError("migrate")
+	}
+	addr := net.JoinHostPort(args[0].Str, args[1].Str)
+	if args[3].Str != "0" {
+		return resp.NewError("ERR FlexDB has a single database, destination-db must be 0")
+	}
+	ms, err := strconv.ParseInt(args[4].Str, 10, 64)
+	if err != nil || ms < 0 {
+		return resp.NewError("ERR timeout is not an integer or out of range")
+	}
+	timeout := time.Duration(ms) * time.Millisecond
+	if ms == 0 {
+		timeout = time.Second
+	}
+
+	keys := []string{args[2].Str}
+	var keep, replace bool
+	var auth []string
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Str) {
+		case "COPY":
+			keep = true
+		case "REPLACE":
+			replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return resp.NewError("ERR syntax error")
+			}
+			auth = []string{"AUTH", args[i+1].Str}
+			i++
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return resp.NewError("ERR syntax error")
+			}
+			auth = []string{"AUTH", args[i+1].Str, args[i+2].Str}
+			i += 2
+		case "KEYS":
+			if args[2].Str != "" {
+				return resp.NewError("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			keys = keys[:0]
+			for _, key := range args[i+1:] {
+				keys = append(keys, key.Str)
+			}
+			i = len(args)
+		default:
+			return resp.NewError("ERR syntax error")
+		}
+	}
+	if len(keys) == 0 {
+		return resp.NewSimpleString("NOKEY")
+	}
+
+	err = h.DB.Migrate(keys, keep, func(moved []db.MigratedKey) error {
+		return h.sendMigrated(addr, timeout, auth, moved, replace)
+	})
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return resp.NewSimpleString("NOKEY")
+	}
+	if err != nil {
+		return resp.NewError(err.Error())
+	}
+	return resp.NewSimpleString("OK")
+}
+
+// sendMigrated restores keys on the server at addr, all of them or none
+// as far as the caller can tell: an error leaves the keys in place here.
+// In cluster mode every RESTORE is sent after ASKING, as the keys belong
+// to a slot the other server may still be importing.
+func (h *Handler) sendMigrated(addr string, timeout time.Duration, auth []string, moved []db.MigratedKey, replace bool) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return fmt.Errorf("IOERR error or timeout connecting to the client: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	w := bufio.NewWriter(conn)
+	send := func(args ...string) {
+		items := make([]resp.Value, len(args))
+		for i, arg := range args {
+			items[i] = resp.NewBulkString(arg)
+		}
+		w.Write(resp.Marshal(resp.NewArray(items)))
+	}
+	replies := 0
+	if auth != nil {
+		send(auth...)
+		replies++
+	}
+	for _, m := range moved {
+		if h.cluster != nil {
+			send("ASKING")
+			replies++
+		}
+		restore := []string{"RESTORE", m.Key, "0", string(m.Payload)}
+		if !m.Expiration.IsZero() {
+			restore = []string{"RESTORE", m.Key, strconv.FormatInt(m.Expiration.UnixMilli(), 10), string(m.Payload), "ABSTTL"}
+		}
+		if replace {
+			restore = append(restore, "REPLACE")
+		}
+		send(restore...)
+		replies++
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("IOERR error or timeout writing to target instance: %v", err)
+	}
+
+	r := bufio.NewReader(conn)
+	var firstErr error
+	for i := 0; i < replies; i++ {
+		reply, err := resp.Parse(r)
+		if err != nil {
+			return fmt.Errorf("IOERR error or timeout reading to target instance: %v", err)
+		}
+		if reply.Type == resp.Error && firstErr == nil {
+			firstErr = fmt.Errorf("ERR Target instance replied with error: %s", reply.Str)
+		}
+	}
+	return firstErr
+}
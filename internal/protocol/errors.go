@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+)
+
+// Redis error classes. The first word of an error reply tells clients what
+// kind of failure happened, so libraries can map them to typed exceptions.
+const (
+	errClassGeneric   = "ERR"
+	errClassWrongType = "WRONGTYPE"
+	errClassNoProto   = "NOPROTO"
+	errClassOOM       = "OOM"
+	errClassReadOnly  = "READONLY"
+	errClassWrongPass = "WRONGPASS"
+	errClassMisconf   = "MISCONF"
+	errClassLoading   = "LOADING"
+)
+
+// newClassError builds an error reply of the given class
+func newClassError(class, msg string) resp.Value {
+	return resp.NewError(class + " " + msg)
+}
+
+// wrongArgsError is the reply for a command called with the wrong arity
+func wrongArgsError(cmd string) resp.Value {
+	return newClassError(errClassGeneric, fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+}
+
+// protocolError is the reply sent before closing a connection whose request
+// could not be parsed
+func protocolError(err error) resp.Value {
+	return newClassError(errClassGeneric, "Protocol error: "+err.Error())
+}
+
+// errorReply converts an error returned by the db package into an error
+// reply carrying the matching Redis error class
+func errorReply(err error) resp.Value {
+	switch {
+	case errors.Is(err, db.ErrWrongType):
+		return newClassError(errClassWrongType, "Operation against a key holding the wrong kind of value")
+	case errors.Is(err, db.ErrKeyNotFound):
+		return newClassError(errClassGeneric, "no such key")
+	case errors.Is(err, db.ErrEncryptionDisabled):
+		return newClassError(errClassGeneric, "encryption is disabled, start the server with --encryption-key-file")
+	case errors.Is(err, db.ErrAccessTrackingDisabled):
+		return newClassError(errClassGeneric, "access tracking is disabled, start the server with --track-access")
+	case errors.Is(err, db.ErrTrashDisabled):
+		return newClassError(errClassGeneric, "trash is disabled, start the server with --trash-retention")
+	case errors.Is(err, db.ErrHistoryDisabled):
+		return newClassError(errClassGeneric, "key history is disabled, start the server with --history")
+	default:
+		return newClassError(errClassGeneric, err.Error())
+	}
+}
+
+// nullOrErrorReply is used by commands that answer a missing key, field or
+// index with a null bulk string. Type mismatches are still reported.
+func nullOrErrorReply(err error) resp.Value {
+	if errors.Is(err, db.ErrWrongType) {
+		return errorReply(err)
+	}
+	return resp.NewNullBulkString()
+}
@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+)
+
+// CommandFunc implements a command added by an embedder. It gets the
+// database and the arguments following the command name, and returns the
+// reply; failures are returned as resp.NewError replies.
+type CommandFunc func(database *db.FlexDB, args []string) resp.Value
+
+// WithCommand adds a read-only command implemented in Go. The name is
+// case-insensitive and must not clash with a built-in command, or
+// NewHandler panics.
+func WithCommand(name string, fn CommandFunc) HandlerOption {
+	return func(h *Handler) {
+		h.registry.Register(extensionName(h, name), extensionHandler(fn))
+	}
+}
+
+// WithWriteCommand adds a command implemented in Go that changes the
+// keyspace, so it is refused like the built-in writes while persistence
+// is failing. Writes it makes through a db.Txn should be logged with
+// Txn.Log and replayed with a db.WithReplay function, or they are lost
+// from the AOF on restart.
+func WithWriteCommand(name string, fn CommandFunc) HandlerOption {
+	return func(h *Handler) {
+		h.registry.RegisterWrite(extensionName(h, name), extensionHandler(fn))
+	}
+}
+
+// extensionName returns the registry name of an added command
+func extensionName(h *Handler, name string) string {
+	name = strings.ToUpper(name)
+	if _, exists := h.registry.Get(name); exists {
+		panic(fmt.Sprintf("protocol: command %s is already registered", name))
+	}
+	return name
+}
+
+// extensionHandler adapts a CommandFunc to the registry
+func extensionHandler(fn CommandFunc) CommandHandler {
+	return func(h *Handler, c *Client, args []resp.Value) resp.Value {
+		return fn(h.DB, argStrings(args))
+	}
+}
@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// faultInjector makes the server misbehave on purpose so applications can
+// check how they cope with a degraded FlexDB. It only exists when the server
+// runs with fault injection enabled.
+type faultInjector struct {
+	mu       sync.Mutex
+	latency  time.Duration // added before every command
+	jitter   time.Duration // random extra latency, up to this much
+	dropRate float64       // probability of closing the connection instead of replying
+	rng      *rand.Rand
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// delay sleeps for the configured command latency
+func (f *faultInjector) delay() {
+	f.mu.Lock()
+	d := f.latency
+	if f.jitter > 0 {
+		d += time.Duration(f.rng.Int63n(int64(f.jitter)))
+	}
+	f.mu.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// shouldDrop reports whether the current connection should be dropped
+func (f *faultInjector) shouldDrop() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dropRate > 0 && f.rng.Float64() < f.dropRate
+}
+
+func (f *faultInjector) setLatency(latency, jitter time.Duration) {
+	f.mu.Lock()
+	f.latency, f.jitter = latency, jitter
+	f.mu.Unlock()
+}
+
+func (f *faultInjector) setDropRate(rate float64) {
+	f.mu.Lock()
+	f.dropRate = rate
+	f.mu.Unlock()
+}
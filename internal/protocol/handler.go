@@ -2,179 +2,367 @@ package protocol
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"net"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"flex-db/internal/db"
+	"flex-db/internal/resp"
+)
+
+// Default request size limits, matching the usual Redis defaults
+const (
+	DefaultMaxLineLength  = 64 * 1024
+	DefaultMaxRequestSize = 512 * 1024 * 1024
+
+	// DefaultMaxKeysReply caps how many keys ALL and KEYS return at once
+	DefaultMaxKeysReply = 10000
+
+	// DefaultBulkConfirmLimit is how many keys the pattern and tag bulk
+	// commands may change before they require FORCE
+	DefaultBulkConfirmLimit = 1000
 )
 
 // Handler manages client connections
 type Handler struct {
-	DB *db.FlexDB
-	registry *CommandRegistry
+	DB         *db.FlexDB
+	registry   *CommandRegistry
+	prompt     bool           // show the interactive "> " prompt on text connections
+	password   string         // clients must AUTH with this password when set
+	faults     *faultInjector // nil unless fault injection is enabled
+	limits     resp.Limits    // bounds on the size of a single request
+	maxKeys    int            // most keys ALL and KEYS may return, 0 for no limit
+	maxBulk    int            // most keys a pattern command changes without FORCE, 0 for no limit
+	adminPort  bool           // admin commands are only allowed on admin connections
+	shutdown   func()         // starts a graceful server shutdown, used by SHUTDOWN
+	stopWrites bool           // refuse write commands while persistence is failing
+
+	started time.Time // reported as uptime by INFO server
+
+	output            OutputLimits // limits on output clients leave unread
+	outputDisconnects atomic.Int64 // clients closed for breaking them
+
+	clientsMu sync.Mutex
+	clients   map[*Client]struct{} // connections currently being served
+	active    sync.WaitGroup
+	closing   bool
+	done      chan struct{} // closed by Shutdown to end blocking commands
+
+	// scriptGate is held shared by every command and exclusively by a
+	// running script, which makes scripts atomic
+	scriptGate sync.RWMutex
+	scripts    scriptCache
+
+	pubsub broker // channel subscriptions, see PUBLISH
+
+	repl    replication // replicas and the master followed, see PSYNC
+	cluster *cluster    // nil unless cluster mode is enabled
+	raft    *raftNode   // nil unless Raft replication is enabled
 }
 
-// NewHandler creates a new command handler
-func NewHandler(database *db.FlexDB) *Handler {
-	return &Handler{
-		DB: database,
-		registry: NewCommandRegistry(),
+// HandlerOption configures optional Handler behaviour
+type HandlerOption func(*Handler)
+
+// WithoutPrompt disables the interactive "> " prompt on text connections,
+// which makes the text protocol easier to drive from scripts
+func WithoutPrompt() HandlerOption {
+	return func(h *Handler) {
+		h.prompt = false
 	}
 }
 
-func validateArgs(cmd string, args []string, expected int) bool {
-	if len(args) < expected {
-		fmt.Printf("%s requires %d arguments\n", cmd, expected)
-		return false
+// WithPassword requires clients to authenticate with AUTH or HELLO before
+// running any other command
+func WithPassword(password string) HandlerOption {
+	return func(h *Handler) {
+		h.password = password
+	}
+}
+
+// WithFaultInjection enables the DEBUG FAULT subcommands, which inject
+// latency, connection drops and fsync failures. Never use it in production.
+func WithFaultInjection() HandlerOption {
+	return func(h *Handler) {
+		h.faults = newFaultInjector()
+	}
+}
+
+// WithRequestLimits bounds the length of an inline command line and the
+// total size of a single request. Clients exceeding either limit get a
+// protocol error and are disconnected. Zero disables the limit.
+func WithRequestLimits(maxLineLength int, maxRequestSize int64) HandlerOption {
+	return func(h *Handler) {
+		h.limits = resp.Limits{MaxLineLength: maxLineLength, MaxRequestSize: maxRequestSize}
+	}
+}
+
+// WithMaxKeysReply caps the number of keys a single ALL or KEYS reply may
+// hold, so listing a big keyspace can't stall the server. Zero removes the cap.
+func WithMaxKeysReply(n int) HandlerOption {
+	return func(h *Handler) {
+		h.maxKeys = n
+	}
+}
+
+// WithBulkConfirmLimit sets how many keys the pattern and tag bulk
+// commands may change before the client has to confirm with FORCE. Zero
+// never asks.
+func WithBulkConfirmLimit(n int) HandlerOption {
+	return func(h *Handler) {
+		h.maxBulk = n
+	}
+}
+
+// WithAdminPort reserves administrative commands (DEBUG, SHUTDOWN,
+// FLUSHALL, BGREWRITEAOF) for connections served by HandleAdminConnection
+func WithAdminPort() HandlerOption {
+	return func(h *Handler) {
+		h.adminPort = true
+	}
+}
+
+// WithShutdownFunc lets the SHUTDOWN command stop the server by calling fn
+func WithShutdownFunc(fn func()) HandlerOption {
+	return func(h *Handler) {
+		h.shutdown = fn
 	}
-	return true
 }
 
+// WithStopWritesOnPersistenceError refuses write commands with a MISCONF
+// error while snapshots or AOF fsyncs are failing, so clients learn that
+// their writes would not be persisted. Writes resume once persistence succeeds.
+func WithStopWritesOnPersistenceError() HandlerOption {
+	return func(h *Handler) {
+		h.stopWrites = true
+	}
+}
+
+// NewHandler creates a new command handler
+func NewHandler(database *db.FlexDB, options ...HandlerOption) *Handler {
+	h := &Handler{
+		DB:       database,
+		registry: NewCommandRegistry(),
+		prompt:   true,
+		started:  time.Now(),
+		clients:  make(map[*Client]struct{}),
+		done:     make(chan struct{}),
+		maxKeys:  DefaultMaxKeysReply,
+		maxBulk:  DefaultBulkConfirmLimit,
+		limits: resp.Limits{
+			MaxLineLength:  DefaultMaxLineLength,
+			MaxRequestSize: DefaultMaxRequestSize,
+		},
+	}
+
+	for _, option := range options {
+		option(h)
+	}
 
+	return h
+}
 
+// HandleConnection serves a client of the public port
 func (h *Handler) HandleConnection(conn net.Conn) {
+	h.serve(conn, false)
+}
+
+// HandleAdminConnection serves a client of the admin port, where
+// administrative commands are allowed
+func (h *Handler) HandleAdminConnection(conn net.Conn) {
+	h.serve(conn, true)
+}
+
+func (h *Handler) serve(conn net.Conn, admin bool) {
+	client := newClient(conn, h.password == "")
+	client.Admin = admin
+	if !h.addClient(client) {
+		conn.Close()
+		return
+	}
+	defer h.removeClient(client)
+	defer h.stopPushing(client)
+	defer h.detachReplica(client)
+
 	protocolType, reader, err := DetectProtocol(conn)
 	if err != nil {
 		fmt.Printf("Error detecting protocol: %v\n", err)
 		conn.Close()
 		return
 	}
+	client.Protocol = protocolType
 
 	switch protocolType {
 	case RESPProtocol:
-		h.HandleRESPConnection(conn, reader)
+		h.HandleRESPConnection(client, reader)
 	case TextProtocol:
-		h.HandleTextConnection(conn, reader)
+		h.HandleTextConnection(client, reader)
+	}
+}
+
+// addClient registers a connection so Shutdown can drain it.
+// It returns false once the handler is shutting down.
+func (h *Handler) addClient(c *Client) bool {
+	h.clientsMu.Lock()
+	defer h.clientsMu.Unlock()
+
+	if h.closing {
+		return false
+	}
+	h.clients[c] = struct{}{}
+	h.active.Add(1)
+	return true
+}
+
+func (h *Handler) removeClient(c *Client) {
+	h.clientsMu.Lock()
+	delete(h.clients, c)
+	h.clientsMu.Unlock()
+	h.active.Done()
+}
+
+// Shutdown drains all connections. New connections are refused, and every
+// connection finishes the commands it has already sent before closing.
+// Connections still open when ctx is done are closed forcefully.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	h.stopFollowing()
+	defer h.stopRaft()
+
+	h.clientsMu.Lock()
+	if !h.closing {
+		close(h.done)
+	}
+	h.closing = true
+	for c := range h.clients {
+		// unblock the pending read; buffered commands are still served
+		c.Conn.SetReadDeadline(time.Now())
+	}
+	h.clientsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		h.clientsMu.Lock()
+		for c := range h.clients {
+			c.Conn.Close()
+		}
+		h.clientsMu.Unlock()
+		return ctx.Err()
 	}
 }
 
-// HandleConnection processes client commands
-func (h *Handler) HandleTextConnection(conn net.Conn, reader *bufio.Reader) {
+// blockingContext returns the context of a blocking command run by c. It
+// ends after timeout, unless timeout is 0, or when the handler shuts down.
+// The command lets go of the script gate while it waits, so scripts can
+// run meanwhile. Commands run by a script can't wait, so their context has
+// already timed out and they return at once if nothing is ready.
+func (h *Handler) blockingContext(c *Client, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if c.inScript {
+		return context.WithDeadline(context.Background(), time.Now())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+	ctx = db.WithWaitHooks(ctx, h.scriptGate.RUnlock, h.scriptGate.RLock)
+	go func() {
+		select {
+		case <-h.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// HandleTextConnection processes commands sent over the line based text protocol.
+// Every command goes through the same registry as RESP, and every reply is
+// written using the text grammar described in text.go
+func (h *Handler) HandleTextConnection(client *Client, reader *bufio.Reader) {
+	conn := client.Conn
 	defer conn.Close()
-	addr := conn.RemoteAddr().String()
-	fmt.Printf("[+] Client connected: %s\n", addr)
-	defer fmt.Printf("[-] Client disconnected: %s\n", addr)
+	fmt.Printf("[+] Client connected: %s\n", client.Addr)
+	defer fmt.Printf("[-] Client disconnected: %s\n", client.Addr)
 
 	writer := bufio.NewWriter(conn)
+	client.writer = writer
 
 	for {
-		writer.WriteString("> ")
+		// subscribed connections get no prompt, which would race their messages
+		client.writeMu.Lock()
+		if h.prompt && client.pushes == nil {
+			writer.WriteString("> ")
+		}
 		writer.Flush()
+		client.writeMu.Unlock()
 
 		// Read client input
-		line, err := reader.ReadString('\n')
+		line, err := resp.ReadLine(reader, h.textLineLimit())
 		if err != nil {
+			if errors.Is(err, resp.ErrLineTooLong) {
+				client.writeMu.Lock()
+				writeTextReply(writer, protocolError(err))
+				writer.Flush()
+				client.writeMu.Unlock()
+			}
 			return
 		}
-		line = strings.TrimSpace(line)
-		args := strings.SplitN(line, " ", 4) // Allow for TTL as 4th argument
-		if len(args) == 0 || args[0] == "" {
+
+		args, err := splitTextArgs(strings.TrimSpace(line))
+		if err != nil {
+			h.reply(client, writer, resp.NewError("ERR "+err.Error()))
+			continue
+		}
+		if len(args) == 0 {
 			continue
 		}
 
 		cmd := strings.ToUpper(args[0])
-		switch cmd {
-		case "SET":
-			if !validateArgs(cmd, args, 2) {
-				writer.WriteString("SET command requires at least two arguments\n")
-				continue
-			}
-			key := args[1]
-			value := args[2]
-			
-			var expiry *time.Time
-			if len(args) == 4 {
-				seconds, err := strconv.ParseInt(args[3], 10, 64)
-				if err != nil {
-					writer.WriteString("Invalid expiration format\n")
-					continue
-				}
-				t := time.Now().Add(time.Duration(seconds) * time.Second)
-				expiry = &t
-			}
-			
-			h.DB.Set(key, value, expiry)
-			writer.WriteString("OK\n")
-		case "GET":
-			if !validateArgs(cmd, args, 2) {
-				writer.WriteString("GET command requires one argument\n")
-				continue
-			}
-			key := args[1]
-			value, err := h.DB.Get(key)
-			if err != nil {
-				writer.WriteString("(nil)\n")
-			} else {
-				writer.WriteString(fmt.Sprintf("%v\n", value))
-			}
-		case "ALL":
-			all := h.DB.All()
-			for k, v := range all {
-				writer.WriteString(fmt.Sprintf("%s: %s\n", k, v))
-			}
-			writer.WriteString("END\n")
-		case "DEL":
-			if !validateArgs(cmd, args, 2) {
-				writer.WriteString("DEL command requires at least one argument\n")
-				continue
-			}
-			for _, key := range args[1:] {
-				h.DB.Delete(key)
-			}
-			writer.WriteString("OK\n")
-		case "EXPIRE":
-			if !validateArgs(cmd, args, 3) {
-				writer.WriteString("EXPIRE command requires two arguments\n")
-				continue
-			}
-			key := args[1]
-			duration, err := strconv.ParseInt(args[2], 10, 64)
-			if err != nil {
-				writer.WriteString("Invalid duration format\n")
-				continue
-			}
-			h.DB.Expire(key, time.Duration(duration)*time.Second)
-			writer.WriteString("OK\n")
-		case "TTL":
-			if !validateArgs(cmd, args, 2) {
-				writer.WriteString("TTL command requires one argument\n")
-				continue
-			}
-			key := args[1]
-			duration, err := h.DB.TTL(key)
-			if err != nil {
-				writer.WriteString("-1\n")
-			} else {
-				writer.WriteString(fmt.Sprintf("%.0f\n", duration.Seconds()))
-			}
-		case "FLUSH":
-			h.DB.Flush()
-			writer.WriteString("OK\n")
-		
-		case "BGREWRITE":
-			go func() {
-				if err := h.DB.RewriteAOF(); err != nil {
-					fmt.Printf("Error rewriting AOF: %v\n", err)
-				}
-			}()
-			writer.WriteString("Background rewrite started\n")
-		
-		case "HELP":
-			writer.WriteString("Available commands:\n\n")
-			for _, cmd := range AVAILABLE_COMMANDS {
-				writer.WriteString(fmt.Sprintf("  %s\n", cmd))
-			}
-			writer.WriteString("\n")
-		case "EXIT":
-			writer.WriteString("Bye 👋\n")
+		if cmd == "EXIT" || cmd == "QUIT" {
+			client.writeMu.Lock()
+			writeTextReply(writer, resp.NewSimpleString("Bye"))
 			writer.Flush()
+			client.writeMu.Unlock()
 			h.DB.Flush()
 			return
-		default:
-			writer.WriteString("Unknown command\n")
 		}
+
+		if h.faults != nil && h.faults.shouldDrop() {
+			return
+		}
+
+		cmdArgs := make([]resp.Value, len(args)-1)
+		for i, arg := range args[1:] {
+			cmdArgs[i] = resp.NewBulkString(arg)
+		}
+
+		result := h.runCommand(client, cmd, cmdArgs)
+		if client.takeReply() {
+			if err := h.reply(client, writer, result); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// textLineLimit returns the longest line a text client may send. A text
+// request is a single line, so both request limits apply to it.
+func (h *Handler) textLineLimit() int {
+	limit := h.limits.MaxLineLength
+	if size := h.limits.MaxRequestSize; size > 0 && (limit <= 0 || size < int64(limit)) {
+		limit = int(size)
 	}
-}
\ No newline at end of file
+	return limit
+}
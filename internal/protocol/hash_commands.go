@@ -1,27 +1,31 @@
 package protocol
 
 import (
+	"strconv"
+
 	"flex-db/internal/resp"
-	"fmt"
 )
 
 // registerHashCommands registers all hash-related commands in the command registry.
 func (r *CommandRegistry) registerHashCommands() {
-	r.Register("HSET", hsetCommand)
+	r.RegisterWrite("HSET", hsetCommand)
 	r.Register("HGET", hgetCommand)
-	r.Register("HDEL", hdelCommand)
+	r.RegisterWrite("HDEL", hdelCommand)
 	r.Register("HGETALL", hgetallCommand)
 	r.Register("HEXISTS", hexistsCommand)
 	r.Register("HLEN", hlenCommand)
 	r.Register("HKEYS", hkeysCommand)
 	r.Register("HVALS", hvalsCommand)
+	r.Register("HSCAN", hscanCommand)
+	r.RegisterWrite("HINCRBY", hincrbyCommand)
+	r.RegisterWrite("HINCRBYFLOAT", hincrbyfloatCommand)
 }
 
 // hsetCommand handles the HSET command.
 // Syntax: HSET key field value
 // Sets the field in the hash stored at key to value.
 // Returns 1 if the field is new, 0 if it was updated.
-func hsetCommand(h *Handler, args []resp.Value) resp.Value {
+func hsetCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) != 3 {
 		return resp.NewError("ERR wrong number of arguments for 'hset' command")
 	}
@@ -32,7 +36,7 @@ func hsetCommand(h *Handler, args []resp.Value) resp.Value {
 
 	created, err := h.DB.HSet(key, field, value)
 	if err != nil {
-		return resp.NewError(fmt.Sprintf("ERR %v", err))
+		return errorReply(err)
 	}
 
 	return resp.NewInteger(int64(created))
@@ -42,7 +46,7 @@ func hsetCommand(h *Handler, args []resp.Value) resp.Value {
 // Syntax: HGET key field
 // Gets the value of a field in a hash.
 // Returns nil if the key or field doesn't exist.
-func hgetCommand(h *Handler, args []resp.Value) resp.Value {
+func hgetCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) != 2 {
 		return resp.NewError("ERR wrong number of arguments for 'hget' command")
 	}
@@ -52,7 +56,7 @@ func hgetCommand(h *Handler, args []resp.Value) resp.Value {
 
 	value, err := h.DB.HGet(key, field)
 	if err != nil {
-		return resp.NewNullBulkString()
+		return nullOrErrorReply(err)
 	}
 
 	return resp.NewBulkString(value)
@@ -62,7 +66,7 @@ func hgetCommand(h *Handler, args []resp.Value) resp.Value {
 // Syntax: HDEL key field [field ...]
 // Removes fields from a hash.
 // Returns the number of fields that were removed.
-func hdelCommand(h *Handler, args []resp.Value) resp.Value {
+func hdelCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) < 2 {
 		return resp.NewError("ERR wrong number of arguments for 'hdel' command")
 	}
@@ -75,7 +79,7 @@ func hdelCommand(h *Handler, args []resp.Value) resp.Value {
 
 	deleted, err := h.DB.HDel(key, fields...)
 	if err != nil {
-		return resp.NewError(fmt.Sprintf("ERR %v", err))
+		return errorReply(err)
 	}
 
 	return resp.NewInteger(int64(deleted))
@@ -85,7 +89,7 @@ func hdelCommand(h *Handler, args []resp.Value) resp.Value {
 // Syntax: HGETALL key
 // Returns all fields and values in a hash.
 // Returns an empty array if the key doesn't exist.
-func hgetallCommand(h *Handler, args []resp.Value) resp.Value {
+func hgetallCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) != 1 {
 		return resp.NewError("ERR wrong number of arguments for 'hgetall' command")
 	}
@@ -93,7 +97,7 @@ func hgetallCommand(h *Handler, args []resp.Value) resp.Value {
 	key := args[0].Str
 	hashMap, err := h.DB.HGetAll(key)
 	if err != nil {
-		return resp.NewError(fmt.Sprintf("ERR %v", err))
+		return errorReply(err)
 	}
 
 	result := resp.Value{
@@ -113,7 +117,7 @@ func hgetallCommand(h *Handler, args []resp.Value) resp.Value {
 // Syntax: HEXISTS key field
 // Checks if a field exists in a hash.
 // Returns 1 if the field exists, 0 otherwise.
-func hexistsCommand(h *Handler, args []resp.Value) resp.Value {
+func hexistsCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) != 2 {
 		return resp.NewError("ERR wrong number of arguments for 'hexists' command")
 	}
@@ -123,7 +127,7 @@ func hexistsCommand(h *Handler, args []resp.Value) resp.Value {
 
 	exists, err := h.DB.HExists(key, field)
 	if err != nil {
-		return resp.NewError(fmt.Sprintf("ERR %v", err))
+		return errorReply(err)
 	}
 
 	if exists {
@@ -136,7 +140,7 @@ func hexistsCommand(h *Handler, args []resp.Value) resp.Value {
 // Syntax: HLEN key
 // Returns the number of fields in a hash.
 // Returns 0 if the key doesn't exist.
-func hlenCommand(h *Handler, args []resp.Value) resp.Value {
+func hlenCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) != 1 {
 		return resp.NewError("ERR wrong number of arguments for 'hlen' command")
 	}
@@ -144,7 +148,7 @@ func hlenCommand(h *Handler, args []resp.Value) resp.Value {
 	key := args[0].Str
 	length, err := h.DB.HLen(key)
 	if err != nil {
-		return resp.NewError(fmt.Sprintf("ERR %v", err))
+		return errorReply(err)
 	}
 
 	return resp.NewInteger(int64(length))
@@ -154,7 +158,7 @@ func hlenCommand(h *Handler, args []resp.Value) resp.Value {
 // Syntax: HKEYS key
 // Returns all fields in a hash.
 // Returns an empty array if the key doesn't exist.
-func hkeysCommand(h *Handler, args []resp.Value) resp.Value {
+func hkeysCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) != 1 {
 		return resp.NewError("ERR wrong number of arguments for 'hkeys' command")
 	}
@@ -162,7 +166,7 @@ func hkeysCommand(h *Handler, args []resp.Value) resp.Value {
 	key := args[0].Str
 	keys, err := h.DB.HKeys(key)
 	if err != nil {
-		return resp.NewError(fmt.Sprintf("ERR %v", err))
+		return errorReply(err)
 	}
 
 	result := resp.Value{
@@ -181,7 +185,7 @@ func hkeysCommand(h *Handler, args []resp.Value) resp.Value {
 // Syntax: HVALS key
 // Returns all values in a hash.
 // Returns an empty array if the key doesn't exist.
-func hvalsCommand(h *Handler, args []resp.Value) resp.Value {
+func hvalsCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) != 1 {
 		return resp.NewError("ERR wrong number of arguments for 'hvals' command")
 	}
@@ -189,7 +193,7 @@ func hvalsCommand(h *Handler, args []resp.Value) resp.Value {
 	key := args[0].Str
 	values, err := h.DB.HVals(key)
 	if err != nil {
-		return resp.NewError(fmt.Sprintf("ERR %v", err))
+		return errorReply(err)
 	}
 
 	result := resp.Value{
@@ -203,3 +207,76 @@ func hvalsCommand(h *Handler, args []resp.Value) resp.Value {
 
 	return result
 }
+
+// hincrbyCommand handles the HINCRBY command.
+// Syntax: HINCRBY key field increment
+// Adds an integer increment to the integer stored in a hash field.
+// Missing keys and fields count as 0.
+// Returns the new value.
+// Example: HINCRBY user:1 visits 1
+func hincrbyCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 3 {
+		return wrongArgsError("hincrby")
+	}
+	delta, err := strconv.ParseInt(args[2].Str, 10, 64)
+	if err != nil {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+
+	value, err := h.DB.HIncrBy(args[0].Str, args[1].Str, delta)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(value)
+}
+
+// hincrbyfloatCommand handles the HINCRBYFLOAT command.
+// Syntax: HINCRBYFLOAT key field increment
+// Adds a floating point increment to the number stored in a hash field,
+// formatted as by INCRBYFLOAT. Missing keys and fields count as 0.
+// Returns the new value.
+func hincrbyfloatCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 3 {
+		return wrongArgsError("hincrbyfloat")
+	}
+	delta, err := parseIncrement(args[2].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	value, err := h.DB.HIncrByFloat(args[0].Str, args[1].Str, delta)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewBulkString(value)
+}
+
+// hscanCommand handles the HSCAN command.
+// Syntax: HSCAN key cursor [MATCH pattern] [COUNT count]
+// Iterates the fields of a hash like SCAN iterates keys, so big hashes
+// can be read a page at a time instead of with HGETALL.
+// Returns [cursor, [field, value, ...]].
+// Example: HSCAN user:1 0 MATCH addr:* COUNT 50
+func hscanCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("hscan")
+	}
+	opts, errReply := h.parseScanArgs("hscan", args[1:], false)
+	if errReply != nil {
+		return *errReply
+	}
+	cursor, errReply := parseScanCursor(args[1].Str)
+	if errReply != nil {
+		return *errReply
+	}
+
+	entries, next, err := h.DB.HScan(args[0].Str, cursor, opts.pattern, opts.count)
+	if err != nil {
+		return errorReply(err)
+	}
+	pairs := make([]resp.Value, 0, 2*len(entries))
+	for _, e := range entries {
+		pairs = append(pairs, resp.NewBulkString(e.Key), resp.NewBulkString(e.Value.(string)))
+	}
+	return scanReply(strconv.FormatUint(next, 10), resp.NewArray(pairs))
+}
@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"strconv"
+
+	"flex-db/internal/resp"
+)
+
+// registerHistoryCommands registers the key history commands
+func (r *CommandRegistry) registerHistoryCommands() {
+	r.Register("HISTORY", historyCommand)
+	r.Register("GETVERSION", getVersionCommand)
+}
+
+// historyCommand handles the HISTORY command.
+// Syntax: HISTORY key
+// Lists the kept versions of a string key, newest first, as
+// [version, unix time in milliseconds, value] entries. The first entry is
+// the current value. Only keys matching a --history pattern have versions.
+// Example: HISTORY config:flags
+func historyCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("history")
+	}
+
+	versions, err := h.DB.History(args[0].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	entries := make([]resp.Value, len(versions))
+	for i, v := range versions {
+		entries[i] = resp.NewArray([]resp.Value{
+			resp.NewInteger(int64(v.Version)),
+			resp.NewInteger(v.Time.UnixMilli()),
+			resp.NewBulkString(v.Value),
+		})
+	}
+	return resp.NewArray(entries)
+}
+
+// getVersionCommand handles the GETVERSION command.
+// Syntax: GETVERSION key version
+// Returns the value key held at the given version, as numbered by
+// HISTORY, or nil if that version is no longer kept. Restore it with SET
+// to undo an overwrite.
+// Example: GETVERSION config:flags 3
+func getVersionCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("getversion")
+	}
+	version, err := strconv.ParseUint(args[1].Str, 10, 64)
+	if err != nil || version == 0 {
+		return resp.NewError("ERR version must be a positive integer")
+	}
+
+	v, ok, err := h.DB.GetVersion(args[0].Str, version)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !ok {
+		return resp.NewNullBulkString()
+	}
+	return resp.NewBulkString(v.Value)
+}
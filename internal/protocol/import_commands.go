@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+)
+
+// registerImportCommands registers IMPORT
+func (r *CommandRegistry) registerImportCommands() {
+	r.RegisterWrite("IMPORT", importCommand)
+}
+
+// importCommand handles the IMPORT command.
+// Syntax: IMPORT format data [REPLACE]
+// Stores the records in data, JSONL lines or CSV rows with a header as
+// format says, in one atomic batch; flexdb import streams files with it.
+// Existing keys are left alone unless REPLACE is given, and a bad record
+// stores nothing.
+// Returns the number of keys stored.
+// Example: IMPORT jsonl "{\"key\":\"user:1\",\"value\":\"alice\"}" REPLACE
+func importCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 && len(args) != 3 {
+		return wrongArgsError("import")
+	}
+	format, err := db.ParseRecordFormat(args[0].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	replace := false
+	if len(args) == 3 {
+		if !strings.EqualFold(args[2].Str, "REPLACE") {
+			return resp.NewError("ERR syntax error")
+		}
+		replace = true
+	}
+
+	var records []db.Record
+	reader := db.NewRecordReader(strings.NewReader(args[1].Str), format)
+	for {
+		rec, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return errorReply(err)
+		}
+		records = append(records, rec)
+	}
+
+	imported, err := h.DB.Import(records, replace)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(imported))
+}
@@ -0,0 +1,335 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+)
+
+// registerInfoCommands registers the server introspection commands
+func (r *CommandRegistry) registerInfoCommands() {
+	r.Register("INFO", infoCommand)
+	r.Register("TIME", timeCommand)
+}
+
+// infoSection renders one section of the INFO reply as "field:value" lines
+type infoSection struct {
+	name   string
+	render func(h *Handler, b *infoBuilder)
+}
+
+// infoSections lists the INFO sections in the order they are printed
+var infoSections = []infoSection{
+	{"server", serverInfo},
+	{"clients", clientsInfo},
+	{"memory", memoryInfo},
+	{"persistence", persistenceInfo},
+	{"replication", replicationInfo},
+	{"keyspace", keyspaceInfo},
+}
+
+// infoBuilder collects the lines of an INFO reply
+type infoBuilder struct {
+	strings.Builder
+}
+
+// field adds a "name:value" line
+func (b *infoBuilder) field(name string, value interface{}) {
+	fmt.Fprintf(b, "%s:%v\r\n", name, value)
+}
+
+// infoCommand handles the INFO command.
+// Syntax: INFO [section ...]
+// Returns server information as "field:value" lines grouped under
+// "# Section" headers. Without arguments, or with "all" or "everything",
+// every section is included.
+// Example: INFO persistence
+func infoCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	wanted := make(map[string]bool, len(args))
+	for _, arg := range args {
+		wanted[strings.ToLower(arg.Str)] = true
+	}
+	all := len(args) == 0 || wanted["all"] || wanted["everything"] || wanted["default"]
+
+	var b infoBuilder
+	for _, section := range infoSections {
+		if !all && !wanted[section.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", strings.ToUpper(section.name[:1])+section.name[1:])
+		section.render(h, &b)
+	}
+
+	return resp.NewBulkString(b.String())
+}
+
+// timeCommand handles the TIME command.
+// Syntax: TIME
+// Returns the server clock as Unix seconds and the microseconds within the
+// second, so clients can measure their clock skew against the server.
+// Example: TIME
+func timeCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 0 {
+		return wrongArgsError("time")
+	}
+
+	now := time.Now()
+	return resp.NewArray([]resp.Value{
+		resp.NewBulkString(strconv.FormatInt(now.Unix(), 10)),
+		resp.NewBulkString(strconv.Itoa(now.Nanosecond() / 1000)),
+	})
+}
+
+// serverInfo renders the server section
+func serverInfo(h *Handler, b *infoBuilder) {
+	now := time.Now()
+	uptime := now.Sub(h.started)
+
+	b.field("go_version", runtime.Version())
+	b.field("os", runtime.GOOS+" "+runtime.GOARCH)
+	b.field("process_id", os.Getpid())
+	b.field("server_time_usec", now.UnixMicro())
+	b.field("uptime_in_seconds", int64(uptime.Seconds()))
+	b.field("uptime_in_days", int64(uptime.Hours()/24))
+	b.field("num_cpus", runtime.NumCPU())
+	b.field("goroutines", runtime.NumGoroutine())
+}
+
+// clientsInfo renders the clients section
+func clientsInfo(h *Handler, b *infoBuilder) {
+	h.clientsMu.Lock()
+	connected := len(h.clients)
+	var maxOutput int64
+	for c := range h.clients {
+		if size := c.out.size(); size > maxOutput {
+			maxOutput = size
+		}
+	}
+	h.clientsMu.Unlock()
+
+	b.field("connected_clients", connected)
+	b.field("max_output_buffer", maxOutput)
+	b.field("output_limit_disconnections", h.outputDisconnects.Load())
+}
+
+// memoryInfo renders the memory section from the Go runtime statistics
+func memoryInfo(h *Handler, b *infoBuilder) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	b.field("used_memory", m.HeapAlloc)
+	b.field("used_memory_sys", m.Sys)
+	b.field("heap_objects", m.HeapObjects)
+	b.field("gc_runs", m.NumGC)
+	b.field("gc_pause_total_us", m.PauseTotalNs/1000)
+}
+
+// runtimeInfo renders the detailed Go runtime statistics of DEBUG RUNTIME
+func runtimeInfo(b *infoBuilder) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	b.field("goroutines", runtime.NumGoroutine())
+	b.field("gomaxprocs", runtime.GOMAXPROCS(0))
+	b.field("cgo_calls", runtime.NumCgoCall())
+
+	b.field("heap_alloc", m.HeapAlloc)
+	b.field("heap_inuse", m.HeapInuse)
+	b.field("heap_idle", m.HeapIdle)
+	b.field("heap_released", m.HeapReleased)
+	b.field("heap_sys", m.HeapSys)
+	b.field("heap_objects", m.HeapObjects)
+	b.field("stack_inuse", m.StackInuse)
+	b.field("sys", m.Sys)
+	b.field("total_alloc", m.TotalAlloc)
+	b.field("mallocs", m.Mallocs)
+	b.field("frees", m.Frees)
+
+	b.field("gc_runs", m.NumGC)
+	b.field("gc_forced", m.NumForcedGC)
+	b.field("gc_next_target", m.NextGC)
+	b.field("gc_cpu_fraction", strconv.FormatFloat(m.GCCPUFraction, 'f', 6, 64))
+	b.field("gc_pause_total_us", m.PauseTotalNs/1000)
+	lastGC := int64(0)
+	if m.LastGC > 0 {
+		lastGC = time.Unix(0, int64(m.LastGC)).Unix()
+	}
+	b.field("gc_last_time", lastGC)
+	if m.NumGC > 0 {
+		b.field("gc_last_pause_us", m.PauseNs[(m.NumGC+255)%256]/1000)
+	}
+}
+
+// persistenceInfo renders the persistence section
+func persistenceInfo(h *Handler, b *infoBuilder) {
+	stats := h.DB.PersistenceStats()
+
+	lastSave := int64(0)
+	if !stats.LastSnapshot.IsZero() {
+		lastSave = stats.LastSnapshot.Unix()
+	}
+
+	oldestUnsaved := int64(0)
+	if !stats.OldestUnsavedChange.IsZero() {
+		oldestUnsaved = time.Since(stats.OldestUnsavedChange).Milliseconds()
+	}
+
+	load := h.DB.LoadProgress()
+	if load.Loading {
+		b.field("loading", 1)
+		b.field("loading_phase", load.Phase)
+		b.field("loading_start_time", load.Started.Unix())
+		b.field("loading_loaded_bytes", load.BytesDone)
+		b.field("loading_total_bytes", load.BytesTotal)
+		b.field("loading_loaded_perc", strconv.FormatFloat(load.Percent(), 'f', 2, 64))
+		b.field("loading_entries", load.Keys)
+		b.field("loading_eta_seconds", int64(load.ETA().Seconds()))
+	} else {
+		b.field("loading", 0)
+		b.field("last_load_duration_ms", load.Duration.Milliseconds())
+	}
+
+	b.field("save_rules", db.FormatSaveRules(h.DB.SaveRules()))
+	b.field("changes_since_last_save", stats.UnsavedChanges)
+	b.field("oldest_unsaved_change_ms", oldestUnsaved)
+	b.field("total_changes", stats.Changes)
+	b.field("last_persist_lag_ms", stats.LastPersistLag.Milliseconds())
+	b.field("writes_throttled", stats.WritesThrottled)
+	b.field("write_throttle_time_ms", stats.ThrottleTime.Milliseconds())
+	bgsaving := 0
+	if h.DB.BGSaveInProgress() {
+		bgsaving = 1
+	}
+	b.field("bgsave_in_progress", bgsaving)
+	b.field("snapshots", stats.Snapshots)
+	b.field("snapshot_failures", stats.SnapshotFailures)
+	b.field("last_snapshot_time", lastSave)
+	b.field("last_snapshot_duration_us", stats.LastSnapshotDuration.Microseconds())
+	b.field("total_snapshot_duration_us", stats.TotalSnapshotDuration.Microseconds())
+	b.field("last_snapshot_bytes", stats.LastSnapshotBytes)
+	b.field("snapshot_bytes_written", stats.SnapshotBytesWritten)
+	b.field("journal_writes", stats.JournalWrites)
+	b.field("cold_values", stats.ColdValues)
+	b.field("cold_values_loaded", stats.ColdValuesLoaded)
+	b.field("last_snapshot_status", persistenceStatus(stats.LastSnapshotError))
+	if stats.LastSnapshotError != nil {
+		b.field("last_snapshot_error", stats.LastSnapshotError)
+	}
+
+	aofEnabled := 0
+	if stats.AOFEnabled {
+		aofEnabled = 1
+	}
+	b.field("aof_enabled", aofEnabled)
+	b.field("aof_buffer_size", stats.AOFBufferSize)
+	b.field("aof_segments", stats.AOFSegments)
+	b.field("aof_bytes_written", stats.AOFBytesWritten)
+	b.field("aof_fsyncs", stats.Fsyncs)
+	b.field("aof_fsync_failures", stats.FsyncFailures)
+	b.field("aof_last_fsync_latency_us", stats.LastFsyncLatency.Microseconds())
+	b.field("aof_total_fsync_latency_us", stats.TotalFsyncLatency.Microseconds())
+	b.field("aof_group_commit_writes", stats.GroupCommitWrites)
+	b.field("aof_last_fsync_status", persistenceStatus(stats.LastFsyncError))
+	if stats.LastFsyncError != nil {
+		b.field("aof_last_fsync_error", stats.LastFsyncError)
+	}
+}
+
+// replicationInfo renders the replication section with the fields of
+// Redis, so existing tools and alerts on replica lag can read it. A
+// replica's lag is the seconds since it last acknowledged the stream.
+func replicationInfo(h *Handler, b *infoBuilder) {
+	status := h.ReplicationStatus()
+	now := time.Now()
+
+	if status.Master == "" {
+		b.field("role", "master")
+	} else {
+		host, port, _ := net.SplitHostPort(status.Master)
+		b.field("role", "slave")
+		b.field("master_host", host)
+		b.field("master_port", port)
+		linkStatus := "down"
+		if status.LinkUp() {
+			linkStatus = "up"
+		}
+		b.field("master_link_status", linkStatus)
+		lastIO := int64(-1)
+		if !status.LastIO.IsZero() {
+			lastIO = int64(now.Sub(status.LastIO).Seconds())
+		}
+		b.field("master_last_io_seconds_ago", lastIO)
+		syncing := 0
+		if status.LinkState == linkSyncing {
+			syncing = 1
+		}
+		b.field("master_sync_in_progress", syncing)
+		b.field("slave_repl_offset", status.Stream.Offset)
+		if !status.DownSince.IsZero() {
+			b.field("master_link_down_since_seconds", int64(now.Sub(status.DownSince).Seconds()))
+		}
+		b.field("slave_read_only", 1)
+	}
+
+	b.field("connected_slaves", len(status.Replicas))
+	for i, r := range status.Replicas {
+		b.field(fmt.Sprintf("slave%d", i), fmt.Sprintf("ip=%s,port=%d,state=online,offset=%d,lag=%d",
+			r.Host, r.Port, r.Acked, int64(now.Sub(r.LastAck).Seconds())))
+	}
+
+	stream := status.Stream
+	b.field("master_replid", stream.ID)
+	replid2, secondOffset := "0000000000000000000000000000000000000000", int64(-1)
+	if stream.PrevID != "" {
+		replid2, secondOffset = stream.PrevID, stream.PrevEnd+1
+	}
+	b.field("master_replid2", replid2)
+	b.field("master_repl_offset", stream.Offset)
+	b.field("second_repl_offset", secondOffset)
+	b.field("repl_stream_commands", stream.Commands)
+	backlogActive := 0
+	if stream.BacklogActive {
+		backlogActive = 1
+	}
+	b.field("repl_backlog_active", backlogActive)
+	b.field("repl_backlog_size", stream.BacklogSize)
+	b.field("repl_backlog_first_byte_offset", stream.BacklogFirst+1)
+	b.field("repl_backlog_histlen", stream.BacklogHeld)
+}
+
+// persistenceStatus renders the outcome of the last persistence attempt
+func persistenceStatus(err error) string {
+	if err != nil {
+		return "err"
+	}
+	return "ok"
+}
+
+// keyspaceInfo renders the keyspace section. The db0 line follows the
+// Redis format so existing tools can read it; the type lines break the
+// keyspace down with estimated memory per type.
+func keyspaceInfo(h *Handler, b *infoBuilder) {
+	// the loader holds the keyspace lock
+	if h.DB.Loading() {
+		return
+	}
+	stats := h.DB.KeyspaceStats()
+
+	if stats.Keys > 0 {
+		b.field("db0", fmt.Sprintf("keys=%d,expires=%d,avg_ttl=%d",
+			stats.Keys, stats.Expires, stats.AvgTTL.Milliseconds()))
+	}
+	for _, ts := range stats.Types {
+		b.field("type_"+ts.Type.String(), fmt.Sprintf("keys=%d,memory=%d", ts.Keys, ts.Memory))
+	}
+}
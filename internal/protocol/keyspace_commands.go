@@ -0,0 +1,567 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+)
+
+// registerKeyspaceCommands registers commands that report on keys rather
+// than read or change their values
+func (r *CommandRegistry) registerKeyspaceCommands() {
+	r.Register("KEYS", keysCommand)
+	r.Register("SCAN", scanCommand)
+	r.Register("RANDOMKEY", randomkeyCommand)
+	r.Register("PREFIXGET", prefixgetCommand)
+	r.RegisterWrite("DELPATTERN", delpatternCommand)
+	r.RegisterWrite("EXPIREPATTERN", expirepatternCommand)
+	r.RegisterWrite("RENAMEPATTERN", renamepatternCommand)
+	r.Register("OBJECT", objectCommand)
+	r.Register("MEMORY", memoryCommand)
+	r.Register("KEYSTATS", keystatsCommand)
+	r.Register("IDLEKEYS", idlekeysCommand)
+}
+
+// keysCommand handles the KEYS command.
+// Syntax: KEYS pattern [LIMIT offset count]
+// Lists keys matching a glob-style pattern in key order. Like ALL, the
+// reply is capped and bigger results must be paged with LIMIT.
+// Example: KEYS user:* LIMIT 0 50
+func keysCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("keys")
+	}
+
+	offset, count, errReply := h.parseKeysLimit("keys", args[1:])
+	if errReply != nil {
+		return *errReply
+	}
+
+	keys, total := h.DB.Keys(args[0].Str, offset, h.fetchCount(count))
+	if count < 0 && h.maxKeys > 0 && len(keys) > h.maxKeys {
+		return h.tooManyKeysError("KEYS", "KEYS <pattern> LIMIT <offset> <count>", total)
+	}
+
+	result := make([]resp.Value, len(keys))
+	for i, key := range keys {
+		result[i] = resp.NewBulkString(key)
+	}
+	return resp.NewArray(result)
+}
+
+// randomkeyCommand handles the RANDOMKEY command.
+// Syntax: RANDOMKEY
+// Returns a key picked uniformly at random, or nil if the database is
+// empty.
+// Example: RANDOMKEY
+func randomkeyCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 0 {
+		return wrongArgsError("randomkey")
+	}
+
+	key, ok := h.DB.RandomKey()
+	if !ok {
+		return resp.NewNullBulkString()
+	}
+	return resp.NewBulkString(key)
+}
+
+// defaultScanCount is how many keys SCAN looks at without COUNT
+const defaultScanCount = 10
+
+// scanCommand handles the SCAN command.
+// Syntax: SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+// Iterates the keyspace without holding the server for the whole of it
+// the way ALL and KEYS do. A scan starts with cursor 0 and passes each
+// reply's cursor, a number, back until it is 0 again. Every call looks at
+// about count keys, 10 by default, and returns those matching the pattern
+// and type, so a page may be empty while more keys follow. Keys that
+// exist for the whole scan are returned once.
+// Returns [cursor, [key, ...]].
+// Example: SCAN 0 MATCH user:* COUNT 100
+func scanCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	opts, errReply := h.parseScanArgs("scan", args, true)
+	if errReply != nil {
+		return *errReply
+	}
+	cursor, errReply := parseScanCursor(args[0].Str)
+	if errReply != nil {
+		return *errReply
+	}
+
+	keys, next := h.DB.Scan(cursor, opts.pattern, opts.typeName, opts.count)
+	return scanReply(strconv.FormatUint(next, 10), membersReply(keys))
+}
+
+// scanArgs are the arguments of SCAN and of the commands scanning a
+// collection
+type scanArgs struct {
+	pattern  string
+	typeName string
+	count    int
+}
+
+// parseScanArgs parses the options of "cursor [MATCH pattern] [COUNT
+// count]", plus "[TYPE type]" when withType is set. The cursor is left to
+// the command.
+func (h *Handler) parseScanArgs(cmd string, args []resp.Value, withType bool) (scanArgs, *resp.Value) {
+	fail := func(v resp.Value) (scanArgs, *resp.Value) {
+		return scanArgs{}, &v
+	}
+	if len(args) == 0 || len(args)%2 != 1 {
+		return fail(wrongArgsError(cmd))
+	}
+
+	opts := scanArgs{count: defaultScanCount}
+	for i := 1; i < len(args); i += 2 {
+		switch option := strings.ToUpper(args[i].Str); {
+		case option == "MATCH":
+			opts.pattern = args[i+1].Str
+		case option == "COUNT":
+			n, err := strconv.Atoi(args[i+1].Str)
+			if err != nil || n <= 0 {
+				return fail(resp.NewError("ERR count is not an integer or out of range"))
+			}
+			if h.maxKeys > 0 && n > h.maxKeys {
+				return fail(resp.NewError(fmt.Sprintf("ERR COUNT is above the limit of %d keys per reply", h.maxKeys)))
+			}
+			opts.count = n
+		case option == "TYPE" && withType:
+			opts.typeName = strings.ToLower(args[i+1].Str)
+		default:
+			return fail(resp.NewError("ERR syntax error"))
+		}
+	}
+	return opts, nil
+}
+
+// scanReply is the [cursor, items] reply of the scan commands
+func scanReply(next string, items resp.Value) resp.Value {
+	return resp.NewArray([]resp.Value{resp.NewBulkString(next), items})
+}
+
+// parseScanCursor parses the numeric cursor of the scan commands
+func parseScanCursor(cursor string) (uint64, *resp.Value) {
+	n, err := strconv.ParseUint(cursor, 10, 64)
+	if err != nil {
+		errReply := resp.NewError("ERR invalid cursor")
+		return 0, &errReply
+	}
+	return n, nil
+}
+
+// prefixgetCommand handles the PREFIXGET command.
+// Syntax: PREFIXGET prefix [CURSOR key] [LIMIT count]
+// Returns the keys starting with prefix and their values in key order, as
+// [cursor, [key, value, ...]]. Keys that don't hold strings have nil
+// values. The cursor is empty once every key was returned, else it is
+// passed back with CURSOR to get the next page. Pages hold count keys, by
+// default as many as the key reply cap allows. Prefixes are looked up in a
+// sorted key index, so reads don't scan the keyspace.
+// Example: PREFIXGET config:app: LIMIT 100
+func prefixgetCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 || len(args)%2 != 1 {
+		return wrongArgsError("prefixget")
+	}
+
+	cursor := ""
+	count := -1
+	if h.maxKeys > 0 {
+		count = h.maxKeys
+	}
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i].Str) {
+		case "CURSOR":
+			cursor = args[i+1].Str
+		case "LIMIT":
+			n, err := strconv.Atoi(args[i+1].Str)
+			if err != nil || n <= 0 {
+				return resp.NewError("ERR count is not an integer or out of range")
+			}
+			count = n
+		default:
+			return resp.NewError("ERR syntax error")
+		}
+	}
+
+	entries, next := h.DB.PrefixGet(args[0].Str, cursor, count)
+	pairs := make([]resp.Value, 0, 2*len(entries))
+	for _, e := range entries {
+		value := resp.NewNullBulkString()
+		if str, ok := e.Value.(string); ok {
+			value = resp.NewBulkString(str)
+		}
+		pairs = append(pairs, resp.NewBulkString(e.Key), value)
+	}
+	return resp.NewArray([]resp.Value{resp.NewBulkString(next), resp.NewArray(pairs)})
+}
+
+// delpatternCommand handles the DELPATTERN command.
+// Syntax: DELPATTERN pattern [FORCE]
+// Deletes every key matching a glob pattern, in batches so other clients
+// keep being served. Matching more keys than the server's confirmation
+// limit fails unless FORCE is given.
+// Returns the number of deleted keys.
+// Example: DELPATTERN session:* FORCE
+func delpatternCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 && len(args) != 2 {
+		return wrongArgsError("delpattern")
+	}
+
+	pattern := args[0].Str
+	if errReply := h.confirmBulk("DELPATTERN", "delete", h.patternCount(pattern), args[1:]); errReply != nil {
+		return *errReply
+	}
+
+	return resp.NewInteger(int64(h.DB.DeletePattern(pattern)))
+}
+
+// expirepatternCommand handles the EXPIREPATTERN command.
+// Syntax: EXPIREPATTERN pattern seconds [FORCE]
+// Sets a TTL on every key matching a glob pattern, in batches. Like
+// DELPATTERN, large matches need FORCE.
+// Returns the number of keys that got the TTL.
+// Example: EXPIREPATTERN cache:* 60
+func expirepatternCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 && len(args) != 3 {
+		return wrongArgsError("expirepattern")
+	}
+
+	pattern := args[0].Str
+	seconds, err := strconv.ParseInt(args[1].Str, 10, 64)
+	if err != nil {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+	if errReply := h.confirmBulk("EXPIREPATTERN", "expire", h.patternCount(pattern), args[2:]); errReply != nil {
+		return *errReply
+	}
+
+	return resp.NewInteger(int64(h.DB.ExpirePattern(pattern, time.Duration(seconds)*time.Second)))
+}
+
+// patternCount returns a function counting the keys matching pattern, for
+// confirmBulk
+func (h *Handler) patternCount(pattern string) func() int {
+	return func() int {
+		_, total := h.DB.Keys(pattern, 0, 0)
+		return total
+	}
+}
+
+// renamepatternCommand handles the RENAMEPATTERN command.
+// Syntax: RENAMEPATTERN source destination [NX] [FORCE]
+// Renames every key matching source to destination, where both patterns
+// hold a single * standing for the same part of the name, e.g.
+// "old:*" "new:*". Keys move with their TTL and tags, in batches like
+// DELPATTERN, and large matches need FORCE. Existing keys with the new
+// names are replaced, or left alone with NX, which also keeps the key that
+// would have replaced them.
+// Returns the number of renamed keys.
+// Example: RENAMEPATTERN user:*:cart cart:* NX
+func renamepatternCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 || len(args) > 4 {
+		return wrongArgsError("renamepattern")
+	}
+
+	src, dst := args[0].Str, args[1].Str
+	rest := args[2:]
+	nx := false
+	if len(rest) > 0 && strings.ToUpper(rest[0].Str) == "NX" {
+		nx = true
+		rest = rest[1:]
+	}
+	if len(rest) > 1 {
+		return resp.NewError("ERR syntax error")
+	}
+	if errReply := h.confirmBulk("RENAMEPATTERN", "rename", h.patternCount(src), rest); errReply != nil {
+		return *errReply
+	}
+
+	renamed, err := h.DB.RenamePattern(src, dst, nx)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(renamed))
+}
+
+// confirmBulk checks the optional FORCE argument of a bulk command and
+// refuses to touch more keys than the confirmation limit without it.
+// count returns how many keys the command would touch.
+func (h *Handler) confirmBulk(cmd, verb string, count func() int, args []resp.Value) *resp.Value {
+	force := false
+	if len(args) == 1 {
+		if strings.ToUpper(args[0].Str) != "FORCE" {
+			reply := resp.NewError("ERR syntax error")
+			return &reply
+		}
+		force = true
+	}
+	if force || h.maxBulk <= 0 {
+		return nil
+	}
+
+	if total := count(); total > h.maxBulk {
+		reply := resp.NewError(fmt.Sprintf("ERR %s would %s %d keys, more than the limit of %d. Repeat the command with FORCE to confirm",
+			cmd, verb, total, h.maxBulk))
+		return &reply
+	}
+	return nil
+}
+
+// parseKeysLimit parses the optional "LIMIT offset count" arguments of ALL
+// and KEYS. count is -1 when LIMIT is absent.
+func (h *Handler) parseKeysLimit(cmd string, args []resp.Value) (offset, count int, errReply *resp.Value) {
+	fail := func(v resp.Value) (int, int, *resp.Value) {
+		return 0, 0, &v
+	}
+
+	switch len(args) {
+	case 0:
+		return 0, -1, nil
+	case 3:
+		if strings.ToUpper(args[0].Str) != "LIMIT" {
+			return fail(resp.NewError("ERR syntax error"))
+		}
+	default:
+		return fail(wrongArgsError(cmd))
+	}
+
+	offset, err := strconv.Atoi(args[1].Str)
+	if err != nil || offset < 0 {
+		return fail(resp.NewError("ERR offset is not an integer or out of range"))
+	}
+	count, err = strconv.Atoi(args[2].Str)
+	if err != nil || count < 0 {
+		return fail(resp.NewError("ERR count is not an integer or out of range"))
+	}
+	if h.maxKeys > 0 && count > h.maxKeys {
+		return fail(resp.NewError(fmt.Sprintf("ERR LIMIT count is above the limit of %d keys per reply", h.maxKeys)))
+	}
+
+	return offset, count, nil
+}
+
+// fetchCount returns how many keys to fetch for a LIMIT count. Without
+// LIMIT one key past the cap is enough to know the reply is too big,
+// without copying the rest of the keyspace.
+func (h *Handler) fetchCount(count int) int {
+	if count < 0 && h.maxKeys > 0 {
+		return h.maxKeys + 1
+	}
+	return count
+}
+
+// tooManyKeysError is the reply when an unpaged ALL or KEYS would exceed
+// the key reply cap. usage shows how to page the same request.
+func (h *Handler) tooManyKeysError(cmd, usage string, total int) resp.Value {
+	fmt.Printf("Refused %s returning %d keys, above the limit of %d\n", cmd, total, h.maxKeys)
+	return resp.NewError(fmt.Sprintf("ERR %s would return %d keys, more than the limit of %d. Page through them with %s, or iterate with SCAN",
+		cmd, total, h.maxKeys, usage))
+}
+
+var objectHelp = []string{
+	"OBJECT <subcommand> [<arg> ...]. Subcommands are:",
+	"ENCODING <key>",
+	"    Return the internal representation of the key's value.",
+	"FREQ <key>",
+	"    Return the number of times the key was accessed. Needs --track-access.",
+	"IDLETIME <key>",
+	"    Return the seconds since the key was last accessed. Needs --track-access.",
+	"HELP",
+	"    Print this help.",
+}
+
+// objectCommand handles the OBJECT command.
+// Syntax: OBJECT subcommand [key]
+// Inspects a key without counting as an access to it.
+// Example: OBJECT IDLETIME session:42
+func objectCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("object")
+	}
+
+	name := args[0].Str
+	switch strings.ToUpper(name) {
+	case "HELP":
+		lines := make([]resp.Value, len(objectHelp))
+		for i, line := range objectHelp {
+			lines[i] = resp.NewSimpleString(line)
+		}
+		return resp.NewArray(lines)
+
+	case "ENCODING":
+		if len(args) != 2 {
+			return wrongArgsError("object|encoding")
+		}
+		encoding, err := h.DB.Encoding(args[1].Str)
+		if errors.Is(err, db.ErrKeyNotFound) {
+			return resp.NewNullBulkString()
+		} else if err != nil {
+			return errorReply(err)
+		}
+		return resp.NewBulkString(encoding)
+
+	case "FREQ":
+		if len(args) != 2 {
+			return wrongArgsError("object|freq")
+		}
+		access, err := h.DB.KeyAccess(args[1].Str)
+		if errors.Is(err, db.ErrKeyNotFound) {
+			return resp.NewNullBulkString()
+		} else if err != nil {
+			return errorReply(err)
+		}
+		return resp.NewInteger(int64(access.Hits))
+
+	case "IDLETIME":
+		if len(args) != 2 {
+			return wrongArgsError("object|idletime")
+		}
+		access, err := h.DB.KeyAccess(args[1].Str)
+		if errors.Is(err, db.ErrKeyNotFound) {
+			return resp.NewNullBulkString()
+		} else if err != nil {
+			return errorReply(err)
+		}
+		return resp.NewInteger(int64(time.Since(access.LastAccess).Seconds()))
+
+	default:
+		return resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try OBJECT HELP.", name))
+	}
+}
+
+var memoryHelp = []string{
+	"MEMORY <subcommand> [<arg> ...]. Subcommands are:",
+	"USAGE <key>",
+	"    Return the estimated bytes the key and its value take in memory.",
+	"HELP",
+	"    Print this help.",
+}
+
+// memoryCommand handles the MEMORY command.
+// Syntax: MEMORY USAGE key
+// Estimates the memory a key and its value take, counting payloads and
+// headers but not allocator slack, to compare keys rather than to add up
+// to the process size.
+// Returns the size in bytes, or nil if the key doesn't exist.
+// Example: MEMORY USAGE cache:home
+func memoryCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("memory")
+	}
+
+	name := args[0].Str
+	switch strings.ToUpper(name) {
+	case "HELP":
+		lines := make([]resp.Value, len(memoryHelp))
+		for i, line := range memoryHelp {
+			lines[i] = resp.NewSimpleString(line)
+		}
+		return resp.NewArray(lines)
+
+	case "USAGE":
+		if len(args) != 2 {
+			return wrongArgsError("memory|usage")
+		}
+		size, err := h.DB.MemoryUsage(args[1].Str)
+		if errors.Is(err, db.ErrKeyNotFound) {
+			return resp.NewNullBulkString()
+		} else if err != nil {
+			return errorReply(err)
+		}
+		return resp.NewInteger(size)
+
+	default:
+		return resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try MEMORY HELP.", name))
+	}
+}
+
+// keystatsCommand handles the KEYSTATS command.
+// Syntax: KEYSTATS [COUNT n]
+// Dumps the access statistics of every key, most frequently used first.
+// Each entry is an array of key, hit count and idle seconds.
+// Example: KEYSTATS COUNT 10
+func keystatsCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	count := -1
+	switch len(args) {
+	case 0:
+	case 2:
+		if strings.ToUpper(args[0].Str) != "COUNT" {
+			return resp.NewError("ERR syntax error")
+		}
+		n, err := strconv.Atoi(args[1].Str)
+		if err != nil || n < 0 {
+			return resp.NewError("ERR value is not an integer or out of range")
+		}
+		count = n
+	default:
+		return wrongArgsError("keystats")
+	}
+
+	stats, err := h.DB.AccessStats()
+	if err != nil {
+		return errorReply(err)
+	}
+	if count >= 0 && count < len(stats) {
+		stats = stats[:count]
+	}
+
+	return accessReply(stats)
+}
+
+// idlekeysCommand handles the IDLEKEYS command.
+// Syntax: IDLEKEYS days [COUNT n]
+// Lists keys that have not been read or written for at least the given
+// number of days, least recently used first, to find data that can be
+// archived or deleted. Days may be fractional.
+// Each entry is an array of key, hit count and idle seconds.
+// Example: IDLEKEYS 30 COUNT 100
+func idlekeysCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 && len(args) != 3 {
+		return wrongArgsError("idlekeys")
+	}
+
+	days, err := strconv.ParseFloat(args[0].Str, 64)
+	if err != nil || days < 0 {
+		return resp.NewError("ERR days is not a valid number")
+	}
+
+	count := -1
+	if len(args) == 3 {
+		if strings.ToUpper(args[1].Str) != "COUNT" {
+			return resp.NewError("ERR syntax error")
+		}
+		count, err = strconv.Atoi(args[2].Str)
+		if err != nil || count < 0 {
+			return resp.NewError("ERR value is not an integer or out of range")
+		}
+	}
+
+	keys, err := h.DB.IdleKeys(time.Duration(days * float64(24*time.Hour)))
+	if err != nil {
+		return errorReply(err)
+	}
+	if count >= 0 && count < len(keys) {
+		keys = keys[:count]
+	}
+
+	return accessReply(keys)
+}
+
+// accessReply formats access statistics as [key, hits, idle seconds] entries
+func accessReply(stats []db.KeyAccess) resp.Value {
+	entries := make([]resp.Value, len(stats))
+	for i, s := range stats {
+		entries[i] = resp.NewArray([]resp.Value{
+			resp.NewBulkString(s.Key),
+			resp.NewInteger(int64(s.Hits)),
+			resp.NewInteger(int64(time.Since(s.LastAccess).Seconds())),
+		})
+	}
+	return resp.NewArray(entries)
+}
@@ -0,0 +1,133 @@
+package protocol
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+)
+
+// newTestHandler returns a handler over an empty database in a temporary
+// directory and an authenticated client of it
+func newTestHandler(t *testing.T) (*Handler, *Client) {
+	t.Helper()
+	database, err := db.NewFlexDB(filepath.Join(t.TempDir(), "flex.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return NewHandler(database), &Client{Protocol: RESPProtocol, Authenticated: true, RespVersion: 2}
+}
+
+// run executes a command for c the way a connection would
+func run(h *Handler, c *Client, cmd string, args ...string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+	return h.executeCommand(c, cmd, values)
+}
+
+func TestScanPages(t *testing.T) {
+	h, c := newTestHandler(t)
+	const total = 250
+	for i := 0; i < total; i++ {
+		run(h, c, "SET", fmt.Sprintf("key:%d", i), "v")
+	}
+
+	seen := make(map[string]bool)
+	cursor := "0"
+	for pages := 0; ; pages++ {
+		if pages > total {
+			t.Fatal("the scan doesn't end")
+		}
+		reply := run(h, c, "SCAN", cursor, "COUNT", "7")
+		if reply.Type == resp.Error || len(reply.Array) != 2 {
+			t.Fatalf("SCAN %s: %+v", cursor, reply)
+		}
+		cursor = reply.Array[0].Str
+		if _, err := strconv.ParseUint(cursor, 10, 64); err != nil {
+			t.Fatalf("cursor %q isn't an integer", cursor)
+		}
+		for _, key := range reply.Array[1].Array {
+			seen[key.Str] = true
+		}
+
+		// keys deleted or created midway must not make the scan skip others
+		if pages == 3 {
+			for i := 0; i < 20; i++ {
+				run(h, c, "DEL", fmt.Sprintf("key:%d", i))
+				run(h, c, "SET", fmt.Sprintf("new:%d", i), "v")
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+
+	for i := 20; i < total; i++ {
+		if key := fmt.Sprintf("key:%d", i); !seen[key] {
+			t.Errorf("the scan skipped %s", key)
+		}
+	}
+}
+
+func TestScanInvalidCursor(t *testing.T) {
+	h, c := newTestHandler(t)
+	for _, cursor := range []string{"abc", "-1", "1.5"} {
+		reply := run(h, c, "SCAN", cursor)
+		if reply.Type != resp.Error || reply.Str != "ERR invalid cursor" {
+			t.Errorf("SCAN %s: got %+v", cursor, reply)
+		}
+	}
+}
+
+func TestCollectionScanPages(t *testing.T) {
+	h, c := newTestHandler(t)
+	const total = 100
+	for i := 0; i < total; i++ {
+		name := fmt.Sprintf("m%d", i)
+		run(h, c, "HSET", "h", name, "v")
+		run(h, c, "SADD", "s", name)
+		run(h, c, "ZADD", "z", strconv.Itoa(i), name)
+	}
+
+	tests := []struct {
+		cmd, key string
+		step     int // items per name in the reply
+	}{
+		{"HSCAN", "h", 2},
+		{"SSCAN", "s", 1},
+		{"ZSCAN", "z", 2},
+	}
+	for _, tt := range tests {
+		seen := make(map[string]bool)
+		cursor := "0"
+		for pages := 0; ; pages++ {
+			if pages > total {
+				t.Fatalf("%s doesn't end", tt.cmd)
+			}
+			reply := run(h, c, tt.cmd, tt.key, cursor, "COUNT", "9")
+			if reply.Type == resp.Error || len(reply.Array) != 2 {
+				t.Fatalf("%s %s: %+v", tt.cmd, cursor, reply)
+			}
+			cursor = reply.Array[0].Str
+			if _, err := strconv.ParseUint(cursor, 10, 64); err != nil {
+				t.Fatalf("%s cursor %q isn't an integer", tt.cmd, cursor)
+			}
+			items := reply.Array[1].Array
+			for i := 0; i < len(items); i += tt.step {
+				seen[items[i].Str] = true
+			}
+			if cursor == "0" {
+				break
+			}
+		}
+		if len(seen) != total {
+			t.Errorf("%s returned %d of %d names", tt.cmd, len(seen), total)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+	"flex-db/internal/utils"
+)
+
+// registerLeaseCommands registers the LEASE command family
+func (r *CommandRegistry) registerLeaseCommands() {
+	r.Register("LEASE", leaseCommand)
+}
+
+var leaseHelp = []string{
+	"LEASE <subcommand> [<arg> ...]. Subcommands are:",
+	"GRANT <name> <ms> [OWNER <owner>]",
+	"    Take the lease for <ms> milliseconds if nobody holds it. Returns its id, or nil.",
+	"KEEPALIVE <name> <id>",
+	"    Restart the lease TTL. Returns the TTL in milliseconds, or 0 if <id> doesn't hold it.",
+	"REVOKE <name> <id>",
+	"    End the lease. Returns 1, or 0 if <id> doesn't hold it.",
+	"GET <name>",
+	"    Show the id, owner and remaining TTL of the lease, or nil.",
+	"LIST [<pattern>]",
+	"    List the names of the held leases.",
+	"WATCH <name> [<timeout-ms>]",
+	"    Wait for the lease to be granted, revoked or to expire. Returns the event, or nil on timeout.",
+	"HELP",
+	"    Print this help.",
+}
+
+// leaseCommand handles the LEASE command.
+// Syntax: LEASE subcommand [arg ...]
+// Leases are in-memory claims with a TTL that their holder keeps alive,
+// for service registration and leader election. They are not persisted.
+// Example: LEASE GRANT leader 10000 OWNER node-1
+func leaseCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("lease")
+	}
+
+	name := args[0].Str
+	subcommand := strings.ToUpper(name)
+	args = args[1:]
+
+	switch subcommand {
+	case "HELP":
+		lines := make([]resp.Value, len(leaseHelp))
+		for i, line := range leaseHelp {
+			lines[i] = resp.NewSimpleString(line)
+		}
+		return resp.NewArray(lines)
+
+	case "GRANT":
+		if len(args) != 2 && len(args) != 4 {
+			return wrongArgsError("lease|grant")
+		}
+		ttl, ok := parseLockTTL(args[1].Str)
+		if !ok {
+			return resp.NewError("ERR invalid expire time in 'lease|grant' command")
+		}
+		owner := ""
+		if len(args) == 4 {
+			if strings.ToUpper(args[2].Str) != "OWNER" {
+				return resp.NewError("ERR syntax error")
+			}
+			owner = args[3].Str
+		}
+		lease, granted := h.DB.GrantLease(args[0].Str, owner, ttl)
+		if !granted {
+			return resp.NewNullBulkString()
+		}
+		return resp.NewBulkString(lease.ID)
+
+	case "KEEPALIVE":
+		if len(args) != 2 {
+			return wrongArgsError("lease|keepalive")
+		}
+		lease, ok := h.DB.KeepAlive(args[0].Str, args[1].Str)
+		if !ok {
+			return resp.NewInteger(0)
+		}
+		return resp.NewInteger(lease.TTL.Milliseconds())
+
+	case "REVOKE":
+		if len(args) != 2 {
+			return wrongArgsError("lease|revoke")
+		}
+		if h.DB.RevokeLease(args[0].Str, args[1].Str) {
+			return resp.NewInteger(1)
+		}
+		return resp.NewInteger(0)
+
+	case "GET":
+		if len(args) != 1 {
+			return wrongArgsError("lease|get")
+		}
+		lease, ok := h.DB.GetLease(args[0].Str)
+		if !ok {
+			return resp.NewNullBulkString()
+		}
+		return resp.NewArray([]resp.Value{
+			resp.NewBulkString("id"), resp.NewBulkString(lease.ID),
+			resp.NewBulkString("owner"), resp.NewBulkString(lease.Owner),
+			resp.NewBulkString("ttl"), resp.NewInteger(time.Until(lease.Expires).Milliseconds()),
+		})
+
+	case "LIST":
+		if len(args) > 1 {
+			return wrongArgsError("lease|list")
+		}
+		pattern := "*"
+		if len(args) == 1 {
+			pattern = args[0].Str
+		}
+		leases := h.DB.Leases(pattern)
+		names := make([]resp.Value, len(leases))
+		for i, lease := range leases {
+			names[i] = resp.NewBulkString(lease.Name)
+		}
+		return resp.NewArray(names)
+
+	case "WATCH":
+		if len(args) != 1 && len(args) != 2 {
+			return wrongArgsError("lease|watch")
+		}
+		var timeout time.Duration
+		if len(args) == 2 {
+			ms, err := utils.ParseInt(args[1].Str)
+			if err != nil || ms < 0 {
+				return resp.NewError("ERR timeout is not an integer or out of range")
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+		}
+
+		ctx, cancel := h.blockingContext(c, timeout)
+		defer cancel()
+		event, err := h.DB.WatchLease(ctx, args[0].Str)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return resp.NewNullBulkString()
+		}
+		if errors.Is(err, context.Canceled) {
+			err = db.ErrShuttingDown
+		}
+		if err != nil {
+			return errorReply(err)
+		}
+		return resp.NewArray([]resp.Value{
+			resp.NewBulkString(event.Type),
+			resp.NewBulkString(event.Lease.Name),
+			resp.NewBulkString(event.Lease.ID),
+			resp.NewBulkString(event.Lease.Owner),
+		})
+
+	default:
+		return resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try LEASE HELP.", name))
+	}
+}
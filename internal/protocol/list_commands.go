@@ -1,24 +1,36 @@
 package protocol
 
 import (
+	"context"
+	"errors"
+	"flex-db/internal/db"
 	"flex-db/internal/resp"
-	"fmt"
+	"math"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // registerListCommands registers all list-related commands in the command registry.
-// This includes LPUSH, RPUSH, LPOP, RPOP, LRANGE, LLEN, LINDEX, LSET, LREM, and LTRIM.
+// This includes LPUSH, RPUSH, LPUSHCAP, RPUSHCAP, LPOP, RPOP, LRANGE, LLEN, LINDEX, LSET, LINSERT, LMOVE, RPOPLPUSH, BLMOVE, BRPOPLPUSH, LREM, and LTRIM.
 func (r *CommandRegistry) registerListCommands() {
-	r.Register("LPUSH", lpushCommand)
-	r.Register("RPUSH", rpushCommand)
-	r.Register("LPOP", lpopCommand)
-	r.Register("RPOP", rpopCommand)
+	r.RegisterWrite("LPUSH", lpushCommand)
+	r.RegisterWrite("RPUSH", rpushCommand)
+	r.RegisterWrite("LPUSHCAP", lpushcapCommand)
+	r.RegisterWrite("RPUSHCAP", rpushcapCommand)
+	r.RegisterWrite("LPOP", lpopCommand)
+	r.RegisterWrite("RPOP", rpopCommand)
 	r.Register("LRANGE", lrangeCommand)
 	r.Register("LLEN", llenCommand)
 	r.Register("LINDEX", lindexCommand)
-	r.Register("LSET", lsetCommand)
-	r.Register("LREM", lremCommand)
-	r.Register("LTRIM", ltrimCommand)
+	r.RegisterWrite("LSET", lsetCommand)
+	r.RegisterWrite("LINSERT", linsertCommand)
+	r.RegisterWrite("LMOVE", lmoveCommand)
+	r.RegisterWrite("RPOPLPUSH", rpoplpushCommand)
+	r.RegisterWrite("BLMOVE", blmoveCommand)
+	r.RegisterWrite("BRPOPLPUSH", brpoplpushCommand)
+	r.RegisterWrite("LREM", lremCommand)
+	r.RegisterWrite("LTRIM", ltrimCommand)
 }
 
 // lpushCommand handles the LPUSH command.
@@ -26,7 +38,7 @@ func (r *CommandRegistry) registerListCommands() {
 // Inserts values at the beginning of a list.
 // Returns the length of the list after the operation.
 // Example: LPUSH mylist "world" "hello"
-func lpushCommand(h *Handler, args []resp.Value) resp.Value {
+func lpushCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) < 2 {
 		return resp.NewError("ERR wrong number of arguments for 'lpush' command")
 	}
@@ -39,7 +51,7 @@ func lpushCommand(h *Handler, args []resp.Value) resp.Value {
 
 	length, err := h.DB.LPush(key, values...)
 	if err != nil {
-		return resp.NewError(fmt.Sprintf("ERR %v", err))
+		return errorReply(err)
 	}
 
 	return resp.NewInteger(int64(length))
@@ -50,7 +62,7 @@ func lpushCommand(h *Handler, args []resp.Value) resp.Value {
 // Appends values to the end of a list.
 // Returns the length of the list after the operation.
 // Example: RPUSH mylist "hello" "world"
-func rpushCommand(h *Handler, args []resp.Value) resp.Value {
+func rpushCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) < 2 {
 		return resp.NewError("ERR wrong number of arguments for 'rpush' command")
 	}
@@ -63,7 +75,51 @@ func rpushCommand(h *Handler, args []resp.Value) resp.Value {
 
 	length, err := h.DB.RPush(key, values...)
 	if err != nil {
-		return resp.NewError(fmt.Sprintf("ERR %v", err))
+		return errorReply(err)
+	}
+
+	return resp.NewInteger(int64(length))
+}
+
+// lpushcapCommand handles the LPUSHCAP command.
+// Syntax: LPUSHCAP key maxlen value [value ...]
+// Inserts values at the beginning of a list and trims elements from the
+// tail so the list never holds more than maxlen, e.g. for recent-N feeds.
+// Returns the length of the list after the operation.
+// Example: LPUSHCAP feed 100 "event"
+func lpushcapCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	return pushCapped(h, "lpushcap", args, h.DB.LPushCapped)
+}
+
+// rpushcapCommand handles the RPUSHCAP command.
+// Syntax: RPUSHCAP key maxlen value [value ...]
+// Appends values to the end of a list and trims elements from the head
+// so the list never holds more than maxlen.
+// Returns the length of the list after the operation.
+// Example: RPUSHCAP log 1000 "line"
+func rpushcapCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	return pushCapped(h, "rpushcap", args, h.DB.RPushCapped)
+}
+
+// pushCapped parses the arguments shared by LPUSHCAP and RPUSHCAP
+func pushCapped(h *Handler, name string, args []resp.Value, push func(string, int, ...string) (int, error)) resp.Value {
+	if len(args) < 3 {
+		return wrongArgsError(name)
+	}
+
+	maxLen, err := strconv.Atoi(args[1].Str)
+	if err != nil || maxLen <= 0 {
+		return resp.NewError("ERR maxlen must be a positive integer")
+	}
+
+	values := make([]string, len(args)-2)
+	for i := 2; i < len(args); i++ {
+		values[i-2] = args[i].Str
+	}
+
+	length, err := push(args[0].Str, maxLen, values...)
+	if err != nil {
+		return errorReply(err)
 	}
 
 	return resp.NewInteger(int64(length))
@@ -74,7 +130,7 @@ func rpushCommand(h *Handler, args []resp.Value) resp.Value {
 // Removes and returns the first element of a list.
 // Returns nil if the key doesn't exist or the list is empty.
 // Example: LPOP mylist
-func lpopCommand(h *Handler, args []resp.Value) resp.Value {
+func lpopCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) != 1 {
 		return resp.NewError("ERR wrong number of arguments for 'lpop' command")
 	}
@@ -82,7 +138,7 @@ func lpopCommand(h *Handler, args []resp.Value) resp.Value {
 	key := args[0].Str
 	value, err := h.DB.LPop(key)
 	if err != nil {
-		return resp.NewNullBulkString()
+		return nullOrErrorReply(err)
 	}
 
 	return resp.NewBulkString(value)
@@ -93,7 +149,7 @@ func lpopCommand(h *Handler, args []resp.Value) resp.Value {
 // Removes and returns the last element of a list.
 // Returns nil if the key doesn't exist or the list is empty.
 // Example: RPOP mylist
-func rpopCommand(h *Handler, args []resp.Value) resp.Value {
+func rpopCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) != 1 {
 		return resp.NewError("ERR wrong number of arguments for 'rpop' command")
 	}
@@ -101,7 +157,7 @@ func rpopCommand(h *Handler, args []resp.Value) resp.Value {
 	key := args[0].Str
 	value, err := h.DB.RPop(key)
 	if err != nil {
-		return resp.NewNullBulkString()
+		return nullOrErrorReply(err)
 	}
 
 	return resp.NewBulkString(value)
@@ -112,7 +168,7 @@ func rpopCommand(h *Handler, args []resp.Value) resp.Value {
 // Returns a range of elements from a list.
 // Start and stop are zero-based indices. Negative indices count from the end.
 // Example: LRANGE mylist 0 -1
-func lrangeCommand(h *Handler, args []resp.Value) resp.Value {
+func lrangeCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) != 3 {
 		return resp.NewError("ERR wrong number of arguments for 'lrange' command")
 	}
@@ -130,7 +186,7 @@ func lrangeCommand(h *Handler, args []resp.Value) resp.Value {
 
 	values, err := h.DB.LRange(key, start, stop)
 	if err != nil {
-		return resp.NewError(fmt.Sprintf("ERR %v", err))
+		return errorReply(err)
 	}
 
 	result := resp.Value{
@@ -150,7 +206,7 @@ func lrangeCommand(h *Handler, args []resp.Value) resp.Value {
 // Returns the length of a list.
 // Returns 0 if the key doesn't exist.
 // Example: LLEN mylist
-func llenCommand(h *Handler, args []resp.Value) resp.Value {
+func llenCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) != 1 {
 		return resp.NewError("ERR wrong number of arguments for 'llen' command")
 	}
@@ -158,7 +214,7 @@ func llenCommand(h *Handler, args []resp.Value) resp.Value {
 	key := args[0].Str
 	length, err := h.DB.LLen(key)
 	if err != nil {
-		return resp.NewError(fmt.Sprintf("ERR %v", err))
+		return errorReply(err)
 	}
 
 	return resp.NewInteger(int64(length))
@@ -169,7 +225,7 @@ func llenCommand(h *Handler, args []resp.Value) resp.Value {
 // Returns the element at the specified index in a list.
 // Returns nil if the key doesn't exist or the index is out of range.
 // Example: LINDEX mylist 0
-func lindexCommand(h *Handler, args []resp.Value) resp.Value {
+func lindexCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) != 2 {
 		return resp.NewError("ERR wrong number of arguments for 'lindex' command")
 	}
@@ -182,7 +238,7 @@ func lindexCommand(h *Handler, args []resp.Value) resp.Value {
 
 	value, err := h.DB.LIndex(key, index)
 	if err != nil {
-		return resp.NewNullBulkString()
+		return nullOrErrorReply(err)
 	}
 
 	return resp.NewBulkString(value)
@@ -193,7 +249,7 @@ func lindexCommand(h *Handler, args []resp.Value) resp.Value {
 // Sets the value of an element at the specified index in a list.
 // Returns an error if the key doesn't exist or the index is out of range.
 // Example: LSET mylist 0 "new"
-func lsetCommand(h *Handler, args []resp.Value) resp.Value {
+func lsetCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) != 3 {
 		return resp.NewError("ERR wrong number of arguments for 'lset' command")
 	}
@@ -208,18 +264,171 @@ func lsetCommand(h *Handler, args []resp.Value) resp.Value {
 
 	err = h.DB.LSet(key, index, value)
 	if err != nil {
-		return resp.NewError(fmt.Sprintf("ERR %v", err))
+		return errorReply(err)
 	}
 
 	return resp.NewSimpleString("OK")
 }
 
+// linsertCommand handles the LINSERT command.
+// Syntax: LINSERT key BEFORE|AFTER pivot value
+// Inserts value before or after the first element equal to pivot.
+// Returns the length of the list after the operation, -1 if pivot isn't
+// in the list, or 0 if the key doesn't exist.
+// Example: LINSERT queue BEFORE "job:9" "job:8"
+func linsertCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 4 {
+		return wrongArgsError("linsert")
+	}
+
+	var before bool
+	switch strings.ToUpper(args[1].Str) {
+	case "BEFORE":
+		before = true
+	case "AFTER":
+	default:
+		return resp.NewError("ERR syntax error")
+	}
+
+	length, err := h.DB.LInsert(args[0].Str, before, args[2].Str, args[3].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(length))
+}
+
+// lmoveCommand handles the LMOVE command.
+// Syntax: LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+// Atomically pops an element from one end of source and pushes it to one
+// end of destination, so a consumer can take a job from a pending list
+// into its processing list without a window where the job is in neither.
+// source and destination may be the same list, which rotates it.
+// Returns the moved element, or nil if source doesn't exist.
+// Example: LMOVE jobs:pending jobs:processing RIGHT LEFT
+func lmoveCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 4 {
+		return wrongArgsError("lmove")
+	}
+	fromLeft, ok1 := parseListEnd(args[2].Str)
+	toLeft, ok2 := parseListEnd(args[3].Str)
+	if !ok1 || !ok2 {
+		return resp.NewError("ERR syntax error")
+	}
+	return lmoveReply(h, args[0].Str, args[1].Str, fromLeft, toLeft)
+}
+
+// rpoplpushCommand handles the RPOPLPUSH command.
+// Syntax: RPOPLPUSH source destination
+// Same as LMOVE source destination RIGHT LEFT.
+// Example: RPOPLPUSH jobs:pending jobs:processing
+func rpoplpushCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("rpoplpush")
+	}
+	return lmoveReply(h, args[0].Str, args[1].Str, false, true)
+}
+
+// blmoveCommand handles the BLMOVE command.
+// Syntax: BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+// LMOVE waiting up to timeout seconds, 0 meaning forever, for source to
+// get an element, so consumers can block for work and move it into their
+// processing list in one call.
+// Returns the moved element, or nil on timeout.
+// Example: BLMOVE jobs:pending jobs:processing RIGHT LEFT 5
+func blmoveCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 5 {
+		return wrongArgsError("blmove")
+	}
+	fromLeft, ok1 := parseListEnd(args[2].Str)
+	toLeft, ok2 := parseListEnd(args[3].Str)
+	if !ok1 || !ok2 {
+		return resp.NewError("ERR syntax error")
+	}
+	return blmoveReply(h, c, args[0].Str, args[1].Str, fromLeft, toLeft, args[4].Str)
+}
+
+// brpoplpushCommand handles the BRPOPLPUSH command.
+// Syntax: BRPOPLPUSH source destination timeout
+// Same as BLMOVE source destination RIGHT LEFT timeout.
+// Example: BRPOPLPUSH jobs:pending jobs:processing 0
+func brpoplpushCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 3 {
+		return wrongArgsError("brpoplpush")
+	}
+	return blmoveReply(h, c, args[0].Str, args[1].Str, false, true, args[2].Str)
+}
+
+// blmoveReply waits for an element to move between lists and replies with
+// it, or with nil once timeout seconds passed
+func blmoveReply(h *Handler, c *Client, src, dst string, fromLeft, toLeft bool, timeout string) resp.Value {
+	wait, errReply := parseBlockTimeout(timeout)
+	if errReply != nil {
+		return *errReply
+	}
+	ctx, cancel := h.blockingContext(c, wait)
+	defer cancel()
+	elem, err := h.DB.LMoveWait(ctx, src, dst, fromLeft, toLeft)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return resp.NewNullBulkString()
+	}
+	if errors.Is(err, context.Canceled) {
+		err = db.ErrShuttingDown
+	}
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewBulkString(elem)
+}
+
+// parseBlockTimeout parses the timeout of a blocking command in seconds,
+// returning 0 for forever
+func parseBlockTimeout(timeout string) (time.Duration, *resp.Value) {
+	seconds, err := strconv.ParseFloat(timeout, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		errReply := resp.NewError("ERR timeout is not a float or out of range")
+		return 0, &errReply
+	}
+	if seconds < 0 {
+		errReply := resp.NewError("ERR timeout is negative")
+		return 0, &errReply
+	}
+
+	wait := time.Duration(0) // forever, also for timeouts too long to represent
+	if seconds*float64(time.Second) < math.MaxInt64 {
+		wait = time.Duration(seconds * float64(time.Second))
+	}
+	return wait, nil
+}
+
+// lmoveReply moves an element between lists and replies with it
+func lmoveReply(h *Handler, src, dst string, fromLeft, toLeft bool) resp.Value {
+	elem, moved, err := h.DB.LMove(src, dst, fromLeft, toLeft)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !moved {
+		return resp.NewNullBulkString()
+	}
+	return resp.NewBulkString(elem)
+}
+
+// parseListEnd parses LEFT or RIGHT, reporting whether it named the head
+func parseListEnd(s string) (left bool, ok bool) {
+	switch strings.ToUpper(s) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	}
+	return false, false
+}
+
 // lremCommand handles the LREM command.
 // Syntax: LREM key count value
 // Removes elements from a list based on the count and value.
 // Returns the number of elements removed.
 // Example: LREM mylist 1 "hello"
-func lremCommand(h *Handler, args []resp.Value) resp.Value {
+func lremCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) != 3 {
 		return resp.NewError("ERR wrong number of arguments for 'lrem' command")
 	}
@@ -234,7 +443,7 @@ func lremCommand(h *Handler, args []resp.Value) resp.Value {
 
 	removed, err := h.DB.LRem(key, count, value)
 	if err != nil {
-		return resp.NewError(fmt.Sprintf("ERR %v", err))
+		return errorReply(err)
 	}
 
 	return resp.NewInteger(int64(removed))
@@ -245,7 +454,7 @@ func lremCommand(h *Handler, args []resp.Value) resp.Value {
 // Trims a list to the specified range.
 // Returns OK if successful.
 // Example: LTRIM mylist 0 0
-func ltrimCommand(h *Handler, args []resp.Value) resp.Value {
+func ltrimCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
 	if len(args) != 3 {
 		return resp.NewError("ERR wrong number of arguments for 'ltrim' command")
 	}
@@ -263,7 +472,7 @@ func ltrimCommand(h *Handler, args []resp.Value) resp.Value {
 
 	err = h.DB.LTrim(key, start, stop)
 	if err != nil {
-		return resp.NewError(fmt.Sprintf("ERR %v", err))
+		return errorReply(err)
 	}
 
 	return resp.NewSimpleString("OK")
@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"strings"
+	"time"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+	"flex-db/internal/utils"
+)
+
+// registerLockCommands registers the distributed lock commands
+func (r *CommandRegistry) registerLockCommands() {
+	r.RegisterWrite("LOCK", lockCommand)
+	r.RegisterWrite("UNLOCK", unlockCommand)
+	r.RegisterWrite("EXTEND", extendCommand)
+}
+
+// parseLockTTL parses a lock TTL in milliseconds, which must be positive
+func parseLockTTL(arg string) (time.Duration, bool) {
+	ms, err := utils.ParseInt(arg)
+	if err != nil || ms <= 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// lockCommand handles the LOCK command.
+// Syntax: LOCK key milliseconds [TOKEN token]
+// Acquires the lock called key for the given time if nobody holds it.
+// Returns the token owning the lock, random unless given, or nil if the
+// lock is held.
+// Example: LOCK lock:orders 30000
+func lockCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 && len(args) != 4 {
+		return wrongArgsError("lock")
+	}
+	ttl, ok := parseLockTTL(args[1].Str)
+	if !ok {
+		return resp.NewError("ERR invalid expire time in 'lock' command")
+	}
+
+	token := db.NewLockToken()
+	if len(args) == 4 {
+		if strings.ToUpper(args[2].Str) != "TOKEN" || args[3].Str == "" {
+			return resp.NewError("ERR syntax error")
+		}
+		token = args[3].Str
+	}
+
+	acquired, err := h.DB.Lock(args[0].Str, token, ttl)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !acquired {
+		return resp.NewNullBulkString()
+	}
+	return resp.NewBulkString(token)
+}
+
+// unlockCommand handles the UNLOCK command.
+// Syntax: UNLOCK key token
+// Releases the lock called key if token owns it.
+// Returns 1 if the lock was released, 0 if token doesn't own it.
+// Example: UNLOCK lock:orders 5f0c...
+func unlockCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("unlock")
+	}
+
+	released, err := h.DB.Unlock(args[0].Str, args[1].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	if released {
+		return resp.NewInteger(1)
+	}
+	return resp.NewInteger(0)
+}
+
+// extendCommand handles the EXTEND command.
+// Syntax: EXTEND key token milliseconds
+// Resets the TTL of the lock called key if token owns it.
+// Returns 1 if the lock was extended, 0 if token doesn't own it.
+// Example: EXTEND lock:orders 5f0c... 30000
+func extendCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 3 {
+		return wrongArgsError("extend")
+	}
+	ttl, ok := parseLockTTL(args[2].Str)
+	if !ok {
+		return resp.NewError("ERR invalid expire time in 'extend' command")
+	}
+
+	extended, err := h.DB.ExtendLock(args[0].Str, args[1].Str, ttl)
+	if err != nil {
+		return errorReply(err)
+	}
+	if extended {
+		return resp.NewInteger(1)
+	}
+	return resp.NewInteger(0)
+}
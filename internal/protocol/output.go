@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"flex-db/internal/resp"
+)
+
+// OutputLimits protects the server from clients that don't read their
+// replies. Zero values disable the corresponding limit.
+type OutputLimits struct {
+	// Hard disconnects a client as soon as its pending output exceeds it
+	Hard int64
+	// Soft disconnects a client whose pending output stays above it for
+	// longer than SoftDuration
+	Soft         int64
+	SoftDuration time.Duration
+	// WriteTimeout disconnects a client that doesn't read a reply within it
+	WriteTimeout time.Duration
+}
+
+// errOutputLimit is returned when a client exceeds its output limits
+var errOutputLimit = errors.New("output buffer limit reached")
+
+// clientOutput tracks the output waiting to be read by a client. Unlike
+// the rest of Client it may be read by other goroutines, so it is locked.
+type clientOutput struct {
+	mu        sync.Mutex
+	pending   int64     // bytes handed to the connection but not yet written
+	softSince time.Time // when pending first went over the soft limit
+}
+
+// reserve accounts for n more pending bytes, failing if that breaks limits
+func (o *clientOutput) reserve(n int64, limits OutputLimits) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	size := o.pending + n
+	if limits.Hard > 0 && size > limits.Hard {
+		return errOutputLimit
+	}
+	if limits.Soft > 0 && size > limits.Soft {
+		now := time.Now()
+		if o.softSince.IsZero() {
+			o.softSince = now
+		} else if now.Sub(o.softSince) > limits.SoftDuration {
+			return errOutputLimit
+		}
+	} else {
+		o.softSince = time.Time{}
+	}
+
+	o.pending = size
+	return nil
+}
+
+// release drops n bytes that were written or discarded
+func (o *clientOutput) release(n int64) {
+	o.mu.Lock()
+	o.pending -= n
+	o.mu.Unlock()
+}
+
+// size returns the pending output in bytes
+func (o *clientOutput) size() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.pending
+}
+
+// WithOutputLimits sets the limits on output clients leave unread
+func WithOutputLimits(limits OutputLimits) HandlerOption {
+	return func(h *Handler) {
+		h.output = limits
+	}
+}
+
+// sendReply encodes v in the client's protocol and writes it out. It
+// returns an error, after which the connection must be closed, when the
+// reply breaks the output limits or can't be written in time.
+func (h *Handler) sendReply(c *Client, w *bufio.Writer, v resp.Value) error {
+	payload := encodeReply(c, v)
+	size := int64(len(payload))
+	if err := c.out.reserve(size, h.output); err != nil {
+		h.outputDisconnects.Add(1)
+		fmt.Printf("Closing client %s: %v (%d bytes pending)\n", c.Addr, err, c.out.size()+size)
+		return err
+	}
+	defer c.out.release(size)
+	return h.writeOutput(c, w, payload)
+}
+
+// encodeReply encodes v in the client's protocol
+func encodeReply(c *Client, v resp.Value) []byte {
+	if c.Protocol == RESPProtocol {
+		return resp.Marshal(v)
+	}
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	writeTextReply(bw, v)
+	bw.Flush()
+	return buf.Bytes()
+}
+
+// writeOutput writes an encoded reply out, failing if the client doesn't
+// read it within the write timeout
+func (h *Handler) writeOutput(c *Client, w *bufio.Writer, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if h.output.WriteTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(h.output.WriteTimeout))
+	}
+	w.Write(payload)
+	if err := w.Flush(); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			h.outputDisconnects.Add(1)
+			fmt.Printf("Closing client %s: not reading its replies\n", c.Addr)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+	"flex-db/internal/utils"
+)
+
+// registerPQCommands registers the priority queue commands
+func (r *CommandRegistry) registerPQCommands() {
+	r.RegisterWrite("PQ.PUSH", pqPushCommand)
+	r.RegisterWrite("PQ.POP", pqPopCommand)
+	r.Register("PQ.PEEK", pqPeekCommand)
+	r.Register("PQ.LEN", pqLenCommand)
+}
+
+// pqPushCommand handles the PQ.PUSH command.
+// Syntax: PQ.PUSH key priority value
+// Queues value behind the values already queued with the same priority.
+// Returns the new length of the queue.
+// Example: PQ.PUSH jobs 10 send-invoice:42
+func pqPushCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 3 {
+		return wrongArgsError("pq.push")
+	}
+	priority, err := utils.ParseInt(args[1].Str)
+	if err != nil {
+		return resp.NewError("ERR priority is not an integer or out of range")
+	}
+
+	length, err := h.DB.PQPush(args[0].Str, priority, args[2].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(length))
+}
+
+// pqPopCommand handles the PQ.POP command.
+// Syntax: PQ.POP key [COUNT count] [BLOCK ms]
+// Removes and returns up to count values, highest priority first and
+// oldest first among equal priorities. With BLOCK it waits up to ms
+// milliseconds, 0 meaning forever, for a value to be pushed.
+// Returns an array of values, or nil if the queue is empty.
+// Example: PQ.POP jobs COUNT 5 BLOCK 1000
+func pqPopCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("pq.pop")
+	}
+
+	count, block, timeout, errReply := parsePopOptions(args[1:])
+	if errReply != nil {
+		return *errReply
+	}
+
+	var items []db.PQItem
+	var err error
+	if block {
+		ctx, cancel := h.blockingContext(c, timeout)
+		defer cancel()
+		items, err = h.DB.PQPopWait(ctx, args[0].Str, count)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return resp.NewNullArray()
+		}
+		if errors.Is(err, context.Canceled) {
+			err = db.ErrShuttingDown
+		}
+	} else {
+		items, err = h.DB.PQPop(args[0].Str, count)
+	}
+	if err != nil {
+		return errorReply(err)
+	}
+	if len(items) == 0 {
+		return resp.NewNullArray()
+	}
+
+	values := make([]resp.Value, len(items))
+	for i, item := range items {
+		values[i] = resp.NewBulkString(item.Value)
+	}
+	return resp.NewArray(values)
+}
+
+// pqPeekCommand handles the PQ.PEEK command.
+// Syntax: PQ.PEEK key
+// Returns the [priority, value] PQ.POP would return next, or nil if the
+// queue is empty.
+// Example: PQ.PEEK jobs
+func pqPeekCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("pq.peek")
+	}
+
+	item, found, err := h.DB.PQPeek(args[0].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !found {
+		return resp.NewNullArray()
+	}
+	return resp.NewArray([]resp.Value{
+		resp.NewInteger(item.Priority),
+		resp.NewBulkString(item.Value),
+	})
+}
+
+// pqLenCommand handles the PQ.LEN command.
+// Syntax: PQ.LEN key
+// Returns the number of queued values.
+// Example: PQ.LEN jobs
+func pqLenCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("pq.len")
+	}
+
+	length, err := h.DB.PQLen(args[0].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(length))
+}
@@ -0,0 +1,398 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"flex-db/internal/resp"
+	"flex-db/internal/utils"
+)
+
+// pushQueueSize is how many messages and replies may wait to be written
+// to a subscribed connection. Their bytes count against the output limits
+// too. A subscriber that falls further behind is disconnected, so a slow
+// reader can't hold up publishers or fill the server's memory.
+const pushQueueSize = 1024
+
+// subscribeModeCommands lists the commands a connection may run while
+// subscribed to channels
+var subscribeModeCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+	"RESET":        true,
+}
+
+// broker routes published messages to the connections subscribed to
+// their channel, or to a pattern matching it
+type broker struct {
+	mu       sync.Mutex
+	channels map[string]map[*Client]struct{}
+	patterns map[string]map[*Client]struct{} // glob patterns, see PSUBSCRIBE
+}
+
+// subscribers returns the subscribers of channels or of patterns
+func (b *broker) subscribers(pattern bool) map[string]map[*Client]struct{} {
+	if b.channels == nil {
+		b.channels = make(map[string]map[*Client]struct{})
+		b.patterns = make(map[string]map[*Client]struct{})
+	}
+	if pattern {
+		return b.patterns
+	}
+	return b.channels
+}
+
+// registerPubSubCommands registers the pub/sub commands
+func (r *CommandRegistry) registerPubSubCommands() {
+	r.Register("SUBSCRIBE", subscribeCommand)
+	r.Register("UNSUBSCRIBE", unsubscribeCommand)
+	r.Register("PSUBSCRIBE", psubscribeCommand)
+	r.Register("PUNSUBSCRIBE", punsubscribeCommand)
+	r.Register("PUBLISH", publishCommand)
+	r.Register("PUBSUB", pubsubCommand)
+}
+
+// subscribeCommand handles the SUBSCRIBE command.
+// Syntax: SUBSCRIBE channel [channel ...]
+// Subscribes the connection to channels. Until it unsubscribes from all
+// of them, it receives ["message", channel, message] for every message
+// published to them and may only run the (P)SUBSCRIBE and
+// (P)UNSUBSCRIBE commands, PING and RESET.
+// Replies with ["subscribe", channel, count] for each channel, count
+// being how many channels and patterns the connection is now subscribed
+// to.
+// Example: SUBSCRIBE news alerts
+func subscribeCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("subscribe")
+	}
+	return h.subscribe(c, argStrings(args), false)
+}
+
+// unsubscribeCommand handles the UNSUBSCRIBE command.
+// Syntax: UNSUBSCRIBE [channel ...]
+// Unsubscribes the connection from the given channels, or from all of
+// them.
+// Replies with ["unsubscribe", channel, count] for each channel, count
+// being how many channels and patterns the connection is still
+// subscribed to.
+// Example: UNSUBSCRIBE news
+func unsubscribeCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	return h.unsubscribeFrom(c, argStrings(args), false)
+}
+
+// psubscribeCommand handles the PSUBSCRIBE command.
+// Syntax: PSUBSCRIBE pattern [pattern ...]
+// Subscribes the connection to every channel matching a glob pattern,
+// like SUBSCRIBE. Messages arrive as ["pmessage", pattern, channel,
+// message], once for each subscribed pattern the channel matches.
+// Replies with ["psubscribe", pattern, count] for each pattern, count
+// counting channels and patterns.
+// Example: PSUBSCRIBE news.* alerts.[0-9]
+func psubscribeCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("psubscribe")
+	}
+	return h.subscribe(c, argStrings(args), true)
+}
+
+// punsubscribeCommand handles the PUNSUBSCRIBE command.
+// Syntax: PUNSUBSCRIBE [pattern ...]
+// Unsubscribes the connection from the given patterns, or from all of
+// them.
+// Replies with ["punsubscribe", pattern, count] for each pattern.
+// Example: PUNSUBSCRIBE news.*
+func punsubscribeCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	return h.unsubscribeFrom(c, argStrings(args), true)
+}
+
+var pubsubHelp = []string{
+	"PUBSUB <subcommand> [<arg> ...]. Subcommands are:",
+	"CHANNELS [<pattern>]",
+	"    Return the channels with subscribers, optionally those matching a pattern.",
+	"NUMSUB [<channel> ...]",
+	"    Return the number of subscribers of each channel.",
+	"NUMPAT",
+	"    Return the number of patterns subscribed to.",
+	"HELP",
+	"    Print this help.",
+}
+
+// pubsubCommand handles the PUBSUB command.
+// Syntax: PUBSUB CHANNELS [pattern] | PUBSUB NUMSUB [channel ...] | PUBSUB NUMPAT
+// Shows which channels are in use. Subscribers of patterns aren't counted
+// by CHANNELS and NUMSUB.
+// Example: PUBSUB NUMSUB news alerts
+func pubsubCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("pubsub")
+	}
+
+	h.pubsub.mu.Lock()
+	defer h.pubsub.mu.Unlock()
+	channels := h.pubsub.subscribers(false)
+
+	name := args[0].Str
+	switch strings.ToUpper(name) {
+	case "HELP":
+		lines := make([]resp.Value, len(pubsubHelp))
+		for i, line := range pubsubHelp {
+			lines[i] = resp.NewSimpleString(line)
+		}
+		return resp.NewArray(lines)
+
+	case "CHANNELS":
+		if len(args) > 2 {
+			return wrongArgsError("pubsub|channels")
+		}
+		names := []string{}
+		for channel := range channels {
+			if len(args) == 1 || utils.MatchGlob(args[1].Str, channel) {
+				names = append(names, channel)
+			}
+		}
+		sort.Strings(names)
+		return membersReply(names)
+
+	case "NUMSUB":
+		result := make([]resp.Value, 0, 2*(len(args)-1))
+		for _, arg := range args[1:] {
+			result = append(result, arg, resp.NewInteger(int64(len(channels[arg.Str]))))
+		}
+		return resp.NewArray(result)
+
+	case "NUMPAT":
+		if len(args) != 1 {
+			return wrongArgsError("pubsub|numpat")
+		}
+		return resp.NewInteger(int64(len(h.pubsub.subscribers(true))))
+
+	default:
+		return resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try PUBSUB HELP.", name))
+	}
+}
+
+// publishCommand handles the PUBLISH command.
+// Syntax: PUBLISH channel message
+// Sends a message to every connection subscribed to the channel or to a
+// pattern matching it. Messages aren't stored: connections subscribing
+// later don't get them.
+// Returns the number of messages sent, a connection subscribed to the
+// channel and to matching patterns getting one for each.
+// Example: PUBLISH news "hello"
+func publishCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("publish")
+	}
+
+	return resp.NewInteger(int64(h.publish(args[0].Str, args[1].Str)))
+}
+
+// publish queues a message for the subscribers of channel and of the
+// patterns matching it, and returns how many messages it queued
+func (h *Handler) publish(channel, message string) int {
+	h.pubsub.mu.Lock()
+	defer h.pubsub.mu.Unlock()
+
+	msg := resp.NewArray([]resp.Value{
+		resp.NewBulkString("message"),
+		resp.NewBulkString(channel),
+		resp.NewBulkString(message),
+	})
+	sent := 0
+	for subscriber := range h.pubsub.subscribers(false)[channel] {
+		h.push(subscriber, msg)
+		sent++
+	}
+
+	for pattern, subscribers := range h.pubsub.subscribers(true) {
+		if !utils.MatchGlob(pattern, channel) {
+			continue
+		}
+		pmsg := resp.NewArray([]resp.Value{
+			resp.NewBulkString("pmessage"),
+			resp.NewBulkString(pattern),
+			resp.NewBulkString(channel),
+			resp.NewBulkString(message),
+		})
+		for subscriber := range subscribers {
+			h.push(subscriber, pmsg)
+			sent++
+		}
+	}
+	return sent
+}
+
+// subscribe adds c to the subscribers of channels or patterns and queues
+// a confirmation for each
+func (h *Handler) subscribe(c *Client, names []string, pattern bool) resp.Value {
+	kind := "subscribe"
+	if pattern {
+		kind = "psubscribe"
+	}
+
+	h.startPushing(c)
+	h.pubsub.mu.Lock()
+	defer h.pubsub.mu.Unlock()
+
+	all := h.pubsub.subscribers(pattern)
+	own := c.subscribed(pattern)
+	for _, name := range names {
+		subscribers := all[name]
+		if subscribers == nil {
+			subscribers = make(map[*Client]struct{})
+			all[name] = subscribers
+		}
+		subscribers[c] = struct{}{}
+		own[name] = struct{}{}
+
+		// queued under the broker lock, so it precedes the channel's messages
+		h.push(c, subscriptionReply(kind, resp.NewBulkString(name), c.subscriptions()))
+	}
+	c.replyQueued = true
+	return resp.NewSimpleString("OK")
+}
+
+// unsubscribeFrom removes c from the subscribers of channels or patterns,
+// or of all of them if names is empty, and queues a confirmation for each
+func (h *Handler) unsubscribeFrom(c *Client, names []string, pattern bool) resp.Value {
+	kind := "unsubscribe"
+	if pattern {
+		kind = "punsubscribe"
+	}
+
+	h.startPushing(c)
+	h.pubsub.mu.Lock()
+	defer h.pubsub.mu.Unlock()
+
+	own := c.subscribed(pattern)
+	if len(names) == 0 {
+		for name := range own {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	if len(names) == 0 {
+		h.push(c, subscriptionReply(kind, resp.NewNullBulkString(), c.subscriptions()))
+	}
+	for _, name := range names {
+		h.unsubscribe(c, name, pattern)
+		h.push(c, subscriptionReply(kind, resp.NewBulkString(name), c.subscriptions()))
+	}
+	c.replyQueued = true
+	return resp.NewSimpleString("OK")
+}
+
+// unsubscribe removes c from the subscribers of a channel or pattern. The
+// caller holds the broker lock.
+func (h *Handler) unsubscribe(c *Client, name string, pattern bool) {
+	delete(c.subscribed(pattern), name)
+	all := h.pubsub.subscribers(pattern)
+	if subscribers, ok := all[name]; ok {
+		delete(subscribers, c)
+		if len(subscribers) == 0 {
+			delete(all, name)
+		}
+	}
+}
+
+// unsubscribeAll removes every subscription of c, without confirmations,
+// when it disconnects or resets
+func (h *Handler) unsubscribeAll(c *Client) {
+	h.pubsub.mu.Lock()
+	defer h.pubsub.mu.Unlock()
+	for _, pattern := range []bool{false, true} {
+		for name := range c.subscribed(pattern) {
+			h.unsubscribe(c, name, pattern)
+		}
+	}
+}
+
+// subscriptionReply is the confirmation of a subscription change
+func subscriptionReply(kind string, channel resp.Value, count int) resp.Value {
+	return resp.NewArray([]resp.Value{
+		resp.NewBulkString(kind),
+		channel,
+		resp.NewInteger(int64(count)),
+	})
+}
+
+// startPushing gives c a queue of output written by its own goroutine,
+// which publishers fill with messages. From then on replies go through
+// the queue too, so they stay in order with the messages.
+func (h *Handler) startPushing(c *Client) {
+	if c.pushes != nil {
+		return
+	}
+	c.pushes = make(chan []byte, pushQueueSize)
+	go h.writePushes(c, c.writer, c.pushes)
+}
+
+// writePushes writes the queued output of c until it disconnects,
+// releasing each payload reserved by push once written
+func (h *Handler) writePushes(c *Client, w *bufio.Writer, queue <-chan []byte) {
+	for payload := range queue {
+		err := h.writeOutput(c, w, payload)
+		c.out.release(int64(len(payload)))
+		if err != nil {
+			c.Conn.Close()
+			return
+		}
+	}
+}
+
+// push encodes v and queues it for c, its size reserved against the
+// output limits until written. It disconnects c if that breaks the limits
+// or its queue is full.
+func (h *Handler) push(c *Client, v resp.Value) {
+	if c.pushOverflow.Load() {
+		return
+	}
+	payload := encodeReply(c, v)
+	size := int64(len(payload))
+	if err := c.out.reserve(size, h.output); err != nil {
+		h.dropPushes(c, fmt.Sprintf("%v (%d bytes pending)", err, c.out.size()+size))
+		return
+	}
+	select {
+	case c.pushes <- payload:
+	default:
+		c.out.release(size)
+		h.dropPushes(c, fmt.Sprintf("%d messages waiting to be read", pushQueueSize))
+	}
+}
+
+// dropPushes closes c for falling behind on its queued output, once
+func (h *Handler) dropPushes(c *Client, reason string) {
+	if c.pushOverflow.CompareAndSwap(false, true) {
+		h.outputDisconnects.Add(1)
+		fmt.Printf("Closing client %s: %s\n", c.Addr, reason)
+		c.Conn.Close()
+	}
+}
+
+// reply sends the reply of a command to c, behind the messages already
+// queued for it once it subscribed
+func (h *Handler) reply(c *Client, w *bufio.Writer, v resp.Value) error {
+	if c.pushes != nil {
+		h.push(c, v)
+		return nil
+	}
+	return h.sendReply(c, w, v)
+}
+
+// stopPushing closes the queue of c once it disconnected. No publisher
+// can reach it anymore, as it has no subscriptions left.
+func (h *Handler) stopPushing(c *Client) {
+	h.unsubscribeAll(c)
+	if c.pushes != nil {
+		close(c.pushes)
+	}
+}
@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"flex-db/internal/db"
+)
+
+func TestPushOutputLimit(t *testing.T) {
+	database, err := db.NewFlexDB(filepath.Join(t.TempDir(), "flex.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	h := NewHandler(database, WithOutputLimits(OutputLimits{Hard: 64 << 10}))
+
+	// nobody reads the other end, so the first push blocks its writer
+	server, client := net.Pipe()
+	defer client.Close()
+	c := newClient(server, true)
+	c.Protocol = RESPProtocol
+	c.writer = bufio.NewWriter(server)
+	run(h, c, "SUBSCRIBE", "news")
+
+	message := strings.Repeat("x", 10<<10)
+	for i := 0; i < 20; i++ {
+		h.publish("news", message)
+	}
+	if !c.pushOverflow.Load() || h.outputDisconnects.Load() != 1 {
+		t.Fatalf("subscriber over the hard limit wasn't closed: %d disconnects", h.outputDisconnects.Load())
+	}
+	if pending := c.out.size(); pending > 64<<10 {
+		t.Errorf("%d bytes pending, over the hard limit", pending)
+	}
+	if _, err := server.Write([]byte("x")); err == nil {
+		t.Error("the subscriber's connection is still open")
+	}
+}
@@ -0,0 +1,171 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+)
+
+// registerQueryCommands registers the QUERY command
+func (r *CommandRegistry) registerQueryCommands() {
+	r.Register("QUERY", queryCommand)
+}
+
+// operatorPrefixes lists the comparison operators longest first, so a
+// condition written without spaces like age>=30 splits correctly
+var operatorPrefixes = []string{">=", "<=", "!=", "=", ">", "<"}
+
+// queryCommand handles the QUERY command.
+// Syntax: QUERY pattern [WHERE field op value [AND field op value ...]] [RETURN field [field ...]] [LIMIT n]
+// Filters the hashes whose key matches pattern server-side. op is one of
+// = != > >= < <=; numbers compare numerically, everything else as strings.
+// Returns matching keys in key order, or with RETURN an array of
+// [key, [field, value, ...]] entries where missing fields are nil.
+// Example: QUERY user:* WHERE age > 30 AND city = "Delhi" RETURN name LIMIT 10
+func queryCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("query")
+	}
+
+	q := db.Query{Pattern: args[0].Str, Limit: -1}
+	limited := false
+	tokens := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		tokens[i] = arg.Str
+	}
+
+	for len(tokens) > 0 {
+		keyword := strings.ToUpper(tokens[0])
+		tokens = tokens[1:]
+
+		switch keyword {
+		case "WHERE":
+			for {
+				cond, rest, err := parseCondition(tokens)
+				if err != nil {
+					return resp.NewError("ERR " + err.Error())
+				}
+				q.Where = append(q.Where, cond)
+				tokens = rest
+				if len(tokens) == 0 || strings.ToUpper(tokens[0]) != "AND" {
+					break
+				}
+				tokens = tokens[1:]
+			}
+
+		case "RETURN":
+			for len(tokens) > 0 && strings.ToUpper(tokens[0]) != "LIMIT" {
+				q.Fields = append(q.Fields, tokens[0])
+				tokens = tokens[1:]
+			}
+			if len(q.Fields) == 0 {
+				return resp.NewError("ERR RETURN needs at least one field")
+			}
+
+		case "LIMIT":
+			if len(tokens) == 0 {
+				return resp.NewError("ERR syntax error")
+			}
+			n, err := strconv.Atoi(tokens[0])
+			if err != nil || n < 0 {
+				return resp.NewError("ERR value is not an integer or out of range")
+			}
+			if h.maxKeys > 0 && n > h.maxKeys {
+				return resp.NewError(fmt.Sprintf("ERR LIMIT count is above the limit of %d keys per reply", h.maxKeys))
+			}
+			q.Limit = n
+			limited = true
+			tokens = tokens[1:]
+
+		default:
+			return resp.NewError(fmt.Sprintf("ERR syntax error near '%s'", keyword))
+		}
+	}
+
+	// like ALL and KEYS, unpaged queries may not exceed the reply cap
+	if !limited && h.maxKeys > 0 {
+		q.Limit = h.maxKeys + 1
+	}
+
+	results, err := h.DB.Query(q)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !limited && h.maxKeys > 0 && len(results) > h.maxKeys {
+		return resp.NewError(fmt.Sprintf("ERR QUERY matched more than the limit of %d keys. Add LIMIT <count> or narrow the pattern", h.maxKeys))
+	}
+
+	reply := make([]resp.Value, len(results))
+	for i, r := range results {
+		if len(q.Fields) == 0 {
+			reply[i] = resp.NewBulkString(r.Key)
+			continue
+		}
+
+		fields := make([]resp.Value, 0, len(q.Fields)*2)
+		for _, f := range q.Fields {
+			fields = append(fields, resp.NewBulkString(f))
+			if v, ok := r.Fields[f]; ok {
+				fields = append(fields, resp.NewBulkString(v))
+			} else {
+				fields = append(fields, resp.NewNullBulkString())
+			}
+		}
+		reply[i] = resp.NewArray([]resp.Value{resp.NewBulkString(r.Key), resp.NewArray(fields)})
+	}
+
+	return resp.NewArray(reply)
+}
+
+// parseCondition reads one "field op value" condition from tokens and
+// returns the tokens after it. The three parts may be separate tokens or
+// written together, e.g. age>30 or age >30. The value is never split, so
+// quoted values can contain operator characters.
+func parseCondition(tokens []string) (db.Condition, []string, error) {
+	var cond db.Condition
+	if len(tokens) == 0 {
+		return cond, nil, fmt.Errorf("WHERE needs a condition")
+	}
+
+	// the field, possibly followed by the operator and value
+	field := tokens[0]
+	tokens = tokens[1:]
+	rest := ""
+	if i := strings.IndexAny(field, "=!<>"); i > 0 {
+		field, rest = field[:i], field[i:]
+	}
+	cond.Field = field
+
+	if rest == "" {
+		if len(tokens) == 0 {
+			return cond, nil, fmt.Errorf("missing operator after '%s'", field)
+		}
+		rest = tokens[0]
+		tokens = tokens[1:]
+	}
+
+	for _, op := range operatorPrefixes {
+		if strings.HasPrefix(rest, op) {
+			cond.Op = op
+			rest = rest[len(op):]
+			break
+		}
+	}
+	if cond.Op == "" {
+		return cond, nil, fmt.Errorf("invalid operator '%s'", rest)
+	}
+
+	if rest == "" {
+		if len(tokens) == 0 {
+			return cond, nil, fmt.Errorf("missing value after '%s %s'", field, cond.Op)
+		}
+		rest = tokens[0]
+		tokens = tokens[1:]
+	}
+	cond.Value = rest
+
+	return cond, tokens, nil
+}
@@ -0,0 +1,129 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+	"flex-db/internal/utils"
+)
+
+// registerQueueCommands registers the job queue commands
+func (r *CommandRegistry) registerQueueCommands() {
+	r.RegisterWrite("QPUSH", qpushCommand)
+	r.RegisterWrite("QPOP", qpopCommand)
+	r.RegisterWrite("QACK", qackCommand)
+	r.Register("QLEN", qlenCommand)
+}
+
+// qpushCommand handles the QPUSH command.
+// Syntax: QPUSH queue payload [payload ...]
+// Queues jobs at the back of a job queue.
+// Returns the number of jobs in the queue, ready or reserved.
+// Example: QPUSH emails welcome:42
+func qpushCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("qpush")
+	}
+
+	length, err := h.DB.QPush(args[0].Str, argStrings(args[1:])...)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(length))
+}
+
+// qpopCommand handles the QPOP command.
+// Syntax: QPOP queue visibility_ms [COUNT count] [BLOCK ms]
+// Reserves up to count jobs, oldest first, for visibility_ms
+// milliseconds. A job not acknowledged with QACK by then goes back to the
+// front of the queue. With BLOCK it waits up to ms milliseconds, 0
+// meaning forever, for a job to be ready.
+// Returns an array of [id, payload] pairs, or nil if no job is ready.
+// Example: QPOP emails 30000 COUNT 10 BLOCK 5000
+func qpopCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("qpop")
+	}
+	ms, err := utils.ParseInt(args[1].Str)
+	if err != nil || ms <= 0 {
+		return resp.NewError("ERR visibility timeout must be a positive integer")
+	}
+	visibility := time.Duration(ms) * time.Millisecond
+
+	count, block, timeout, errReply := parsePopOptions(args[2:])
+	if errReply != nil {
+		return *errReply
+	}
+
+	var jobs []db.Job
+	if block {
+		ctx, cancel := h.blockingContext(c, timeout)
+		defer cancel()
+		jobs, err = h.DB.QPopWait(ctx, args[0].Str, count, visibility)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return resp.NewNullArray()
+		}
+		if errors.Is(err, context.Canceled) {
+			err = db.ErrShuttingDown
+		}
+	} else {
+		jobs, err = h.DB.QPop(args[0].Str, count, visibility)
+	}
+	if err != nil {
+		return errorReply(err)
+	}
+	if len(jobs) == 0 {
+		return resp.NewNullArray()
+	}
+
+	result := make([]resp.Value, len(jobs))
+	for i, job := range jobs {
+		result[i] = resp.NewArray([]resp.Value{
+			resp.NewBulkString(job.ID),
+			resp.NewBulkString(job.Payload),
+		})
+	}
+	return resp.NewArray(result)
+}
+
+// qackCommand handles the QACK command.
+// Syntax: QACK queue id [id ...]
+// Acknowledges reserved jobs, removing them for good. Jobs whose
+// visibility timeout passed can't be acknowledged, as they may already be
+// reserved by another consumer.
+// Returns the number of jobs acknowledged.
+// Example: QACK emails 17
+func qackCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("qack")
+	}
+
+	acked, err := h.DB.QAck(args[0].Str, argStrings(args[1:])...)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(acked))
+}
+
+// qlenCommand handles the QLEN command.
+// Syntax: QLEN queue
+// Returns [ready, reserved]: the number of jobs waiting to be popped and
+// the number popped but not acknowledged yet.
+// Example: QLEN emails
+func qlenCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("qlen")
+	}
+
+	ready, reserved, err := h.DB.QLen(args[0].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewArray([]resp.Value{
+		resp.NewInteger(int64(ready)),
+		resp.NewInteger(int64(reserved)),
+	})
+}
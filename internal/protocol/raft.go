@@ -0,0 +1,522 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+
+	"flex-db/internal/resp"
+)
+
+// Raft replication
+//
+// As an alternative to PSYNC replication, a group of servers, usually
+// three, can replicate through a Raft log. A write is only applied, on
+// every server and in the same order, once a majority of the group
+// stored it, so an acknowledged write survives the loss of any minority
+// and the group elects a new leader by itself when the leader goes down.
+//
+// Only the leader accepts writes; the other servers answer NOTLEADER.
+// Reads are served by every server from the writes it applied so far,
+// so only the leader's replies include every acknowledged write.
+//
+// The log carries the clients' commands, which every server runs in
+// turn, so they must give the same result everywhere. Each entry carries
+// the leader's time, which the servers apply it at instead of their own
+// clocks, so commands going by the clock, such as THROTTLE or QPOP, agree
+// everywhere, and the leader makes relative expirations absolute before
+// proposing a write. Only the leader looks for expired keys, and proposes
+// removing them like a write. Commands depending on randomness, local
+// state or files, or that block, are refused. The keyspace is rebuilt
+// from the log and its snapshots when a server starts, so --aof isn't
+// used alongside it.
+
+// errClassNotLeader is the error class of a write sent to a follower
+const errClassNotLeader = "NOTLEADER"
+
+// raftApplyTimeout bounds how long a write waits to enter the Raft log
+const raftApplyTimeout = 10 * time.Second
+
+// raftUnsupported lists the commands refused with Raft replication
+var raftUnsupported = map[string]bool{
+	// each server empties its trash by its own clock
+	"UNDELETE": true,
+	// they draw random tokens
+	"LOCK":   true,
+	"UNLOCK": true,
+	"EXTEND": true,
+	// scripts are cached by each server and may do any of the above
+	"EVAL":    true,
+	"EVALSHA": true,
+	// they can't wait for data from within the log
+	"BLMOVE":     true,
+	"BRPOPLPUSH": true,
+	"BZPOPMIN":   true,
+	"BZPOPMAX":   true,
+	// they read files or reach servers outside the group
+	"IMPORT":    true,
+	"MIGRATE":   true,
+	"REPLICAOF": true,
+	"SLAVEOF":   true,
+}
+
+// raftBlocking lists the commands refused with Raft replication when
+// given the BLOCK option, which can't wait from within the log either
+var raftBlocking = map[string]bool{
+	"DELAY.POP": true,
+	"QPOP":      true,
+	"PQ.POP":    true,
+}
+
+// raftRefused reports whether cmd, called with args, is refused with Raft
+// replication
+func raftRefused(cmd string, args []resp.Value) bool {
+	if raftUnsupported[cmd] {
+		return true
+	}
+	if raftBlocking[cmd] {
+		// the options follow the key
+		for i := 1; i < len(args); i++ {
+			if strings.EqualFold(args[i].Str, "BLOCK") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RaftConfig configures Raft replication, see the start of raft.go
+type RaftConfig struct {
+	ID        string // unique ID of this server in the group
+	Addr      string // host:port the other servers reach the Raft transport on
+	Dir       string // where the log and its snapshots are kept
+	Bootstrap bool   // start a new group with this server as its only member
+}
+
+// raftNode is this server's member of the Raft group
+type raftNode struct {
+	*raft.Raft
+	id    string
+	store *raftboltdb.BoltStore
+}
+
+// StartRaft makes the server a member of a Raft group, see the start of
+// raft.go. The keys loaded from the snapshot file are dropped for those
+// of the group. Call it before serving clients.
+func (h *Handler) StartRaft(cfg RaftConfig) error {
+	<-h.DB.Loaded()
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return err
+	}
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(cfg.ID)
+	conf.LogLevel = "WARN"
+	conf.LogOutput = os.Stdout
+
+	transport, err := raft.NewTCPTransport(cfg.Addr, nil, 3, 10*time.Second, os.Stdout)
+	if err != nil {
+		return fmt.Errorf("failed to start the Raft transport: %w", err)
+	}
+	snapshots, err := raft.NewFileSnapshotStore(cfg.Dir, 2, os.Stdout)
+	if err != nil {
+		transport.Close()
+		return fmt.Errorf("failed to open the Raft snapshots: %w", err)
+	}
+	store, err := raftboltdb.NewBoltStore(filepath.Join(cfg.Dir, "raft.db"))
+	if err != nil {
+		transport.Close()
+		return fmt.Errorf("failed to open the Raft log: %w", err)
+	}
+
+	// the log and its snapshots rebuild the keyspace
+	h.DB.FlushAll()
+	fsm := &raftFSM{h: h, dir: cfg.Dir, client: &Client{
+		Addr:          "raft",
+		Protocol:      RESPProtocol,
+		RespVersion:   2,
+		Authenticated: true,
+		Admin:         true,
+		inScript:      true, // blocking commands return at once
+	}}
+	r, err := raft.NewRaft(conf, fsm, store, store, snapshots, transport)
+	if err != nil {
+		store.Close()
+		transport.Close()
+		return fmt.Errorf("failed to start Raft: %w", err)
+	}
+
+	if cfg.Bootstrap {
+		existing, err := raft.HasExistingState(store, store, snapshots)
+		if err != nil {
+			r.Shutdown()
+			store.Close()
+			return err
+		}
+		if !existing {
+			err := r.BootstrapCluster(raft.Configuration{Servers: []raft.Server{{
+				ID:      conf.LocalID,
+				Address: transport.LocalAddr(),
+			}}}).Error()
+			if err != nil {
+				r.Shutdown()
+				store.Close()
+				return fmt.Errorf("failed to bootstrap the Raft group: %w", err)
+			}
+		}
+	}
+
+	h.raft = &raftNode{Raft: r, id: cfg.ID, store: store}
+	h.DB.SetExpirer(raftExpirer{h})
+	return nil
+}
+
+// stopRaft leaves the Raft group, if any, on shutdown
+func (h *Handler) stopRaft() {
+	if h.raft == nil {
+		return
+	}
+	if err := h.raft.Shutdown().Error(); err != nil {
+		fmt.Printf("Error stopping Raft: %v\n", err)
+	}
+	h.raft.store.Close()
+}
+
+// notLeaderError is the reply to a write or RAFT subcommand that only
+// the leader can run
+func (h *Handler) notLeaderError() resp.Value {
+	if _, id := h.raft.LeaderWithID(); id != "" {
+		return newClassError(errClassNotLeader, fmt.Sprintf("Writes go to the leader %s", id))
+	}
+	return newClassError(errClassNotLeader, "No leader is elected")
+}
+
+// proposeWrite runs a write through the Raft log and returns its reply
+// from the leader
+func (h *Handler) proposeWrite(c *Client, cmd string, args []resp.Value) resp.Value {
+	if h.raft.State() != raft.Leader {
+		return h.notLeaderError()
+	}
+
+	now := time.Now()
+	cmd, args = raftAbsolute(now, cmd, args, c.Protocol == TextProtocol)
+	return h.propose(now, raftWrite, cmd, args)
+}
+
+// Kinds of Raft log entries
+const (
+	raftWrite  = "write"  // a client's write
+	raftExpire = "expire" // a DEL of keys the leader found expired
+)
+
+// propose appends an entry to the Raft log and returns its reply. The
+// entry is the array [time, kind, command, arguments...], the time being
+// the leader's in Unix milliseconds.
+func (h *Handler) propose(now time.Time, kind, cmd string, args []resp.Value) resp.Value {
+	items := make([]resp.Value, 0, len(args)+3)
+	items = append(items,
+		resp.NewBulkString(strconv.FormatInt(now.UnixMilli(), 10)),
+		resp.NewBulkString(kind),
+		resp.NewBulkString(cmd))
+	items = append(items, args...)
+
+	future := h.raft.Apply(resp.Marshal(resp.NewArray(items)), raftApplyTimeout)
+	switch err := future.Error(); {
+	case errors.Is(err, raft.ErrNotLeader):
+		return h.notLeaderError()
+	case errors.Is(err, raft.ErrLeadershipLost):
+		return newClassError(errClassNotLeader, "Leadership was lost, the write may or may not be applied")
+	case err != nil:
+		return resp.NewError("ERR " + err.Error())
+	}
+	return future.Response().(resp.Value)
+}
+
+// raftAbsolute rewrites the relative times of a write, which every
+// server would otherwise resolve with its own clock, to absolute times
+// from now on the leader's clock. text is set for writes of text protocol
+// clients, whose SET takes a bare TTL.
+func raftAbsolute(now time.Time, cmd string, args []resp.Value, text bool) (string, []resp.Value) {
+	at := func(d time.Duration) resp.Value {
+		return resp.NewBulkString(strconv.FormatInt(now.Add(d).UnixMilli(), 10))
+	}
+	args = append([]resp.Value(nil), args...)
+
+	switch cmd {
+	case "SET":
+		if len(args) == 3 && text {
+			if seconds, err := strconv.ParseInt(args[2].Str, 10, 64); err == nil {
+				return cmd, []resp.Value{args[0], args[1], resp.NewBulkString("PXAT"), at(time.Duration(seconds) * time.Second)}
+			}
+		}
+		for i := 2; i+1 < len(args); i++ {
+			unit := time.Second
+			switch strings.ToUpper(args[i].Str) {
+			case "PX":
+				unit = time.Millisecond
+			case "EX":
+			default:
+				continue
+			}
+			if n, err := strconv.ParseInt(args[i+1].Str, 10, 64); err == nil {
+				args[i], args[i+1] = resp.NewBulkString("PXAT"), at(time.Duration(n)*unit)
+			}
+		}
+	case "EXPIRE", "PEXPIRE":
+		if len(args) < 2 {
+			break
+		}
+		unit := time.Second
+		if cmd == "PEXPIRE" {
+			unit = time.Millisecond
+		}
+		if n, err := strconv.ParseInt(args[1].Str, 10, 64); err == nil {
+			cmd, args[1] = "PEXPIREAT", at(time.Duration(n)*unit)
+		}
+	case "RESTORE":
+		if len(args) < 3 {
+			break
+		}
+		for _, arg := range args[3:] {
+			if strings.ToUpper(arg.Str) == "ABSTTL" {
+				return cmd, args
+			}
+		}
+		if ttl, err := strconv.ParseInt(args[1].Str, 10, 64); err == nil && ttl > 0 {
+			args[1] = at(time.Duration(ttl) * time.Millisecond)
+			args = append(args, resp.NewBulkString("ABSTTL"))
+		}
+	case "TS.ADD":
+		if len(args) >= 2 && args[1].Str == "*" {
+			args[1] = at(0)
+		}
+	}
+	return cmd, args
+}
+
+// raftFSM applies the writes of the Raft log to the keyspace
+type raftFSM struct {
+	h      *Handler
+	dir    string  // where snapshots are spooled
+	client *Client // runs the writes
+}
+
+// Apply runs a write of the log, on every server in the same order and
+// at the time of the leader that proposed it
+func (f *raftFSM) Apply(entry *raft.Log) interface{} {
+	v, err := resp.Parse(bufio.NewReader(bytes.NewReader(entry.Data)))
+	if err != nil || v.Type != resp.Array || len(v.Array) < 3 {
+		return resp.NewError("ERR unreadable Raft log entry")
+	}
+	ms, err := strconv.ParseInt(v.Array[0].Str, 10, 64)
+	if err != nil {
+		return resp.NewError("ERR unreadable Raft log entry")
+	}
+	kind, cmd, args := v.Array[1].Str, strings.ToUpper(v.Array[2].Str), v.Array[3:]
+
+	var reply resp.Value
+	f.h.DB.ApplyAt(time.UnixMilli(ms), func() {
+		if kind == raftExpire {
+			// keys written since the leader found them expired stay
+			reply = resp.NewInteger(int64(len(f.h.DB.ExpireKeys(argStrings(args)...))))
+			return
+		}
+		handler, exists := f.h.registry.Get(cmd)
+		if !exists {
+			reply = resp.NewError(fmt.Sprintf("ERR unknown command '%s'", cmd))
+			return
+		}
+		f.h.scriptGate.RLock()
+		defer f.h.scriptGate.RUnlock()
+		reply = handler(f.h, f.client, args)
+	})
+	return reply
+}
+
+// raftExpirer leaves active expiration to the leader of the Raft group,
+// which proposes removing the keys it finds expired, see db.SetExpirer
+type raftExpirer struct {
+	h *Handler
+}
+
+func (e raftExpirer) Leading() bool {
+	return e.h.raft.State() == raft.Leader
+}
+
+func (e raftExpirer) Expire(keys []string) {
+	args := make([]resp.Value, len(keys))
+	for i, key := range keys {
+		args[i] = resp.NewBulkString(key)
+	}
+	if reply := e.h.propose(time.Now(), raftExpire, "DEL", args); reply.Type == resp.Error {
+		fmt.Printf("Error expiring keys through Raft: %s\n", reply.Str)
+	}
+}
+
+// Snapshot copies the keyspace aside for Raft to compact the log
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	file, err := os.CreateTemp(f.dir, "keyspace-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.h.DB.Backup(file); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &raftSnapshot{file: file}, nil
+}
+
+// Restore replaces the keyspace with a snapshot of the group
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	file, err := os.CreateTemp(f.dir, "keyspace-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = io.Copy(file, rc)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return f.h.DB.ReplaceKeyspace(file.Name())
+}
+
+// raftSnapshot is a copy of the keyspace taken by raftFSM.Snapshot
+type raftSnapshot struct {
+	file *os.File
+}
+
+// Persist writes the copy to the snapshot store
+func (s *raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		sink.Cancel()
+		return err
+	}
+	if _, err := io.Copy(sink, s.file); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release removes the copy
+func (s *raftSnapshot) Release() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
+
+// registerRaftCommands registers RAFT
+func (r *CommandRegistry) registerRaftCommands() {
+	r.RegisterAdmin("RAFT", raftCommand)
+}
+
+var raftHelp = []string{
+	"RAFT <subcommand> [<arg> ...]. Subcommands are:",
+	"JOIN <id> <host:port>",
+	"    Add the server with Raft address <host:port> to the group. Leader only.",
+	"REMOVE <id>",
+	"    Remove a server from the group. Leader only.",
+	"STATUS",
+	"    Return this server's state, the leader and the members of the group.",
+	"HELP",
+	"    Print this help.",
+}
+
+// raftCommand handles the RAFT command.
+// Syntax: RAFT JOIN id host:port | RAFT REMOVE id | RAFT STATUS
+// Manages the members of the Raft group, see the start of raft.go.
+// Example: RAFT JOIN node2 10.0.0.2:7000
+func raftCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("raft")
+	}
+	name := strings.ToUpper(args[0].Str)
+	args = args[1:]
+
+	if name == "HELP" {
+		lines := make([]resp.Value, len(raftHelp))
+		for i, line := range raftHelp {
+			lines[i] = resp.NewSimpleString(line)
+		}
+		return resp.NewArray(lines)
+	}
+	if h.raft == nil {
+		return resp.NewError("ERR Raft replication is disabled, start the server with --raft-id")
+	}
+
+	switch name {
+	case "JOIN":
+		if len(args) != 2 {
+			return wrongArgsError("raft|join")
+		}
+		future := h.raft.AddVoter(raft.ServerID(args[0].Str), raft.ServerAddress(args[1].Str), 0, raftApplyTimeout)
+		return h.raftReply(future.Error())
+
+	case "REMOVE":
+		if len(args) != 1 {
+			return wrongArgsError("raft|remove")
+		}
+		future := h.raft.RemoveServer(raft.ServerID(args[0].Str), 0, raftApplyTimeout)
+		return h.raftReply(future.Error())
+
+	case "STATUS":
+		if len(args) != 0 {
+			return wrongArgsError("raft|status")
+		}
+		return h.raftStatus()
+	}
+	return resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try RAFT HELP.", name))
+}
+
+// raftReply is the reply to a change of the members of the group
+func (h *Handler) raftReply(err error) resp.Value {
+	switch {
+	case errors.Is(err, raft.ErrNotLeader):
+		return h.notLeaderError()
+	case err != nil:
+		return resp.NewError("ERR " + err.Error())
+	}
+	return resp.NewSimpleString("OK")
+}
+
+// raftStatus is the reply to RAFT STATUS
+func (h *Handler) raftStatus() resp.Value {
+	leaderAddr, leaderID := h.raft.LeaderWithID()
+	stats := h.raft.Stats()
+
+	members := []resp.Value{}
+	if future := h.raft.GetConfiguration(); future.Error() == nil {
+		for _, server := range future.Configuration().Servers {
+			members = append(members, resp.NewArray([]resp.Value{
+				resp.NewBulkString(string(server.ID)),
+				resp.NewBulkString(string(server.Address)),
+				resp.NewBulkString(strings.ToLower(server.Suffrage.String())),
+			}))
+		}
+	}
+
+	return resp.NewArray([]resp.Value{
+		resp.NewBulkString("id"), resp.NewBulkString(h.raft.id),
+		resp.NewBulkString("state"), resp.NewBulkString(strings.ToLower(h.raft.State().String())),
+		resp.NewBulkString("leader_id"), resp.NewBulkString(string(leaderID)),
+		resp.NewBulkString("leader_addr"), resp.NewBulkString(string(leaderAddr)),
+		resp.NewBulkString("term"), resp.NewBulkString(stats["term"]),
+		resp.NewBulkString("commit_index"), resp.NewBulkString(stats["commit_index"]),
+		resp.NewBulkString("applied_index"), resp.NewBulkString(stats["applied_index"]),
+		resp.NewBulkString("members"), resp.NewArray(members),
+	})
+}
@@ -0,0 +1,32 @@
+package protocol
+
+import (
+	"testing"
+
+	"flex-db/internal/resp"
+)
+
+func TestRaftRefused(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []string
+		want bool
+	}{
+		{"THROTTLE", []string{"k", "10", "5", "60"}, false},
+		{"QPOP", []string{"q", "30000", "COUNT", "2"}, false},
+		{"QPOP", []string{"q", "30000", "block", "100"}, true},
+		{"DELAY.POP", []string{"block"}, false},
+		{"PQ.POP", []string{"pq", "BLOCK", "0"}, true},
+		{"LOCK", []string{"l", "1000"}, true},
+		{"UNDELETE", []string{"k"}, true},
+	}
+	for _, tt := range tests {
+		var args []resp.Value
+		for _, arg := range tt.args {
+			args = append(args, resp.NewBulkString(arg))
+		}
+		if got := raftRefused(tt.cmd, args); got != tt.want {
+			t.Errorf("%s %v: got %v, want %v", tt.cmd, tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,708 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+)
+
+// Replication, see the db package for the stream and its backlog.
+//
+// A replica connects to its master like a client and sends
+// PSYNC <replication id> <offset + 1>, the first byte of the stream it
+// lacks. The master answers +CONTINUE <id> and the rest of the stream, or
+// +FULLRESYNC <id> <offset> followed by a snapshot as SYNC sends it and
+// the stream from that offset on. The stream is made of the commands the
+// master logs, which the replica applies and acknowledges every second
+// with REPLCONF ACK <offset>. The master adds a PING to the stream every
+// replPingInterval, so a replica that hears nothing for replTimeout
+// reconnects.
+const (
+	replPingInterval   = 10 * time.Second
+	replTimeout        = 60 * time.Second
+	replAckInterval    = time.Second
+	replReconnectDelay = time.Second
+
+	// replChunkSize is the most stream bytes written to a replica at once
+	replChunkSize = 64 * 1024
+)
+
+// replication is the replication state of a Handler
+type replication struct {
+	mu       sync.Mutex
+	replicas map[*Client]*attachedReplica // replicas streaming from this server
+	master   *masterLink                  // nil unless this server is a replica
+	pinging  bool                         // pingReplicas is running
+
+	masterAuth   string // password sent to the master, see WithMasterAuth
+	announcePort int    // port the master is told this server listens on, see WithAnnouncePort
+}
+
+// attachedReplica is a replica streaming from this server
+type attachedReplica struct {
+	stream *db.ReplicationStream
+	cancel context.CancelFunc
+}
+
+// masterLink follows the master of this server
+type masterLink struct {
+	addr   string
+	cancel context.CancelFunc
+	done   chan struct{} // closed once followMaster returned
+	state  string        // as ROLE reports it, changed under replication.mu
+
+	// for INFO replication, changed under replication.mu too
+	lastIO    time.Time // when the master last sent a command
+	downSince time.Time // when the link went down, zero while connected
+}
+
+// States of a masterLink
+const (
+	linkConnecting = "connecting" // dialing or waiting to redial
+	linkSyncing    = "sync"       // resynchronizing
+	linkConnected  = "connected"  // applying the stream
+)
+
+// WithMasterAuth makes the server authenticate with password when it
+// connects to its master as a replica
+func WithMasterAuth(password string) HandlerOption {
+	return func(h *Handler) {
+		h.repl.masterAuth = password
+	}
+}
+
+// WithAnnouncePort makes the server tell its master, once it's a replica,
+// that it serves clients on port. The master lists replicas with ROLE,
+// which is how a failover coordinator finds them.
+func WithAnnouncePort(port int) HandlerOption {
+	return func(h *Handler) {
+		h.repl.announcePort = port
+	}
+}
+
+// registerReplicationCommands registers PSYNC, REPLCONF and REPLICAOF
+func (r *CommandRegistry) registerReplicationCommands() {
+	r.RegisterAdmin("PSYNC", psyncCommand)
+	r.RegisterAdmin("REPLCONF", replconfCommand)
+	r.RegisterAdmin("REPLICAOF", replicaofCommand)
+	r.RegisterAdmin("SLAVEOF", replicaofCommand)
+	r.Register("WAIT", waitCommand)
+	r.Register("ROLE", roleCommand)
+}
+
+// psyncCommand handles the PSYNC command.
+// Syntax: PSYNC replicationid offset
+// Sent by a replica, see the start of replication.go. Afterwards the
+// connection carries the replication stream and only REPLCONF is
+// expected from the replica.
+// Example: PSYNC 8de1787ba490483314a4d30f1c628bc8e6a9a4a8 1034
+func psyncCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("psync")
+	}
+	if c.Protocol != RESPProtocol {
+		return resp.NewError("ERR PSYNC needs the RESP protocol")
+	}
+	offset, err := strconv.ParseInt(args[1].Str, 10, 64)
+	if err != nil {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+
+	if stream, ok := h.DB.PartialSync(args[0].Str, offset-1); ok {
+		fmt.Printf("Continuing replica %s from offset %d\n", c.Addr, stream.Offset())
+		c.writeMu.Lock()
+		c.writer.WriteString("+CONTINUE " + stream.ID() + "\r\n")
+		err := c.writer.Flush()
+		c.writeMu.Unlock()
+		if err != nil {
+			c.Conn.Close()
+			return resp.Value{}
+		}
+		c.replyQueued = true
+		h.attachReplica(c, stream)
+		return resp.Value{}
+	}
+
+	// like SYNC, the snapshot is spooled since a bulk string needs its
+	// length up front
+	spool, err := os.CreateTemp("", "flexdb-psync-*")
+	if err != nil {
+		return errorReply(fmt.Errorf("failed to create snapshot: %w", err))
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	h.scriptGate.RLock()
+	stream, size, err := h.DB.FullSync(spool)
+	h.scriptGate.RUnlock()
+	if err != nil {
+		return errorReply(err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return errorReply(err)
+	}
+	fmt.Printf("Full resync of replica %s at offset %d\n", c.Addr, stream.Offset())
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.replyQueued = true
+	w := bufio.NewWriterSize(&deadlineWriter{conn: c.Conn, timeout: h.output.WriteTimeout}, 64*1024)
+	fmt.Fprintf(w, "+FULLRESYNC %s %d\r\n$%d\r\n", stream.ID(), stream.Offset(), size)
+	io.Copy(w, spool)
+	w.WriteString("\r\n")
+	if err := w.Flush(); err != nil {
+		fmt.Printf("Closing replica %s: snapshot transfer failed: %v\n", c.Addr, err)
+		c.Conn.Close()
+		return resp.Value{}
+	}
+	h.attachReplica(c, stream)
+	return resp.Value{}
+}
+
+// replconfCommand handles the REPLCONF command.
+// Syntax: REPLCONF ACK offset | REPLCONF option value [option value ...]
+// ACK is how a replica reports the offset it applied, and gets no reply.
+// The other options a replica may send before PSYNC, like listening-port
+// and capa, are accepted and ignored.
+// Example: REPLCONF ACK 1034
+func replconfCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return wrongArgsError("replconf")
+	}
+	if strings.ToUpper(args[0].Str) == "ACK" {
+		offset, err := strconv.ParseInt(args[1].Str, 10, 64)
+		if err != nil {
+			return resp.NewError("ERR value is not an integer or out of range")
+		}
+		h.repl.mu.Lock()
+		if r, ok := h.repl.replicas[c]; ok {
+			r.stream.Ack(offset)
+		}
+		h.repl.mu.Unlock()
+		c.replyQueued = true
+		return resp.Value{}
+	}
+	for i := 0; i < len(args); i += 2 {
+		if strings.ToLower(args[i].Str) == "listening-port" {
+			port, err := strconv.Atoi(args[i+1].Str)
+			if err != nil || port <= 0 || port > 65535 {
+				return resp.NewError("ERR Invalid listening port")
+			}
+			c.replicaPort = port
+		}
+	}
+	return resp.NewSimpleString("OK")
+}
+
+// roleCommand handles the ROLE command.
+// Syntax: ROLE
+// Describes the server's part in replication. A master replies with
+// master, its replication offset and a host, port and acknowledged offset
+// for every replica that announced its port. A replica replies with
+// slave, the host and port of its master, the state of its link
+// (connecting, sync or connected) and its replication offset.
+// Example: ROLE
+func roleCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 0 {
+		return wrongArgsError("role")
+	}
+	offset := resp.NewInteger(h.DB.ReplicationOffset())
+
+	h.repl.mu.Lock()
+	defer h.repl.mu.Unlock()
+	if link := h.repl.master; link != nil {
+		host, port, _ := net.SplitHostPort(link.addr)
+		return resp.NewArray([]resp.Value{
+			resp.NewBulkString("slave"),
+			resp.NewBulkString(host),
+			resp.NewInteger(parsePort(port)),
+			resp.NewBulkString(link.state),
+			offset,
+		})
+	}
+
+	replicas := []resp.Value{}
+	for rc, r := range h.repl.replicas {
+		if rc.replicaPort == 0 {
+			continue
+		}
+		host, _, _ := net.SplitHostPort(rc.Addr)
+		replicas = append(replicas, resp.NewArray([]resp.Value{
+			resp.NewBulkString(host),
+			resp.NewBulkString(strconv.Itoa(rc.replicaPort)),
+			resp.NewBulkString(strconv.FormatInt(r.stream.Acked(), 10)),
+		}))
+	}
+	return resp.NewArray([]resp.Value{resp.NewBulkString("master"), offset, resp.NewArray(replicas)})
+}
+
+// ReplicationStatus is the replication state INFO replication and the
+// metrics report
+type ReplicationStatus struct {
+	Stream   db.ReplicationStats
+	Replicas []ReplicaStatus // replicas streaming from this server
+
+	// the master followed, with Master empty unless this server is a replica
+	Master    string    // host:port of the master
+	LinkState string    // connecting, sync or connected, as ROLE reports it
+	LastIO    time.Time // when the master last sent a command, zero if never
+	DownSince time.Time // when the link went down, zero while connected
+}
+
+// LinkUp reports whether the server is a replica applying its master's
+// stream
+func (s ReplicationStatus) LinkUp() bool {
+	return s.LinkState == linkConnected
+}
+
+// ReplicaStatus is a replica streaming from this server
+type ReplicaStatus struct {
+	Host    string
+	Port    int       // port the replica listens on, 0 if it didn't say
+	Acked   int64     // offset the replica acknowledged
+	LastAck time.Time // when it last acknowledged
+}
+
+// ReplicationStatus returns the replication state of the server
+func (h *Handler) ReplicationStatus() ReplicationStatus {
+	status := ReplicationStatus{Stream: h.DB.ReplicationStats()}
+
+	h.repl.mu.Lock()
+	defer h.repl.mu.Unlock()
+	for rc, r := range h.repl.replicas {
+		host, _, _ := net.SplitHostPort(rc.Addr)
+		status.Replicas = append(status.Replicas, ReplicaStatus{
+			Host:    host,
+			Port:    rc.replicaPort,
+			Acked:   r.stream.Acked(),
+			LastAck: r.stream.LastAck(),
+		})
+	}
+	sort.Slice(status.Replicas, func(i, j int) bool {
+		a, b := status.Replicas[i], status.Replicas[j]
+		return a.Host < b.Host || (a.Host == b.Host && a.Port < b.Port)
+	})
+	if link := h.repl.master; link != nil {
+		status.Master = link.addr
+		status.LinkState = link.state
+		status.LastIO = link.lastIO
+		status.DownSince = link.downSince
+	}
+	return status
+}
+
+// parsePort returns the number of a port validated when it was set
+func parsePort(port string) int64 {
+	n, _ := strconv.ParseInt(port, 10, 64)
+	return n
+}
+
+// replicaofCommand handles the REPLICAOF command, also called SLAVEOF.
+// Syntax: REPLICAOF host port | REPLICAOF NO ONE
+// Makes the server a read-only replica of the master at host:port,
+// dropping its keys for the master's unless it can continue from its
+// own replication stream. NO ONE stops following the master and makes
+// the server a master again, keeping its keys.
+// Example: REPLICAOF 10.0.0.1 9000
+func replicaofCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("replicaof")
+	}
+	if strings.ToUpper(args[0].Str) == "NO" && strings.ToUpper(args[1].Str) == "ONE" {
+		if h.stopFollowing() {
+			h.DB.Promote()
+			fmt.Println("Promoted to master")
+		}
+		return resp.NewSimpleString("OK")
+	}
+	port, err := strconv.Atoi(args[1].Str)
+	if err != nil || port <= 0 || port > 65535 {
+		return resp.NewError("ERR Invalid master port")
+	}
+	h.ReplicaOf(net.JoinHostPort(args[0].Str, args[1].Str))
+	return resp.NewSimpleString("OK")
+}
+
+// waitCommand handles the WAIT command.
+// Syntax: WAIT numreplicas timeout
+// Blocks until numreplicas replicas acknowledged every write made so far,
+// or until timeout milliseconds passed, 0 meaning forever. Replies with
+// how many replicas acknowledged them, which may be fewer on timeout.
+// Example: WAIT 1 500
+func waitCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("wait")
+	}
+	n, err := strconv.Atoi(args[0].Str)
+	if err != nil {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+	ms, err := strconv.ParseInt(args[1].Str, 10, 64)
+	if err != nil {
+		return resp.NewError("ERR timeout is not an integer or out of range")
+	}
+	if ms < 0 {
+		return resp.NewError("ERR timeout is negative")
+	}
+	if h.following() {
+		return resp.NewError("ERR WAIT cannot be used with replica instances")
+	}
+
+	wait := time.Duration(0) // forever, also for timeouts too long to represent
+	if ms < math.MaxInt64/int64(time.Millisecond) {
+		wait = time.Duration(ms) * time.Millisecond
+	}
+	ctx, cancel := h.blockingContext(c, wait)
+	defer cancel()
+	return resp.NewInteger(int64(h.DB.WaitForReplicas(ctx, n)))
+}
+
+// attachReplica streams the replication stream to the replica on c until
+// it disconnects, see detachReplica
+func (h *Handler) attachReplica(c *Client, stream *db.ReplicationStream) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.repl.mu.Lock()
+	if h.repl.replicas == nil {
+		h.repl.replicas = make(map[*Client]*attachedReplica)
+	}
+	h.repl.replicas[c] = &attachedReplica{stream: stream, cancel: cancel}
+	if !h.repl.pinging {
+		h.repl.pinging = true
+		go h.pingReplicas()
+	}
+	h.repl.mu.Unlock()
+
+	go h.streamTo(ctx, c, stream)
+}
+
+// detachReplica stops streaming to c, if it's a replica
+func (h *Handler) detachReplica(c *Client) {
+	h.repl.mu.Lock()
+	defer h.repl.mu.Unlock()
+	if r, ok := h.repl.replicas[c]; ok {
+		r.cancel()
+		r.stream.Close()
+		delete(h.repl.replicas, c)
+	}
+}
+
+// streamTo writes the stream to the replica on c until ctx is done. A
+// replica that fell behind the backlog is disconnected, and resyncs fully
+// when it reconnects.
+func (h *Handler) streamTo(ctx context.Context, c *Client, stream *db.ReplicationStream) {
+	for {
+		data, err := stream.Next(ctx, replChunkSize)
+		if err != nil {
+			if errors.Is(err, db.ErrBacklogOverrun) {
+				fmt.Printf("Closing replica %s: %v\n", c.Addr, err)
+				c.Conn.Close()
+			}
+			return
+		}
+
+		c.writeMu.Lock()
+		if h.output.WriteTimeout > 0 {
+			c.Conn.SetWriteDeadline(time.Now().Add(h.output.WriteTimeout))
+		}
+		c.writer.Write(data)
+		err = c.writer.Flush()
+		c.writeMu.Unlock()
+		if err != nil {
+			c.Conn.Close()
+			return
+		}
+	}
+}
+
+// pingReplicas adds a PING to the stream every replPingInterval until the
+// handler shuts down
+func (h *Handler) pingReplicas() {
+	ticker := time.NewTicker(replPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			h.DB.FeedPing()
+		}
+	}
+}
+
+// ReplicaOf makes the server a replica of the master at addr, replacing
+// the master it follows if any. Write commands are refused from then on.
+func (h *Handler) ReplicaOf(addr string) {
+	h.stopFollowing()
+	h.DB.BecomeReplica()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	link := &masterLink{addr: addr, cancel: cancel, done: make(chan struct{}), state: linkConnecting, downSince: time.Now()}
+	h.repl.mu.Lock()
+	h.repl.master = link
+	h.repl.mu.Unlock()
+	go h.followMaster(ctx, link)
+}
+
+// stopFollowing disconnects from the master and reports whether the
+// server was a replica
+func (h *Handler) stopFollowing() bool {
+	h.repl.mu.Lock()
+	link := h.repl.master
+	h.repl.master = nil
+	h.repl.mu.Unlock()
+	if link == nil {
+		return false
+	}
+	link.cancel()
+	<-link.done
+	return true
+}
+
+// following reports whether the server is a replica
+func (h *Handler) following() bool {
+	h.repl.mu.Lock()
+	defer h.repl.mu.Unlock()
+	return h.repl.master != nil
+}
+
+// followMaster applies the master's stream, reconnecting whenever the
+// link breaks, until ctx is done
+func (h *Handler) followMaster(ctx context.Context, link *masterLink) {
+	defer close(link.done)
+	select {
+	case <-h.DB.Loaded():
+	case <-ctx.Done():
+		return
+	}
+
+	for {
+		err := h.syncWithMaster(ctx, link)
+		h.setLinkState(link, linkConnecting)
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Printf("Lost master %s: %v\n", link.addr, err)
+		select {
+		case <-time.After(replReconnectDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// syncWithMaster connects to the master, resynchronizes and applies its
+// stream until the connection breaks or ctx is done
+func (h *Handler) syncWithMaster(ctx context.Context, link *masterLink) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", link.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-closed:
+		}
+	}()
+
+	r := bufio.NewReaderSize(conn, 64*1024)
+	var writeMu sync.Mutex
+	send := func(args ...string) error {
+		items := make([]resp.Value, len(args))
+		for i, arg := range args {
+			items[i] = resp.NewBulkString(arg)
+		}
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(replTimeout))
+		_, err := conn.Write(resp.Marshal(resp.NewArray(items)))
+		return err
+	}
+
+	if h.repl.masterAuth != "" {
+		if err := send("AUTH", h.repl.masterAuth); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		reply, err := resp.Parse(r)
+		if err != nil {
+			return err
+		}
+		if reply.Type == resp.Error {
+			return fmt.Errorf("AUTH failed: %s", reply.Str)
+		}
+	}
+
+	if h.repl.announcePort != 0 {
+		if err := send("REPLCONF", "listening-port", strconv.Itoa(h.repl.announcePort)); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		if _, err := resp.Parse(r); err != nil {
+			return err
+		}
+	}
+
+	h.setLinkState(link, linkSyncing)
+	offset := h.DB.ReplicationOffset()
+	if err := send("PSYNC", h.DB.ReplicationID(), strconv.FormatInt(offset+1, 10)); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(replTimeout))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) >= 1 && fields[0] == "+CONTINUE":
+		if len(fields) == 2 {
+			h.DB.ContinueReplication(fields[1])
+		}
+		fmt.Printf("Continuing from master %s at offset %d\n", link.addr, offset)
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		masterOffset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected PSYNC reply %q", strings.TrimSpace(line))
+		}
+		if err := h.loadMasterSnapshot(r, conn, fields[1], masterOffset); err != nil {
+			return err
+		}
+		fmt.Printf("Full resync from master %s done at offset %d\n", link.addr, masterOffset)
+	case strings.HasPrefix(line, "-"):
+		return errors.New(strings.TrimSpace(line[1:]))
+	default:
+		return fmt.Errorf("unexpected PSYNC reply %q", strings.TrimSpace(line))
+	}
+
+	h.setLinkState(link, linkConnected)
+	go func() {
+		ticker := time.NewTicker(replAckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closed:
+				return
+			case <-ticker.C:
+				if err := send("REPLCONF", "ACK", strconv.FormatInt(h.DB.ReplicationOffset(), 10)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		v, err := resp.Parse(r)
+		if err != nil {
+			return err
+		}
+		parts, err := streamCommand(v)
+		if err != nil {
+			return err
+		}
+		h.repl.mu.Lock()
+		link.lastIO = time.Now()
+		h.repl.mu.Unlock()
+		if err := h.DB.ApplyReplicated(parts); err != nil {
+			fmt.Printf("Error applying replicated %s: %v\n", parts[0], err)
+		}
+		// the acknowledged offset includes the GETACK itself
+		if len(parts) >= 2 && strings.EqualFold(parts[0], "REPLCONF") && strings.EqualFold(parts[1], "GETACK") {
+			if err := send("REPLCONF", "ACK", strconv.FormatInt(h.DB.ReplicationOffset(), 10)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// setLinkState records the state of link for ROLE
+func (h *Handler) setLinkState(link *masterLink, state string) {
+	h.repl.mu.Lock()
+	defer h.repl.mu.Unlock()
+	link.state = state
+	switch {
+	case state == linkConnected:
+		link.lastIO, link.downSince = time.Now(), time.Time{}
+	case link.downSince.IsZero():
+		link.downSince = time.Now()
+	}
+}
+
+// loadMasterSnapshot reads the snapshot of a full resynchronization into
+// a temporary file and replaces the keyspace with it
+func (h *Handler) loadMasterSnapshot(r *bufio.Reader, conn net.Conn, id string, offset int64) error {
+	conn.SetReadDeadline(time.Now().Add(replTimeout))
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(header, "$")), 10, 64)
+	if !strings.HasPrefix(header, "$") || err != nil || size < 0 {
+		return fmt.Errorf("unexpected snapshot header %q", strings.TrimSpace(header))
+	}
+
+	file, err := os.CreateTemp("", "flexdb-replica-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	// the deadline is pushed back as long as the snapshot keeps coming
+	_, err = io.CopyN(file, &deadlineReader{conn: conn, r: r, timeout: replTimeout}, size)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("snapshot transfer failed: %w", err)
+	}
+	if _, err := r.Discard(2); err != nil {
+		return err
+	}
+	return h.DB.LoadFullSync(file.Name(), id, offset)
+}
+
+// streamCommand returns the command and arguments of a command of the
+// replication stream
+func streamCommand(v resp.Value) ([]string, error) {
+	if v.Type != resp.Array || v.Null || len(v.Array) == 0 {
+		return nil, errors.New("replication stream holds something else than a command")
+	}
+	parts := make([]string, len(v.Array))
+	for i, item := range v.Array {
+		if item.Type != resp.BulkString || item.Null {
+			return nil, errors.New("replicated command argument is not a bulk string")
+		}
+		parts[i] = item.Str
+	}
+	return parts, nil
+}
+
+// deadlineReader reads from a connection through r, giving each read its
+// own deadline so a long transfer only fails if the connection stalls
+type deadlineReader struct {
+	conn    net.Conn
+	r       io.Reader
+	timeout time.Duration
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(d.timeout))
+	return d.r.Read(p)
+}
@@ -2,10 +2,10 @@ package protocol
 
 import (
 	"bufio"
+	"errors"
 	"flex-db/internal/db"
 	"flex-db/internal/resp"
 	"fmt"
-	"net"
 	"strings"
 )
 
@@ -13,57 +13,154 @@ type RESPHandler struct {
 	DB *db.FlexDB
 }
 
-func (h *Handler) HandleRESPConnection(conn net.Conn, reader *bufio.Reader) {
+func (h *Handler) HandleRESPConnection(client *Client, reader *bufio.Reader) {
+	conn := client.Conn
 	defer conn.Close()
-	addr := conn.RemoteAddr().String()
-	fmt.Printf("[+] RESP client connected: %s\n", addr)
-	defer fmt.Printf("[-] RESP client disconnted: %s\n", addr)
+	fmt.Printf("[+] RESP client connected: %s\n", client.Addr)
+	defer fmt.Printf("[-] RESP client disconnted: %s\n", client.Addr)
 
 	writer := bufio.NewWriter(conn)
+	client.writer = writer
 
 	for {
 		// parse the RESP command
-		value, err := resp.Parse(reader)
+		value, err := resp.ParseWithLimits(reader, h.limits)
 		if err != nil {
+			// the rest of an oversized request is still unread, so the
+			// connection can't be resynchronised and is closed
+			if errors.Is(err, resp.ErrLineTooLong) || errors.Is(err, resp.ErrRequestTooLarge) {
+				client.writeMu.Lock()
+				writer.Write(resp.Marshal(protocolError(err)))
+				writer.Flush()
+				client.writeMu.Unlock()
+			}
 			return
 		}
 
 		// command should be a arry of bulk strings
 		if value.Type != resp.Array || value.Null {
-			writeRESPError(writer, "ERR invalid command format")
+			h.reply(client, writer, resp.NewError("ERR invalid command format"))
 			continue
 		}
 
 		if len(value.Array) == 0 {
-			writeRESPError(writer, "ERR empty command")
+			h.reply(client, writer, resp.NewError("ERR empty command"))
+			continue
 		}
 
 		if value.Array[0].Type != resp.BulkString {
-			writeRESPError(writer, "ERR command must be a bulk string")
+			h.reply(client, writer, resp.NewError("ERR command must be a bulk string"))
+			continue
+		}
+
+		if h.faults != nil && h.faults.shouldDrop() {
+			return
 		}
 
 		cmd := value.Array[0].Str
 		args := value.Array[1:]
 
-		result := h.executeCommand(cmd, args)
-		writer.Write(resp.Marshal(result))
-		writer.Flush()
+		result := h.runCommand(client, cmd, args)
+		if client.takeReply() {
+			if err := h.reply(client, writer, result); err != nil {
+				return
+			}
+		}
 	}
 }
 
+// allowedWhileLoading lists the commands served before the dataset is
+// loaded. None of them touch the keyspace.
+var allowedWhileLoading = map[string]bool{
+	"AUTH":     true,
+	"HELLO":    true,
+	"CLIENT":   true,
+	"INFO":     true,
+	"TIME":     true,
+	"HELP":     true,
+	"SHUTDOWN": true,
+}
+
+// runCommand executes a command sent by a client. A write is only
+// answered once it's on disk when the AOF is synced always.
+func (h *Handler) runCommand(client *Client, cmd string, args []resp.Value) resp.Value {
+	result := h.executeCommand(client, cmd, args)
+	if h.registry.IsWrite(strings.ToUpper(cmd)) {
+		h.DB.WaitForAOFSync()
+	}
+	return result
+}
+
 // command executor and returns a RESP value
-func (h *Handler) executeCommand(cmd string, args []resp.Value) resp.Value {
+func (h *Handler) executeCommand(client *Client, cmd string, args []resp.Value) resp.Value {
 	cmd = strings.ToUpper(cmd)
 
 	handler, exists := h.registry.Get(cmd)
 	if !exists {
 		return resp.NewError(fmt.Sprintf("ERR unknown command '%s'", cmd))
 	}
-	return handler(h, args)
 
-}
+	// unauthenticated clients may only authenticate
+	if !client.Authenticated && cmd != "AUTH" && cmd != "HELLO" {
+		return resp.NewError("NOAUTH Authentication required.")
+	}
+
+	if client.subscriptions() > 0 && !subscribeModeCommands[cmd] {
+		return resp.NewError(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(cmd)))
+	}
+
+	if h.adminPort && !client.Admin && h.registry.IsAdmin(cmd) {
+		return resp.NewError(fmt.Sprintf("ERR '%s' is only allowed on the admin port", cmd))
+	}
+
+	if !allowedWhileLoading[cmd] && h.DB.Loading() {
+		return newClassError(errClassLoading, "FlexDB is loading the dataset in memory")
+	}
+
+	if h.cluster != nil {
+		if redirect := h.route(client, cmd, args); redirect != nil {
+			return *redirect
+		}
+	}
+
+	if h.raft != nil && raftRefused(cmd, args) {
+		return resp.NewError(fmt.Sprintf("ERR '%s' is not available with Raft replication", cmd))
+	}
+
+	if h.registry.IsWrite(cmd) {
+		if h.following() {
+			return newClassError(errClassReadOnly, "You can't write against a read only replica.")
+		}
+		if h.stopWrites {
+			if err := h.DB.PersistenceError(); err != nil {
+				return newClassError(errClassMisconf, "Persistence is failing, writes are refused until it recovers: "+err.Error())
+			}
+		}
+		h.DB.WaitForPersistence()
+	}
+
+	client.recordCommand(cmd, args)
+
+	// DEBUG stays fast so injected faults can always be turned off
+	if h.faults != nil && cmd != "DEBUG" {
+		h.faults.delay()
+	}
+
+	// writes are applied through the Raft log, see raft.go
+	if h.raft != nil && h.registry.IsWrite(cmd) {
+		return h.proposeWrite(client, cmd, args)
+	}
+
+	// commands of a script run under the script's exclusive hold
+	if client.inScript {
+		if noScript[cmd] {
+			return resp.NewError(fmt.Sprintf("ERR '%s' is not allowed from scripts", cmd))
+		}
+	} else if !runsScript[cmd] && !locksScriptGate[cmd] {
+		h.scriptGate.RLock()
+		defer h.scriptGate.RUnlock()
+	}
+
+	return handler(h, client, args)
 
-func writeRESPError(writer *bufio.Writer, msg string) {
-	writer.Write(resp.Marshal(resp.NewError(msg)))
-	writer.Flush()
 }
@@ -0,0 +1,423 @@
+package protocol
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"flex-db/internal/resp"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// scriptTimeout bounds how long a script may hold the server. A script
+// stopped by it keeps the writes it already made.
+const scriptTimeout = 5 * time.Second
+
+// runsScript lists the commands that take the script gate exclusively
+// instead of sharing it
+var runsScript = map[string]bool{
+	"EVAL":    true,
+	"EVALSHA": true,
+}
+
+// locksScriptGate lists the commands that share the script gate only for
+// part of their run, taking it themselves
+var locksScriptGate = map[string]bool{
+	"SYNC":  true,
+	"PSYNC": true,
+}
+
+// noScript lists the commands scripts may not call
+var noScript = map[string]bool{
+	"EVAL":         true,
+	"EVALSHA":      true,
+	"SCRIPT":       true,
+	"AUTH":         true,
+	"HELLO":        true,
+	"CLIENT":       true,
+	"SHUTDOWN":     true,
+	"SYNC":         true,
+	"PSYNC":        true,
+	"REPLCONF":     true,
+	"REPLICAOF":    true,
+	"SLAVEOF":      true,
+	"WAIT":         true,
+	"RAFT":         true,
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+}
+
+// registerScriptCommands registers the Lua scripting commands
+func (r *CommandRegistry) registerScriptCommands() {
+	r.RegisterWrite("EVAL", evalCommand)
+	r.RegisterWrite("EVALSHA", evalshaCommand)
+	r.Register("SCRIPT", scriptCommand)
+}
+
+// scriptCache holds compiled scripts by the SHA1 of their source
+type scriptCache struct {
+	mu     sync.Mutex
+	protos map[string]*lua.FunctionProto
+}
+
+// load compiles a script, caches it and returns its SHA1
+func (sc *scriptCache) load(source string) (string, *lua.FunctionProto, error) {
+	sum := sha1.Sum([]byte(source))
+	sha := hex.EncodeToString(sum[:])
+	if proto, ok := sc.get(sha); ok {
+		return sha, proto, nil
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(source), "user_script")
+	if err != nil {
+		return "", nil, err
+	}
+	proto, err := lua.Compile(chunk, "user_script")
+	if err != nil {
+		return "", nil, err
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.protos == nil {
+		sc.protos = make(map[string]*lua.FunctionProto)
+	}
+	sc.protos[sha] = proto
+	return sha, proto, nil
+}
+
+// get returns the compiled script with the given SHA1
+func (sc *scriptCache) get(sha string) (*lua.FunctionProto, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	proto, ok := sc.protos[strings.ToLower(sha)]
+	return proto, ok
+}
+
+// flush forgets every script
+func (sc *scriptCache) flush() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.protos = nil
+}
+
+// evalCommand handles the EVAL command.
+// Syntax: EVAL script numkeys [key ...] [arg ...]
+// Runs a Lua script with the keys in KEYS and the other arguments in
+// ARGV. The script calls commands with redis.call, which raises command
+// errors, or redis.pcall, which returns them as {err=...} tables. No other
+// command runs while a script does, so scripts are atomic.
+// Returns the value the script returns, converted as Redis does.
+// Example: EVAL "return redis.call('INCRBY', KEYS[1], ARGV[1])" 1 hits 5
+func evalCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("eval")
+	}
+
+	_, proto, err := h.scripts.load(args[0].Str)
+	if err != nil {
+		return resp.NewError("ERR Error compiling script: " + scriptErrorText(err))
+	}
+	return h.runScript(c, proto, args[1:])
+}
+
+// evalshaCommand handles the EVALSHA command.
+// Syntax: EVALSHA sha1 numkeys [key ...] [arg ...]
+// Runs a script loaded with SCRIPT LOAD or an earlier EVAL, like EVAL.
+// Example: EVALSHA 6b1bf486c81ceb7edf3c093f4c48582e38c0e791 1 hits 5
+func evalshaCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("evalsha")
+	}
+
+	proto, ok := h.scripts.get(args[0].Str)
+	if !ok {
+		return resp.NewError("NOSCRIPT No matching script. Please use EVAL.")
+	}
+	return h.runScript(c, proto, args[1:])
+}
+
+var scriptHelp = []string{
+	"SCRIPT <subcommand> [<arg> ...]. Subcommands are:",
+	"LOAD <script>",
+	"    Cache a script and return its SHA1 for EVALSHA.",
+	"EXISTS <sha1> [<sha1> ...]",
+	"    Return 1 or 0 for each SHA1, whether the script is cached.",
+	"FLUSH",
+	"    Forget every cached script.",
+	"HELP",
+	"    Print this help.",
+}
+
+// scriptCommand handles the SCRIPT command.
+// Syntax: SCRIPT LOAD script | SCRIPT EXISTS sha1 [sha1 ...] | SCRIPT FLUSH
+// Manages the cache of scripts run with EVALSHA. The cache is kept in
+// memory, so clients should fall back to EVAL on NOSCRIPT errors.
+// Example: SCRIPT LOAD "return redis.call('GET', KEYS[1])"
+func scriptCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("script")
+	}
+
+	name := args[0].Str
+	switch strings.ToUpper(name) {
+	case "HELP":
+		lines := make([]resp.Value, len(scriptHelp))
+		for i, line := range scriptHelp {
+			lines[i] = resp.NewSimpleString(line)
+		}
+		return resp.NewArray(lines)
+
+	case "LOAD":
+		if len(args) != 2 {
+			return wrongArgsError("script|load")
+		}
+		sha, _, err := h.scripts.load(args[1].Str)
+		if err != nil {
+			return resp.NewError("ERR Error compiling script: " + scriptErrorText(err))
+		}
+		return resp.NewBulkString(sha)
+
+	case "EXISTS":
+		if len(args) < 2 {
+			return wrongArgsError("script|exists")
+		}
+		result := make([]resp.Value, len(args)-1)
+		for i, arg := range args[1:] {
+			result[i] = resp.NewInteger(0)
+			if _, ok := h.scripts.get(arg.Str); ok {
+				result[i] = resp.NewInteger(1)
+			}
+		}
+		return resp.NewArray(result)
+
+	case "FLUSH":
+		h.scripts.flush()
+		return resp.NewSimpleString("OK")
+
+	default:
+		return resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try SCRIPT HELP.", name))
+	}
+}
+
+// runScript runs a compiled script with "numkeys key... arg..." as args,
+// holding the script gate so no other command runs meanwhile
+func (h *Handler) runScript(c *Client, proto *lua.FunctionProto, args []resp.Value) resp.Value {
+	numKeys, err := strconv.Atoi(args[0].Str)
+	if err != nil {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+	if numKeys < 0 {
+		return resp.NewError("ERR Number of keys can't be negative")
+	}
+	if numKeys > len(args)-1 {
+		return resp.NewError("ERR Number of keys can't be greater than number of args")
+	}
+
+	h.scriptGate.Lock()
+	defer h.scriptGate.Unlock()
+	c.inScript = true
+	defer func() { c.inScript = false }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	defer cancel()
+	L := newScriptState(h, c, args[1:1+numKeys], args[1+numKeys:])
+	defer L.Close()
+	L.SetContext(ctx)
+
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 1, nil); err != nil {
+		if ctx.Err() != nil {
+			return resp.NewError(fmt.Sprintf("ERR script stopped after running for %v; writes it made were kept", scriptTimeout))
+		}
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			if t, ok := apiErr.Object.(*lua.LTable); ok {
+				if msg, ok := t.RawGetString("err").(lua.LString); ok {
+					return resp.NewError(string(msg))
+				}
+			}
+			err = errors.New(apiErr.Object.String())
+		}
+		return resp.NewError("ERR Error running script: " + scriptErrorText(err))
+	}
+	return fromLua(L.Get(-1))
+}
+
+// scriptErrorText returns a Lua error message on one line, as error
+// replies can't hold line breaks
+func scriptErrorText(err error) string {
+	return strings.Join(strings.Fields(err.Error()), " ")
+}
+
+// newScriptState creates the interpreter of one script run, with the
+// base, table, string and math libraries, but nothing touching files or
+// the process
+func newScriptState(h *Handler, c *Client, keys, argv []resp.Value) *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	L.SetGlobal("KEYS", stringsTable(L, keys))
+	L.SetGlobal("ARGV", stringsTable(L, argv))
+
+	redis := L.NewTable()
+	L.SetField(redis, "call", L.NewFunction(func(L *lua.LState) int {
+		return scriptCall(L, h, c, false)
+	}))
+	L.SetField(redis, "pcall", L.NewFunction(func(L *lua.LState) int {
+		return scriptCall(L, h, c, true)
+	}))
+	L.SetField(redis, "error_reply", L.NewFunction(func(L *lua.LState) int {
+		L.Push(replyTable(L, "err", L.CheckString(1)))
+		return 1
+	}))
+	L.SetField(redis, "status_reply", L.NewFunction(func(L *lua.LState) int {
+		L.Push(replyTable(L, "ok", L.CheckString(1)))
+		return 1
+	}))
+	L.SetGlobal("redis", redis)
+	return L
+}
+
+// scriptCall runs the command given as arguments to redis.call, or to
+// redis.pcall when protected, and pushes its reply
+func scriptCall(L *lua.LState, h *Handler, c *Client, protected bool) int {
+	n := L.GetTop()
+	if n == 0 {
+		L.RaiseError("please specify at least one argument for redis.call()")
+	}
+	args := make([]resp.Value, n)
+	for i := 1; i <= n; i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString:
+			args[i-1] = resp.NewBulkString(string(v))
+		case lua.LNumber:
+			args[i-1] = resp.NewBulkString(formatLuaNumber(v))
+		default:
+			L.RaiseError("Lua redis() command arguments must be strings or integers")
+		}
+	}
+
+	reply := h.executeCommand(c, args[0].Str, args[1:])
+	if reply.Type == resp.Error && !protected {
+		L.Error(replyTable(L, "err", reply.Str), 0)
+	}
+	L.Push(toLua(L, reply))
+	return 1
+}
+
+// formatLuaNumber formats a number passed to redis.call, integers without
+// a fraction
+func formatLuaNumber(n lua.LNumber) string {
+	f := float64(n)
+	if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'g', 17, 64)
+}
+
+// stringsTable returns the values as a Lua array of strings
+func stringsTable(L *lua.LState, values []resp.Value) *lua.LTable {
+	t := L.CreateTable(len(values), 0)
+	for _, v := range values {
+		t.Append(lua.LString(v.Str))
+	}
+	return t
+}
+
+// replyTable returns the {ok=...} or {err=...} table standing for a
+// status or error reply
+func replyTable(L *lua.LState, field, msg string) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString(field, lua.LString(msg))
+	return t
+}
+
+// toLua converts a command reply for a script: integers become numbers,
+// bulk strings strings, nil replies false, arrays tables, and status and
+// error replies {ok=...} and {err=...} tables
+func toLua(L *lua.LState, v resp.Value) lua.LValue {
+	switch v.Type {
+	case resp.Integer:
+		return lua.LNumber(v.Int)
+	case resp.SimpleString:
+		return replyTable(L, "ok", v.Str)
+	case resp.Error:
+		return replyTable(L, "err", v.Str)
+	case resp.Array:
+		if v.Null {
+			return lua.LFalse
+		}
+		t := L.CreateTable(len(v.Array), 0)
+		for _, item := range v.Array {
+			t.Append(toLua(L, item))
+		}
+		return t
+	default:
+		if v.Null {
+			return lua.LFalse
+		}
+		return lua.LString(v.Str)
+	}
+}
+
+// fromLua converts the value a script returns to a reply, the reverse of
+// toLua: numbers are truncated to integers, true becomes 1 and false nil,
+// and arrays stop at their first nil
+func fromLua(lv lua.LValue) resp.Value {
+	switch v := lv.(type) {
+	case lua.LNumber:
+		return resp.NewInteger(int64(v))
+	case lua.LString:
+		return resp.NewBulkString(string(v))
+	case lua.LBool:
+		if v {
+			return resp.NewInteger(1)
+		}
+		return resp.NewNullBulkString()
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			return resp.NewError(string(msg))
+		}
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			return resp.NewSimpleString(string(msg))
+		}
+		var items []resp.Value
+		for i := 1; ; i++ {
+			item := v.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			items = append(items, fromLua(item))
+		}
+		return resp.NewArray(items)
+	default:
+		return resp.NewNullBulkString()
+	}
+}
@@ -0,0 +1,255 @@
+package protocol
+
+import (
+	"strconv"
+
+	"flex-db/internal/resp"
+)
+
+// registerSetCommands registers the set commands
+func (r *CommandRegistry) registerSetCommands() {
+	r.RegisterWrite("SADD", saddCommand)
+	r.RegisterWrite("SREM", sremCommand)
+	r.Register("SMEMBERS", smembersCommand)
+	r.Register("SISMEMBER", sismemberCommand)
+	r.Register("SCARD", scardCommand)
+	r.Register("SSCAN", sscanCommand)
+	r.Register("SINTER", sinterCommand)
+	r.Register("SUNION", sunionCommand)
+	r.Register("SDIFF", sdiffCommand)
+	r.RegisterWrite("SINTERSTORE", sinterstoreCommand)
+	r.RegisterWrite("SUNIONSTORE", sunionstoreCommand)
+	r.RegisterWrite("SDIFFSTORE", sdiffstoreCommand)
+}
+
+// saddCommand handles the SADD command.
+// Syntax: SADD key member [member ...]
+// Adds members to the set stored at key, creating it if needed.
+// Returns the number of members that were new.
+// Example: SADD tags:post:1 go databases
+func saddCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("sadd")
+	}
+
+	added, err := h.DB.SAdd(args[0].Str, argStrings(args[1:])...)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(added))
+}
+
+// sremCommand handles the SREM command.
+// Syntax: SREM key member [member ...]
+// Removes members from a set. The key is deleted once the set is empty.
+// Returns the number of members that were removed.
+// Example: SREM tags:post:1 go
+func sremCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("srem")
+	}
+
+	removed, err := h.DB.SRem(args[0].Str, argStrings(args[1:])...)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(removed))
+}
+
+// smembersCommand handles the SMEMBERS command.
+// Syntax: SMEMBERS key
+// Returns the members of a set, sorted, or an empty array if the key
+// doesn't exist.
+// Example: SMEMBERS tags:post:1
+func smembersCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("smembers")
+	}
+
+	members, err := h.DB.SMembers(args[0].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	return membersReply(members)
+}
+
+// sismemberCommand handles the SISMEMBER command.
+// Syntax: SISMEMBER key member
+// Returns 1 if member is in the set, 0 otherwise.
+// Example: SISMEMBER tags:post:1 go
+func sismemberCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("sismember")
+	}
+
+	found, err := h.DB.SIsMember(args[0].Str, args[1].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	if found {
+		return resp.NewInteger(1)
+	}
+	return resp.NewInteger(0)
+}
+
+// scardCommand handles the SCARD command.
+// Syntax: SCARD key
+// Returns the number of members of a set, 0 if the key doesn't exist.
+// Example: SCARD tags:post:1
+func scardCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("scard")
+	}
+
+	length, err := h.DB.SCard(args[0].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(length))
+}
+
+// sscanCommand handles the SSCAN command.
+// Syntax: SSCAN key cursor [MATCH pattern] [COUNT count]
+// Iterates the members of a set like SCAN iterates keys.
+// Returns [cursor, [member, ...]].
+// Example: SSCAN tags 0 COUNT 100
+func sscanCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("sscan")
+	}
+	opts, errReply := h.parseScanArgs("sscan", args[1:], false)
+	if errReply != nil {
+		return *errReply
+	}
+	cursor, errReply := parseScanCursor(args[1].Str)
+	if errReply != nil {
+		return *errReply
+	}
+
+	members, next, err := h.DB.SScan(args[0].Str, cursor, opts.pattern, opts.count)
+	if err != nil {
+		return errorReply(err)
+	}
+	return scanReply(strconv.FormatUint(next, 10), membersReply(members))
+}
+
+// sinterCommand handles the SINTER command.
+// Syntax: SINTER key [key ...]
+// Missing keys count as empty sets.
+// Returns the members present in every set, sorted.
+// Example: SINTER tags:post:1 tags:post:2
+func sinterCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("sinter")
+	}
+
+	members, err := h.DB.SInter(argStrings(args)...)
+	if err != nil {
+		return errorReply(err)
+	}
+	return membersReply(members)
+}
+
+// sunionCommand handles the SUNION command.
+// Syntax: SUNION key [key ...]
+// Returns the members present in any of the sets, sorted.
+// Example: SUNION tags:post:1 tags:post:2
+func sunionCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("sunion")
+	}
+
+	members, err := h.DB.SUnion(argStrings(args)...)
+	if err != nil {
+		return errorReply(err)
+	}
+	return membersReply(members)
+}
+
+// sdiffCommand handles the SDIFF command.
+// Syntax: SDIFF key [key ...]
+// Returns the members of the first set missing from all the others,
+// sorted.
+// Example: SDIFF tags:post:1 tags:post:2
+func sdiffCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("sdiff")
+	}
+
+	members, err := h.DB.SDiff(argStrings(args)...)
+	if err != nil {
+		return errorReply(err)
+	}
+	return membersReply(members)
+}
+
+// sinterstoreCommand handles the SINTERSTORE command.
+// Syntax: SINTERSTORE destination key [key ...]
+// Stores the intersection of the sets in destination, replacing it. An
+// empty result deletes destination.
+// Returns the size of the stored set.
+// Example: SINTERSTORE common tags:post:1 tags:post:2
+func sinterstoreCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("sinterstore")
+	}
+
+	size, err := h.DB.SInterStore(args[0].Str, argStrings(args[1:])...)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(size))
+}
+
+// sunionstoreCommand handles the SUNIONSTORE command.
+// Syntax: SUNIONSTORE destination key [key ...]
+// Stores the union of the sets in destination, replacing it.
+// Returns the size of the stored set.
+// Example: SUNIONSTORE all tags:post:1 tags:post:2
+func sunionstoreCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("sunionstore")
+	}
+
+	size, err := h.DB.SUnionStore(args[0].Str, argStrings(args[1:])...)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(size))
+}
+
+// sdiffstoreCommand handles the SDIFFSTORE command.
+// Syntax: SDIFFSTORE destination key [key ...]
+// Stores the difference of the sets in destination, replacing it. An
+// empty result deletes destination.
+// Returns the size of the stored set.
+// Example: SDIFFSTORE only1 tags:post:1 tags:post:2
+func sdiffstoreCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("sdiffstore")
+	}
+
+	size, err := h.DB.SDiffStore(args[0].Str, argStrings(args[1:])...)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(size))
+}
+
+// argStrings returns the string form of command arguments
+func argStrings(args []resp.Value) []string {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = arg.Str
+	}
+	return strs
+}
+
+// membersReply returns set members as an array of bulk strings
+func membersReply(members []string) resp.Value {
+	result := make([]resp.Value, len(members))
+	for i, member := range members {
+		result[i] = resp.NewBulkString(member)
+	}
+	return resp.NewArray(result)
+}
@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	"strconv"
+	"time"
+
+	"flex-db/internal/resp"
+)
+
+// registerTagCommands registers the key tagging commands
+func (r *CommandRegistry) registerTagCommands() {
+	r.RegisterWrite("TAG", tagCommand)
+	r.RegisterWrite("UNTAG", untagCommand)
+	r.Register("TAGS", tagsCommand)
+	r.Register("KEYSBYTAG", keysbytagCommand)
+	r.RegisterWrite("DELBYTAG", delbytagCommand)
+	r.RegisterWrite("EXPIREBYTAG", expirebytagCommand)
+}
+
+// tagCommand handles the TAG command.
+// Syntax: TAG key tag [tag ...]
+// Attaches tags to an existing key. Tags stay when the value is
+// overwritten and go when the key is deleted or expires.
+// Returns the number of tags the key didn't have yet.
+// Example: TAG user:42 tenant:acme beta
+func tagCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("tag")
+	}
+
+	tags := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		tags[i] = arg.Str
+	}
+	added, err := h.DB.Tag(args[0].Str, tags...)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(added))
+}
+
+// untagCommand handles the UNTAG command.
+// Syntax: UNTAG key tag [tag ...]
+// Returns the number of tags removed from the key.
+// Example: UNTAG user:42 beta
+func untagCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("untag")
+	}
+
+	tags := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		tags[i] = arg.Str
+	}
+	return resp.NewInteger(int64(h.DB.Untag(args[0].Str, tags...)))
+}
+
+// tagsCommand handles the TAGS command.
+// Syntax: TAGS key
+// Returns the tags of a key, sorted.
+// Example: TAGS user:42
+func tagsCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("tags")
+	}
+
+	tags, err := h.DB.Tags(args[0].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	result := make([]resp.Value, len(tags))
+	for i, tag := range tags {
+		result[i] = resp.NewBulkString(tag)
+	}
+	return resp.NewArray(result)
+}
+
+// keysbytagCommand handles the KEYSBYTAG command.
+// Syntax: KEYSBYTAG tag
+// Returns the keys carrying a tag, sorted. The lookup uses the tag index
+// and doesn't scan the keyspace.
+// Example: KEYSBYTAG tenant:acme
+func keysbytagCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("keysbytag")
+	}
+
+	keys := h.DB.TaggedKeys(args[0].Str)
+	result := make([]resp.Value, len(keys))
+	for i, key := range keys {
+		result[i] = resp.NewBulkString(key)
+	}
+	return resp.NewArray(result)
+}
+
+// delbytagCommand handles the DELBYTAG command.
+// Syntax: DELBYTAG tag [FORCE]
+// Deletes every key carrying a tag, in batches like DELPATTERN, and like
+// it needs FORCE for more keys than the confirmation limit.
+// Returns the number of deleted keys.
+// Example: DELBYTAG tenant:acme FORCE
+func delbytagCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 && len(args) != 2 {
+		return wrongArgsError("delbytag")
+	}
+
+	tag := args[0].Str
+	if errReply := h.confirmBulk("DELBYTAG", "delete", h.tagCount(tag), args[1:]); errReply != nil {
+		return *errReply
+	}
+
+	return resp.NewInteger(int64(h.DB.DeleteTagged(tag)))
+}
+
+// expirebytagCommand handles the EXPIREBYTAG command.
+// Syntax: EXPIREBYTAG tag seconds [FORCE]
+// Sets a TTL on every key carrying a tag, in batches like EXPIREPATTERN.
+// Returns the number of keys that got the TTL.
+// Example: EXPIREBYTAG tenant:acme 3600
+func expirebytagCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 && len(args) != 3 {
+		return wrongArgsError("expirebytag")
+	}
+
+	tag := args[0].Str
+	seconds, err := strconv.ParseInt(args[1].Str, 10, 64)
+	if err != nil {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+	if errReply := h.confirmBulk("EXPIREBYTAG", "expire", h.tagCount(tag), args[2:]); errReply != nil {
+		return *errReply
+	}
+
+	return resp.NewInteger(int64(h.DB.ExpireTagged(tag, time.Duration(seconds)*time.Second)))
+}
+
+// tagCount returns a function counting the keys carrying tag, for
+// confirmBulk
+func (h *Handler) tagCount(tag string) func() int {
+	return func() int {
+		return len(h.DB.TaggedKeys(tag))
+	}
+}
@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+
+	"flex-db/internal/resp"
+)
+
+// The text protocol answers every command with exactly one reply. A reply
+// starts with a status line whose first word names its type:
+//
+//	OK [message]   status reply, e.g. "OK" or "OK PONG"
+//	ERR <message>  error reply
+//	NIL            missing value
+//	INT <n>        integer reply
+//	STR <len>      string reply, followed by a line holding exactly len bytes
+//	ARR <n>        array reply, followed by n nested replies
+//
+// Every line ends with "\n", so clients can read replies line by line and
+// only need the length of STR payloads to stay in sync.
+
+// writeTextReply writes v to the writer using the text reply grammar
+func writeTextReply(writer *bufio.Writer, v resp.Value) {
+	switch v.Type {
+	case resp.SimpleString:
+		if v.Str == "" || v.Str == "OK" {
+			writer.WriteString("OK\n")
+		} else {
+			fmt.Fprintf(writer, "OK %s\n", v.Str)
+		}
+	case resp.Error:
+		fmt.Fprintf(writer, "ERR %s\n", strings.TrimPrefix(v.Str, "ERR "))
+	case resp.Integer:
+		fmt.Fprintf(writer, "INT %d\n", v.Int)
+	case resp.BulkString:
+		if v.Null {
+			writer.WriteString("NIL\n")
+			return
+		}
+		fmt.Fprintf(writer, "STR %d\n%s\n", len(v.Str), v.Str)
+	case resp.Array:
+		if v.Null {
+			writer.WriteString("NIL\n")
+			return
+		}
+		fmt.Fprintf(writer, "ARR %d\n", len(v.Array))
+		for _, item := range v.Array {
+			writeTextReply(writer, item)
+		}
+	default:
+		writer.WriteString("ERR unknown reply type\n")
+	}
+}
+
+// splitTextArgs splits a text protocol line into arguments.
+// Arguments are separated by whitespace; double quotes group an argument
+// that contains spaces, e.g. SET greeting "hello world"
+func splitTextArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inQuotes := false
+	hasArg := false
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+			hasArg = true
+		case (c == ' ' || c == '\t') && !inQuotes:
+			if hasArg {
+				args = append(args, current.String())
+				current.Reset()
+				hasArg = false
+			}
+		default:
+			current.WriteByte(c)
+			hasArg = true
+		}
+	}
+
+	if inQuotes {
+		return nil, errors.New("unbalanced quotes in request")
+	}
+
+	if hasArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"math"
+	"time"
+
+	"flex-db/internal/resp"
+	"flex-db/internal/utils"
+)
+
+// registerThrottleCommands registers the rate limiting commands
+func (r *CommandRegistry) registerThrottleCommands() {
+	r.RegisterWrite("THROTTLE", throttleCommand)
+}
+
+// throttleCommand handles the THROTTLE command.
+// Syntax: THROTTLE key max_burst count period [quantity]
+// Rate limits key to count requests every period seconds, with bursts of
+// up to max_burst extra requests, and counts quantity requests (default
+// 1) against it if they fit.
+// Returns an array of: 0 if allowed or 1 if limited, the limit
+// (max_burst + 1), the remaining requests, seconds until a retry would be
+// allowed (-1 if allowed) and seconds until the limit fully resets.
+// Example: THROTTLE user:42 15 30 60
+func throttleCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 4 && len(args) != 5 {
+		return wrongArgsError("throttle")
+	}
+
+	numbers := make([]int64, 4)
+	numbers[3] = 1
+	for i, arg := range args[1:] {
+		n, err := utils.ParseInt(arg.Str)
+		if err != nil || n < 0 {
+			return resp.NewError("ERR value is not an integer or out of range")
+		}
+		numbers[i] = n
+	}
+	maxBurst, count, period, quantity := numbers[0], numbers[1], numbers[2], numbers[3]
+	if count == 0 || period == 0 {
+		return resp.NewError("ERR count and period must be positive")
+	}
+
+	result, err := h.DB.Throttle(args[0].Str, maxBurst, count, time.Duration(period)*time.Second, quantity)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	limited, retryAfter := int64(1), ceilSeconds(result.RetryAfter)
+	if result.Allowed {
+		limited, retryAfter = 0, -1
+	}
+	return resp.NewArray([]resp.Value{
+		resp.NewInteger(limited),
+		resp.NewInteger(result.Limit),
+		resp.NewInteger(result.Remaining),
+		resp.NewInteger(retryAfter),
+		resp.NewInteger(ceilSeconds(result.ResetAfter)),
+	})
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,183 @@
+package protocol
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+	"flex-db/internal/utils"
+)
+
+// registerTimeSeriesCommands registers the time series commands
+func (r *CommandRegistry) registerTimeSeriesCommands() {
+	r.RegisterWrite("TS.CREATE", tsCreateCommand)
+	r.RegisterWrite("TS.ADD", tsAddCommand)
+	r.Register("TS.GET", tsGetCommand)
+	r.Register("TS.RANGE", tsRangeCommand)
+}
+
+// tsCreateCommand handles the TS.CREATE command.
+// Syntax: TS.CREATE key [RETENTION ms]
+// Creates an empty time series. With RETENTION, samples more than ms
+// milliseconds older than the newest one are dropped.
+// Returns OK, or an error if the key exists.
+// Example: TS.CREATE cpu:host1 RETENTION 86400000
+func tsCreateCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 && len(args) != 3 {
+		return wrongArgsError("ts.create")
+	}
+	retention, errReply := parseRetention(args[1:])
+	if errReply != nil {
+		return *errReply
+	}
+
+	if err := h.DB.TSCreate(args[0].Str, retention); err != nil {
+		return errorReply(err)
+	}
+	return resp.NewSimpleString("OK")
+}
+
+// tsAddCommand handles the TS.ADD command.
+// Syntax: TS.ADD key timestamp|* value [RETENTION ms]
+// Adds a sample, replacing any sample with the same timestamp. The
+// timestamp is in unix milliseconds, * meaning now. A missing series is
+// created, with RETENTION if given.
+// Returns the timestamp of the sample.
+// Example: TS.ADD cpu:host1 * 42.5
+func tsAddCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 3 && len(args) != 5 {
+		return wrongArgsError("ts.add")
+	}
+	retention, errReply := parseRetention(args[3:])
+	if errReply != nil {
+		return *errReply
+	}
+
+	var timestamp int64
+	if args[1].Str == "*" {
+		timestamp = time.Now().UnixMilli()
+	} else {
+		t, err := utils.ParseInt(args[1].Str)
+		if err != nil || t < 0 {
+			return resp.NewError("ERR invalid timestamp")
+		}
+		timestamp = t
+	}
+	value, err := strconv.ParseFloat(args[2].Str, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return resp.NewError("ERR value is not a valid float")
+	}
+
+	sample := db.Sample{Timestamp: timestamp, Value: value}
+	if err := h.DB.TSAdd(args[0].Str, sample, retention); err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(timestamp)
+}
+
+// tsGetCommand handles the TS.GET command.
+// Syntax: TS.GET key
+// Returns the newest sample as [timestamp, value], or nil if the series
+// is empty or doesn't exist.
+// Example: TS.GET cpu:host1
+func tsGetCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("ts.get")
+	}
+
+	sample, found, err := h.DB.TSGet(args[0].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !found {
+		return resp.NewNullArray()
+	}
+	return sampleReply(sample)
+}
+
+// tsRangeCommand handles the TS.RANGE command.
+// Syntax: TS.RANGE key from to [AGGREGATION avg|sum|min|max|count bucket_ms]
+// Returns the samples from from to to, both inclusive, as [timestamp,
+// value] pairs. from may be - and to may be + for the oldest and newest
+// samples. AGGREGATION groups samples into buckets of bucket_ms aligned
+// to the epoch and returns one sample per non-empty bucket, stamped with
+// the bucket's start.
+// Example: TS.RANGE cpu:host1 - + AGGREGATION avg 60000
+func tsRangeCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 3 && len(args) != 6 {
+		return wrongArgsError("ts.range")
+	}
+
+	from, to := int64(0), int64(math.MaxInt64)
+	if args[1].Str != "-" {
+		t, err := utils.ParseInt(args[1].Str)
+		if err != nil {
+			return resp.NewError("ERR invalid timestamp")
+		}
+		from = t
+	}
+	if args[2].Str != "+" {
+		t, err := utils.ParseInt(args[2].Str)
+		if err != nil {
+			return resp.NewError("ERR invalid timestamp")
+		}
+		to = t
+	}
+
+	var agg db.Aggregation
+	var bucket time.Duration
+	if len(args) == 6 {
+		if !strings.EqualFold(args[3].Str, "AGGREGATION") {
+			return resp.NewError("ERR syntax error")
+		}
+		var ok bool
+		agg, ok = db.Aggregations[strings.ToLower(args[4].Str)]
+		if !ok {
+			return resp.NewError("ERR unknown aggregation '" + args[4].Str + "'")
+		}
+		ms, err := utils.ParseInt(args[5].Str)
+		if err != nil || ms <= 0 {
+			return resp.NewError("ERR bucket duration must be a positive integer")
+		}
+		bucket = time.Duration(ms) * time.Millisecond
+	}
+
+	samples, err := h.DB.TSRange(args[0].Str, from, to, agg, bucket)
+	if err != nil {
+		return errorReply(err)
+	}
+	result := make([]resp.Value, len(samples))
+	for i, s := range samples {
+		result[i] = sampleReply(s)
+	}
+	return resp.NewArray(result)
+}
+
+// parseRetention parses the optional "RETENTION ms" of the time series
+// commands, 0 meaning samples are kept forever
+func parseRetention(args []resp.Value) (time.Duration, *resp.Value) {
+	if len(args) == 0 {
+		return 0, nil
+	}
+	if !strings.EqualFold(args[0].Str, "RETENTION") {
+		errReply := resp.NewError("ERR syntax error")
+		return 0, &errReply
+	}
+	ms, err := utils.ParseInt(args[1].Str)
+	if err != nil || ms < 0 {
+		errReply := resp.NewError("ERR retention must be a non-negative integer")
+		return 0, &errReply
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// sampleReply returns a sample as [timestamp, value]
+func sampleReply(s db.Sample) resp.Value {
+	return resp.NewArray([]resp.Value{
+		resp.NewInteger(s.Timestamp),
+		resp.NewBulkString(strconv.FormatFloat(s.Value, 'f', -1, 64)),
+	})
+}
@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"flex-db/internal/resp"
+)
+
+// registerTrashCommands registers UNDELETE and the TRASH command family
+func (r *CommandRegistry) registerTrashCommands() {
+	r.RegisterWrite("UNDELETE", undeleteCommand)
+	r.Register("TRASH", trashCommand)
+}
+
+// undeleteCommand handles the UNDELETE command.
+// Syntax: UNDELETE key
+// Restores a key removed by DEL from the trash, with the value and TTL it
+// had when deleted.
+// Returns 1 if the key was restored, 0 if it isn't in the trash, and an
+// error if the key was written again since.
+// Example: UNDELETE user:42
+func undeleteCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("undelete")
+	}
+
+	restored, err := h.DB.Undelete(args[0].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	if restored {
+		return resp.NewInteger(1)
+	}
+	return resp.NewInteger(0)
+}
+
+var trashHelp = []string{
+	"TRASH <subcommand> [<arg> ...]. Subcommands are:",
+	"LIST [<pattern>]",
+	"    List the deleted keys in the trash as [key, type, milliseconds until purged].",
+	"EMPTY [<pattern>]",
+	"    Drop keys from the trash for good. Returns how many were dropped.",
+	"HELP",
+	"    Print this help.",
+}
+
+// trashCommand handles the TRASH command.
+// Syntax: TRASH subcommand [arg ...]
+// Inspects and empties the trash of keys removed by DEL, kept for
+// --trash-retention so UNDELETE can restore them.
+// Example: TRASH LIST user:*
+func trashCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return wrongArgsError("trash")
+	}
+
+	name := args[0].Str
+	subcommand := strings.ToUpper(name)
+	args = args[1:]
+
+	switch subcommand {
+	case "HELP":
+		lines := make([]resp.Value, len(trashHelp))
+		for i, line := range trashHelp {
+			lines[i] = resp.NewSimpleString(line)
+		}
+		return resp.NewArray(lines)
+
+	case "LIST":
+		if len(args) > 1 {
+			return wrongArgsError("trash|list")
+		}
+		pattern := "*"
+		if len(args) == 1 {
+			pattern = args[0].Str
+		}
+		entries, err := h.DB.Trash(pattern)
+		if err != nil {
+			return errorReply(err)
+		}
+		values := make([]resp.Value, len(entries))
+		for i, e := range entries {
+			values[i] = resp.NewArray([]resp.Value{
+				resp.NewBulkString(e.Key),
+				resp.NewBulkString(e.Type.String()),
+				resp.NewInteger(time.Until(e.Purge).Milliseconds()),
+			})
+		}
+		return resp.NewArray(values)
+
+	case "EMPTY":
+		if len(args) > 1 {
+			return wrongArgsError("trash|empty")
+		}
+		pattern := "*"
+		if len(args) == 1 {
+			pattern = args[0].Str
+		}
+		dropped, err := h.DB.EmptyTrash(pattern)
+		if err != nil {
+			return errorReply(err)
+		}
+		return resp.NewInteger(int64(dropped))
+
+	default:
+		return resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try TRASH HELP.", name))
+	}
+}
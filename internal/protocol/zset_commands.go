@@ -0,0 +1,490 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"flex-db/internal/db"
+	"flex-db/internal/resp"
+)
+
+// registerZSetCommands registers the sorted set commands
+func (r *CommandRegistry) registerZSetCommands() {
+	r.RegisterWrite("ZADD", zaddCommand)
+	r.Register("ZSCORE", zscoreCommand)
+	r.Register("ZCARD", zcardCommand)
+	r.Register("ZRANGE", zrangeCommand)
+	r.Register("ZRANGEBYSCORE", zrangebyscoreCommand)
+	r.Register("ZSCAN", zscanCommand)
+	r.Register("ZRANK", zrankCommand)
+	r.Register("ZREVRANK", zrevrankCommand)
+	r.RegisterWrite("ZINCRBY", zincrbyCommand)
+	r.RegisterWrite("ZREM", zremCommand)
+	r.RegisterWrite("ZPOPMIN", zpopminCommand)
+	r.RegisterWrite("ZPOPMAX", zpopmaxCommand)
+	r.RegisterWrite("BZPOPMIN", bzpopminCommand)
+	r.RegisterWrite("BZPOPMAX", bzpopmaxCommand)
+}
+
+// zaddCommand handles the ZADD command.
+// Syntax: ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+// Sets the scores of members, adding those not in the set yet. NX only
+// adds new members, XX only updates existing ones, GT and LT only update
+// scores that increase or decrease, and CH counts members whose score
+// changed as well as new ones. INCR adds the score to the member's like
+// ZINCRBY and takes a single score/member pair.
+// Returns the number of members added, or changed with CH. With INCR it
+// returns the new score, or nil if the options blocked the update.
+// Example: ZADD leaderboard 1500 alice 1320 bob
+func zaddCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 3 {
+		return wrongArgsError("zadd")
+	}
+
+	var flags db.ZAddFlags
+	incr := false
+	i := 1
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Str) {
+		case "NX":
+			flags.NX = true
+			continue
+		case "XX":
+			flags.XX = true
+			continue
+		case "GT":
+			flags.GT = true
+			continue
+		case "LT":
+			flags.LT = true
+			continue
+		case "CH":
+			flags.CH = true
+			continue
+		case "INCR":
+			incr = true
+			continue
+		}
+		break
+	}
+	if flags.NX && flags.XX {
+		return resp.NewError("ERR XX and NX options at the same time are not compatible")
+	}
+	if (flags.GT && flags.LT) || (flags.NX && (flags.GT || flags.LT)) {
+		return resp.NewError("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return resp.NewError("ERR syntax error")
+	}
+	if incr && len(pairs) != 2 {
+		return resp.NewError("ERR INCR option supports a single increment-element pair")
+	}
+	entries := make([]db.ZEntry, 0, len(pairs)/2)
+	for j := 0; j < len(pairs); j += 2 {
+		score, err := parseScore(pairs[j].Str)
+		if err != nil {
+			return resp.NewError("ERR value is not a valid float")
+		}
+		entries = append(entries, db.ZEntry{Member: pairs[j+1].Str, Score: score})
+	}
+
+	if incr {
+		score, updated, err := h.DB.ZAddIncr(args[0].Str, entries[0].Member, entries[0].Score, flags)
+		if err != nil {
+			return errorReply(err)
+		}
+		if !updated {
+			return resp.NewNullBulkString()
+		}
+		return resp.NewBulkString(formatScore(score))
+	}
+
+	count, err := h.DB.ZAdd(args[0].Str, entries, flags)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(count))
+}
+
+// zscoreCommand handles the ZSCORE command.
+// Syntax: ZSCORE key member
+// Returns the score of member, or nil if the member or key doesn't exist.
+// Example: ZSCORE leaderboard alice
+func zscoreCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("zscore")
+	}
+
+	score, found, err := h.DB.ZScore(args[0].Str, args[1].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !found {
+		return resp.NewNullBulkString()
+	}
+	return resp.NewBulkString(formatScore(score))
+}
+
+// zcardCommand handles the ZCARD command.
+// Syntax: ZCARD key
+// Returns the number of members of a sorted set, 0 if the key doesn't
+// exist.
+// Example: ZCARD leaderboard
+func zcardCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return wrongArgsError("zcard")
+	}
+
+	length, err := h.DB.ZCard(args[0].Str)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(length))
+}
+
+// zrangeCommand handles the ZRANGE command.
+// Syntax: ZRANGE key start stop [WITHSCORES]
+// Returns the members ranked start to stop, lowest score first and equal
+// scores by member. Ranks are zero-based and negative ones count from
+// the end. WITHSCORES follows each member with its score.
+// Example: ZRANGE leaderboard 0 9 WITHSCORES
+func zrangeCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 3 && len(args) != 4 {
+		return wrongArgsError("zrange")
+	}
+	withScores := false
+	if len(args) == 4 {
+		if !strings.EqualFold(args[3].Str, "WITHSCORES") {
+			return resp.NewError("ERR syntax error")
+		}
+		withScores = true
+	}
+
+	start, err := strconv.Atoi(args[1].Str)
+	if err != nil {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+	stop, err := strconv.Atoi(args[2].Str)
+	if err != nil {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+
+	entries, err := h.DB.ZRange(args[0].Str, start, stop)
+	if err != nil {
+		return errorReply(err)
+	}
+	return zentriesReply(entries, withScores)
+}
+
+// zrangebyscoreCommand handles the ZRANGEBYSCORE command.
+// Syntax: ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+// Returns the members scored between min and max, lowest score first.
+// Bounds are inclusive unless prefixed with "(", and may be -inf or +inf.
+// LIMIT skips offset members and returns at most count, all of them if
+// count is negative.
+// Example: ZRANGEBYSCORE requests:user:42 (1700000000 +inf LIMIT 0 10
+func zrangebyscoreCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 3 {
+		return wrongArgsError("zrangebyscore")
+	}
+
+	var r db.ScoreRange
+	var err error
+	r.Min, r.MinExclusive, err = parseScoreBound(args[1].Str)
+	if err != nil {
+		return resp.NewError("ERR min or max is not a float")
+	}
+	r.Max, r.MaxExclusive, err = parseScoreBound(args[2].Str)
+	if err != nil {
+		return resp.NewError("ERR min or max is not a float")
+	}
+
+	withScores := false
+	offset, count := 0, -1
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Str) {
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return resp.NewError("ERR syntax error")
+			}
+			o, err1 := strconv.Atoi(args[i+1].Str)
+			n, err2 := strconv.Atoi(args[i+2].Str)
+			if err1 != nil || err2 != nil {
+				return resp.NewError("ERR value is not an integer or out of range")
+			}
+			if o < 0 {
+				// Redis answers a negative offset with nothing
+				return resp.NewArray([]resp.Value{})
+			}
+			offset, count = o, n
+			i += 2
+		default:
+			return resp.NewError("ERR syntax error")
+		}
+	}
+
+	entries, err := h.DB.ZRangeByScore(args[0].Str, r, offset, count)
+	if err != nil {
+		return errorReply(err)
+	}
+	return zentriesReply(entries, withScores)
+}
+
+// zscanCommand handles the ZSCAN command.
+// Syntax: ZSCAN key cursor [MATCH pattern] [COUNT count]
+// Iterates the members of a sorted set like SCAN iterates keys. Members
+// come in scan order rather than by score, so a member whose score
+// changes during the scan is still returned once.
+// Returns [cursor, [member, score, ...]].
+// Example: ZSCAN leaderboard 0 COUNT 100
+func zscanCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("zscan")
+	}
+	opts, errReply := h.parseScanArgs("zscan", args[1:], false)
+	if errReply != nil {
+		return *errReply
+	}
+	cursor, errReply := parseScanCursor(args[1].Str)
+	if errReply != nil {
+		return *errReply
+	}
+
+	entries, next, err := h.DB.ZScan(args[0].Str, cursor, opts.pattern, opts.count)
+	if err != nil {
+		return errorReply(err)
+	}
+	return scanReply(strconv.FormatUint(next, 10), zentriesReply(entries, true))
+}
+
+// zrankCommand handles the ZRANK command.
+// Syntax: ZRANK key member
+// Returns the zero-based rank of member, lowest score first, or nil if
+// the member or key doesn't exist.
+// Example: ZRANK leaderboard alice
+func zrankCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("zrank")
+	}
+	return rankReply(h.DB.ZRank(args[0].Str, args[1].Str, false))
+}
+
+// zrevrankCommand handles the ZREVRANK command.
+// Syntax: ZREVRANK key member
+// Returns the zero-based rank of member, highest score first, or nil if
+// the member or key doesn't exist.
+// Example: ZREVRANK leaderboard alice
+func zrevrankCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return wrongArgsError("zrevrank")
+	}
+	return rankReply(h.DB.ZRank(args[0].Str, args[1].Str, true))
+}
+
+// rankReply answers ZRANK and ZREVRANK
+func rankReply(rank int, found bool, err error) resp.Value {
+	if err != nil {
+		return errorReply(err)
+	}
+	if !found {
+		return resp.NewNullBulkString()
+	}
+	return resp.NewInteger(int64(rank))
+}
+
+// zincrbyCommand handles the ZINCRBY command.
+// Syntax: ZINCRBY key increment member
+// Adds increment to the score of member, adding the member if needed.
+// Returns the new score.
+// Example: ZINCRBY leaderboard 25 alice
+func zincrbyCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) != 3 {
+		return wrongArgsError("zincrby")
+	}
+	increment, err := parseScore(args[1].Str)
+	if err != nil {
+		return resp.NewError("ERR value is not a valid float")
+	}
+
+	score, err := h.DB.ZIncrBy(args[0].Str, args[2].Str, increment)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewBulkString(formatScore(score))
+}
+
+// zremCommand handles the ZREM command.
+// Syntax: ZREM key member [member ...]
+// Removes members from a sorted set. The key is deleted once the set is
+// empty.
+// Returns the number of members removed.
+// Example: ZREM leaderboard bob
+func zremCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return wrongArgsError("zrem")
+	}
+
+	removed, err := h.DB.ZRem(args[0].Str, argStrings(args[1:])...)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewInteger(int64(removed))
+}
+
+// parseScore parses a sorted set score. Infinities are valid scores, NaN
+// isn't.
+func parseScore(s string) (float64, error) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err == nil && math.IsNaN(score) {
+		return 0, strconv.ErrSyntax
+	}
+	return score, err
+}
+
+// parseScoreBound parses a ZRANGEBYSCORE bound, which is exclusive when
+// prefixed with "("
+func parseScoreBound(s string) (float64, bool, error) {
+	if strings.HasPrefix(s, "(") {
+		score, err := parseScore(s[1:])
+		return score, true, err
+	}
+	score, err := parseScore(s)
+	return score, false, err
+}
+
+// formatScore formats a sorted set score as Redis does, with infinities
+// as "inf" and "-inf"
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	default:
+		return strconv.FormatFloat(score, 'f', -1, 64)
+	}
+}
+
+// zpopminCommand handles the ZPOPMIN command.
+// Syntax: ZPOPMIN key [count]
+// Removes the count members with the lowest scores, 1 by default. The key
+// is deleted once the set is empty.
+// Returns the removed members each followed by its score, lowest first.
+// Example: ZPOPMIN tasks 2
+func zpopminCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	return zpopReply(h, args, false)
+}
+
+// zpopmaxCommand handles the ZPOPMAX command.
+// Syntax: ZPOPMAX key [count]
+// ZPOPMIN for the members with the highest scores, highest first.
+// Example: ZPOPMAX leaderboard
+func zpopmaxCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	return zpopReply(h, args, true)
+}
+
+// zpopReply pops members for ZPOPMIN or ZPOPMAX and replies with them
+func zpopReply(h *Handler, args []resp.Value, highest bool) resp.Value {
+	name := "zpopmin"
+	if highest {
+		name = "zpopmax"
+	}
+	if len(args) != 1 && len(args) != 2 {
+		return wrongArgsError(name)
+	}
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].Str)
+		if err != nil {
+			return resp.NewError("ERR value is not an integer or out of range")
+		}
+		if n < 0 {
+			return resp.NewError("ERR value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	var entries []db.ZEntry
+	var err error
+	if highest {
+		entries, err = h.DB.ZPopMax(args[0].Str, count)
+	} else {
+		entries, err = h.DB.ZPopMin(args[0].Str, count)
+	}
+	if err != nil {
+		return errorReply(err)
+	}
+	return zentriesReply(entries, true)
+}
+
+// bzpopminCommand handles the BZPOPMIN command.
+// Syntax: BZPOPMIN key [key ...] timeout
+// ZPOPMIN of the first key holding a non-empty sorted set, checked left to
+// right, waiting up to timeout seconds, 0 meaning forever, for one of them
+// to get a member.
+// Returns [key, member, score], or nil on timeout.
+// Example: BZPOPMIN tasks:urgent tasks:normal 5
+func bzpopminCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	return bzpopReply(h, c, args, false)
+}
+
+// bzpopmaxCommand handles the BZPOPMAX command.
+// Syntax: BZPOPMAX key [key ...] timeout
+// BZPOPMIN for the member with the highest score.
+// Example: BZPOPMAX bids 0
+func bzpopmaxCommand(h *Handler, c *Client, args []resp.Value) resp.Value {
+	return bzpopReply(h, c, args, true)
+}
+
+// bzpopReply waits to pop a member for BZPOPMIN or BZPOPMAX and replies
+// with it, or with nil once the timeout passed
+func bzpopReply(h *Handler, c *Client, args []resp.Value, highest bool) resp.Value {
+	if len(args) < 2 {
+		if highest {
+			return wrongArgsError("bzpopmax")
+		}
+		return wrongArgsError("bzpopmin")
+	}
+	wait, errReply := parseBlockTimeout(args[len(args)-1].Str)
+	if errReply != nil {
+		return *errReply
+	}
+
+	ctx, cancel := h.blockingContext(c, wait)
+	defer cancel()
+	key, entry, err := h.DB.ZPopWait(ctx, argStrings(args[:len(args)-1]), highest)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return resp.NewNullArray()
+	}
+	if errors.Is(err, context.Canceled) {
+		err = db.ErrShuttingDown
+	}
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.NewArray([]resp.Value{
+		resp.NewBulkString(key),
+		resp.NewBulkString(entry.Member),
+		resp.NewBulkString(formatScore(entry.Score)),
+	})
+}
+
+// zentriesReply returns sorted set members as an array, each followed by
+// its score if withScores is set
+func zentriesReply(entries []db.ZEntry, withScores bool) resp.Value {
+	result := make([]resp.Value, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, resp.NewBulkString(e.Member))
+		if withScores {
+			result = append(result, resp.NewBulkString(formatScore(e.Score)))
+		}
+	}
+	return resp.NewArray(result)
+}
@@ -28,19 +28,32 @@ type Value struct {
 
 // Common RESP errors
 var (
-	ErrInvalidSyntax = errors.New("invalid RESP syntax")
-	ErrNotRESP       = errors.New("not a RESP message")
+	ErrInvalidSyntax   = errors.New("invalid RESP syntax")
+	ErrNotRESP         = errors.New("not a RESP message")
+	ErrLineTooLong     = errors.New("too big inline request")
+	ErrRequestTooLarge = errors.New("too big request")
 )
 
+// Limits bounds how much memory a single request may make the parser
+// allocate. Zero means unlimited.
+type Limits struct {
+	MaxLineLength  int   // longest inline command or header line, in bytes
+	MaxRequestSize int64 // total payload of one request, in bytes
+}
+
+// maxPrealloc caps how many array elements are allocated up front, so a
+// huge declared count can't allocate memory before the data arrives
+const maxPrealloc = 1024
+
 // util func to convert a value to its RESP wire format
 func Marshal(v Value) []byte {
 	switch v.Type {
 	case SimpleString:
 		return fmt.Appendf(nil, "+%s\r\n", v.Str)
 	case Error:
-		return fmt.Appendf(nil, "+%s\r\n", v.Str)
+		return fmt.Appendf(nil, "-%s\r\n", v.Str)
 	case Integer:
-		return fmt.Appendf(nil, "+%d\r\n", v.Int)
+		return fmt.Appendf(nil, ":%d\r\n", v.Int)
 	case BulkString:
 		if v.Null {
 			return []byte("$-1\r\n")
@@ -95,39 +108,71 @@ func NewNullArray() Value {
 	return Value{Type: Array, Null: true}
 }
 
+// Parse reads a single RESP value from reader without any size limits
 func Parse(reader *bufio.Reader) (Value, error) {
-	b, err := reader.ReadByte()
+	return ParseWithLimits(reader, Limits{})
+}
+
+// ParseWithLimits reads a single RESP value from reader. It returns
+// ErrLineTooLong or ErrRequestTooLarge as soon as the request is known to
+// exceed limits; the rest of the request is left unread.
+func ParseWithLimits(reader *bufio.Reader, limits Limits) (Value, error) {
+	p := &parser{reader: reader, limits: limits, remaining: limits.MaxRequestSize}
+	return p.parse()
+}
+
+// parser tracks the request budget while a value is parsed
+type parser struct {
+	reader    *bufio.Reader
+	limits    Limits
+	remaining int64
+}
+
+// consume charges n bytes against the request budget
+func (p *parser) consume(n int64) error {
+	if p.limits.MaxRequestSize <= 0 {
+		return nil
+	}
+	if n > p.remaining {
+		return ErrRequestTooLarge
+	}
+	p.remaining -= n
+	return nil
+}
+
+func (p *parser) parse() (Value, error) {
+	b, err := p.reader.ReadByte()
 	if err != nil {
 		return Value{}, err
 	}
 
 	switch b {
 	case SimpleString:
-		return parseSimpleString(reader)
+		return p.parseSimpleString()
 	case Error:
-		return parseError(reader)
+		return p.parseError()
 	case Integer:
-		return parseInteger(reader)
+		return p.parseInteger()
 	case BulkString:
-		return parseBulkString(reader)
+		return p.parseBulkString()
 	case Array:
-		return parseArray(reader)
+		return p.parseArray()
 	default:
-		reader.UnreadByte()
-		return parseInlineCommand(reader)
+		p.reader.UnreadByte()
+		return p.parseInlineCommand()
 	}
 }
 
-func parseSimpleString(reader *bufio.Reader) (Value, error) {
-	line, err := readLine(reader)
+func (p *parser) parseSimpleString() (Value, error) {
+	line, err := p.readLine()
 	if err != nil {
 		return Value{}, err
 	}
 	return Value{Type: SimpleString, Str: line}, nil
 }
 
-func parseError(reader *bufio.Reader) (Value, error) {
-	line, err := readLine(reader)
+func (p *parser) parseError() (Value, error) {
+	line, err := p.readLine()
 	if err != nil {
 		return Value{}, err
 	}
@@ -135,8 +180,8 @@ func parseError(reader *bufio.Reader) (Value, error) {
 	return Value{Type: Error, Str: line}, nil
 }
 
-func parseInteger(reader *bufio.Reader) (Value, error) {
-	line, err := readLine(reader)
+func (p *parser) parseInteger() (Value, error) {
+	line, err := p.readLine()
 	if err != nil {
 		return Value{}, err
 	}
@@ -149,8 +194,8 @@ func parseInteger(reader *bufio.Reader) (Value, error) {
 	return Value{Type: Integer, Int: n}, nil
 }
 
-func parseBulkString(reader *bufio.Reader) (Value, error) {
-	line, err := readLine(reader)
+func (p *parser) parseBulkString() (Value, error) {
+	line, err := p.readLine()
 	if err != nil {
 		return Value{}, err
 	}
@@ -168,18 +213,23 @@ func parseBulkString(reader *bufio.Reader) (Value, error) {
 		return Value{}, ErrInvalidSyntax
 	}
 
+	// check the declared length before allocating the buffer
+	if err := p.consume(int64(length) + 2); err != nil {
+		return Value{}, err
+	}
+
 	buf := make([]byte, length)
-	_, err = io.ReadFull(reader, buf)
+	_, err = io.ReadFull(p.reader, buf)
 	if err != nil {
 		return Value{}, err
 	}
 
-	_, err = reader.ReadByte()
+	_, err = p.reader.ReadByte()
 	if err != nil {
 		return Value{}, err
 	}
 
-	_, err = reader.ReadByte()
+	_, err = p.reader.ReadByte()
 	if err != nil {
 		return Value{}, err
 	}
@@ -187,8 +237,8 @@ func parseBulkString(reader *bufio.Reader) (Value, error) {
 	return Value{Type: BulkString, Str: string(buf)}, nil
 }
 
-func parseArray(reader *bufio.Reader) (Value, error) {
-	line, err := readLine(reader)
+func (p *parser) parseArray() (Value, error) {
+	line, err := p.readLine()
 	if err != nil {
 		return Value{}, err
 	}
@@ -206,9 +256,14 @@ func parseArray(reader *bufio.Reader) (Value, error) {
 		return Value{}, ErrInvalidSyntax
 	}
 
-	items := make([]Value, 0, count)
+	capacity := count
+	if capacity > maxPrealloc {
+		capacity = maxPrealloc
+	}
+
+	items := make([]Value, 0, capacity)
 	for i := 0; i < count; i++ {
-		item, err := Parse(reader)
+		item, err := p.parse()
 		if err != nil {
 			return Value{}, err
 		}
@@ -218,8 +273,8 @@ func parseArray(reader *bufio.Reader) (Value, error) {
 	return Value{Type: Array, Array: items}, nil
 }
 
-func parseInlineCommand(reader *bufio.Reader) (Value, error) {
-	line, err := readLine(reader)
+func (p *parser) parseInlineCommand() (Value, error) {
+	line, err := p.readLine()
 	if err != nil {
 		return Value{}, err
 	}
@@ -237,11 +292,15 @@ func parseInlineCommand(reader *bufio.Reader) (Value, error) {
 	return Value{Type: Array, Array: items}, nil
 }
 
-func readLine(reader *bufio.Reader) (string, error) {
-	line, err := reader.ReadString('\n')
+// readLine reads a CRLF terminated line, charging it against the budget
+func (p *parser) readLine() (string, error) {
+	line, err := ReadLine(p.reader, p.limits.MaxLineLength)
 	if err != nil {
 		return "", err
 	}
+	if err := p.consume(int64(len(line))); err != nil {
+		return "", err
+	}
 
 	if len(line) < 2 || line[len(line)-2] != '\r' {
 		return "", ErrInvalidSyntax
@@ -249,3 +308,30 @@ func readLine(reader *bufio.Reader) (string, error) {
 
 	return line[:len(line)-2], nil
 }
+
+// ReadLine reads up to and including the next '\n'. When maxLength is
+// positive and the line grows longer than that, it stops reading and
+// returns ErrLineTooLong instead of buffering the whole line.
+func ReadLine(reader *bufio.Reader, maxLength int) (string, error) {
+	if maxLength <= 0 {
+		return reader.ReadString('\n')
+	}
+
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLength {
+			return "", ErrLineTooLong
+		}
+		line = append(line, chunk...)
+
+		switch err {
+		case nil:
+			return string(line), nil
+		case bufio.ErrBufferFull:
+			continue
+		default:
+			return "", err
+		}
+	}
+}